@@ -5,9 +5,14 @@ package config
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/pingcap/tiproxy/lib/util/errors"
 )
 
 type Namespace struct {
@@ -17,14 +22,305 @@ type Namespace struct {
 }
 
 type FrontendNamespace struct {
-	User     string    `yaml:"user" json:"user" toml:"user"`
+	User string `yaml:"user" json:"user" toml:"user"`
+	// ProxyTLVs selects the namespace by the TLVs in PROXY protocol headers, such as the VPC endpoint ID sent by a cloud NLB.
+	// If it's set, only the connections carrying one of the TLVs are allowed to access the namespace.
+	ProxyTLVs []ProxyTLVRule `yaml:"proxy-tlvs,omitempty" json:"proxy-tlvs,omitempty" toml:"proxy-tlvs,omitempty"`
+	// RequireTLS rejects the plaintext connections to the namespace.
+	RequireTLS bool `yaml:"require-tls,omitempty" json:"require-tls,omitempty" toml:"require-tls,omitempty"`
+	// RequireTLSUsers rejects the plaintext connections of these users.
+	RequireTLSUsers []string `yaml:"require-tls-users,omitempty" json:"require-tls-users,omitempty" toml:"require-tls-users,omitempty"`
+	// CertUsers maps the identities of client certificates to the MySQL users that they can log in as.
+	// If it's set, the clients must present a certificate and log in as a user mapped from its identity.
+	// The certificate is verified by the CA in Security, or by the CA in server-tls if Security has no CA.
+	CertUsers []CertUserRule `yaml:"cert-users,omitempty" json:"cert-users,omitempty" toml:"cert-users,omitempty"`
+	// LocalUsers are the accounts stored in the proxy. If any account is set in LocalUsers or LocalUserFile,
+	// the proxy authenticates the clients by itself and rejects the unknown users without contacting the backends.
+	// COM_CHANGE_USER is rejected if LocalUsers, LocalUserFile, RequireTLSUsers, or CertUsers is set.
+	LocalUsers []LocalUser `yaml:"local-users,omitempty" json:"local-users,omitempty" toml:"local-users,omitempty"`
+	// LocalUserFile is a TOML file that contains more accounts in `[[users]]` tables. It's read when the namespace is loaded.
+	LocalUserFile string `yaml:"local-user-file,omitempty" json:"local-user-file,omitempty" toml:"local-user-file,omitempty"`
+	// AllowCIDRs and DenyCIDRs filter the clients of the namespace by their addresses, after the global and listener filters.
+	AllowCIDRs []string `yaml:"allow-cidrs,omitempty" json:"allow-cidrs,omitempty" toml:"allow-cidrs,omitempty"`
+	DenyCIDRs  []string `yaml:"deny-cidrs,omitempty" json:"deny-cidrs,omitempty" toml:"deny-cidrs,omitempty"`
+	// Security restricts the client connections that use TLS: min-tls-version and cipher-suites limit the negotiated
+	// TLS version and cipher suite, and ca verifies the client certificates.
+	// The certificates are sent only if the server-tls of the proxy has a CA, so set skip-ca if the certificates are optional.
 	Security TLSConfig `yaml:"security" json:"security" toml:"security"`
+	// Limits protect the proxy and the clients from oversized requests and runaway queries.
+	Limits QueryLimits `yaml:"limits" json:"limits" toml:"limits"`
+	// LoadData restricts `LOAD DATA LOCAL INFILE` so that one tenant's bulk load doesn't saturate the network of the proxy.
+	LoadData LoadDataPolicy `yaml:"load-data" json:"load-data" toml:"load-data"`
+}
+
+// maxAllowedPacket is the max value of max_allowed_packet in MySQL.
+const maxAllowedPacket = 1 << 30
+
+// QueryLimits contains the limits of the requests and the result sets. 0 means no limit.
+type QueryLimits struct {
+	// MaxRequestBytes is the max size of a request packet, similar to max_allowed_packet.
+	// The proxy returns an error and closes the connection if a request exceeds it.
+	MaxRequestBytes int `yaml:"max-request-bytes,omitempty" json:"max-request-bytes,omitempty" toml:"max-request-bytes,omitempty"`
+	// MaxResultRows and MaxResultBytes limit each result set, or each batch of rows fetched from a cursor.
+	// If a result set exceeds them, the proxy stops forwarding it, discards the rest of the results of the query,
+	// and returns an error to the client. The session is kept.
+	MaxResultRows  int64 `yaml:"max-result-rows,omitempty" json:"max-result-rows,omitempty" toml:"max-result-rows,omitempty"`
+	MaxResultBytes int64 `yaml:"max-result-bytes,omitempty" json:"max-result-bytes,omitempty" toml:"max-result-bytes,omitempty"`
+}
+
+func (ql *QueryLimits) Check() error {
+	if ql.MaxRequestBytes < 0 || ql.MaxRequestBytes > maxAllowedPacket {
+		return errors.Wrapf(ErrInvalidConfigValue, "max-request-bytes must be between 0 and %d", maxAllowedPacket)
+	}
+	if ql.MaxResultRows < 0 {
+		return errors.Wrapf(ErrInvalidConfigValue, "max-result-rows must be greater than or equal to 0")
+	}
+	if ql.MaxResultBytes < 0 {
+		return errors.Wrapf(ErrInvalidConfigValue, "max-result-bytes must be greater than or equal to 0")
+	}
+	return nil
+}
+
+// LoadDataPolicy contains the restrictions of `LOAD DATA LOCAL INFILE`. 0 means no limit.
+type LoadDataPolicy struct {
+	// DisableLocal clears the CLIENT_LOCAL_FILES capability sent to the backends. If a backend still requests a file,
+	// the proxy sends it an empty file, discards the remaining results of the query, and returns an error to the client.
+	// The capability is advertised to the clients before the namespace is known, so it's only cleared for the clients
+	// when all the namespaces disable it. Otherwise, the clients may still enable it but won't be asked for any file.
+	DisableLocal bool `yaml:"disable-local,omitempty" json:"disable-local,omitempty" toml:"disable-local,omitempty"`
+	// MaxBytes is the max size of the file sent by each load. If a load exceeds it, the proxy discards the rest of the
+	// file, ends the file for the backend, and returns an error to the client. The session is kept, but the data sent
+	// before exceeding the limit may be loaded by the backend.
+	MaxBytes int64 `yaml:"max-bytes,omitempty" json:"max-bytes,omitempty" toml:"max-bytes,omitempty"`
+	// MaxBytesPerSecond throttles the file data sent by each connection.
+	MaxBytesPerSecond int64 `yaml:"max-bytes-per-second,omitempty" json:"max-bytes-per-second,omitempty" toml:"max-bytes-per-second,omitempty"`
+}
+
+func (lp *LoadDataPolicy) Check() error {
+	if lp.MaxBytes < 0 {
+		return errors.Wrapf(ErrInvalidConfigValue, "max-bytes must be greater than or equal to 0")
+	}
+	if lp.MaxBytesPerSecond < 0 {
+		return errors.Wrapf(ErrInvalidConfigValue, "max-bytes-per-second must be greater than or equal to 0")
+	}
+	return nil
+}
+
+// ProxyTLVRule matches a TLV in PROXY protocol headers.
+type ProxyTLVRule struct {
+	// Type is the TLV type, e.g. 0x02 for the authority and 0xEA for AWS.
+	Type uint8 `yaml:"type" json:"type" toml:"type"`
+	// Subtype is the first byte of vendor-specific TLVs, e.g. 0x01 for the AWS VPC endpoint ID. 0 means no subtype.
+	Subtype uint8  `yaml:"subtype,omitempty" json:"subtype,omitempty" toml:"subtype,omitempty"`
+	Value   string `yaml:"value" json:"value" toml:"value"`
+}
+
+// Match returns whether the TLV matches the rule.
+func (r *ProxyTLVRule) Match(typ uint8, content []byte) bool {
+	if typ != r.Type {
+		return false
+	}
+	if r.Subtype != 0 {
+		if len(content) == 0 || content[0] != r.Subtype {
+			return false
+		}
+		content = content[1:]
+	}
+	return string(content) == r.Value
+}
+
+// CertUserRule maps the identity of a client certificate to MySQL users.
+type CertUserRule struct {
+	// Identity matches the subject CN or any SAN (DNS name, email, URI or IP) of the certificate.
+	Identity string `yaml:"identity" json:"identity" toml:"identity"`
+	// Users are the MySQL users that the identity can log in as. "*" matches any user.
+	Users []string `yaml:"users" json:"users" toml:"users"`
+}
+
+// Match returns whether the identity can log in as the user.
+func (r *CertUserRule) Match(identity, user string) bool {
+	if identity != r.Identity {
+		return false
+	}
+	for _, u := range r.Users {
+		if u == "*" || u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// LocalUser is an account stored in the proxy.
+type LocalUser struct {
+	User string `yaml:"user" json:"user" toml:"user"`
+	// AuthPlugin is mysql_native_password or caching_sha2_password. Empty means mysql_native_password.
+	AuthPlugin string `yaml:"auth-plugin,omitempty" json:"auth-plugin,omitempty" toml:"auth-plugin,omitempty"`
+	// AuthString is the password hash in hex. Empty means the password is empty.
+	//   - mysql_native_password: SHA1(SHA1(password)), which is the same as `authentication_string` in `mysql.user`.
+	//   - caching_sha2_password: SHA2(SHA2(password)), e.g. `SELECT SHA2(UNHEX(SHA2('password', 256)), 256)`.
+	AuthString string `yaml:"auth-string,omitempty" json:"auth-string,omitempty" toml:"auth-string,omitempty"`
+	// BackendUser and BackendPassword are the credentials to log in to the backend after the client is authenticated.
+	// If BackendUser is empty, the auth exchange is still relayed to the backend, so the client needs to pass both.
+	// In this case, AuthPlugin must be the same as the plugin of the backend account.
+	BackendUser     string `yaml:"backend-user,omitempty" json:"backend-user,omitempty" toml:"backend-user,omitempty"`
+	BackendPassword string `yaml:"backend-password,omitempty" json:"backend-password,omitempty" toml:"backend-password,omitempty"`
+}
+
+// AuthHash decodes AuthString and checks whether it matches AuthPlugin.
+func (u *LocalUser) AuthHash() ([]byte, error) {
+	if len(u.AuthString) == 0 {
+		return nil, nil
+	}
+	hash, err := hex.DecodeString(strings.TrimPrefix(u.AuthString, "*"))
+	if err != nil {
+		return nil, errors.Wrapf(ErrInvalidConfigValue, "invalid auth-string of user %s", u.User)
+	}
+	size := sha1.Size
+	switch u.AuthPlugin {
+	case "", "mysql_native_password":
+	case "caching_sha2_password":
+		size = sha256.Size
+	default:
+		return nil, errors.Wrapf(ErrInvalidConfigValue, "unsupported auth-plugin %s of user %s", u.AuthPlugin, u.User)
+	}
+	if len(hash) != size {
+		return nil, errors.Wrapf(ErrInvalidConfigValue, "invalid auth-string length of user %s", u.User)
+	}
+	return hash, nil
+}
+
+// NewLocalUsers parses the accounts in a user file.
+func NewLocalUsers(data []byte) ([]LocalUser, error) {
+	var file struct {
+		Users []LocalUser `toml:"users"`
+	}
+	if err := toml.Unmarshal(data, &file); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return file.Users, nil
 }
 
 type BackendNamespace struct {
-	Instances []string  `yaml:"instances" json:"instances" toml:"instances"`
-	Security  TLSConfig `yaml:"security" json:"security" toml:"security"`
-	//HealthCheck  HealthCheck `yaml:"health-check" json:"health-check" toml:"health-check"`
+	Instances []string `yaml:"instances" json:"instances" toml:"instances"`
+	// DNS names that are resolved periodically to discover backends, e.g. a headless service.
+	// `host:port` is resolved by A/AAAA records and `srv+name` is resolved by SRV records.
+	DNS         []string           `yaml:"dns,omitempty" json:"dns,omitempty" toml:"dns,omitempty"`
+	Security    TLSConfig          `yaml:"security" json:"security" toml:"security"`
+	HealthCheck BackendHealthCheck `yaml:"health-check" json:"health-check" toml:"health-check"`
+	// Migration decides what to do with the sessions that can't be migrated in time, e.g. when they are in long transactions.
+	Migration MigrationDeadline `yaml:"migration" json:"migration" toml:"migration"`
+	// Compression compresses the traffic between the proxy and the backends, regardless of whether the clients compress.
+	Compression BackendCompression `yaml:"compression" json:"compression" toml:"compression"`
+}
+
+const (
+	// CompressionZstd compresses the backend traffic with zstd, which requires the backends to support zstd.
+	CompressionZstd = "zstd"
+	// CompressionZlib compresses the backend traffic with zlib.
+	CompressionZlib = "zlib"
+	// CompressionNone disables compression between the proxy and the backends even if the clients compress.
+	CompressionNone = "none"
+)
+
+// BackendCompression contains the compression configurations between the proxy and the backends.
+type BackendCompression struct {
+	// Algorithm is "zstd", "zlib" or "none". Empty means following the client.
+	// It's only used when the backend supports the algorithm, otherwise the traffic is not compressed.
+	Algorithm string `yaml:"algorithm,omitempty" json:"algorithm,omitempty" toml:"algorithm,omitempty"`
+	// Level is the compression level: 1~22 for zstd and 1~9 for zlib. 0 means the default level.
+	Level int `yaml:"level,omitempty" json:"level,omitempty" toml:"level,omitempty"`
+}
+
+func (bc *BackendCompression) Check() error {
+	maxLevel := 0
+	switch bc.Algorithm {
+	case "", CompressionNone:
+		return nil
+	case CompressionZstd:
+		maxLevel = 22
+	case CompressionZlib:
+		maxLevel = 9
+	default:
+		return errors.Wrapf(ErrInvalidConfigValue, "unsupported compression algorithm %s", bc.Algorithm)
+	}
+	if bc.Level < 0 || bc.Level > maxLevel {
+		return errors.Wrapf(ErrInvalidConfigValue, "%s compression level must be between 0 and %d", bc.Algorithm, maxLevel)
+	}
+	return nil
+}
+
+const (
+	// MigrationActionRollback rolls back the transaction, migrates the session, and returns an error to the next command.
+	MigrationActionRollback = "rollback"
+	// MigrationActionClose closes the session.
+	MigrationActionClose = "close"
+)
+
+// MigrationDeadline contains the configurations of forced migration.
+type MigrationDeadline struct {
+	// DeadlineMs is how long a session waits for its transaction to finish after it's notified to migrate.
+	// 0 means waiting until the transaction finishes.
+	DeadlineMs int `yaml:"deadline-ms,omitempty" json:"deadline-ms,omitempty" toml:"deadline-ms,omitempty"`
+	// Action is "rollback" or "close", which is taken when the deadline expires. Empty means "rollback".
+	Action string `yaml:"action,omitempty" json:"action,omitempty" toml:"action,omitempty"`
+}
+
+func (md *MigrationDeadline) Check() error {
+	if md.DeadlineMs < 0 {
+		return errors.Wrapf(ErrInvalidConfigValue, "migration deadline-ms must be greater than or equal to 0")
+	}
+	switch md.Action {
+	case "", MigrationActionRollback, MigrationActionClose:
+	default:
+		return errors.Wrapf(ErrInvalidConfigValue, "unsupported migration action %s", md.Action)
+	}
+	return nil
+}
+
+// BackendHealthCheck contains the health check configurations that can be set for each namespace.
+// Zero values mean using the default values.
+type BackendHealthCheck struct {
+	// RiseThreshold is the number of consecutive successful checks to mark an unhealthy backend healthy.
+	RiseThreshold int `yaml:"rise-threshold,omitempty" json:"rise-threshold,omitempty" toml:"rise-threshold,omitempty"`
+	// FallThreshold is the number of consecutive failed checks to mark a healthy backend unhealthy.
+	FallThreshold int `yaml:"fall-threshold,omitempty" json:"fall-threshold,omitempty" toml:"fall-threshold,omitempty"`
+	// SQLUser enables the SQL-level health check. The proxy logs in to the backends with SQLUser and SQLPassword
+	// and runs SQLQuery to verify that the backends can serve queries.
+	SQLUser     string `yaml:"sql-user,omitempty" json:"sql-user,omitempty" toml:"sql-user,omitempty"`
+	SQLPassword string `yaml:"sql-password,omitempty" json:"sql-password,omitempty" toml:"sql-password,omitempty"`
+	SQLQuery    string `yaml:"sql-query,omitempty" json:"sql-query,omitempty" toml:"sql-query,omitempty"`
+	// SQLTimeoutMs is the timeout of the whole SQL-level health check, including connecting and querying.
+	SQLTimeoutMs int `yaml:"sql-timeout-ms,omitempty" json:"sql-timeout-ms,omitempty" toml:"sql-timeout-ms,omitempty"`
+	// The backend is marked as degraded if the SQL-level health check takes longer than SQLSlowThresholdMs.
+	SQLSlowThresholdMs int `yaml:"sql-slow-threshold-ms,omitempty" json:"sql-slow-threshold-ms,omitempty" toml:"sql-slow-threshold-ms,omitempty"`
+	// The backend is marked as degraded if its CPU usage reaches DegradedCPUPercent. It requires Prometheus.
+	DegradedCPUPercent int `yaml:"degraded-cpu-percent,omitempty" json:"degraded-cpu-percent,omitempty" toml:"degraded-cpu-percent,omitempty"`
+}
+
+// Apply overwrites the health check configurations with the values set in the namespace.
+func (bhc *BackendHealthCheck) Apply(hc *HealthCheck) {
+	if bhc.RiseThreshold > 0 {
+		hc.RiseThreshold = bhc.RiseThreshold
+	}
+	if bhc.FallThreshold > 0 {
+		hc.FallThreshold = bhc.FallThreshold
+	}
+	if len(bhc.SQLUser) > 0 {
+		hc.SQLUser = bhc.SQLUser
+		hc.SQLPassword = bhc.SQLPassword
+	}
+	if len(bhc.SQLQuery) > 0 {
+		hc.SQLQuery = bhc.SQLQuery
+	}
+	if bhc.SQLTimeoutMs > 0 {
+		hc.SQLTimeout = time.Duration(bhc.SQLTimeoutMs) * time.Millisecond
+	}
+	if bhc.SQLSlowThresholdMs > 0 {
+		hc.SQLSlowThreshold = time.Duration(bhc.SQLSlowThresholdMs) * time.Millisecond
+	}
+	if bhc.DegradedCPUPercent > 0 {
+		hc.DegradedCPUUsage = float64(bhc.DegradedCPUPercent) / 100
+	}
 }
 
 const (
@@ -34,6 +330,13 @@ const (
 	healthCheckTimeout       = 2 * time.Second
 	readMetricsInterval      = 15 * time.Second
 	readMetricsTimeout       = 3 * time.Second
+	failureThreshold         = 5
+	failureWindow            = 10 * time.Second
+	ejectDuration            = 10 * time.Second
+	riseThreshold            = 1
+	fallThreshold            = 1
+	sqlProbeQuery            = "SELECT 1"
+	sqlProbeTimeout          = 3 * time.Second
 )
 
 // HealthCheck contains some configurations for health check.
@@ -47,18 +350,42 @@ type HealthCheck struct {
 	DialTimeout     time.Duration `yaml:"dial-timeout" json:"dial-timeout" toml:"dial-timeout"`
 	MetricsInterval time.Duration `yaml:"metrics-interval" json:"metrics-interval" toml:"metrics-interval"`
 	MetricsTimeout  time.Duration `yaml:"metrics-timeout" json:"metrics-timeout" toml:"metrics-timeout"`
+	// A backend is ejected once real traffic fails FailureThreshold times in a row within FailureWindow.
+	// It's probed again after EjectDuration.
+	FailureThreshold int           `yaml:"failure-threshold" json:"failure-threshold" toml:"failure-threshold"`
+	FailureWindow    time.Duration `yaml:"failure-window" json:"failure-window" toml:"failure-window"`
+	EjectDuration    time.Duration `yaml:"eject-duration" json:"eject-duration" toml:"eject-duration"`
+	// The status changes only after RiseThreshold consecutive successes or FallThreshold consecutive failures.
+	RiseThreshold int `yaml:"rise-threshold" json:"rise-threshold" toml:"rise-threshold"`
+	FallThreshold int `yaml:"fall-threshold" json:"fall-threshold" toml:"fall-threshold"`
+	// The SQL-level health check is enabled only when SQLUser is set.
+	// A backend is marked as degraded if the check takes longer than SQLSlowThreshold. 0 means no limit.
+	SQLUser          string        `yaml:"sql-user" json:"sql-user" toml:"sql-user"`
+	SQLPassword      string        `yaml:"sql-password,omitempty" json:"sql-password,omitempty" toml:"sql-password,omitempty"`
+	SQLQuery         string        `yaml:"sql-query" json:"sql-query" toml:"sql-query"`
+	SQLTimeout       time.Duration `yaml:"sql-timeout" json:"sql-timeout" toml:"sql-timeout"`
+	SQLSlowThreshold time.Duration `yaml:"sql-slow-threshold" json:"sql-slow-threshold" toml:"sql-slow-threshold"`
+	// A backend is marked as degraded if its CPU usage reaches DegradedCPUUsage, which is between 0 and 1. 0 means no limit.
+	DegradedCPUUsage float64 `yaml:"degraded-cpu-usage" json:"degraded-cpu-usage" toml:"degraded-cpu-usage"`
 }
 
 // NewDefaultHealthCheckConfig creates a default HealthCheck.
 func NewDefaultHealthCheckConfig() *HealthCheck {
 	return &HealthCheck{
-		Enable:          true,
-		Interval:        healthCheckInterval,
-		MaxRetries:      healthCheckMaxRetries,
-		RetryInterval:   healthCheckRetryInterval,
-		DialTimeout:     healthCheckTimeout,
-		MetricsInterval: readMetricsInterval,
-		MetricsTimeout:  readMetricsTimeout,
+		Enable:           true,
+		Interval:         healthCheckInterval,
+		MaxRetries:       healthCheckMaxRetries,
+		RetryInterval:    healthCheckRetryInterval,
+		DialTimeout:      healthCheckTimeout,
+		MetricsInterval:  readMetricsInterval,
+		MetricsTimeout:   readMetricsTimeout,
+		FailureThreshold: failureThreshold,
+		FailureWindow:    failureWindow,
+		EjectDuration:    ejectDuration,
+		RiseThreshold:    riseThreshold,
+		FallThreshold:    fallThreshold,
+		SQLQuery:         sqlProbeQuery,
+		SQLTimeout:       sqlProbeTimeout,
 	}
 }
 
@@ -81,6 +408,27 @@ func (hc *HealthCheck) Check() {
 	if hc.MetricsTimeout == 0 {
 		hc.MetricsTimeout = readMetricsTimeout
 	}
+	if hc.FailureThreshold == 0 {
+		hc.FailureThreshold = failureThreshold
+	}
+	if hc.FailureWindow == 0 {
+		hc.FailureWindow = failureWindow
+	}
+	if hc.EjectDuration == 0 {
+		hc.EjectDuration = ejectDuration
+	}
+	if hc.RiseThreshold == 0 {
+		hc.RiseThreshold = riseThreshold
+	}
+	if hc.FallThreshold == 0 {
+		hc.FallThreshold = fallThreshold
+	}
+	if len(hc.SQLQuery) == 0 {
+		hc.SQLQuery = sqlProbeQuery
+	}
+	if hc.SQLTimeout == 0 {
+		hc.SQLTimeout = sqlProbeTimeout
+	}
 }
 
 func NewNamespace(data []byte) (*Namespace, error) {
@@ -96,3 +444,28 @@ func (cfg *Namespace) ToBytes() ([]byte, error) {
 	err := toml.NewEncoder(b).Encode(cfg)
 	return b.Bytes(), err
 }
+
+// redactedSecret replaces the credentials in the configs that are shown to users.
+const redactedSecret = "******"
+
+func redactSecret(secret string) string {
+	if len(secret) == 0 {
+		return secret
+	}
+	return redactedSecret
+}
+
+// Redact returns a copy of the config whose credentials are masked, so it's safe to be returned by the HTTP API.
+func (cfg *Namespace) Redact() *Namespace {
+	redacted := *cfg
+	if len(cfg.Frontend.LocalUsers) > 0 {
+		redacted.Frontend.LocalUsers = make([]LocalUser, 0, len(cfg.Frontend.LocalUsers))
+		for _, u := range cfg.Frontend.LocalUsers {
+			u.AuthString = redactSecret(u.AuthString)
+			u.BackendPassword = redactSecret(u.BackendPassword)
+			redacted.Frontend.LocalUsers = append(redacted.Frontend.LocalUsers, u)
+		}
+	}
+	redacted.Backend.HealthCheck.SQLPassword = redactSecret(cfg.Backend.HealthCheck.SQLPassword)
+	return &redacted
+}
@@ -5,6 +5,7 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -13,21 +14,58 @@ var testNamespaceConfig = Namespace{
 	Namespace: "test_ns",
 	Frontend: FrontendNamespace{
 		User: "xx",
+		ProxyTLVs: []ProxyTLVRule{
+			{Type: 0x02, Value: "tidb.example.com"},
+			{Type: 0xEA, Subtype: 0x01, Value: "vpce-123"},
+		},
+		RequireTLS:      true,
+		RequireTLSUsers: []string{"root"},
+		AllowCIDRs:      []string{"10.0.0.0/8"},
+		DenyCIDRs:       []string{"10.0.0.1"},
+		CertUsers: []CertUserRule{
+			{Identity: "app.example.com", Users: []string{"app", "app_ro"}},
+		},
+		LocalUsers: []LocalUser{
+			{User: "app", AuthString: "*6BB4837EB74329105EE4568DDA7DC67ED2CA2AD9", BackendUser: "svc", BackendPassword: "svc_pwd"},
+		},
+		LocalUserFile: "users.toml",
 		Security: TLSConfig{
 			CA:        "t",
 			Cert:      "t",
 			Key:       "t",
 			AutoCerts: true,
 		},
+		Limits: QueryLimits{
+			MaxRequestBytes: 1 << 20,
+			MaxResultRows:   10000,
+			MaxResultBytes:  1 << 30,
+		},
+		LoadData: LoadDataPolicy{
+			DisableLocal:      true,
+			MaxBytes:          1 << 30,
+			MaxBytesPerSecond: 1 << 20,
+		},
 	},
 	Backend: BackendNamespace{
 		Instances: []string{"127.0.0.1:4000", "127.0.0.1:4001"},
+		DNS:       []string{"tidb.svc:4000"},
 		Security: TLSConfig{
 			CA:     "t",
 			Cert:   "t",
 			Key:    "t",
 			SkipCA: true,
 		},
+		HealthCheck: BackendHealthCheck{
+			RiseThreshold: 2,
+		},
+		Migration: MigrationDeadline{
+			DeadlineMs: 60000,
+			Action:     MigrationActionClose,
+		},
+		Compression: BackendCompression{
+			Algorithm: CompressionZstd,
+			Level:     3,
+		},
 	},
 }
 
@@ -40,3 +78,210 @@ func TestNamespaceConfig(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, data1, data2)
 }
+
+func TestApplyBackendHealthCheck(t *testing.T) {
+	hc := NewDefaultHealthCheckConfig()
+	testNamespaceConfig.Backend.HealthCheck.Apply(hc)
+	require.Equal(t, 2, hc.RiseThreshold)
+	require.Equal(t, fallThreshold, hc.FallThreshold)
+	require.Empty(t, hc.SQLUser)
+	require.Equal(t, sqlProbeQuery, hc.SQLQuery)
+
+	bhc := BackendHealthCheck{
+		SQLUser:            "probe",
+		SQLPassword:        "123456",
+		SQLTimeoutMs:       500,
+		SQLSlowThresholdMs: 100,
+		DegradedCPUPercent: 80,
+	}
+	bhc.Apply(hc)
+	require.Equal(t, "probe", hc.SQLUser)
+	require.Equal(t, "123456", hc.SQLPassword)
+	require.Equal(t, sqlProbeQuery, hc.SQLQuery)
+	require.Equal(t, 500*time.Millisecond, hc.SQLTimeout)
+	require.Equal(t, 100*time.Millisecond, hc.SQLSlowThreshold)
+	require.Equal(t, 0.8, hc.DegradedCPUUsage)
+}
+
+func TestProxyTLVRule(t *testing.T) {
+	tests := []struct {
+		rule    ProxyTLVRule
+		typ     uint8
+		content []byte
+		match   bool
+	}{
+		{ProxyTLVRule{Type: 0x02, Value: "a.com"}, 0x02, []byte("a.com"), true},
+		{ProxyTLVRule{Type: 0x02, Value: "a.com"}, 0x02, []byte("b.com"), false},
+		{ProxyTLVRule{Type: 0x02, Value: "a.com"}, 0x05, []byte("a.com"), false},
+		{ProxyTLVRule{Type: 0xEA, Subtype: 0x01, Value: "vpce-1"}, 0xEA, []byte("\x01vpce-1"), true},
+		{ProxyTLVRule{Type: 0xEA, Subtype: 0x01, Value: "vpce-1"}, 0xEA, []byte("\x02vpce-1"), false},
+		{ProxyTLVRule{Type: 0xEA, Subtype: 0x01, Value: "vpce-1"}, 0xEA, nil, false},
+		{ProxyTLVRule{Type: 0xEA, Value: "vpce-1"}, 0xEA, []byte("\x01vpce-1"), false},
+	}
+	for i, test := range tests {
+		require.Equal(t, test.match, test.rule.Match(test.typ, test.content), "case %d", i)
+	}
+}
+
+func TestCertUserRule(t *testing.T) {
+	tests := []struct {
+		rule     CertUserRule
+		identity string
+		user     string
+		match    bool
+	}{
+		{CertUserRule{Identity: "app", Users: []string{"u1", "u2"}}, "app", "u2", true},
+		{CertUserRule{Identity: "app", Users: []string{"u1", "u2"}}, "app", "u3", false},
+		{CertUserRule{Identity: "app", Users: []string{"u1"}}, "other", "u1", false},
+		{CertUserRule{Identity: "app", Users: []string{"*"}}, "app", "u3", true},
+		{CertUserRule{Identity: "app"}, "app", "u1", false},
+	}
+	for i, test := range tests {
+		require.Equal(t, test.match, test.rule.Match(test.identity, test.user), "case %d", i)
+	}
+}
+
+func TestLocalUser(t *testing.T) {
+	tests := []struct {
+		user LocalUser
+		size int
+		err  bool
+	}{
+		{LocalUser{User: "u"}, 0, false},
+		{LocalUser{User: "u", AuthString: "*6BB4837EB74329105EE4568DDA7DC67ED2CA2AD9"}, 20, false},
+		{LocalUser{User: "u", AuthString: "6bb4837eb74329105ee4568dda7dc67ed2ca2ad9", AuthPlugin: "mysql_native_password"}, 20, false},
+		{LocalUser{User: "u", AuthString: "*6BB4837EB74329105EE4568DDA7DC67ED2CA2AD9", AuthPlugin: "caching_sha2_password"}, 0, true},
+		{LocalUser{User: "u", AuthString: "0000000000000000000000000000000000000000000000000000000000000000", AuthPlugin: "caching_sha2_password"}, 32, false},
+		{LocalUser{User: "u", AuthString: "*6BB4837EB74329105EE4568DDA7DC67ED2CA2AD9", AuthPlugin: "sha256_password"}, 0, true},
+		{LocalUser{User: "u", AuthString: "xyz"}, 0, true},
+	}
+	for i, test := range tests {
+		hash, err := test.user.AuthHash()
+		if test.err {
+			require.Error(t, err, "case %d", i)
+			continue
+		}
+		require.NoError(t, err, "case %d", i)
+		require.Len(t, hash, test.size, "case %d", i)
+	}
+
+	users, err := NewLocalUsers([]byte(`
+[[users]]
+user = "u1"
+auth-string = "*6BB4837EB74329105EE4568DDA7DC67ED2CA2AD9"
+
+[[users]]
+user = "u2"
+auth-plugin = "caching_sha2_password"
+backend-user = "svc"
+`))
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	require.Equal(t, "u1", users[0].User)
+	require.Equal(t, "svc", users[1].BackendUser)
+}
+
+func TestCheckMigrationDeadline(t *testing.T) {
+	tests := []struct {
+		md    MigrationDeadline
+		valid bool
+	}{
+		{MigrationDeadline{}, true},
+		{MigrationDeadline{DeadlineMs: 1000, Action: MigrationActionRollback}, true},
+		{MigrationDeadline{DeadlineMs: 1000, Action: MigrationActionClose}, true},
+		{MigrationDeadline{DeadlineMs: -1}, false},
+		{MigrationDeadline{DeadlineMs: 1000, Action: "kill"}, false},
+	}
+	for i, test := range tests {
+		err := test.md.Check()
+		if test.valid {
+			require.NoError(t, err, "case %d", i)
+		} else {
+			require.ErrorIs(t, err, ErrInvalidConfigValue, "case %d", i)
+		}
+	}
+}
+
+func TestCheckBackendCompression(t *testing.T) {
+	tests := []struct {
+		bc    BackendCompression
+		valid bool
+	}{
+		{BackendCompression{}, true},
+		{BackendCompression{Algorithm: CompressionNone}, true},
+		{BackendCompression{Algorithm: CompressionZstd}, true},
+		{BackendCompression{Algorithm: CompressionZstd, Level: 22}, true},
+		{BackendCompression{Algorithm: CompressionZlib, Level: 9}, true},
+		{BackendCompression{Algorithm: CompressionZlib, Level: 10}, false},
+		{BackendCompression{Algorithm: CompressionZstd, Level: -1}, false},
+		{BackendCompression{Algorithm: "lz4"}, false},
+	}
+	for i, test := range tests {
+		err := test.bc.Check()
+		if test.valid {
+			require.NoError(t, err, "case %d", i)
+		} else {
+			require.ErrorIs(t, err, ErrInvalidConfigValue, "case %d", i)
+		}
+	}
+}
+
+func TestCheckQueryLimits(t *testing.T) {
+	tests := []struct {
+		ql    QueryLimits
+		valid bool
+	}{
+		{QueryLimits{}, true},
+		{QueryLimits{MaxRequestBytes: 1 << 20, MaxResultRows: 100, MaxResultBytes: 1 << 20}, true},
+		{QueryLimits{MaxRequestBytes: -1}, false},
+		{QueryLimits{MaxRequestBytes: 1<<30 + 1}, false},
+		{QueryLimits{MaxResultRows: -1}, false},
+		{QueryLimits{MaxResultBytes: -1}, false},
+	}
+	for i, test := range tests {
+		err := test.ql.Check()
+		if test.valid {
+			require.NoError(t, err, "case %d", i)
+		} else {
+			require.ErrorIs(t, err, ErrInvalidConfigValue, "case %d", i)
+		}
+	}
+}
+
+func TestCheckLoadDataPolicy(t *testing.T) {
+	tests := []struct {
+		lp    LoadDataPolicy
+		valid bool
+	}{
+		{LoadDataPolicy{}, true},
+		{LoadDataPolicy{DisableLocal: true, MaxBytes: 1 << 20, MaxBytesPerSecond: 1 << 20}, true},
+		{LoadDataPolicy{MaxBytes: -1}, false},
+		{LoadDataPolicy{MaxBytesPerSecond: -1}, false},
+	}
+	for i, test := range tests {
+		err := test.lp.Check()
+		if test.valid {
+			require.NoError(t, err, "case %d", i)
+		} else {
+			require.ErrorIs(t, err, ErrInvalidConfigValue, "case %d", i)
+		}
+	}
+}
+
+func TestRedactNamespace(t *testing.T) {
+	cfg := testNamespaceConfig
+	cfg.Backend.HealthCheck.SQLPassword = "probe_pwd"
+	redacted := cfg.Redact()
+	require.Len(t, redacted.Frontend.LocalUsers, len(cfg.Frontend.LocalUsers))
+	for i, u := range redacted.Frontend.LocalUsers {
+		original := cfg.Frontend.LocalUsers[i]
+		require.Equal(t, original.User, u.User)
+		require.Equal(t, original.BackendUser, u.BackendUser)
+		require.NotEqual(t, original.AuthString, u.AuthString)
+		require.NotEqual(t, original.BackendPassword, u.BackendPassword)
+	}
+	require.Equal(t, redactedSecret, redacted.Backend.HealthCheck.SQLPassword)
+	// The original config is unchanged.
+	require.Equal(t, "svc_pwd", cfg.Frontend.LocalUsers[0].BackendPassword)
+	require.Equal(t, "probe_pwd", cfg.Backend.HealthCheck.SQLPassword)
+}
@@ -5,14 +5,24 @@ package config
 
 import (
 	"bytes"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/pingcap/tiproxy/lib/util/errors"
 )
 
+const (
+	// UnixSocketAddrPrefix is the prefix of Unix socket addresses in the proxy addr, e.g. `unix:///tmp/tiproxy.sock`.
+	UnixSocketAddrPrefix = "unix://"
+	defUnixSocketPerm    = "0600"
+)
+
 var (
 	ErrUnsupportedProxyProtocolVersion = errors.New("unsupported proxy protocol version")
 	ErrInvalidConfigValue              = errors.New("invalid config value")
@@ -48,22 +58,53 @@ type ProxyServerOnline struct {
 	BackendHealthyKeepalive KeepAlive `yaml:"backend-healthy-keepalive" toml:"backend-healthy-keepalive" json:"backend-healthy-keepalive"`
 	// BackendUnhealthyKeepalive applies when the observer treats the backend as unhealthy.
 	// The config values can be aggressive because the backend may stop anytime.
-	BackendUnhealthyKeepalive  KeepAlive `yaml:"backend-unhealthy-keepalive" toml:"backend-unhealthy-keepalive" json:"backend-unhealthy-keepalive"`
-	ProxyProtocol              string    `yaml:"proxy-protocol,omitempty" toml:"proxy-protocol,omitempty" json:"proxy-protocol,omitempty"`
-	GracefulWaitBeforeShutdown int       `yaml:"graceful-wait-before-shutdown,omitempty" toml:"graceful-wait-before-shutdown,omitempty" json:"graceful-wait-before-shutdown,omitempty"`
-	GracefulCloseConnTimeout   int       `yaml:"graceful-close-conn-timeout,omitempty" toml:"graceful-close-conn-timeout,omitempty" json:"graceful-close-conn-timeout,omitempty"`
+	BackendUnhealthyKeepalive KeepAlive `yaml:"backend-unhealthy-keepalive" toml:"backend-unhealthy-keepalive" json:"backend-unhealthy-keepalive"`
+	ProxyProtocol             string    `yaml:"proxy-protocol,omitempty" toml:"proxy-protocol,omitempty" json:"proxy-protocol,omitempty"`
+	// TrustedCIDRs are the upstream proxies allowed to send PROXY headers. Empty means trusting all peers for compatibility,
+	// which allows any client to spoof its address, so it should be set whenever proxy-protocol is enabled.
+	TrustedCIDRs []string `yaml:"trusted-cidrs,omitempty" toml:"trusted-cidrs,omitempty" json:"trusted-cidrs,omitempty"`
+	// AllowCIDRs and DenyCIDRs filter the clients by their addresses, which are the source addresses in PROXY headers if exist.
+	// A client is rejected if it matches DenyCIDRs, or AllowCIDRs is not empty and it doesn't match AllowCIDRs.
+	AllowCIDRs                 []string `yaml:"allow-cidrs,omitempty" toml:"allow-cidrs,omitempty" json:"allow-cidrs,omitempty"`
+	DenyCIDRs                  []string `yaml:"deny-cidrs,omitempty" toml:"deny-cidrs,omitempty" json:"deny-cidrs,omitempty"`
+	GracefulWaitBeforeShutdown int      `yaml:"graceful-wait-before-shutdown,omitempty" toml:"graceful-wait-before-shutdown,omitempty" json:"graceful-wait-before-shutdown,omitempty"`
+	GracefulCloseConnTimeout   int      `yaml:"graceful-close-conn-timeout,omitempty" toml:"graceful-close-conn-timeout,omitempty" json:"graceful-close-conn-timeout,omitempty"`
+	// MigrationBufferSize limits the long data and cursor rows that each connection buffers for session migration. 0 means the default value.
+	MigrationBufferSize int `yaml:"migration-buffer-size,omitempty" toml:"migration-buffer-size,omitempty" json:"migration-buffer-size,omitempty"`
 }
 
 type ProxyServer struct {
-	Addr              string `yaml:"addr,omitempty" toml:"addr,omitempty" json:"addr,omitempty"`
-	AdvertiseAddr     string `yaml:"advertise-addr,omitempty" toml:"advertise-addr,omitempty" json:"advertise-addr,omitempty"`
-	PDAddrs           string `yaml:"pd-addrs,omitempty" toml:"pd-addrs,omitempty" json:"pd-addrs,omitempty"`
+	Addr          string `yaml:"addr,omitempty" toml:"addr,omitempty" json:"addr,omitempty"`
+	AdvertiseAddr string `yaml:"advertise-addr,omitempty" toml:"advertise-addr,omitempty" json:"advertise-addr,omitempty"`
+	PDAddrs       string `yaml:"pd-addrs,omitempty" toml:"pd-addrs,omitempty" json:"pd-addrs,omitempty"`
+	// Listeners declares listeners with their own settings. Addr is ignored if it's set.
+	Listeners []ProxyListener `yaml:"listeners,omitempty" toml:"listeners,omitempty" json:"listeners,omitempty"`
+	// UnixSocketPerm is the file permission of the Unix sockets in Addr, e.g. "0600". Empty means "0600".
+	UnixSocketPerm    string `yaml:"unix-socket-perm,omitempty" toml:"unix-socket-perm,omitempty" json:"unix-socket-perm,omitempty"`
 	ProxyServerOnline `yaml:",inline" toml:",inline" json:",inline"`
 }
 
+// ProxyListener is a SQL listener with its own settings.
+type ProxyListener struct {
+	// Addr is a TCP address or a Unix socket like `unix:///tmp/tiproxy.sock`.
+	Addr string `yaml:"addr" toml:"addr" json:"addr"`
+	// RequireSecureTransport rejects the clients that don't enable TLS.
+	RequireSecureTransport bool `yaml:"require-secure-transport,omitempty" toml:"require-secure-transport,omitempty" json:"require-secure-transport,omitempty"`
+	// ProxyProtocol expects PROXY headers from clients. Whether to send headers to backends is decided by proxy-protocol of the proxy.
+	ProxyProtocol bool `yaml:"proxy-protocol,omitempty" toml:"proxy-protocol,omitempty" json:"proxy-protocol,omitempty"`
+	// Namespace is used when the connection doesn't match any namespace, instead of the `default` namespace.
+	Namespace string `yaml:"namespace,omitempty" toml:"namespace,omitempty" json:"namespace,omitempty"`
+	// MaxConnections limits the connections of this listener. 0 means no limitation.
+	MaxConnections uint64 `yaml:"max-connections,omitempty" toml:"max-connections,omitempty" json:"max-connections,omitempty"`
+	// AllowCIDRs and DenyCIDRs filter the clients of this listener, and [proxy.allow-cidrs] and [proxy.deny-cidrs] still apply.
+	AllowCIDRs []string `yaml:"allow-cidrs,omitempty" toml:"allow-cidrs,omitempty" json:"allow-cidrs,omitempty"`
+	DenyCIDRs  []string `yaml:"deny-cidrs,omitempty" toml:"deny-cidrs,omitempty" json:"deny-cidrs,omitempty"`
+}
+
 type API struct {
-	Addr          string `yaml:"addr,omitempty" toml:"addr,omitempty" json:"addr,omitempty"`
-	ProxyProtocol string `yaml:"proxy-protocol,omitempty" toml:"proxy-protocol,omitempty" json:"proxy-protocol,omitempty"`
+	Addr          string   `yaml:"addr,omitempty" toml:"addr,omitempty" json:"addr,omitempty"`
+	ProxyProtocol string   `yaml:"proxy-protocol,omitempty" toml:"proxy-protocol,omitempty" json:"proxy-protocol,omitempty"`
+	TrustedCIDRs  []string `yaml:"trusted-cidrs,omitempty" toml:"trusted-cidrs,omitempty" json:"trusted-cidrs,omitempty"`
 }
 
 type Advance struct {
@@ -96,6 +137,12 @@ type TLSConfig struct {
 	RSAKeySize         int    `yaml:"rsa-key-size,omitempty" toml:"rsa-key-size,omitempty" json:"rsa-key-size,omitempty"`
 	AutoExpireDuration string `yaml:"autocert-expire-duration,omitempty" toml:"autocert-expire-duration,omitempty" json:"autocert-expire-duration,omitempty"`
 	SkipCA             bool   `yaml:"skip-ca,omitempty" toml:"skip-ca,omitempty" json:"skip-ca,omitempty"`
+	// CipherSuites limits the cipher suites for TLS 1.0-1.2, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256.
+	// Empty means the default cipher suites of Go.
+	CipherSuites []string `yaml:"cipher-suites,omitempty" toml:"cipher-suites,omitempty" json:"cipher-suites,omitempty"`
+	// SessionCacheSize is the number of TLS sessions cached for resumption in a client object.
+	// 0 means the default size and a negative value disables resumption.
+	SessionCacheSize int `yaml:"session-cache-size,omitempty" toml:"session-cache-size,omitempty" json:"session-cache-size,omitempty"`
 }
 
 func (c TLSConfig) HasCert() bool {
@@ -112,6 +159,25 @@ type Security struct {
 	ClusterTLS        TLSConfig `yaml:"cluster-tls,omitempty" toml:"cluster-tls,omitempty" json:"cluster-tls,omitempty"`
 	SQLTLS            TLSConfig `yaml:"sql-tls,omitempty" toml:"sql-tls,omitempty" json:"sql-tls,omitempty"`
 	RequireBackendTLS bool      `yaml:"require-backend-tls,omitempty" toml:"require-backend-tls,omitempty" json:"require-backend-tls,omitempty"`
+	// SHA2PrivateKey is the RSA private key file to exchange caching_sha2_password passwords with the clients that don't enable TLS.
+	// A key pair is generated if it's empty.
+	SHA2PrivateKey string `yaml:"sha2-private-key,omitempty" toml:"sha2-private-key,omitempty" json:"sha2-private-key,omitempty"`
+	// AuthWebhook authorizes the clients by an external HTTP(S) service during the handshake. nil means disabled.
+	AuthWebhook *AuthWebhook `yaml:"auth-webhook,omitempty" toml:"auth-webhook,omitempty" json:"auth-webhook,omitempty"`
+}
+
+// AuthWebhook is the HTTP(S) endpoint that decides whether a client is allowed to connect.
+// COM_CHANGE_USER is rejected once the webhook is enabled.
+type AuthWebhook struct {
+	URL string `yaml:"url,omitempty" toml:"url,omitempty" json:"url,omitempty"`
+	// TimeoutMs is the timeout of each request. It's 3000 if it's 0.
+	TimeoutMs int `yaml:"timeout-ms,omitempty" toml:"timeout-ms,omitempty" json:"timeout-ms,omitempty"`
+	// CacheTTLMs is how long the decisions are cached. The decisions are not cached if it's 0.
+	CacheTTLMs int `yaml:"cache-ttl-ms,omitempty" toml:"cache-ttl-ms,omitempty" json:"cache-ttl-ms,omitempty"`
+	// FailOpen allows the clients when the webhook fails. Otherwise, the clients are rejected.
+	FailOpen bool `yaml:"fail-open,omitempty" toml:"fail-open,omitempty" json:"fail-open,omitempty"`
+	// TLS is a client object to access the webhook.
+	TLS TLSConfig `yaml:"tls,omitempty" toml:"tls,omitempty" json:"tls,omitempty"`
 }
 
 func DefaultKeepAlive() (frontend, backendHealthy, backendUnhealthy KeepAlive) {
@@ -168,16 +234,58 @@ func (cfg *Config) Check() error {
 		cfg.Workdir = filepath.Clean(filepath.Join(d, "work"))
 	}
 
-	switch cfg.Proxy.ProxyProtocol {
-	case "v2":
-	case "":
-	default:
-		return errors.Wrapf(ErrUnsupportedProxyProtocolVersion, "%s", cfg.Proxy.ProxyProtocol)
+	for _, version := range []string{cfg.Proxy.ProxyProtocol, cfg.API.ProxyProtocol} {
+		switch version {
+		case "v1", "v2":
+		case "":
+		default:
+			return errors.Wrapf(ErrUnsupportedProxyProtocolVersion, "%s", version)
+		}
+	}
+	if err := checkCIDRs("trusted-cidrs", cfg.Proxy.TrustedCIDRs); err != nil {
+		return err
+	}
+	if err := checkCIDRs("trusted-cidrs", cfg.API.TrustedCIDRs); err != nil {
+		return err
+	}
+	if err := checkCIDRs("allow-cidrs", cfg.Proxy.AllowCIDRs); err != nil {
+		return err
+	}
+	if err := checkCIDRs("deny-cidrs", cfg.Proxy.DenyCIDRs); err != nil {
+		return err
+	}
+
+	addrs := make(map[string]struct{}, len(cfg.Proxy.Listeners))
+	for _, listener := range cfg.Proxy.Listeners {
+		if listener.Addr == "" {
+			return errors.Wrapf(ErrInvalidConfigValue, "the addr of listeners must be set")
+		}
+		if _, ok := addrs[listener.Addr]; ok {
+			return errors.Wrapf(ErrInvalidConfigValue, "duplicate listener addr %s", listener.Addr)
+		}
+		addrs[listener.Addr] = struct{}{}
+		if err := checkCIDRs("allow-cidrs", listener.AllowCIDRs); err != nil {
+			return err
+		}
+		if err := checkCIDRs("deny-cidrs", listener.DenyCIDRs); err != nil {
+			return err
+		}
+	}
+	if _, err := cfg.Proxy.UnixSocketFileMode(); err != nil {
+		return err
 	}
 
 	if cfg.Proxy.ConnBufferSize > 0 && (cfg.Proxy.ConnBufferSize > 16*1024*1024 || cfg.Proxy.ConnBufferSize < 1024) {
 		return errors.Wrapf(ErrInvalidConfigValue, "conn-buffer-size must be between 1K and 16M")
 	}
+	if cfg.Proxy.MigrationBufferSize < 0 {
+		return errors.Wrapf(ErrInvalidConfigValue, "migration-buffer-size must be greater than or equal to 0")
+	}
+	if cfg.Security.AuthWebhook != nil {
+		if err := cfg.Security.AuthWebhook.check(); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -187,3 +295,58 @@ func (cfg *Config) ToBytes() ([]byte, error) {
 	err := toml.NewEncoder(b).Encode(cfg)
 	return b.Bytes(), errors.WithStack(err)
 }
+
+func (w *AuthWebhook) check() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.Wrapf(ErrInvalidConfigValue, "invalid auth-webhook url %s", w.URL)
+	}
+	if w.TimeoutMs < 0 || w.CacheTTLMs < 0 {
+		return errors.Wrapf(ErrInvalidConfigValue, "timeout-ms and cache-ttl-ms of auth-webhook must not be negative")
+	}
+	return nil
+}
+
+// checkCIDRs checks whether the CIDRs of the config item are valid. A plain IP is also valid.
+func checkCIDRs(name string, cidrs []string) error {
+	for _, cidr := range cidrs {
+		if strings.Contains(cidr, "/") {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return errors.Wrapf(ErrInvalidConfigValue, "invalid %s %s", name, cidr)
+			}
+		} else if net.ParseIP(cidr) == nil {
+			return errors.Wrapf(ErrInvalidConfigValue, "invalid %s %s", name, cidr)
+		}
+	}
+	return nil
+}
+
+// UnixSocketFileMode parses UnixSocketPerm, which is an octal number. Empty means the default value.
+func (ps *ProxyServer) UnixSocketFileMode() (os.FileMode, error) {
+	permStr := ps.UnixSocketPerm
+	if permStr == "" {
+		permStr = defUnixSocketPerm
+	}
+	perm, err := strconv.ParseUint(permStr, 8, 32)
+	if err != nil || perm > uint64(os.ModePerm) {
+		return 0, errors.Wrapf(ErrInvalidConfigValue, "invalid unix-socket-perm %s", ps.UnixSocketPerm)
+	}
+	return os.FileMode(perm), nil
+}
+
+// ListenerConfigs returns the listeners to create. If Listeners is not set, each address in Addr becomes a listener
+// and it expects PROXY headers when proxy-protocol is enabled.
+func (ps *ProxyServer) ListenerConfigs() []ProxyListener {
+	if len(ps.Listeners) > 0 {
+		return ps.Listeners
+	}
+	addrs := strings.Split(ps.Addr, ",")
+	listeners := make([]ProxyListener, 0, len(addrs))
+	for _, addr := range addrs {
+		listeners = append(listeners, ProxyListener{
+			Addr:          addr,
+			ProxyProtocol: ps.ProxyProtocol != "",
+		})
+	}
+	return listeners
+}
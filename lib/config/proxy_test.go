@@ -20,12 +20,20 @@ var testProxyConfig = Config{
 	Proxy: ProxyServer{
 		Addr:    "0.0.0.0:4000",
 		PDAddrs: "127.0.0.1:4089",
+		Listeners: []ProxyListener{
+			{Addr: "0.0.0.0:4001", RequireSecureTransport: true, ProxyProtocol: true, Namespace: "public", MaxConnections: 10,
+				AllowCIDRs: []string{"10.0.0.0/8"}, DenyCIDRs: []string{"10.0.0.1"}},
+		},
 		ProxyServerOnline: ProxyServerOnline{
 			MaxConnections:             1,
 			FrontendKeepalive:          KeepAlive{Enabled: true},
 			ProxyProtocol:              "v2",
+			TrustedCIDRs:               []string{"10.0.0.0/8"},
+			AllowCIDRs:                 []string{"10.0.0.0/8", "192.168.0.0/16"},
+			DenyCIDRs:                  []string{"192.168.1.1"},
 			GracefulWaitBeforeShutdown: 10,
 			ConnBufferSize:             32 * 1024,
+			MigrationBufferSize:        1024 * 1024,
 		},
 	},
 	API: API{
@@ -69,8 +77,18 @@ var testProxyConfig = Config{
 			SkipCA:             true,
 			Cert:               "b",
 			Key:                "c",
+			SessionCacheSize:   100,
 		},
 		RequireBackendTLS: true,
+		AuthWebhook: &AuthWebhook{
+			URL:        "https://127.0.0.1:8080/auth",
+			TimeoutMs:  1000,
+			CacheTTLMs: 5000,
+			FailOpen:   true,
+			TLS: TLSConfig{
+				CA: "a",
+			},
+		},
 	},
 }
 
@@ -103,16 +121,100 @@ func TestProxyCheck(t *testing.T) {
 		},
 		{
 			pre: func(t *testing.T, c *Config) {
-				c.Proxy.ProxyProtocol = "v1"
+				c.Proxy.ProxyProtocol = "v3"
+			},
+			err: ErrUnsupportedProxyProtocolVersion,
+		},
+		{
+			pre: func(t *testing.T, c *Config) {
+				c.API.ProxyProtocol = "v3"
 			},
 			err: ErrUnsupportedProxyProtocolVersion,
 		},
+		{
+			pre: func(t *testing.T, c *Config) {
+				c.Proxy.ProxyProtocol = "v1"
+				c.API.ProxyProtocol = "v1"
+				c.Proxy.TrustedCIDRs = []string{"10.0.0.0/8", "192.168.1.1", "::1"}
+			},
+			post: func(t *testing.T, c *Config) {},
+		},
+		{
+			pre: func(t *testing.T, c *Config) {
+				c.Proxy.Listeners = []ProxyListener{{Addr: "0.0.0.0:6000"}, {Addr: ""}}
+			},
+			err: ErrInvalidConfigValue,
+		},
+		{
+			pre: func(t *testing.T, c *Config) {
+				c.Proxy.Listeners = []ProxyListener{{Addr: "0.0.0.0:6000"}, {Addr: "0.0.0.0:6000"}}
+			},
+			err: ErrInvalidConfigValue,
+		},
+		{
+			pre: func(t *testing.T, c *Config) {
+				c.Proxy.UnixSocketPerm = "0666"
+			},
+			post: func(t *testing.T, c *Config) {
+				perm, err := c.Proxy.UnixSocketFileMode()
+				require.NoError(t, err)
+				require.Equal(t, os.FileMode(0666), perm)
+			},
+		},
+		{
+			pre: func(t *testing.T, c *Config) {
+				c.Proxy.UnixSocketPerm = "0999"
+			},
+			err: ErrInvalidConfigValue,
+		},
+		{
+			pre: func(t *testing.T, c *Config) {
+				c.Proxy.TrustedCIDRs = []string{"10.0.0.0/33"}
+			},
+			err: ErrInvalidConfigValue,
+		},
+		{
+			pre: func(t *testing.T, c *Config) {
+				c.API.TrustedCIDRs = []string{"abc"}
+			},
+			err: ErrInvalidConfigValue,
+		},
+		{
+			pre: func(t *testing.T, c *Config) {
+				c.Proxy.DenyCIDRs = []string{"abc"}
+			},
+			err: ErrInvalidConfigValue,
+		},
+		{
+			pre: func(t *testing.T, c *Config) {
+				c.Proxy.Listeners = []ProxyListener{{Addr: "0.0.0.0:4001", AllowCIDRs: []string{"10.0.0.0/33"}}}
+			},
+			err: ErrInvalidConfigValue,
+		},
 		{
 			pre: func(t *testing.T, c *Config) {
 				c.Proxy.ConnBufferSize = 100 * 1024 * 1024
 			},
 			err: ErrInvalidConfigValue,
 		},
+		{
+			pre: func(t *testing.T, c *Config) {
+				c.Proxy.MigrationBufferSize = -1
+			},
+			err: ErrInvalidConfigValue,
+		},
+		{
+			pre: func(t *testing.T, c *Config) {
+				c.Security.AuthWebhook = &AuthWebhook{URL: "tcp://127.0.0.1:8080"}
+			},
+			err: ErrInvalidConfigValue,
+		},
+		{
+			pre: func(t *testing.T, c *Config) {
+				c.Security.AuthWebhook = &AuthWebhook{URL: "http://127.0.0.1:8080", TimeoutMs: -1}
+			},
+			err: ErrInvalidConfigValue,
+		},
 	}
 	for _, tc := range testcases {
 		cfg := testProxyConfig
@@ -125,3 +227,22 @@ func TestProxyCheck(t *testing.T) {
 		tc.post(t, &cfg)
 	}
 }
+
+func TestListenerConfigs(t *testing.T) {
+	ps := ProxyServer{
+		Addr: "0.0.0.0:6000,unix:///tmp/tiproxy.sock",
+		ProxyServerOnline: ProxyServerOnline{
+			ProxyProtocol: "v2",
+		},
+	}
+	require.Equal(t, []ProxyListener{
+		{Addr: "0.0.0.0:6000", ProxyProtocol: true},
+		{Addr: "unix:///tmp/tiproxy.sock", ProxyProtocol: true},
+	}, ps.ListenerConfigs())
+
+	ps.Listeners = []ProxyListener{
+		{Addr: "0.0.0.0:6000", Namespace: "internal"},
+		{Addr: "0.0.0.0:6001", RequireSecureTransport: true, ProxyProtocol: true, MaxConnections: 100},
+	}
+	require.Equal(t, ps.Listeners, ps.ListenerConfigs())
+}
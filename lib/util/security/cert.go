@@ -4,6 +4,7 @@
 package security
 
 import (
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
@@ -20,6 +21,11 @@ const (
 	// Recreate the auto certs one hour before it expires.
 	// It should be longer than defaultRetryInterval.
 	recreateAutoCertAdvance = 24 * time.Hour
+	// DefaultSessionCacheSize is the default number of TLS sessions cached by a client config.
+	DefaultSessionCacheSize = 1024
+	// sessionTicketKeyRotation is how often a server config generates a new session ticket key.
+	// It's checked periodically by RotateTicketKeys, so the actual interval may be a little longer.
+	sessionTicketKeyRotation = 24 * time.Hour
 )
 
 var emptyCert = new(tls.Certificate)
@@ -30,6 +36,15 @@ type CertInfo struct {
 	cert        atomic.Pointer[tls.Certificate]
 	autoCertExp atomic.Int64
 	server      bool
+	// The fields below are only accessed by Reload and RotateTicketKeys, which are never called concurrently.
+	// They are kept across reloads so that TLS sessions can still be resumed after reloading.
+	sessionCache     tls.ClientSessionCache
+	sessionCacheSize int
+	// ticketKeys are the session ticket keys of a server config. The first one encrypts new tickets.
+	ticketKeys    [][32]byte
+	ticketKeyTime time.Time
+	// serverConfig is the last server config returned by Reload. Its ticket keys are rotated in place.
+	serverConfig *tls.Config
 }
 
 func NewCert(server bool) *CertInfo {
@@ -47,6 +62,9 @@ func (ci *CertInfo) Reload(lg *zap.Logger) (tlsConfig *tls.Config, err error) {
 	// - For CA: customize InsecureSkipVerify + VerifyPeerCertificate
 	if ci.server {
 		tlsConfig, err = ci.buildServerConfig(lg)
+		if err == nil {
+			ci.serverConfig = tlsConfig
+		}
 	} else {
 		tlsConfig, err = ci.buildClientConfig(lg)
 	}
@@ -108,6 +126,56 @@ func (ci *CertInfo) verifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certifi
 	return err
 }
 
+// getSessionCache returns the client session cache shared by the configs built from ci.
+func (ci *CertInfo) getSessionCache(size int) tls.ClientSessionCache {
+	if size < 0 {
+		ci.sessionCache, ci.sessionCacheSize = nil, 0
+		return nil
+	}
+	if size == 0 {
+		size = DefaultSessionCacheSize
+	}
+	if ci.sessionCache == nil || ci.sessionCacheSize != size {
+		ci.sessionCache, ci.sessionCacheSize = tls.NewLRUClientSessionCache(size), size
+	}
+	return ci.sessionCache
+}
+
+// rotateTicketKeys generates a new session ticket key periodically and keeps the previous one,
+// so that the tickets issued before the rotation can still be resumed.
+func (ci *CertInfo) rotateTicketKeys(now time.Time) ([][32]byte, error) {
+	if len(ci.ticketKeys) > 0 && now.Sub(ci.ticketKeyTime) < sessionTicketKeyRotation {
+		return ci.ticketKeys, nil
+	}
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	keys := [][32]byte{key}
+	if len(ci.ticketKeys) > 0 {
+		keys = append(keys, ci.ticketKeys[0])
+	}
+	ci.ticketKeys, ci.ticketKeyTime = keys, now
+	return keys, nil
+}
+
+// RotateTicketKeys rotates the session ticket keys of the last server config once they expire.
+// It should be called periodically because Reload may fail or be called rarely.
+func (ci *CertInfo) RotateTicketKeys() error {
+	if ci.serverConfig == nil {
+		return nil
+	}
+	oldKeys := ci.ticketKeys
+	keys, err := ci.rotateTicketKeys(time.Now())
+	if err != nil {
+		return err
+	}
+	if len(oldKeys) == 0 || keys[0] != oldKeys[0] {
+		ci.serverConfig.SetSessionTicketKeys(keys)
+	}
+	return nil
+}
+
 func (ci *CertInfo) loadCA(pemCerts []byte) (*x509.CertPool, error) {
 	pool := x509.NewCertPool()
 	for len(pemCerts) > 0 {
@@ -149,9 +217,18 @@ func (ci *CertInfo) buildServerConfig(lg *zap.Logger) (*tls.Config, error) {
 		GetClientCertificate:  ci.getClientCert,
 		VerifyPeerCertificate: ci.verifyPeerCertificate,
 	}
+	cipherSuites, err := ParseCipherSuites(cfg.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	tcfg.CipherSuites = cipherSuites
+	ticketKeys, err := ci.rotateTicketKeys(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	tcfg.SetSessionTicketKeys(ticketKeys)
 
 	var certPEM, keyPEM []byte
-	var err error
 	if autoCerts {
 		now := time.Now()
 		if time.Unix(ci.autoCertExp.Load(), 0).Before(now) {
@@ -222,6 +299,7 @@ func (ci *CertInfo) buildClientConfig(lg *zap.Logger) (*tls.Config, error) {
 			return &tls.Config{
 				InsecureSkipVerify: true,
 				MinVersion:         GetMinTLSVer(cfg.MinTLSVersion, lg),
+				ClientSessionCache: ci.getSessionCache(cfg.SessionCacheSize),
 			}, nil
 		}
 		lg.Info("no CA to verify server connections, disable TLS")
@@ -234,6 +312,7 @@ func (ci *CertInfo) buildClientConfig(lg *zap.Logger) (*tls.Config, error) {
 		GetClientCertificate:  ci.getClientCert,
 		InsecureSkipVerify:    true,
 		VerifyPeerCertificate: ci.verifyPeerCertificate,
+		ClientSessionCache:    ci.getSessionCache(cfg.SessionCacheSize),
 	}
 
 	certBytes, err := os.ReadFile(cfg.CA)
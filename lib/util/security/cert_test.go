@@ -458,3 +458,93 @@ func connectWithTLS(ctls, stls *tls.Config) (clientErr, serverErr error) {
 	wg.Wait()
 	return
 }
+
+func TestSessionResumption(t *testing.T) {
+	lg, _ := logger.CreateLoggerForTest(t)
+	sci := NewCert(true)
+	sci.SetConfig(config.TLSConfig{AutoCerts: true})
+	cci := NewCert(false)
+	cci.SetConfig(config.TLSConfig{SkipCA: true})
+	resumed := func() bool {
+		stls, err := sci.Reload(lg)
+		require.NoError(t, err)
+		ctls, err := cci.Reload(lg)
+		require.NoError(t, err)
+		return resumeTLS(t, ctls, stls)
+	}
+
+	// The session is resumed after reloading.
+	require.False(t, resumed())
+	require.True(t, resumed())
+
+	// The tickets of the previous key are still accepted after rotation.
+	sci.ticketKeyTime = sci.ticketKeyTime.Add(-sessionTicketKeyRotation)
+	require.True(t, resumed())
+	require.Len(t, sci.ticketKeys, 2)
+
+	// Resumption is disabled.
+	cci.SetConfig(config.TLSConfig{SkipCA: true, SessionCacheSize: -1})
+	require.False(t, resumed())
+}
+
+func TestRotateTicketKeys(t *testing.T) {
+	lg, _ := logger.CreateLoggerForTest(t)
+	sci := NewCert(true)
+	sci.SetConfig(config.TLSConfig{AutoCerts: true})
+	cci := NewCert(false)
+	cci.SetConfig(config.TLSConfig{SkipCA: true})
+	stls, err := sci.Reload(lg)
+	require.NoError(t, err)
+	ctls, err := cci.Reload(lg)
+	require.NoError(t, err)
+	require.False(t, resumeTLS(t, ctls, stls))
+	require.True(t, resumeTLS(t, ctls, stls))
+
+	// The keys are not rotated before they expire.
+	keys := sci.ticketKeys
+	require.NoError(t, sci.RotateTicketKeys())
+	require.Equal(t, keys, sci.ticketKeys)
+	require.True(t, resumeTLS(t, ctls, stls))
+
+	// The keys of the same config are rotated without reloading, and the tickets of expired keys are rejected.
+	for i := 0; i < 2; i++ {
+		sci.ticketKeyTime = sci.ticketKeyTime.Add(-sessionTicketKeyRotation)
+		require.NoError(t, sci.RotateTicketKeys())
+	}
+	require.NotContains(t, sci.ticketKeys, keys[0])
+	require.False(t, resumeTLS(t, ctls, stls))
+	require.True(t, resumeTLS(t, ctls, stls))
+
+	// Nothing happens if TLS is disabled.
+	sci.SetConfig(config.TLSConfig{})
+	stls, err = sci.Reload(lg)
+	require.NoError(t, err)
+	require.Nil(t, stls)
+	sci.ticketKeyTime = sci.ticketKeyTime.Add(-sessionTicketKeyRotation)
+	require.NoError(t, sci.RotateTicketKeys())
+}
+
+// resumeTLS connects with TLS and returns whether the session is resumed.
+func resumeTLS(t *testing.T, ctls, stls *tls.Config) bool {
+	var state tls.ConnectionState
+	client, server := net.Pipe()
+	var wg waitgroup.WaitGroup
+	wg.Run(func() {
+		tlsConn := tls.Client(client, ctls)
+		require.NoError(t, tlsConn.Handshake())
+		// The session ticket of TLS 1.3 is processed when reading the data after the handshake.
+		_, err := tlsConn.Read(make([]byte, 1))
+		require.NoError(t, err)
+		state = tlsConn.ConnectionState()
+		_ = client.Close()
+	})
+	wg.Run(func() {
+		tlsConn := tls.Server(server, stls)
+		require.NoError(t, tlsConn.Handshake())
+		_, err := tlsConn.Write([]byte{0})
+		require.NoError(t, err)
+		_ = server.Close()
+	})
+	wg.Wait()
+	return state.DidResume
+}
@@ -0,0 +1,81 @@
+// Copyright 2024 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package security
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+
+	"github.com/pingcap/tiproxy/lib/util/errors"
+)
+
+// DefaultRSAKeySize is the size of the generated RSA keys, the same as the default size in MySQL.
+const DefaultRSAKeySize = 2048
+
+// GenerateRSAKey generates an RSA key pair. rsaKeySize less than 1024 means using DefaultRSAKeySize.
+func GenerateRSAKey(rsaKeySize int) (*rsa.PrivateKey, error) {
+	if rsaKeySize < 1024 {
+		rsaKeySize = DefaultRSAKeySize
+	}
+	key, err := rsa.GenerateKey(rand.Reader, rsaKeySize)
+	return key, errors.WithStack(err)
+}
+
+// LoadRSAKey loads an RSA private key from a PEM file in the PKCS #1 or PKCS #8 format.
+func LoadRSAKey(path string) (*rsa.PrivateKey, error) {
+	keyPEM, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return ParseRSAKey(keyPEM)
+}
+
+// ParseRSAKey parses an RSA private key in the PKCS #1 or PKCS #8 format.
+func ParseRSAKey(keyPEM []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("failed to decode RSA private key PEM")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("the private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// EncodeRSAPublicKey encodes the public key in the PEM format that MySQL clients accept.
+func EncodeRSAPublicKey(key *rsa.PublicKey) ([]byte, error) {
+	keyBytes, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: keyBytes}), nil
+}
+
+// ParseRSAPublicKey parses the public key in the PEM format that MySQL servers send.
+func ParseRSAPublicKey(keyPEM []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("failed to decode RSA public key PEM")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("the public key is not an RSA key")
+	}
+	return rsaKey, nil
+}
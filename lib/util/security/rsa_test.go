@@ -0,0 +1,49 @@
+// Copyright 2024 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package security
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRSAKey(t *testing.T) {
+	key, err := GenerateRSAKey(1024)
+	require.NoError(t, err)
+
+	// PKCS #1
+	dir := t.TempDir()
+	pkcs1Path := filepath.Join(dir, "pkcs1.pem")
+	require.NoError(t, os.WriteFile(pkcs1Path, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600))
+	loaded, err := LoadRSAKey(pkcs1Path)
+	require.NoError(t, err)
+	require.True(t, key.Equal(loaded))
+
+	// PKCS #8
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	pkcs8Path := filepath.Join(dir, "pkcs8.pem")
+	require.NoError(t, os.WriteFile(pkcs8Path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), 0600))
+	loaded, err = LoadRSAKey(pkcs8Path)
+	require.NoError(t, err)
+	require.True(t, key.Equal(loaded))
+
+	_, err = ParseRSAKey([]byte("invalid"))
+	require.Error(t, err)
+	_, err = LoadRSAKey(filepath.Join(dir, "not_exist"))
+	require.Error(t, err)
+
+	pubPEM, err := EncodeRSAPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	pub, err := ParseRSAPublicKey(pubPEM)
+	require.NoError(t, err)
+	require.True(t, key.PublicKey.Equal(pub))
+	_, err = ParseRSAPublicKey([]byte("invalid"))
+	require.Error(t, err)
+}
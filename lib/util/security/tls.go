@@ -238,6 +238,25 @@ func BuildClientTLSConfig(logger *zap.Logger, cfg config.TLSConfig) (*tls.Config
 	return tcfg, nil
 }
 
+// SessionCacheWithKey returns a view of the cache that stores the session by the key rather than the server name.
+// It's used when multiple servers share the same server name, such as the backends on the same host.
+func SessionCacheWithKey(cache tls.ClientSessionCache, key string) tls.ClientSessionCache {
+	return &keyedSessionCache{cache: cache, key: key}
+}
+
+type keyedSessionCache struct {
+	cache tls.ClientSessionCache
+	key   string
+}
+
+func (c *keyedSessionCache) Get(string) (*tls.ClientSessionState, bool) {
+	return c.cache.Get(c.key)
+}
+
+func (c *keyedSessionCache) Put(_ string, cs *tls.ClientSessionState) {
+	c.cache.Put(c.key, cs)
+}
+
 // GetMinTLSVer parses the min tls version from config and reports warning if necessary.
 func GetMinTLSVer(tlsVerStr string, logger *zap.Logger) uint16 {
 	var minTLSVersion uint16 = tls.VersionTLS12
@@ -259,3 +278,27 @@ func GetMinTLSVer(tlsVerStr string, logger *zap.Logger) uint16 {
 	}
 	return minTLSVersion
 }
+
+// ParseCipherSuites parses the cipher suite names, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, into IDs.
+// It returns nil if names is empty, which means using the default cipher suites of Go.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	suites := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := suites[strings.TrimSpace(name)]
+		if !ok {
+			return nil, errors.Errorf("unsupported cipher suite %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
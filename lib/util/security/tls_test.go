@@ -63,3 +63,16 @@ func TestGetMinTLSVer(t *testing.T) {
 		}
 	}
 }
+
+func TestParseCipherSuites(t *testing.T) {
+	ids, err := ParseCipherSuites(nil)
+	require.NoError(t, err)
+	require.Nil(t, ids)
+
+	ids, err = ParseCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", " TLS_RSA_WITH_AES_128_CBC_SHA"})
+	require.NoError(t, err)
+	require.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_RSA_WITH_AES_128_CBC_SHA}, ids)
+
+	_, err = ParseCipherSuites([]string{"TLS_UNKNOWN"})
+	require.ErrorContains(t, err, "TLS_UNKNOWN")
+}
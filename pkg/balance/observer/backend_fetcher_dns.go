@@ -0,0 +1,127 @@
+// Copyright 2024 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package observer
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pingcap/tiproxy/lib/util/errors"
+	"go.uber.org/zap"
+)
+
+var _ BackendFetcher = (*DNSFetcher)(nil)
+
+// The prefix of the names that are resolved by SRV records, e.g. `srv+_mysql._tcp.tidb.svc.cluster.local`.
+const srvPrefix = "srv+"
+
+// DNSResolver resolves host names. *net.Resolver implements it and it can be replaced with a stub in tests.
+type DNSResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNSFetcher fetches the backend list by resolving host names, e.g. a headless service in Kubernetes.
+// A name in the form of `host:port` is resolved by A/AAAA records and a name prefixed with `srv+` is resolved by SRV records.
+// Each resolved IP:port is a backend.
+type DNSFetcher struct {
+	resolver DNSResolver
+	logger   *zap.Logger
+	names    []string
+	// The last successful results of each name. They are used when resolving fails temporarily.
+	lastAddrs map[string][]string
+}
+
+func NewDNSFetcher(names []string, resolver DNSResolver, logger *zap.Logger) *DNSFetcher {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &DNSFetcher{
+		resolver:  resolver,
+		logger:    logger,
+		names:     names,
+		lastAddrs: make(map[string][]string, len(names)),
+	}
+}
+
+// GetBackendList implements BackendFetcher.GetBackendList interface.
+// It's only called in the observing goroutine, so it's not protected by locks.
+func (df *DNSFetcher) GetBackendList(ctx context.Context) (map[string]*BackendInfo, error) {
+	backends := make(map[string]*BackendInfo)
+	var lastErr error
+	resolved := false
+	for _, name := range df.names {
+		addrs, err := df.resolve(ctx, name)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			var ok bool
+			if addrs, ok = df.lastAddrs[name]; !ok {
+				df.logger.Warn("resolve backend name failed", zap.String("name", name), zap.Error(err))
+				continue
+			}
+			df.logger.Warn("resolve backend name failed, using the last result", zap.String("name", name),
+				zap.Strings("addrs", addrs), zap.Error(err))
+		} else {
+			df.lastAddrs[name] = addrs
+		}
+		resolved = true
+		for _, addr := range addrs {
+			backends[addr] = &BackendInfo{}
+		}
+	}
+	// If all the names fail, report the error so that clients know why there are no backends.
+	if !resolved && lastErr != nil {
+		return nil, lastErr
+	}
+	return backends, nil
+}
+
+func (df *DNSFetcher) resolve(ctx context.Context, name string) ([]string, error) {
+	if srvName, ok := strings.CutPrefix(name, srvPrefix); ok {
+		return df.resolveSRV(ctx, srvName)
+	}
+	host, port, err := net.SplitHostPort(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid backend name %s", name)
+	}
+	return df.resolveHost(ctx, host, port)
+}
+
+func (df *DNSFetcher) resolveSRV(ctx context.Context, name string) ([]string, error) {
+	_, records, err := df.resolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "lookup SRV %s failed", name)
+	}
+	var addrs []string
+	for _, record := range records {
+		// The target is usually a host name, e.g. the name of a pod.
+		target := strings.TrimSuffix(record.Target, ".")
+		targetAddrs, err := df.resolveHost(ctx, target, strconv.Itoa(int(record.Port)))
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, targetAddrs...)
+	}
+	return addrs, nil
+}
+
+func (df *DNSFetcher) resolveHost(ctx context.Context, host, port string) ([]string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{net.JoinHostPort(host, port)}, nil
+	}
+	ips, err := df.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, errors.Wrapf(err, "lookup host %s failed", host)
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip, port))
+	}
+	return addrs, nil
+}
@@ -5,6 +5,7 @@ package observer
 
 import (
 	"context"
+	"net"
 	"testing"
 
 	tidbinfo "github.com/pingcap/tidb/domain/infosync"
@@ -116,3 +117,44 @@ func TestPDFetcher(t *testing.T) {
 		require.NoError(t, err)
 	}
 }
+
+func TestDNSFetcher(t *testing.T) {
+	lg, _ := logger.CreateLoggerForTest(t)
+	resolver := newMockResolver()
+	resolver.setHost("tidb.svc", []string{"10.0.0.1", "10.0.0.2"})
+	resolver.setHost("tidb-0.tidb.svc", []string{"10.0.1.1"})
+	resolver.setHost("tidb-1.tidb.svc", []string{"fd00::1"})
+	resolver.setSRV("_mysql._tcp.tidb.svc", []*net.SRV{
+		{Target: "tidb-0.tidb.svc.", Port: 4000},
+		{Target: "tidb-1.tidb.svc.", Port: 4001},
+	})
+	fetcher := NewDNSFetcher([]string{"tidb.svc:4000", "srv+_mysql._tcp.tidb.svc", "127.0.0.1:4000"}, resolver, lg)
+
+	checkAddrs := func(expected ...string) {
+		backends, err := fetcher.GetBackendList(context.Background())
+		require.NoError(t, err)
+		addrs := make([]string, 0, len(backends))
+		for addr := range backends {
+			addrs = append(addrs, addr)
+		}
+		require.ElementsMatch(t, expected, addrs)
+	}
+	checkAddrs("10.0.0.1:4000", "10.0.0.2:4000", "10.0.1.1:4000", "[fd00::1]:4001", "127.0.0.1:4000")
+
+	// Backends are added and removed.
+	resolver.setHost("tidb.svc", []string{"10.0.0.2", "10.0.0.3"})
+	checkAddrs("10.0.0.2:4000", "10.0.0.3:4000", "10.0.1.1:4000", "[fd00::1]:4001", "127.0.0.1:4000")
+
+	// The last result is used when resolving fails.
+	resolver.setHost("tidb.svc", nil)
+	checkAddrs("10.0.0.2:4000", "10.0.0.3:4000", "10.0.1.1:4000", "[fd00::1]:4001", "127.0.0.1:4000")
+
+	// Report the error if all the names fail.
+	fetcher = NewDNSFetcher([]string{"tidb.svc:4000", "srv+_mysql._tcp.unknown.svc"}, resolver, lg)
+	_, err := fetcher.GetBackendList(context.Background())
+	require.Error(t, err)
+
+	fetcher = NewDNSFetcher([]string{"tidb.svc"}, resolver, lg)
+	_, err = fetcher.GetBackendList(context.Background())
+	require.ErrorContains(t, err, "invalid backend name")
+}
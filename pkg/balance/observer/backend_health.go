@@ -3,7 +3,11 @@
 
 package observer
 
-import "fmt"
+import (
+	"fmt"
+
+	pnet "github.com/pingcap/tiproxy/pkg/proxy/net"
+)
 
 type BackendStatus int
 
@@ -25,6 +29,9 @@ const (
 	StatusMemoryHigh
 	StatusRunSlow
 	StatusSchemaOutdated
+	// StatusDegraded means the backend can still serve but it's slow or partially failing.
+	// It gets no new connections while other backends are available and its connections are drained slowly.
+	StatusDegraded
 )
 
 var statusNames = map[BackendStatus]string{
@@ -33,6 +40,7 @@ var statusNames = map[BackendStatus]string{
 	StatusMemoryHigh:     "memory high",
 	StatusRunSlow:        "run slow",
 	StatusSchemaOutdated: "schema outdated",
+	StatusDegraded:       "degraded",
 }
 
 var statusScores = map[BackendStatus]int{
@@ -41,6 +49,13 @@ var statusScores = map[BackendStatus]int{
 	StatusMemoryHigh:     5000,
 	StatusRunSlow:        5000,
 	StatusSchemaOutdated: 10000000,
+	// Higher than the score of any healthy backend so that it's chosen only when no healthy backends are available.
+	StatusDegraded: 1000000,
+}
+
+// Available returns true if the backend can serve connections, even though it may be degraded.
+func (bs BackendStatus) Available() bool {
+	return bs == StatusHealthy || bs == StatusDegraded
 }
 
 type BackendHealth struct {
@@ -49,10 +64,12 @@ type BackendHealth struct {
 	PingErr error
 	// The backend version that returned to the client during handshake.
 	ServerVersion string
+	// The capability in the initial handshake of the backend. It's 0 if it's unknown.
+	Capability pnet.Capability
 }
 
 func (bh *BackendHealth) Equals(health BackendHealth) bool {
-	return bh.Status == health.Status && bh.ServerVersion == health.ServerVersion
+	return bh.Status == health.Status && bh.ServerVersion == health.ServerVersion && bh.Capability == health.Capability
 }
 
 func (bh *BackendHealth) String() string {
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/pingcap/tiproxy/lib/config"
+	"github.com/pingcap/tiproxy/lib/util/errors"
 	"github.com/pingcap/tiproxy/lib/util/waitgroup"
 	"github.com/pingcap/tiproxy/pkg/metrics"
 	"github.com/pingcap/tiproxy/pkg/util/monotime"
@@ -28,22 +29,39 @@ type BackendObserver interface {
 	Start(ctx context.Context)
 	Subscribe(name string) <-chan HealthResult
 	Refresh()
+	// ReportFailure records a failure of real traffic on the backend. It's used for passive health check.
+	ReportFailure(addr string, errType TrafficErrType, err error)
+	// ReportSuccess records a success of real traffic on the backend.
+	ReportSuccess(addr string)
+	// HealthHistory returns the recent status changes of each backend.
+	HealthHistory() map[string][]HealthEvent
 	Close()
 }
 
 // DefaultBackendObserver refreshes backend list and notifies BackendEventReceiver.
 type DefaultBackendObserver struct {
 	sync.Mutex
-	subscribers       map[string]chan HealthResult
-	curBackends       map[string]*BackendHealth
-	wg                waitgroup.WaitGroup
-	refreshChan       chan struct{}
+	subscribers map[string]chan HealthResult
+	curBackends map[string]*BackendHealth
+	wg          waitgroup.WaitGroup
+	refreshChan chan struct{}
+	// ejectChan is used to notify the subscribers immediately after a backend is ejected.
+	ejectChan         chan struct{}
 	fetcher           BackendFetcher
 	hc                HealthCheck
 	cancelFunc        context.CancelFunc
 	logger            *zap.Logger
 	healthCheckConfig *config.HealthCheck
 	wgp               *waitgroup.WaitGroupPool
+	breakers          struct {
+		sync.Mutex
+		m map[string]*circuitBreaker
+	}
+	thresholds map[string]*thresholdState
+	history    struct {
+		sync.Mutex
+		m map[string][]HealthEvent
+	}
 }
 
 // NewDefaultBackendObserver creates a BackendObserver.
@@ -56,10 +74,14 @@ func NewDefaultBackendObserver(logger *zap.Logger, config *config.HealthCheck,
 		hc:                hc,
 		wgp:               waitgroup.NewWaitGroupPool(goPoolSize, goMaxIdle),
 		refreshChan:       make(chan struct{}),
+		ejectChan:         make(chan struct{}, 1),
 		fetcher:           backendFetcher,
 		subscribers:       make(map[string]chan HealthResult),
 		curBackends:       make(map[string]*BackendHealth),
+		thresholds:        make(map[string]*thresholdState),
 	}
+	bo.breakers.m = make(map[string]*circuitBreaker)
+	bo.history.m = make(map[string][]HealthEvent)
 	return bo
 }
 
@@ -91,25 +113,126 @@ func (bo *DefaultBackendObserver) observe(ctx context.Context) {
 			bo.logger.Error("fetching backends encounters error", zap.Error(err))
 			result.err = err
 		} else {
-			result.backends = bo.checkHealth(ctx, backendInfo)
+			result.backends = bo.applyBreakers(bo.applyThresholds(bo.checkHealth(ctx, backendInfo)), true)
 		}
 		bo.updateHealthResult(result)
 		bo.notifySubscribers(ctx, result)
 
 		cost := monotime.Since(startTime)
 		metrics.HealthCheckCycleGauge.Set(cost.Seconds())
-		wait := bo.healthCheckConfig.Interval - cost
-		if wait > 0 {
-			select {
-			case <-time.After(wait):
-			case <-bo.refreshChan:
-			case <-ctx.Done():
-				return
+		if !bo.waitNextCycle(ctx, bo.healthCheckConfig.Interval-cost) {
+			return
+		}
+	}
+}
+
+// waitNextCycle waits until the next health check cycle. It returns false if the context is done.
+// If a backend is ejected while waiting, the subscribers are notified immediately without probing the backends.
+func (bo *DefaultBackendObserver) waitNextCycle(ctx context.Context, wait time.Duration) bool {
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case <-bo.refreshChan:
+			return true
+		case <-bo.ejectChan:
+			backends := make(map[string]*BackendHealth, len(bo.curBackends))
+			for addr, health := range bo.curBackends {
+				backends[addr] = health
 			}
+			result := HealthResult{backends: bo.applyBreakers(backends, false)}
+			bo.updateHealthResult(result)
+			bo.notifySubscribers(ctx, result)
+		case <-ctx.Done():
+			return false
 		}
 	}
 }
 
+// ReportFailure implements BackendObserver.ReportFailure interface.
+// The backend is ejected once the failures reach the threshold, rather than waiting for the next health check.
+func (bo *DefaultBackendObserver) ReportFailure(addr string, errType TrafficErrType, err error) {
+	// Passive health check is disabled along with the active health check, or when the failure threshold is not set.
+	if !bo.healthCheckConfig.Enable || bo.healthCheckConfig.FailureThreshold <= 0 {
+		return
+	}
+	bo.breakers.Lock()
+	cb, ok := bo.breakers.m[addr]
+	if !ok {
+		cb = &circuitBreaker{}
+		bo.breakers.m[addr] = cb
+	}
+	opened := cb.onFailure(monotime.Now(), bo.healthCheckConfig.FailureThreshold, bo.healthCheckConfig.FailureWindow, errType, err)
+	reason := cb.reason
+	bo.breakers.Unlock()
+	if !opened {
+		return
+	}
+	bo.logger.Warn("backend is ejected by passive health check", zap.String("backend_addr", addr),
+		zap.Stringer("err_type", errType), zap.NamedError("reason", reason))
+	select {
+	case bo.ejectChan <- struct{}{}:
+	default:
+	}
+}
+
+// ReportSuccess implements BackendObserver.ReportSuccess interface.
+func (bo *DefaultBackendObserver) ReportSuccess(addr string) {
+	bo.breakers.Lock()
+	// An ejected backend is only restored by the health check.
+	if cb, ok := bo.breakers.m[addr]; ok && cb.state != breakerOpen {
+		cb.onSuccess()
+	}
+	bo.breakers.Unlock()
+}
+
+// applyBreakers overrides the health of the ejected backends.
+// `probed` indicates whether `backends` is the result of a new health check, which is used to restore the half-open backends.
+func (bo *DefaultBackendObserver) applyBreakers(backends map[string]*BackendHealth, probed bool) map[string]*BackendHealth {
+	now := monotime.Now()
+	bo.breakers.Lock()
+	defer bo.breakers.Unlock()
+	for addr, cb := range bo.breakers.m {
+		health, ok := backends[addr]
+		if !ok {
+			if probed {
+				delete(bo.breakers.m, addr)
+			}
+			continue
+		}
+		if probed && cb.state == breakerOpen && cb.openTime.Add(bo.healthCheckConfig.EjectDuration).Before(now) {
+			cb.state = breakerHalfOpen
+		}
+		switch cb.state {
+		case breakerOpen:
+		case breakerHalfOpen:
+			if !probed {
+				continue
+			}
+			if health.Status == StatusHealthy {
+				bo.logger.Info("backend is restored by passive health check", zap.String("backend_addr", addr))
+				cb.onSuccess()
+				continue
+			}
+			cb.state = breakerOpen
+			cb.openTime = now
+		default:
+			continue
+		}
+		backends[addr] = &BackendHealth{
+			Status:        StatusCannotConnect,
+			PingErr:       cb.reason,
+			ServerVersion: health.ServerVersion,
+		}
+	}
+	return backends
+}
+
 func (bo *DefaultBackendObserver) checkHealth(ctx context.Context, backends map[string]*BackendInfo) map[string]*BackendHealth {
 	curBackendHealth := make(map[string]*BackendHealth, len(backends))
 	// Serverless tier checks health in Gateway instead of in TiProxy.
@@ -153,23 +276,29 @@ func (bo *DefaultBackendObserver) updateHealthResult(result HealthResult) {
 	if result.err != nil {
 		return
 	}
+	now := time.Now()
 	for addr, newHealth := range result.backends {
-		if newHealth.Status == StatusCannotConnect {
-			continue
+		oldHealth, ok := bo.curBackends[addr]
+		if !ok || oldHealth.Status != newHealth.Status {
+			bo.addHealthEvent(addr, now, newHealth.Status, newHealth.PingErr)
+		}
+		// A new backend is regarded as down before.
+		oldStatus := StatusCannotConnect
+		if ok {
+			oldStatus = oldHealth.Status
 		}
-		if oldHealth, ok := bo.curBackends[addr]; !ok || oldHealth.Status == StatusCannotConnect {
-			updateBackendStatusMetrics(addr, StatusCannotConnect, StatusHealthy)
+		if oldStatus != newHealth.Status {
+			updateBackendStatusMetrics(addr, oldStatus, newHealth.Status)
 		}
 	}
 	for addr, oldHealth := range bo.curBackends {
-		if oldHealth.Status == StatusCannotConnect {
-			continue
-		}
-		if newHealth, ok := result.backends[addr]; !ok || newHealth.Status == StatusCannotConnect {
-			updateBackendStatusMetrics(addr, StatusHealthy, StatusCannotConnect)
+		if _, ok := result.backends[addr]; !ok && oldHealth.Status != StatusCannotConnect {
+			bo.addHealthEvent(addr, now, StatusCannotConnect, errors.New("removed from backend list"))
+			updateBackendStatusMetrics(addr, oldHealth.Status, StatusCannotConnect)
 		}
 	}
 	bo.curBackends = result.backends
+	bo.pruneHealthHistory(now)
 }
 
 func (bo *DefaultBackendObserver) notifySubscribers(ctx context.Context, result HealthResult) {
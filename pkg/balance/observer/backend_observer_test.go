@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/pingcap/tiproxy/lib/config"
+	"github.com/pingcap/tiproxy/lib/util/errors"
 	"github.com/pingcap/tiproxy/lib/util/logger"
 	"github.com/pingcap/tiproxy/lib/util/waitgroup"
 	"github.com/stretchr/testify/require"
@@ -141,6 +142,103 @@ func TestMultiSubscribers(t *testing.T) {
 	}
 }
 
+// Test that the backend is ejected by the failures of real traffic and then restored by the health check.
+func TestPassiveHealthCheck(t *testing.T) {
+	ts := newObserverTestSuite(t)
+	ts.bo.healthCheckConfig.FailureThreshold = 3
+	ts.bo.healthCheckConfig.FailureWindow = 200 * time.Millisecond
+	ts.bo.healthCheckConfig.EjectDuration = 500 * time.Millisecond
+	t.Cleanup(ts.close)
+	backend := ts.addBackend()
+	ts.bo.Start(context.Background())
+	ts.checkStatus(backend, StatusHealthy)
+
+	// A success resets the failures.
+	ts.bo.ReportFailure(backend, TrafficErrDial, errors.New("mock dial error"))
+	ts.bo.ReportFailure(backend, TrafficErrDial, errors.New("mock dial error"))
+	ts.bo.ReportSuccess(backend)
+	ts.bo.ReportFailure(backend, TrafficErrDial, errors.New("mock dial error"))
+	ts.bo.ReportFailure(backend, TrafficErrDial, errors.New("mock dial error"))
+	ts.checkStatus(backend, StatusHealthy)
+	// The failures out of the window are not counted.
+	time.Sleep(300 * time.Millisecond)
+	ts.bo.ReportFailure(backend, TrafficErrRead, errors.New("mock read error"))
+	ts.checkStatus(backend, StatusHealthy)
+
+	// The backend is ejected although the health check succeeds.
+	ts.bo.ReportFailure(backend, TrafficErrRead, errors.New("mock read error"))
+	ts.bo.ReportFailure(backend, TrafficErrRead, errors.New("mock read error"))
+	ts.checkStatus(backend, StatusCannotConnect)
+	result := ts.getResultFromCh()
+	require.ErrorContains(t, result.Backends()[backend].PingErr, "ejected after 3 consecutive read failures")
+
+	// The backend is restored after the eject duration.
+	require.Eventually(t, func() bool {
+		result := ts.getResultFromCh()
+		return result.Backends()[backend].Status == StatusHealthy
+	}, 3*time.Second, time.Millisecond)
+	require.True(t, checkBackendStatusMetrics(backend, StatusHealthy))
+}
+
+// Test that the ejected backend is not restored if the health check also fails.
+func TestEjectedBackendStillDown(t *testing.T) {
+	ts := newObserverTestSuite(t)
+	ts.bo.healthCheckConfig.FailureThreshold = 1
+	ts.bo.healthCheckConfig.EjectDuration = 100 * time.Millisecond
+	t.Cleanup(ts.close)
+	backend := ts.addBackend()
+	ts.bo.Start(context.Background())
+	ts.checkStatus(backend, StatusHealthy)
+
+	ts.setHealth(backend, StatusCannotConnect)
+	ts.bo.ReportFailure(backend, TrafficErrHandshake, errors.New("mock handshake error"))
+	ts.checkStatus(backend, StatusCannotConnect)
+	for i := 0; i < 3; i++ {
+		ts.checkStatus(backend, StatusCannotConnect)
+	}
+	ts.setHealth(backend, StatusHealthy)
+	require.Eventually(t, func() bool {
+		result := ts.getResultFromCh()
+		return result.Backends()[backend].Status == StatusHealthy
+	}, 3*time.Second, time.Millisecond)
+}
+
+// Test that the status changes only after enough consecutive check results and the changes are recorded.
+func TestHealthThresholds(t *testing.T) {
+	ts := newObserverTestSuite(t)
+	ts.bo.healthCheckConfig.RiseThreshold = 3
+	ts.bo.healthCheckConfig.FallThreshold = 2
+	t.Cleanup(ts.close)
+	backend := ts.addBackend()
+	ts.bo.Start(context.Background())
+	ts.checkStatus(backend, StatusHealthy)
+
+	ts.setHealth(backend, StatusCannotConnect)
+	ts.checkStatus(backend, StatusHealthy)
+	ts.checkStatus(backend, StatusCannotConnect)
+	ts.setHealth(backend, StatusHealthy)
+	ts.checkStatus(backend, StatusCannotConnect)
+	ts.checkStatus(backend, StatusCannotConnect)
+	ts.checkStatus(backend, StatusHealthy)
+	// A single failure doesn't break the successes.
+	ts.setHealth(backend, StatusCannotConnect)
+	ts.checkStatus(backend, StatusHealthy)
+	ts.setHealth(backend, StatusHealthy)
+	ts.checkStatus(backend, StatusHealthy)
+
+	history := ts.bo.HealthHistory()[backend]
+	statuses := make([]string, 0, len(history))
+	for _, event := range history {
+		statuses = append(statuses, event.Status)
+	}
+	require.Equal(t, []string{"healthy", "down", "healthy"}, statuses)
+
+	ts.removeBackend(backend)
+	ts.checkStatus(backend, StatusCannotConnect)
+	history = ts.bo.HealthHistory()[backend]
+	require.Equal(t, "removed from backend list", history[len(history)-1].Reason)
+}
+
 type observerTestSuite struct {
 	t          *testing.T
 	bo         *DefaultBackendObserver
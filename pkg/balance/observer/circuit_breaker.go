@@ -0,0 +1,81 @@
+// Copyright 2024 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package observer
+
+import (
+	"time"
+
+	"github.com/pingcap/tiproxy/lib/util/errors"
+	"github.com/pingcap/tiproxy/pkg/util/monotime"
+)
+
+// TrafficErrType indicates in which phase the real traffic fails on a backend.
+type TrafficErrType int
+
+const (
+	TrafficErrDial TrafficErrType = iota
+	TrafficErrHandshake
+	TrafficErrRead
+)
+
+func (t TrafficErrType) String() string {
+	switch t {
+	case TrafficErrDial:
+		return "dial"
+	case TrafficErrHandshake:
+		return "handshake"
+	case TrafficErrRead:
+		return "read"
+	}
+	return "unknown"
+}
+
+type breakerState int
+
+const (
+	// The backend is routable and failures are being counted.
+	breakerClosed breakerState = iota
+	// The backend is ejected and won't be probed until the eject duration passes.
+	breakerOpen
+	// The eject duration has passed and the next health check decides whether to restore the backend.
+	breakerHalfOpen
+)
+
+// circuitBreaker records the consecutive failures of real traffic on one backend.
+type circuitBreaker struct {
+	state    breakerState
+	failures int
+	// The time of the first failure among the consecutive failures.
+	firstFailTime monotime.Time
+	openTime      monotime.Time
+	// reason is reported as the PingErr of the backend when the breaker is open.
+	reason error
+}
+
+// onFailure records a failure and returns true if the breaker turns open.
+func (cb *circuitBreaker) onFailure(now monotime.Time, threshold int, window time.Duration, errType TrafficErrType, err error) bool {
+	switch cb.state {
+	case breakerOpen:
+		return false
+	case breakerClosed:
+		if cb.failures == 0 || cb.firstFailTime.Add(window).Before(now) {
+			cb.failures = 0
+			cb.firstFailTime = now
+		}
+		cb.failures++
+		if cb.failures < threshold {
+			return false
+		}
+	}
+	cb.state = breakerOpen
+	cb.openTime = now
+	cb.reason = errors.Wrapf(err, "ejected after %d consecutive %s failures", cb.failures, errType.String())
+	return true
+}
+
+func (cb *circuitBreaker) onSuccess() {
+	cb.state = breakerClosed
+	cb.failures = 0
+	cb.reason = nil
+}
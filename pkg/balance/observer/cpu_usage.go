@@ -0,0 +1,65 @@
+// Copyright 2024 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package observer
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pingcap/tiproxy/pkg/balance/metricsreader"
+	"github.com/prometheus/common/model"
+)
+
+// The CPU usage of each TiDB instance, ranging from 0 to 1. `%[1]s` is replaced with the label key by the metrics reader.
+const cpuUsagePromQL = `irate(process_cpu_seconds_total{%[1]s="tidb"}[30s])/tidb_server_maxprocs{%[1]s="tidb"}`
+
+// CPUReader reads the CPU usage of the backends from Prometheus.
+// It's shared by all the namespaces so that the query is sent only once.
+type CPUReader struct {
+	mr      metricsreader.MetricsReader
+	queryID uint64
+}
+
+func NewCPUReader(mr metricsreader.MetricsReader) *CPUReader {
+	queryID := mr.AddQueryExpr(metricsreader.QueryExpr{
+		PromQL:   cpuUsagePromQL,
+		Range:    time.Minute,
+		HasLabel: true,
+	})
+	return &CPUReader{
+		mr:      mr,
+		queryID: queryID,
+	}
+}
+
+// CPUUsage returns the latest CPU usage of the backend. It returns false if the usage is unknown,
+// e.g. Prometheus is unavailable or the backend is a static backend without a status port.
+func (cr *CPUReader) CPUUsage(info *BackendInfo) (float64, bool) {
+	if info == nil || len(info.IP) == 0 {
+		return 0, false
+	}
+	qr := cr.mr.GetQueryResult(cr.queryID)
+	if qr.Err != nil || qr.Empty() {
+		return 0, false
+	}
+	matrix, ok := qr.Value.(model.Matrix)
+	if !ok {
+		return 0, false
+	}
+	// The `instance` label is the status address of TiDB.
+	instance := net.JoinHostPort(info.IP, strconv.Itoa(int(info.StatusPort)))
+	for _, series := range matrix {
+		if string(series.Metric[model.InstanceLabel]) != instance || len(series.Values) == 0 {
+			continue
+		}
+		return float64(series.Values[len(series.Values)-1].Value), true
+	}
+	return 0, false
+}
+
+// Close removes the query from the metrics reader.
+func (cr *CPUReader) Close() {
+	cr.mr.RemoveQueryExpr(cr.queryID)
+}
@@ -23,18 +23,29 @@ type HealthCheck interface {
 	Check(ctx context.Context, addr string, info *BackendInfo) *BackendHealth
 }
 
+// SQLProber logs in to the backend and runs the probe query. It's implemented by the proxy so that
+// the SQL-level health check goes through the same authentication path as client connections.
+type SQLProber interface {
+	Probe(ctx context.Context, addr string, cfg *config.HealthCheck) error
+}
+
 const (
 	statusPathSuffix = "/status"
 )
 
+// The status port returns non-200 codes when the backend is shutting down gracefully.
+var errGracefulShutdown = errors.New("backend is shutting down")
+
 type DefaultHealthCheck struct {
-	cfg     *config.HealthCheck
-	logger  *zap.Logger
-	httpCli *http.Client
-	httpTLS bool
+	cfg       *config.HealthCheck
+	logger    *zap.Logger
+	httpCli   *http.Client
+	sqlProber SQLProber
+	cpuReader *CPUReader
+	httpTLS   bool
 }
 
-func NewDefaultHealthCheck(httpCli *http.Client, cfg *config.HealthCheck, logger *zap.Logger) *DefaultHealthCheck {
+func NewDefaultHealthCheck(httpCli *http.Client, sqlProber SQLProber, cpuReader *CPUReader, cfg *config.HealthCheck, logger *zap.Logger) *DefaultHealthCheck {
 	if httpCli == nil {
 		httpCli = http.DefaultClient
 	}
@@ -43,10 +54,12 @@ func NewDefaultHealthCheck(httpCli *http.Client, cfg *config.HealthCheck, logger
 		httpTLS = true
 	}
 	return &DefaultHealthCheck{
-		httpCli: httpCli,
-		httpTLS: httpTLS,
-		cfg:     cfg,
-		logger:  logger,
+		httpCli:   httpCli,
+		httpTLS:   httpTLS,
+		sqlProber: sqlProber,
+		cpuReader: cpuReader,
+		cfg:       cfg,
+		logger:    logger,
 	}
 }
 
@@ -57,17 +70,50 @@ func (dhc *DefaultHealthCheck) Check(ctx context.Context, addr string, info *Bac
 	if !dhc.cfg.Enable {
 		return bh
 	}
+	// The status port may fail while the SQL port works, so the SQL port is still checked if the backend is degraded.
 	dhc.checkStatusPort(ctx, info, bh)
-	if bh.Status != StatusHealthy {
+	if bh.Status == StatusCannotConnect {
 		return bh
 	}
 	dhc.checkSqlPort(ctx, addr, bh)
+	if bh.Status == StatusCannotConnect {
+		return bh
+	}
+	dhc.checkSqlQuery(ctx, addr, bh)
+	if bh.Status != StatusHealthy {
+		return bh
+	}
+	dhc.checkCPUUsage(info, bh)
 	return bh
 }
 
+// A backend may accept connections but fail to run queries, e.g. it can't reach TiKV or PD.
+// Run a query to find such backends if the health check user is configured.
+func (dhc *DefaultHealthCheck) checkSqlQuery(ctx context.Context, addr string, bh *BackendHealth) {
+	if dhc.sqlProber == nil || len(dhc.cfg.SQLUser) == 0 || ctx.Err() != nil {
+		return
+	}
+	startTime := monotime.Now()
+	err := dhc.sqlProber.Probe(ctx, addr, dhc.cfg)
+	latency := monotime.Since(startTime)
+	setProbeSQLMetrics(addr, latency)
+	if err != nil {
+		bh.Status = StatusCannotConnect
+		bh.PingErr = errors.Wrapf(err, "run probe query failed")
+		return
+	}
+	if bh.Status == StatusHealthy && dhc.cfg.SQLSlowThreshold > 0 && latency > dhc.cfg.SQLSlowThreshold {
+		bh.Status = StatusDegraded
+		bh.PingErr = errors.Errorf("probe query takes %s, exceeding %s", latency, dhc.cfg.SQLSlowThreshold)
+	}
+}
+
 func (dhc *DefaultHealthCheck) checkSqlPort(ctx context.Context, addr string, bh *BackendHealth) {
 	// Also dial the SQL port just in case that the SQL port hangs.
-	var serverVersion string
+	var (
+		serverVersion string
+		capability    pnet.Capability
+	)
 	err := dhc.connectWithRetry(ctx, func() error {
 		startTime := monotime.Now()
 		conn, err := net.DialTimeout("tcp", addr, dhc.cfg.DialTimeout)
@@ -78,11 +124,12 @@ func (dhc *DefaultHealthCheck) checkSqlPort(ctx context.Context, addr string, bh
 		if err = conn.SetReadDeadline(time.Now().Add(dhc.cfg.DialTimeout)); err != nil {
 			return err
 		}
-		serverVersion, err = pnet.ReadServerVersion(conn)
+		serverVersion, capability, err = pnet.ReadServerHandshake(conn)
 		if ignoredErr := conn.Close(); ignoredErr != nil && !pnet.IsDisconnectError(ignoredErr) {
 			dhc.logger.Warn("close connection in health check failed", zap.Error(ignoredErr))
 		}
 		bh.ServerVersion = serverVersion
+		bh.Capability = capability
 		return err
 	})
 	if err != nil {
@@ -112,7 +159,7 @@ func (dhc *DefaultHealthCheck) checkStatusPort(ctx context.Context, info *Backen
 		resp, err := httpCli.Get(url)
 		if err == nil {
 			if resp.StatusCode != http.StatusOK {
-				err = backoff.Permanent(errors.Errorf("http status %d", resp.StatusCode))
+				err = backoff.Permanent(errors.Wrapf(errGracefulShutdown, "http status %d", resp.StatusCode))
 			}
 			if ignoredErr := resp.Body.Close(); ignoredErr != nil {
 				dhc.logger.Warn("close http response in health check failed", zap.Error(ignoredErr))
@@ -120,9 +167,27 @@ func (dhc *DefaultHealthCheck) checkStatusPort(ctx context.Context, info *Backen
 		}
 		return err
 	})
-	if err != nil {
+	switch {
+	case err == nil:
+	case errors.Is(err, errGracefulShutdown):
 		bh.Status = StatusCannotConnect
 		bh.PingErr = errors.Wrapf(err, "connect status port failed")
+	default:
+		// The status port is unreachable but the SQL port may still work, so it's a partial failure.
+		bh.Status = StatusDegraded
+		bh.PingErr = errors.Wrapf(err, "connect status port failed")
+	}
+}
+
+// A busy backend is degraded so that new connections go to other backends.
+func (dhc *DefaultHealthCheck) checkCPUUsage(info *BackendInfo, bh *BackendHealth) {
+	if dhc.cpuReader == nil || dhc.cfg.DegradedCPUUsage <= 0 {
+		return
+	}
+	usage, ok := dhc.cpuReader.CPUUsage(info)
+	if ok && usage >= dhc.cfg.DegradedCPUUsage {
+		bh.Status = StatusDegraded
+		bh.PingErr = errors.Errorf("cpu usage %.2f reaches %.2f", usage, dhc.cfg.DegradedCPUUsage)
 	}
 }
 
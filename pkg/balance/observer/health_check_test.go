@@ -10,6 +10,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/pingcap/tiproxy/lib/util/errors"
 	"github.com/pingcap/tiproxy/lib/util/logger"
 	"github.com/pingcap/tiproxy/lib/util/waitgroup"
 	pnet "github.com/pingcap/tiproxy/pkg/proxy/net"
@@ -20,11 +21,12 @@ import (
 
 func TestReadServerVersion(t *testing.T) {
 	lg, _ := logger.CreateLoggerForTest(t)
-	hc := NewDefaultHealthCheck(nil, newHealthCheckConfigForTest(), lg)
+	hc := NewDefaultHealthCheck(nil, nil, nil, newHealthCheckConfigForTest(), lg)
 	backend, info := newBackendServer(t)
 	backend.serverVersion.Store("1.0")
 	health := hc.Check(context.Background(), backend.sqlAddr, info)
 	require.Equal(t, "1.0", health.ServerVersion)
+	require.Equal(t, pnet.ClientDeprecateEOF|pnet.ClientSessionTrack, health.Capability)
 	backend.stopSQLServer()
 	backend.serverVersion.Store("2.0")
 	backend.startSQLServer()
@@ -37,7 +39,7 @@ func TestReadServerVersion(t *testing.T) {
 func TestHealthCheck(t *testing.T) {
 	lg, _ := logger.CreateLoggerForTest(t)
 	cfg := newHealthCheckConfigForTest()
-	hc := NewDefaultHealthCheck(nil, cfg, lg)
+	hc := NewDefaultHealthCheck(nil, nil, nil, cfg, lg)
 	backend, info := newBackendServer(t)
 	health := hc.Check(context.Background(), backend.sqlAddr, info)
 	require.Equal(t, StatusHealthy, health.Status)
@@ -56,9 +58,10 @@ func TestHealthCheck(t *testing.T) {
 	health = hc.Check(context.Background(), backend.sqlAddr, info)
 	require.Equal(t, StatusHealthy, health.Status)
 
+	// The status port times out but the SQL port works.
 	backend.setHTTPWait(time.Second + cfg.DialTimeout)
 	health = hc.Check(context.Background(), backend.sqlAddr, info)
-	require.Equal(t, StatusCannotConnect, health.Status)
+	require.Equal(t, StatusDegraded, health.Status)
 	backend.setHTTPWait(time.Duration(0))
 	health = hc.Check(context.Background(), backend.sqlAddr, info)
 	require.Equal(t, StatusHealthy, health.Status)
@@ -66,6 +69,83 @@ func TestHealthCheck(t *testing.T) {
 	backend.close()
 }
 
+func TestSQLHealthCheck(t *testing.T) {
+	lg, _ := logger.CreateLoggerForTest(t)
+	cfg := newHealthCheckConfigForTest()
+	prober := &mockSQLProber{}
+	hc := NewDefaultHealthCheck(nil, prober, nil, cfg, lg)
+	backend, info := newBackendServer(t)
+
+	// The SQL-level health check is disabled without the user.
+	health := hc.Check(context.Background(), backend.sqlAddr, info)
+	require.Equal(t, StatusHealthy, health.Status)
+	require.Equal(t, 0, prober.getProbes())
+
+	cfg.SQLUser = "probe"
+	health = hc.Check(context.Background(), backend.sqlAddr, info)
+	require.Equal(t, StatusHealthy, health.Status)
+	require.Equal(t, 1, prober.getProbes())
+
+	prober.setResult(errors.New("tikv server timeout"), 0)
+	health = hc.Check(context.Background(), backend.sqlAddr, info)
+	require.Equal(t, StatusCannotConnect, health.Status)
+	require.ErrorContains(t, health.PingErr, "tikv server timeout")
+
+	cfg.SQLSlowThreshold = 10 * time.Millisecond
+	prober.setResult(nil, 50*time.Millisecond)
+	health = hc.Check(context.Background(), backend.sqlAddr, info)
+	require.Equal(t, StatusDegraded, health.Status)
+	require.Error(t, health.PingErr)
+
+	prober.setResult(nil, 0)
+	health = hc.Check(context.Background(), backend.sqlAddr, info)
+	require.Equal(t, StatusHealthy, health.Status)
+
+	// The query is not run if the SQL port is down.
+	backend.stopSQLServer()
+	probes := prober.getProbes()
+	health = hc.Check(context.Background(), backend.sqlAddr, info)
+	require.Equal(t, StatusCannotConnect, health.Status)
+	require.Equal(t, probes, prober.getProbes())
+	backend.startSQLServer()
+	backend.close()
+}
+
+func TestDegradedHealthCheck(t *testing.T) {
+	lg, _ := logger.CreateLoggerForTest(t)
+	cfg := newHealthCheckConfigForTest()
+	mr := newMockMetricsReader()
+	hc := NewDefaultHealthCheck(nil, nil, NewCPUReader(mr), cfg, lg)
+	backend, info := newBackendServer(t)
+
+	// The CPU usage is ignored without the threshold.
+	mr.setCPUUsage(info, 0.95)
+	health := hc.Check(context.Background(), backend.sqlAddr, info)
+	require.Equal(t, StatusHealthy, health.Status)
+
+	cfg.DegradedCPUUsage = 0.9
+	health = hc.Check(context.Background(), backend.sqlAddr, info)
+	require.Equal(t, StatusDegraded, health.Status)
+	require.ErrorContains(t, health.PingErr, "cpu usage")
+	mr.setCPUUsage(info, 0.5)
+	health = hc.Check(context.Background(), backend.sqlAddr, info)
+	require.Equal(t, StatusHealthy, health.Status)
+
+	// The status port is down but the SQL port works.
+	backend.stopHTTPServer()
+	health = hc.Check(context.Background(), backend.sqlAddr, info)
+	require.Equal(t, StatusDegraded, health.Status)
+	// Both are down.
+	backend.stopSQLServer()
+	health = hc.Check(context.Background(), backend.sqlAddr, info)
+	require.Equal(t, StatusCannotConnect, health.Status)
+	backend.startSQLServer()
+	backend.startHTTPServer()
+	health = hc.Check(context.Background(), backend.sqlAddr, info)
+	require.Equal(t, StatusHealthy, health.Status)
+	backend.close()
+}
+
 type backendServer struct {
 	t             *testing.T
 	sqlListener   net.Listener
@@ -121,7 +201,7 @@ func (srv *backendServer) startSQLServer() {
 				// listener is closed
 				break
 			}
-			if err = pnet.WriteServerVersion(conn, srv.serverVersion.Load()); err != nil {
+			if err = pnet.WriteServerHandshake(conn, srv.serverVersion.Load(), pnet.ClientDeprecateEOF|pnet.ClientSessionTrack); err != nil {
 				break
 			}
 			_ = conn.Close()
@@ -0,0 +1,108 @@
+// Copyright 2024 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package observer
+
+import (
+	"time"
+)
+
+const (
+	// The max number of health events kept for each backend.
+	maxHealthEvents = 20
+	// The history of a removed backend is kept for a while so that users can see why it's removed.
+	removedHistoryTTL = 10 * time.Minute
+)
+
+// HealthEvent records a status change of a backend.
+type HealthEvent struct {
+	Time   time.Time `json:"time"`
+	Status string    `json:"status"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// thresholdState counts the consecutive check results of a backend to suppress flapping.
+type thresholdState struct {
+	// health is the latest health that is confirmed by the rise and fall thresholds.
+	health    *BackendHealth
+	successes int
+	failures  int
+}
+
+// applyThresholds keeps the previous status of a backend until the status changes for enough consecutive checks.
+// It's only called in the observing goroutine, so it's not protected by locks.
+func (bo *DefaultBackendObserver) applyThresholds(backends map[string]*BackendHealth) map[string]*BackendHealth {
+	for addr, health := range backends {
+		state, ok := bo.thresholds[addr]
+		if !ok {
+			// Trust the first result of a new backend so that it's routable as soon as possible.
+			bo.thresholds[addr] = &thresholdState{health: health}
+			continue
+		}
+		if health.Status == StatusHealthy {
+			state.successes++
+			state.failures = 0
+		} else {
+			state.failures++
+			state.successes = 0
+		}
+		wasHealthy := state.health.Status == StatusHealthy
+		switch {
+		case wasHealthy && health.Status != StatusHealthy && state.failures < bo.healthCheckConfig.FallThreshold:
+			backends[addr] = state.health
+		case !wasHealthy && health.Status == StatusHealthy && state.successes < bo.healthCheckConfig.RiseThreshold:
+			backends[addr] = state.health
+		default:
+			state.health = health
+		}
+	}
+	for addr := range bo.thresholds {
+		if _, ok := backends[addr]; !ok {
+			delete(bo.thresholds, addr)
+		}
+	}
+	return backends
+}
+
+// addHealthEvent records a status change. `now` is passed in to make all the events in one cycle share the same time.
+func (bo *DefaultBackendObserver) addHealthEvent(addr string, now time.Time, status BackendStatus, reason error) {
+	event := HealthEvent{
+		Time:   now,
+		Status: status.String(),
+	}
+	if reason != nil {
+		event.Reason = reason.Error()
+	}
+	bo.history.Lock()
+	events := append(bo.history.m[addr], event)
+	if len(events) > maxHealthEvents {
+		events = events[len(events)-maxHealthEvents:]
+	}
+	bo.history.m[addr] = events
+	bo.history.Unlock()
+}
+
+// pruneHealthHistory removes the history of the backends that have been removed for a long time.
+func (bo *DefaultBackendObserver) pruneHealthHistory(now time.Time) {
+	bo.history.Lock()
+	defer bo.history.Unlock()
+	for addr, events := range bo.history.m {
+		if _, ok := bo.curBackends[addr]; ok {
+			continue
+		}
+		if len(events) == 0 || now.Sub(events[len(events)-1].Time) > removedHistoryTTL {
+			delete(bo.history.m, addr)
+		}
+	}
+}
+
+// HealthHistory implements BackendObserver.HealthHistory interface.
+func (bo *DefaultBackendObserver) HealthHistory() map[string][]HealthEvent {
+	bo.history.Lock()
+	defer bo.history.Unlock()
+	history := make(map[string][]HealthEvent, len(bo.history.m))
+	for addr, events := range bo.history.m {
+		history[addr] = append([]HealthEvent(nil), events...)
+	}
+	return history
+}
@@ -28,6 +28,10 @@ func setPingBackendMetrics(addr string, startTime monotime.Time) {
 	metrics.PingBackendGauge.WithLabelValues(addr).Set(cost.Seconds())
 }
 
+func setProbeSQLMetrics(addr string, cost time.Duration) {
+	metrics.ProbeSQLGauge.WithLabelValues(addr).Set(cost.Seconds())
+}
+
 func readHealthCheckCycle() (time.Duration, error) {
 	seconds, err := metrics.ReadGauge(metrics.HealthCheckCycleGauge)
 	return time.Duration(int(seconds * float64(time.Second))), err
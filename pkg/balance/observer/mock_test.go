@@ -5,13 +5,18 @@ package observer
 
 import (
 	"context"
+	"net"
 	"net/http"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/pingcap/tiproxy/lib/config"
+	"github.com/pingcap/tiproxy/pkg/balance/metricsreader"
 	"github.com/pingcap/tiproxy/pkg/manager/infosync"
+	"github.com/prometheus/common/model"
 )
 
 type mockTpFetcher struct {
@@ -92,6 +97,140 @@ func (mhc *mockHealthCheck) removeBackend(addr string) {
 	delete(mhc.backends, addr)
 }
 
+type mockSQLProber struct {
+	sync.Mutex
+	err    error
+	wait   time.Duration
+	probes int
+}
+
+func (msp *mockSQLProber) Probe(ctx context.Context, _ string, _ *config.HealthCheck) error {
+	msp.Lock()
+	defer msp.Unlock()
+	msp.probes++
+	if msp.wait > 0 {
+		time.Sleep(msp.wait)
+	}
+	return msp.err
+}
+
+func (msp *mockSQLProber) setResult(err error, wait time.Duration) {
+	msp.Lock()
+	defer msp.Unlock()
+	msp.err = err
+	msp.wait = wait
+}
+
+func (msp *mockSQLProber) getProbes() int {
+	msp.Lock()
+	defer msp.Unlock()
+	return msp.probes
+}
+
+type mockMetricsReader struct {
+	sync.Mutex
+	results map[uint64]metricsreader.QueryResult
+	lastID  uint64
+}
+
+func newMockMetricsReader() *mockMetricsReader {
+	return &mockMetricsReader{
+		results: make(map[uint64]metricsreader.QueryResult),
+	}
+}
+
+func (mmr *mockMetricsReader) Start(ctx context.Context) {
+}
+
+func (mmr *mockMetricsReader) AddQueryExpr(queryExpr metricsreader.QueryExpr) uint64 {
+	mmr.Lock()
+	defer mmr.Unlock()
+	mmr.lastID++
+	return mmr.lastID
+}
+
+func (mmr *mockMetricsReader) RemoveQueryExpr(id uint64) {
+	mmr.Lock()
+	defer mmr.Unlock()
+	delete(mmr.results, id)
+}
+
+func (mmr *mockMetricsReader) GetQueryResult(id uint64) metricsreader.QueryResult {
+	mmr.Lock()
+	defer mmr.Unlock()
+	return mmr.results[id]
+}
+
+func (mmr *mockMetricsReader) Subscribe(receiverName string) <-chan struct{} {
+	return nil
+}
+
+func (mmr *mockMetricsReader) Close() {
+}
+
+// setCPUUsage sets the CPU usage of the backend for the latest query.
+func (mmr *mockMetricsReader) setCPUUsage(info *BackendInfo, usage float64) {
+	mmr.Lock()
+	defer mmr.Unlock()
+	mmr.results[mmr.lastID] = metricsreader.QueryResult{
+		Value: model.Matrix{
+			{
+				Metric: model.Metric{model.InstanceLabel: model.LabelValue(net.JoinHostPort(info.IP, strconv.Itoa(int(info.StatusPort))))},
+				Values: []model.SamplePair{{Timestamp: model.Now(), Value: model.SampleValue(usage)}},
+			},
+		},
+	}
+}
+
+type mockResolver struct {
+	sync.Mutex
+	hosts map[string][]string
+	srvs  map[string][]*net.SRV
+}
+
+func newMockResolver() *mockResolver {
+	return &mockResolver{
+		hosts: make(map[string][]string),
+		srvs:  make(map[string][]*net.SRV),
+	}
+}
+
+func (mr *mockResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	mr.Lock()
+	defer mr.Unlock()
+	ips, ok := mr.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+func (mr *mockResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	mr.Lock()
+	defer mr.Unlock()
+	records, ok := mr.srvs[name]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return name, records, nil
+}
+
+func (mr *mockResolver) setHost(host string, ips []string) {
+	mr.Lock()
+	defer mr.Unlock()
+	if ips == nil {
+		delete(mr.hosts, host)
+		return
+	}
+	mr.hosts[host] = ips
+}
+
+func (mr *mockResolver) setSRV(name string, records []*net.SRV) {
+	mr.Lock()
+	defer mr.Unlock()
+	mr.srvs[name] = records
+}
+
 type mockHttpHandler struct {
 	t      *testing.T
 	httpOK atomic.Bool
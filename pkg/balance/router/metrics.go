@@ -6,6 +6,7 @@ package router
 import (
 	"github.com/pingcap/tiproxy/pkg/metrics"
 	"github.com/pingcap/tiproxy/pkg/util/monotime"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func setBackendConnMetrics(addr string, conns int) {
@@ -17,6 +18,11 @@ func readBackendConnMetrics(addr string) (int, error) {
 	return int(val), err
 }
 
+// deleteBackendMetrics deletes the per-connection metrics of a removed backend so that the series don't accumulate.
+func deleteBackendMetrics(addr string) {
+	metrics.TLSSessionCounter.DeletePartialMatch(prometheus.Labels{metrics.LblBackend: addr})
+}
+
 func succeedToLabel(succeed bool) string {
 	if succeed {
 		return "succeed"
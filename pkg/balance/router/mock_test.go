@@ -100,12 +100,14 @@ func (conn *mockRedirectableConn) redirectFail() {
 type mockBackendObserver struct {
 	sync.Mutex
 	healths    map[string]*observer.BackendHealth
+	failures   map[string]int
 	subscriber chan observer.HealthResult
 }
 
 func newMockBackendObserver() *mockBackendObserver {
 	return &mockBackendObserver{
-		healths: make(map[string]*observer.BackendHealth),
+		healths:  make(map[string]*observer.BackendHealth),
+		failures: make(map[string]int),
 	}
 }
 
@@ -142,14 +144,38 @@ func (mbo *mockBackendObserver) Refresh() {
 	mbo.addBackend("0")
 }
 
-func (mbo *mockBackendObserver) notify(err error) {
+func (mbo *mockBackendObserver) ReportFailure(addr string, errType observer.TrafficErrType, err error) {
+	mbo.Lock()
+	defer mbo.Unlock()
+	mbo.failures[addr]++
+}
+
+func (mbo *mockBackendObserver) ReportSuccess(addr string) {
 	mbo.Lock()
 	defer mbo.Unlock()
+	mbo.failures[addr] = 0
+}
+
+func (mbo *mockBackendObserver) getFailures(addr string) int {
+	mbo.Lock()
+	defer mbo.Unlock()
+	return mbo.failures[addr]
+}
+
+func (mbo *mockBackendObserver) HealthHistory() map[string][]observer.HealthEvent {
+	return nil
+}
+
+func (mbo *mockBackendObserver) notify(err error) {
+	mbo.Lock()
 	healths := make(map[string]*observer.BackendHealth, len(mbo.healths))
 	for addr, health := range mbo.healths {
 		healths[addr] = health
 	}
-	mbo.subscriber <- observer.NewHealthResult(healths, err)
+	subscriber := mbo.subscriber
+	mbo.Unlock()
+	// Don't hold the lock while sending, otherwise it deadlocks with the router calling Refresh().
+	subscriber <- observer.NewHealthResult(healths, err)
 }
 
 func (mbo *mockBackendObserver) Close() {
@@ -10,6 +10,7 @@ import (
 	glist "github.com/bahlo/generic-list-go"
 	"github.com/pingcap/tiproxy/lib/util/errors"
 	"github.com/pingcap/tiproxy/pkg/balance/observer"
+	pnet "github.com/pingcap/tiproxy/pkg/proxy/net"
 	"github.com/pingcap/tiproxy/pkg/util/monotime"
 )
 
@@ -22,6 +23,9 @@ type ConnEventReceiver interface {
 	OnRedirectSucceed(from, to string, conn RedirectableConn) error
 	OnRedirectFail(from, to string, conn RedirectableConn) error
 	OnConnClosed(addr string, conn RedirectableConn) error
+	// OnBackendFailure and OnBackendSuccess report the results of real traffic for passive health check.
+	OnBackendFailure(addr string, errType observer.TrafficErrType, err error)
+	OnBackendSuccess(addr string)
 }
 
 // Router routes client connections to backends.
@@ -35,6 +39,8 @@ type Router interface {
 	ConnCount() int
 	// ServerVersion returns the TiDB version.
 	ServerVersion() string
+	// Capability returns the capabilities supported by all the backends. It returns 0 if it's unknown.
+	Capability() pnet.Capability
 	Close()
 }
 
@@ -63,6 +69,9 @@ const (
 	// After a connection fails to redirect, it may contain some unmigratable status.
 	// Limit its redirection interval to avoid unnecessary retrial to reduce latency jitter.
 	redirectFailMinInterval = 3 * time.Second
+	// The connections on degraded backends are drained slowly because degraded backends can still serve.
+	// At most one connection is migrated from degraded backends during each interval.
+	degradedRedirectInterval = 100 * time.Millisecond
 )
 
 // RedirectableConn indicates a redirect-able connection.
@@ -79,6 +88,8 @@ type RedirectableConn interface {
 type BackendInst interface {
 	Addr() string
 	Healthy() bool
+	// Capability returns the capability of the backend. It returns 0 if it's unknown.
+	Capability() pnet.Capability
 }
 
 // backendWrapper contains the connections on the backend.
@@ -123,7 +134,7 @@ func (b *backendWrapper) Status() observer.BackendStatus {
 
 func (b *backendWrapper) Healthy() bool {
 	b.mu.RLock()
-	healthy := b.mu.Status == observer.StatusHealthy
+	healthy := b.mu.Status.Available()
 	b.mu.RUnlock()
 	return healthy
 }
@@ -135,6 +146,13 @@ func (b *backendWrapper) ServerVersion() string {
 	return version
 }
 
+func (b *backendWrapper) Capability() pnet.Capability {
+	b.mu.RLock()
+	capability := b.mu.Capability
+	b.mu.RUnlock()
+	return capability
+}
+
 func (b *backendWrapper) Equals(health observer.BackendHealth) bool {
 	b.mu.RLock()
 	equal := b.mu.BackendHealth.Equals(health)
@@ -12,6 +12,7 @@ import (
 	"github.com/pingcap/tiproxy/lib/util/errors"
 	"github.com/pingcap/tiproxy/lib/util/waitgroup"
 	"github.com/pingcap/tiproxy/pkg/balance/observer"
+	pnet "github.com/pingcap/tiproxy/pkg/proxy/net"
 	"github.com/pingcap/tiproxy/pkg/util/monotime"
 	"go.uber.org/zap"
 )
@@ -36,6 +37,8 @@ type ScoreBasedRouter struct {
 	observeError error
 	// Only store the version of a random backend, so the client may see a wrong version when backends are upgrading.
 	serverVersion string
+	// The last time a connection is migrated from a degraded backend.
+	lastDegradedRedirect monotime.Time
 }
 
 // NewScoreBasedRouter creates a ScoreBasedRouter.
@@ -290,6 +293,20 @@ func (router *ScoreBasedRouter) OnConnClosed(addr string, conn RedirectableConn)
 	return nil
 }
 
+// OnBackendFailure implements ConnEventReceiver.OnBackendFailure interface.
+func (router *ScoreBasedRouter) OnBackendFailure(addr string, errType observer.TrafficErrType, err error) {
+	if router.observer != nil {
+		router.observer.ReportFailure(addr, errType, err)
+	}
+}
+
+// OnBackendSuccess implements ConnEventReceiver.OnBackendSuccess interface.
+func (router *ScoreBasedRouter) OnBackendSuccess(addr string) {
+	if router.observer != nil {
+		router.observer.ReportSuccess(addr)
+	}
+}
+
 func (router *ScoreBasedRouter) updateBackendHealth(healthResults observer.HealthResult) {
 	router.Lock()
 	defer router.Unlock()
@@ -362,13 +379,18 @@ func (router *ScoreBasedRouter) rebalance(maxNum int) {
 	router.Lock()
 	defer router.Unlock()
 	for i := 0; i < maxNum; i++ {
+		drainDegraded := router.lastDegradedRedirect.Add(degradedRedirectInterval).Before(curTime)
 		var busiestEle *glist.Element[*backendWrapper]
 		for be := router.backends.Front(); be != nil; be = be.Next() {
 			backend := be.Value
-			if backend.connList.Len() > 0 {
-				busiestEle = be
-				break
+			if backend.connList.Len() == 0 {
+				continue
 			}
+			if backend.Status() == observer.StatusDegraded && !drainDegraded {
+				continue
+			}
+			busiestEle = be
+			break
 		}
 		if busiestEle == nil {
 			break
@@ -402,6 +424,9 @@ func (router *ScoreBasedRouter) rebalance(maxNum int) {
 		router.logger.Debug("begin redirect connection", zap.Uint64("connID", conn.ConnectionID()),
 			zap.String("from", busiestBackend.addr), zap.String("to", idlestBackend.addr),
 			zap.Int("from_score", busiestBackend.score()), zap.Int("to_score", idlestBackend.score()))
+		if busiestBackend.Status() == observer.StatusDegraded {
+			router.lastDegradedRedirect = curTime
+		}
 		busiestBackend.connScore--
 		router.adjustBackendList(busiestEle, true)
 		idlestBackend.connScore++
@@ -419,6 +444,7 @@ func (router *ScoreBasedRouter) removeBackendIfEmpty(be *glist.Element[*backendW
 	// And if also connScore == 0, there won't be any incoming connections.
 	if backend.Status() == observer.StatusCannotConnect && backend.connList.Len() == 0 && backend.connScore <= 0 {
 		router.backends.Remove(be)
+		deleteBackendMetrics(backend.addr)
 		return true
 	}
 	return false
@@ -442,6 +468,29 @@ func (router *ScoreBasedRouter) ServerVersion() string {
 	return version
 }
 
+// Capability implements Router.Capability interface.
+// The unhealthy backends are skipped because no connection will be routed to them.
+func (router *ScoreBasedRouter) Capability() pnet.Capability {
+	router.Lock()
+	defer router.Unlock()
+	var capability pnet.Capability
+	for be := router.backends.Front(); be != nil; be = be.Next() {
+		if !be.Value.Healthy() {
+			continue
+		}
+		backendCapability := be.Value.Capability()
+		if backendCapability == 0 {
+			continue
+		}
+		if capability == 0 {
+			capability = backendCapability
+		} else {
+			capability &= backendCapability
+		}
+	}
+	return capability
+}
+
 // Close implements Router.Close interface.
 func (router *ScoreBasedRouter) Close() {
 	if router.cancelFunc != nil {
@@ -3,7 +3,12 @@
 
 package router
 
-import "sync/atomic"
+import (
+	"sync/atomic"
+
+	"github.com/pingcap/tiproxy/pkg/balance/observer"
+	pnet "github.com/pingcap/tiproxy/pkg/proxy/net"
+)
 
 var _ Router = &StaticRouter{}
 
@@ -59,6 +64,10 @@ func (r *StaticRouter) ServerVersion() string {
 	return ""
 }
 
+func (r *StaticRouter) Capability() pnet.Capability {
+	return 0
+}
+
 func (r *StaticRouter) Close() {
 }
 
@@ -75,6 +84,12 @@ func (r *StaticRouter) OnConnClosed(addr string, conn RedirectableConn) error {
 	return nil
 }
 
+func (r *StaticRouter) OnBackendFailure(addr string, errType observer.TrafficErrType, err error) {
+}
+
+func (r *StaticRouter) OnBackendSuccess(addr string) {
+}
+
 type StaticBackend struct {
 	addr    string
 	healthy atomic.Bool
@@ -96,6 +111,10 @@ func (b *StaticBackend) Healthy() bool {
 	return b.healthy.Load()
 }
 
+func (b *StaticBackend) Capability() pnet.Capability {
+	return 0
+}
+
 func (b *StaticBackend) SetHealthy(healthy bool) {
 	b.healthy.Store(healthy)
 }
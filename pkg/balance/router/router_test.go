@@ -17,6 +17,7 @@ import (
 	"github.com/pingcap/tiproxy/lib/util/waitgroup"
 	"github.com/pingcap/tiproxy/pkg/balance/observer"
 	"github.com/pingcap/tiproxy/pkg/metrics"
+	pnet "github.com/pingcap/tiproxy/pkg/proxy/net"
 	"github.com/stretchr/testify/require"
 )
 
@@ -729,6 +730,34 @@ func TestGetServerVersion(t *testing.T) {
 	require.True(t, version == "1.0" || version == "2.0")
 }
 
+func TestGetCapability(t *testing.T) {
+	lg, _ := logger.CreateLoggerForTest(t)
+	rt := NewScoreBasedRouter(lg)
+	t.Cleanup(rt.Close)
+	require.Zero(t, rt.Capability())
+	backends := map[string]*observer.BackendHealth{
+		"0": {
+			Status:     observer.StatusHealthy,
+			Capability: pnet.ClientDeprecateEOF | pnet.ClientSessionTrack,
+		},
+		"1": {
+			Status:     observer.StatusHealthy,
+			Capability: pnet.ClientDeprecateEOF | pnet.ClientCompress,
+		},
+		// The capability is unknown.
+		"2": {
+			Status: observer.StatusHealthy,
+		},
+		// The unhealthy backend is skipped.
+		"3": {
+			Status:     observer.StatusCannotConnect,
+			Capability: pnet.ClientSessionTrack,
+		},
+	}
+	rt.updateBackendHealth(observer.NewHealthResult(backends, nil))
+	require.Equal(t, pnet.ClientDeprecateEOF, rt.Capability())
+}
+
 func TestBackendHealthy(t *testing.T) {
 	// Make the connection redirect.
 	tester := newRouterTester(t)
@@ -746,6 +775,44 @@ func TestBackendHealthy(t *testing.T) {
 	tester.redirectFinish(1, false)
 }
 
+// Test that degraded backends get no new connections unless no other backends are available,
+// and their connections are drained slowly.
+func TestDegradedBackend(t *testing.T) {
+	tester := newRouterTester(t)
+	tester.addBackends(1)
+	tester.addConnections(10)
+	degradedAddr := tester.getBackendByIndex(0).addr
+	tester.updateBackendStatusByAddr(degradedAddr, observer.StatusDegraded)
+	for _, conn := range tester.conns {
+		require.True(t, conn.from.Healthy())
+	}
+	// The degraded backend is still used when no other backends are available.
+	tester.addConnections(1)
+	require.Equal(t, 11, tester.getBackendByIndex(0).connList.Len())
+	tester.closeConnections(1, false)
+
+	// New connections go to the healthy backend.
+	tester.addBackends(1)
+	tester.addConnections(5)
+	for _, conn := range tester.conns {
+		if conn.connID > 11 {
+			require.NotEqual(t, degradedAddr, conn.from.Addr())
+		}
+	}
+
+	// Only one connection is migrated in each interval.
+	tester.rebalance(10)
+	tester.checkRedirectingNum(1)
+	tester.rebalance(10)
+	tester.checkRedirectingNum(1)
+	time.Sleep(degradedRedirectInterval)
+	tester.rebalance(10)
+	tester.checkRedirectingNum(2)
+	tester.redirectFinish(2, true)
+	require.Equal(t, 8, tester.getBackendByIndex(0).connList.Len())
+	require.Equal(t, degradedAddr, tester.getBackendByIndex(0).addr)
+}
+
 func TestCloseRedirectingConns(t *testing.T) {
 	// Make the connection redirect.
 	tester := newRouterTester(t)
@@ -782,3 +849,46 @@ func TestUpdateBackendHealth(t *testing.T) {
 	tester.killBackends(1)
 	tester.checkBackendNum(3)
 }
+
+// Test that the results of real traffic are reported to the observer.
+func TestReportBackendResult(t *testing.T) {
+	lg, _ := logger.CreateLoggerForTest(t)
+	rt := NewScoreBasedRouter(lg)
+	bo := newMockBackendObserver()
+	bo.Start(context.Background())
+	rt.Init(context.Background(), bo)
+	t.Cleanup(rt.Close)
+	t.Cleanup(bo.Close)
+
+	rt.OnBackendFailure("0", observer.TrafficErrDial, errors.New("mock dial error"))
+	rt.OnBackendFailure("0", observer.TrafficErrRead, errors.New("mock read error"))
+	require.Equal(t, 2, bo.getFailures("0"))
+	rt.OnBackendSuccess("0")
+	require.Equal(t, 0, bo.getFailures("0"))
+}
+
+// Test that the metrics of a backend are deleted after the backend is removed.
+func TestDeleteBackendMetrics(t *testing.T) {
+	tester := newRouterTester(t)
+	tester.addBackends(2)
+	addrs := []string{tester.getBackendByIndex(0).addr, tester.getBackendByIndex(1).addr}
+	for _, addr := range addrs {
+		metrics.TLSSessionCounter.WithLabelValues(addr, "hit").Inc()
+		metrics.TLSSessionCounter.WithLabelValues(addr, "miss").Inc()
+	}
+	// The backend isn't removed when there are connections on it.
+	tester.addConnections(10)
+	tester.killBackends(2)
+	tester.checkBackendNum(2)
+	for _, addr := range addrs {
+		val, err := metrics.ReadCounter(metrics.TLSSessionCounter.WithLabelValues(addr, "hit"))
+		require.NoError(t, err)
+		require.Equal(t, 1, val)
+	}
+	tester.closeConnections(10, false)
+	tester.checkBackendNum(0)
+	for _, addr := range addrs {
+		require.False(t, metrics.TLSSessionCounter.DeleteLabelValues(addr, "hit"))
+		require.False(t, metrics.TLSSessionCounter.DeleteLabelValues(addr, "miss"))
+	}
+}
@@ -5,7 +5,9 @@ package cert
 
 import (
 	"context"
+	"crypto/rsa"
 	"crypto/tls"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -19,6 +21,8 @@ import (
 
 const (
 	defaultRetryInterval = 1 * time.Hour
+	// ticketKeyCheckInterval is how often the session ticket keys of the server configs are checked for rotation.
+	ticketKeyCheckInterval = 1 * time.Minute
 )
 
 // CertManager reloads certs and offers interfaces for fetching TLS configs.
@@ -33,6 +37,9 @@ type CertManager struct {
 	clusterTLSConfig    atomic.Pointer[tls.Config]
 	sqlTLS              *security.CertInfo // proxy -> tidb sql port
 	sqlTLSConfig        atomic.Pointer[tls.Config]
+	rsaKeyPath          string // caching_sha2_password key exchange
+	rsaKey              atomic.Pointer[rsa.PrivateKey]
+	rsaKeyMu            sync.Mutex
 
 	cancel        context.CancelFunc
 	wg            waitgroup.WaitGroup
@@ -71,6 +78,7 @@ func (cm *CertManager) setConfig(cfg *config.Config) {
 	cm.serverHTTPTLS.SetConfig(cfg.Security.ServerHTTPTLS)
 	cm.clusterTLS.SetConfig(cfg.Security.ClusterTLS)
 	cm.sqlTLS.SetConfig(cfg.Security.SQLTLS)
+	cm.rsaKeyPath = cfg.Security.SHA2PrivateKey
 }
 
 func (cm *CertManager) SetRetryInterval(interval time.Duration) {
@@ -93,6 +101,26 @@ func (cm *CertManager) SQLTLS() *tls.Config {
 	return cm.sqlTLSConfig.Load()
 }
 
+// RSAKey returns the RSA key pair to exchange caching_sha2_password passwords with the clients that don't enable TLS.
+// If no key file is configured, a key pair is generated on the first call.
+func (cm *CertManager) RSAKey() *rsa.PrivateKey {
+	if key := cm.rsaKey.Load(); key != nil {
+		return key
+	}
+	cm.rsaKeyMu.Lock()
+	defer cm.rsaKeyMu.Unlock()
+	if key := cm.rsaKey.Load(); key != nil {
+		return key
+	}
+	key, err := security.GenerateRSAKey(security.DefaultRSAKeySize)
+	if err != nil {
+		cm.logger.Error("failed to generate RSA key", zap.Error(err))
+		return nil
+	}
+	cm.rsaKey.Store(key)
+	return key
+}
+
 // The proxy is supposed to be always online, so it should reload certs automatically,
 // rather than reloading it by restarting the proxy.
 // The proxy periodically reloads certs. If it fails, we will retry in the next round.
@@ -100,10 +128,14 @@ func (cm *CertManager) SQLTLS() *tls.Config {
 func (cm *CertManager) reloadLoop(ctx context.Context, cfgch <-chan *config.Config) {
 	// Failing to reload certs may cause even more serious problems than TiProxy reboot, so we don't recover panics.
 	cm.wg.Run(func() {
+		ticker := time.NewTicker(ticketKeyCheckInterval)
+		defer ticker.Stop()
 		for {
 			select {
 			case <-ctx.Done():
 				return
+			case <-ticker.C:
+				cm.rotateTicketKeys()
 			case cfg := <-cfgch:
 				// If cfgch is closed, it will always come here. But if cfgch is nil, it won't come here.
 				if cfg == nil {
@@ -122,7 +154,7 @@ func (cm *CertManager) reloadLoop(ctx context.Context, cfgch <-chan *config.Conf
 
 // If any error happens, we still continue and use the old cert.
 func (cm *CertManager) reload() error {
-	errs := make([]error, 0, 4)
+	errs := make([]error, 0, 5)
 	if tlsConfig, err := cm.serverSQLTLS.Reload(cm.logger); err != nil {
 		errs = append(errs, err)
 	} else {
@@ -143,6 +175,13 @@ func (cm *CertManager) reload() error {
 	} else {
 		cm.sqlTLSConfig.Store(tlsConfig)
 	}
+	if len(cm.rsaKeyPath) > 0 {
+		if key, err := security.LoadRSAKey(cm.rsaKeyPath); err != nil {
+			errs = append(errs, err)
+		} else {
+			cm.rsaKey.Store(key)
+		}
+	}
 	var err error
 	if len(errs) > 0 {
 		metrics.ServerErrCounter.WithLabelValues("load_cert").Add(float64(len(errs)))
@@ -152,6 +191,17 @@ func (cm *CertManager) reload() error {
 	return err
 }
 
+// rotateTicketKeys rotates the session ticket keys even if reloading fails.
+// It runs in the reload goroutine so that it never runs concurrently with reloading.
+func (cm *CertManager) rotateTicketKeys() {
+	for _, ci := range []*security.CertInfo{cm.serverSQLTLS, cm.serverHTTPTLS} {
+		if err := ci.RotateTicketKeys(); err != nil {
+			metrics.ServerErrCounter.WithLabelValues("load_cert").Inc()
+			cm.logger.Error("failed to rotate session ticket keys", zap.Error(err))
+		}
+	}
+}
+
 func (cm *CertManager) Close() {
 	if cm.cancel != nil {
 		cm.cancel()
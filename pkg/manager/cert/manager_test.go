@@ -5,6 +5,8 @@ package cert
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"net"
@@ -45,6 +47,11 @@ func connectWithTLS(ctls, stls *tls.Config) (clientErr, serverErr error) {
 	wg.Run(func() {
 		tlsConn := tls.Client(client, ctls)
 		clientErr = tlsConn.Handshake()
+		if clientErr == nil {
+			// Read the session tickets sent after the handshake, otherwise the server blocks on the pipe.
+			_ = tlsConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			_, _ = tlsConn.Read(make([]byte, 1))
+		}
 		_ = client.Close()
 	})
 	wg.Run(func() {
@@ -425,3 +432,31 @@ func TestWatchConfig(t *testing.T) {
 		}, time.Second, 10*time.Millisecond)
 	}
 }
+
+func TestRSAKey(t *testing.T) {
+	lg, _ := logger.CreateLoggerForTest(t)
+	// generate a key if no key file is set
+	certMgr := NewCertManager()
+	require.NoError(t, certMgr.Init(&config.Config{}, lg, nil))
+	key := certMgr.RSAKey()
+	require.NotNil(t, key)
+	require.Same(t, key, certMgr.RSAKey())
+	certMgr.Close()
+
+	// load the key file
+	key, err := security.GenerateRSAKey(1024)
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "rsa.pem")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600))
+	cfg := &config.Config{}
+	cfg.Security.SHA2PrivateKey = keyPath
+	certMgr = NewCertManager()
+	require.NoError(t, certMgr.Init(cfg, lg, nil))
+	require.True(t, key.Equal(certMgr.RSAKey()))
+	certMgr.Close()
+
+	// fail to load the key file
+	cfg.Security.SHA2PrivateKey = filepath.Join(t.TempDir(), "not_exist")
+	certMgr = NewCertManager()
+	require.Error(t, certMgr.Init(cfg, lg, nil))
+}
@@ -177,10 +177,16 @@ func (is *InfoSyncer) getTopologyInfo(cfg *config.Config) (*TopologyInfo, error)
 		s = ""
 	}
 	dir := path.Dir(s)
-	addrs := strings.Split(cfg.Proxy.Addr, ",")
-	ip, port, err := net.SplitHostPort(addrs[0])
-	if err != nil {
-		return nil, errors.WithStack(err)
+	// Unix sockets are only accessible locally, so report the first TCP address.
+	var ip, port string
+	for _, listener := range cfg.Proxy.ListenerConfigs() {
+		if strings.HasPrefix(listener.Addr, config.UnixSocketAddrPrefix) {
+			continue
+		}
+		if ip, port, err = net.SplitHostPort(listener.Addr); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		break
 	}
 	_, statusPort, err := net.SplitHostPort(cfg.API.Addr)
 	if err != nil {
@@ -196,20 +196,23 @@ func TestGetTopology(t *testing.T) {
 		{"[F02::1:FF47]:34", "", "34", false},
 		{"192.0.0.1:6049", "", "6049", false},
 		{"0.0.0.0:1000", "tc-tiproxy-0.tc-tiproxy-peer.ns.svc", "1000", false},
+		{"unix:///tmp/tiproxy.sock,127.0.0.1:34", "", "34", false},
 	} {
+		addrs := strings.Split(cas.addr, ",")
+		tcpAddr := addrs[len(addrs)-1]
 		is, err := ts.is.getTopologyInfo(&config.Config{
 			Proxy: config.ProxyServer{
 				Addr:          cas.addr,
 				AdvertiseAddr: cas.advertiseAddr,
 			},
 			API: config.API{
-				Addr: cas.addr,
+				Addr: tcpAddr,
 			},
 		})
 		require.NoError(t, err)
 		ip := cas.advertiseAddr
 		if len(ip) == 0 {
-			ip, _, err = net.SplitHostPort(cas.addr)
+			ip, _, err = net.SplitHostPort(tcpAddr)
 			require.NoError(t, err)
 			if cas.nonUnicast {
 				ip = sys.GetGlobalUnicastIP()
@@ -0,0 +1,42 @@
+// Copyright 2024 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package namespace
+
+import (
+	"os"
+
+	"github.com/pingcap/tiproxy/lib/config"
+	"github.com/pingcap/tiproxy/lib/util/errors"
+)
+
+// loadLocalUsers loads the accounts in the config and the user file.
+// It returns nil if no account is set, which means the backends authenticate the clients.
+func loadLocalUsers(cfg *config.FrontendNamespace) (map[string]*config.LocalUser, error) {
+	users := cfg.LocalUsers
+	if len(cfg.LocalUserFile) > 0 {
+		data, err := os.ReadFile(cfg.LocalUserFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read user file")
+		}
+		fileUsers, err := config.NewLocalUsers(data)
+		if err != nil {
+			return nil, err
+		}
+		users = append(append(make([]config.LocalUser, 0, len(users)+len(fileUsers)), users...), fileUsers...)
+	}
+	if len(users) == 0 {
+		return nil, nil
+	}
+	userMap := make(map[string]*config.LocalUser, len(users))
+	for i := range users {
+		if _, ok := userMap[users[i].User]; ok {
+			return nil, errors.Wrapf(ErrDuplicatedUser, "user %s", users[i].User)
+		}
+		if _, err := users[i].AuthHash(); err != nil {
+			return nil, err
+		}
+		userMap[users[i].User] = &users[i]
+	}
+	return userMap, nil
+}
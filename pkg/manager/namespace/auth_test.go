@@ -0,0 +1,47 @@
+// Copyright 2024 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package namespace
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pingcap/tiproxy/lib/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadLocalUsers(t *testing.T) {
+	users, err := loadLocalUsers(&config.FrontendNamespace{})
+	require.NoError(t, err)
+	require.Nil(t, users)
+
+	userFile := filepath.Join(t.TempDir(), "users.toml")
+	require.NoError(t, os.WriteFile(userFile, []byte(`
+[[users]]
+user = "u2"
+auth-string = "*6BB4837EB74329105EE4568DDA7DC67ED2CA2AD9"
+`), 0600))
+	cfg := &config.FrontendNamespace{
+		LocalUsers:    []config.LocalUser{{User: "u1"}},
+		LocalUserFile: userFile,
+	}
+	users, err = loadLocalUsers(cfg)
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	require.Equal(t, "u1", users["u1"].User)
+	require.Equal(t, "u2", users["u2"].User)
+
+	cfg.LocalUsers = append(cfg.LocalUsers, config.LocalUser{User: "u2"})
+	_, err = loadLocalUsers(cfg)
+	require.ErrorIs(t, err, ErrDuplicatedUser)
+
+	cfg.LocalUsers = []config.LocalUser{{User: "u3", AuthString: "xyz"}}
+	_, err = loadLocalUsers(cfg)
+	require.ErrorIs(t, err, config.ErrInvalidConfigValue)
+
+	cfg.LocalUserFile = filepath.Join(t.TempDir(), "not_exist")
+	_, err = loadLocalUsers(cfg)
+	require.Error(t, err)
+}
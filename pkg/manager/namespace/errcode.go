@@ -15,4 +15,9 @@ var (
 	ErrInvalidSqlTimeout           = errors.New("invalid sql timeout")
 
 	ErrInvalidScope = errors.New("invalid scope")
+
+	ErrInsecureTransport = errors.New("connections using insecure transport are prohibited")
+	ErrTLSPolicy         = errors.New("the TLS connection is not allowed by the namespace")
+	ErrCertIdentity      = errors.New("the certificate identity is not mapped to the user")
+	ErrHostNotAllowed    = errors.New("the client address is not allowed by the namespace")
 )
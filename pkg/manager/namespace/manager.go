@@ -17,6 +17,8 @@ import (
 	"github.com/pingcap/tiproxy/pkg/balance/metricsreader"
 	"github.com/pingcap/tiproxy/pkg/balance/observer"
 	"github.com/pingcap/tiproxy/pkg/balance/router"
+	pnet "github.com/pingcap/tiproxy/pkg/proxy/net"
+	"github.com/pingcap/tiproxy/pkg/proxy/proxyprotocol"
 	"go.uber.org/zap"
 )
 
@@ -26,6 +28,8 @@ type NamespaceManager struct {
 	promFetcher   metricsreader.PromInfoFetcher
 	metricsReader metricsreader.MetricsReader
 	httpCli       *http.Client
+	sqlProber     observer.SQLProber
+	cpuReader     *observer.CPUReader
 	logger        *zap.Logger
 	nsm           map[string]*Namespace
 }
@@ -37,10 +41,38 @@ func NewNamespaceManager() *NamespaceManager {
 func (mgr *NamespaceManager) buildNamespace(cfg *config.Namespace) (*Namespace, error) {
 	logger := mgr.logger.With(zap.String("namespace", cfg.Namespace))
 
+	tlsPolicy, err := newTLSPolicy(&cfg.Frontend, logger)
+	if err != nil {
+		return nil, err
+	}
+	localUsers, err := loadLocalUsers(&cfg.Frontend)
+	if err != nil {
+		return nil, err
+	}
+	ipFilter, err := pnet.NewIPFilter(cfg.Frontend.AllowCIDRs, cfg.Frontend.DenyCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Backend.Migration.Check(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Backend.Compression.Check(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Frontend.Limits.Check(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Frontend.LoadData.Check(); err != nil {
+		return nil, err
+	}
+
 	// init BackendFetcher
 	var fetcher observer.BackendFetcher
 	healthCheckCfg := config.NewDefaultHealthCheckConfig()
-	if !reflect.ValueOf(mgr.tpFetcher).IsNil() {
+	cfg.Backend.HealthCheck.Apply(healthCheckCfg)
+	if len(cfg.Backend.DNS) > 0 {
+		fetcher = observer.NewDNSFetcher(cfg.Backend.DNS, nil, logger.Named("be_fetcher"))
+	} else if !reflect.ValueOf(mgr.tpFetcher).IsNil() {
 		fetcher = observer.NewPDFetcher(mgr.tpFetcher, logger.Named("be_fetcher"), healthCheckCfg)
 	} else {
 		fetcher = observer.NewStaticFetcher(cfg.Backend.Instances)
@@ -48,16 +80,24 @@ func (mgr *NamespaceManager) buildNamespace(cfg *config.Namespace) (*Namespace,
 
 	// init Router
 	rt := router.NewScoreBasedRouter(logger.Named("router"))
-	hc := observer.NewDefaultHealthCheck(mgr.httpCli, healthCheckCfg, logger.Named("hc"))
+	hc := observer.NewDefaultHealthCheck(mgr.httpCli, mgr.sqlProber, mgr.cpuReader, healthCheckCfg, logger.Named("hc"))
 	bo := observer.NewDefaultBackendObserver(logger.Named("observer"), healthCheckCfg, fetcher, hc)
 	bo.Start(context.Background())
 	rt.Init(context.Background(), bo)
 
 	return &Namespace{
-		name:   cfg.Namespace,
-		user:   cfg.Frontend.User,
-		bo:     bo,
-		router: rt,
+		name:       cfg.Namespace,
+		user:       cfg.Frontend.User,
+		proxyTLVs:  cfg.Frontend.ProxyTLVs,
+		tls:        tlsPolicy,
+		ipFilter:   ipFilter,
+		localUsers: localUsers,
+		bo:         bo,
+		router:     rt,
+		migration:  cfg.Backend.Migration,
+		compress:   cfg.Backend.Compression,
+		limits:     cfg.Frontend.Limits,
+		loadData:   cfg.Frontend.LoadData,
 	}, nil
 }
 
@@ -82,21 +122,46 @@ func (mgr *NamespaceManager) CommitNamespaces(nss []*config.Namespace, nss_delet
 		nsm[ns.Name()] = ns
 	}
 
+	if err := checkProxyTLVConflicts(nsm); err != nil {
+		return err
+	}
+
 	mgr.Lock()
 	mgr.nsm = nsm
 	mgr.Unlock()
 	return nil
 }
 
+// checkProxyTLVConflicts rejects the TLV rules that select different namespaces with the same TLV.
+func checkProxyTLVConflicts(nsm map[string]*Namespace) error {
+	owners := make(map[string]string)
+	for name, ns := range nsm {
+		for _, rule := range ns.proxyTLVs {
+			// A rule with a subtype matches the same TLV as a rule whose value starts with the subtype.
+			key := fmt.Sprintf("%d/%s", rule.Type, rule.Value)
+			if rule.Subtype != 0 {
+				key = fmt.Sprintf("%d/%s", rule.Type, append([]byte{rule.Subtype}, rule.Value...))
+			}
+			if owner, ok := owners[key]; ok && owner != name {
+				return fmt.Errorf("%w: namespaces %s and %s have the same proxy TLV rule", config.ErrInvalidConfigValue, owner, name)
+			}
+			owners[key] = name
+		}
+	}
+	return nil
+}
+
 func (mgr *NamespaceManager) Init(logger *zap.Logger, nscs []*config.Namespace, tpFetcher observer.TopologyFetcher,
-	promFetcher metricsreader.PromInfoFetcher, httpCli *http.Client) error {
+	promFetcher metricsreader.PromInfoFetcher, httpCli *http.Client, sqlProber observer.SQLProber) error {
 	mgr.Lock()
 	mgr.tpFetcher = tpFetcher
 	mgr.promFetcher = promFetcher
 	mgr.httpCli = httpCli
+	mgr.sqlProber = sqlProber
 	mgr.logger = logger
 	healthCheckCfg := config.NewDefaultHealthCheckConfig()
 	mgr.metricsReader = metricsreader.NewDefaultMetricsReader(logger.Named("mr"), mgr.promFetcher, healthCheckCfg)
+	mgr.cpuReader = observer.NewCPUReader(mgr.metricsReader)
 	mgr.Unlock()
 
 	mgr.metricsReader.Start(context.Background())
@@ -123,6 +188,76 @@ func (mgr *NamespaceManager) GetNamespaceByUser(user string) (*Namespace, bool)
 	return nil, false
 }
 
+// GetNamespaceByProxyTLV returns the namespace whose TLV rules match the PROXY protocol TLVs.
+// If the TLVs match multiple namespaces, the one with the smallest name is chosen so that the result is stable.
+func (mgr *NamespaceManager) GetNamespaceByProxyTLV(tlvs []proxyprotocol.ProxyTlv) (*Namespace, bool) {
+	if len(tlvs) == 0 {
+		return nil, false
+	}
+	mgr.RLock()
+	defer mgr.RUnlock()
+
+	var matched *Namespace
+	for _, ns := range mgr.nsm {
+		if len(ns.proxyTLVs) > 0 && ns.MatchProxyTLV(tlvs) && (matched == nil || ns.Name() < matched.Name()) {
+			matched = ns
+		}
+	}
+	return matched, matched != nil
+}
+
+// LocalLoadDisabled returns true if every namespace disables `LOAD DATA LOCAL INFILE`,
+// so that the proxy can refuse it in the initial handshake before the namespace is known.
+func (mgr *NamespaceManager) LocalLoadDisabled() bool {
+	mgr.RLock()
+	defer mgr.RUnlock()
+
+	for _, ns := range mgr.nsm {
+		if !ns.LoadDataPolicy().DisableLocal {
+			return false
+		}
+	}
+	return len(mgr.nsm) > 0
+}
+
+// Capability returns the capabilities supported by the backends of all the namespaces,
+// because the client may be routed to any namespace after the initial handshake.
+// It returns 0 if it's unknown.
+func (mgr *NamespaceManager) Capability() pnet.Capability {
+	mgr.RLock()
+	defer mgr.RUnlock()
+
+	var capability pnet.Capability
+	for _, ns := range mgr.nsm {
+		rt := ns.GetRouter()
+		if rt == nil {
+			continue
+		}
+		nsCapability := rt.Capability()
+		if nsCapability == 0 {
+			continue
+		}
+		if capability == 0 {
+			capability = nsCapability
+		} else {
+			capability &= nsCapability
+		}
+	}
+	return capability
+}
+
+// HealthHistory returns the recent status changes of the backends in each namespace.
+func (mgr *NamespaceManager) HealthHistory() map[string]map[string][]observer.HealthEvent {
+	mgr.RLock()
+	defer mgr.RUnlock()
+
+	history := make(map[string]map[string][]observer.HealthEvent, len(mgr.nsm))
+	for name, ns := range mgr.nsm {
+		history[name] = ns.HealthHistory()
+	}
+	return history
+}
+
 func (mgr *NamespaceManager) RedirectConnections() []error {
 	mgr.RLock()
 	defer mgr.RUnlock()
@@ -143,6 +278,7 @@ func (mgr *NamespaceManager) Close() error {
 		ns.Close()
 	}
 	mgr.RUnlock()
+	mgr.cpuReader.Close()
 	mgr.metricsReader.Close()
 	return nil
 }
@@ -0,0 +1,95 @@
+// Copyright 2024 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package namespace
+
+import (
+	"testing"
+
+	"github.com/pingcap/tiproxy/lib/config"
+	"github.com/pingcap/tiproxy/pkg/balance/router"
+	pnet "github.com/pingcap/tiproxy/pkg/proxy/net"
+	"github.com/pingcap/tiproxy/pkg/proxy/proxyprotocol"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetNamespaceByProxyTLV(t *testing.T) {
+	mgr := &NamespaceManager{
+		nsm: map[string]*Namespace{
+			"b":       {name: "b", proxyTLVs: []config.ProxyTLVRule{{Type: 0x02, Value: "tidb.example.com"}}},
+			"a":       {name: "a", proxyTLVs: []config.ProxyTLVRule{{Type: 0xEA, Subtype: 0x01, Value: "vpce-123"}}},
+			"default": {name: "default"},
+		},
+	}
+	authority := proxyprotocol.ProxyTlv{Typ: proxyprotocol.ProxyTlvAuthority, Content: []byte("tidb.example.com")}
+	vpce := proxyprotocol.ProxyTlv{Typ: proxyprotocol.ProxyTlvAWS, Content: append([]byte{proxyprotocol.ProxyTlvAWSVPCEndpointID}, "vpce-123"...)}
+
+	_, ok := mgr.GetNamespaceByProxyTLV(nil)
+	require.False(t, ok)
+	ns, ok := mgr.GetNamespaceByProxyTLV([]proxyprotocol.ProxyTlv{authority})
+	require.True(t, ok)
+	require.Equal(t, "b", ns.Name())
+	// The TLVs match both namespaces, and the result must be stable.
+	for i := 0; i < 10; i++ {
+		ns, ok = mgr.GetNamespaceByProxyTLV([]proxyprotocol.ProxyTlv{authority, vpce})
+		require.True(t, ok)
+		require.Equal(t, "a", ns.Name())
+	}
+}
+
+func TestCheckProxyTLVConflicts(t *testing.T) {
+	tests := []struct {
+		rules [2][]config.ProxyTLVRule
+		valid bool
+	}{
+		{[2][]config.ProxyTLVRule{{{Type: 0x02, Value: "a.com"}}, {{Type: 0x02, Value: "b.com"}}}, true},
+		{[2][]config.ProxyTLVRule{{{Type: 0x02, Value: "a.com"}}, {{Type: 0x03, Value: "a.com"}}}, true},
+		{[2][]config.ProxyTLVRule{{{Type: 0x02, Value: "a.com"}}, {{Type: 0x02, Value: "a.com"}}}, false},
+		{[2][]config.ProxyTLVRule{{{Type: 0xEA, Subtype: 0x01, Value: "vpce"}}, {{Type: 0xEA, Value: "\x01vpce"}}}, false},
+	}
+	for i, test := range tests {
+		nsm := map[string]*Namespace{
+			"a": {name: "a", proxyTLVs: test.rules[0]},
+			"b": {name: "b", proxyTLVs: test.rules[1]},
+		}
+		err := checkProxyTLVConflicts(nsm)
+		if test.valid {
+			require.NoError(t, err, "case %d", i)
+		} else {
+			require.ErrorIs(t, err, config.ErrInvalidConfigValue, "case %d", i)
+		}
+	}
+}
+
+func TestLocalLoadDisabled(t *testing.T) {
+	mgr := &NamespaceManager{nsm: map[string]*Namespace{}}
+	require.False(t, mgr.LocalLoadDisabled())
+	mgr.nsm["a"] = &Namespace{name: "a", loadData: config.LoadDataPolicy{DisableLocal: true}}
+	require.True(t, mgr.LocalLoadDisabled())
+	mgr.nsm["default"] = &Namespace{name: "default"}
+	require.False(t, mgr.LocalLoadDisabled())
+	mgr.nsm["default"].loadData.DisableLocal = true
+	require.True(t, mgr.LocalLoadDisabled())
+}
+
+type mockCapabilityRouter struct {
+	router.Router
+	capability pnet.Capability
+}
+
+func (r *mockCapabilityRouter) Capability() pnet.Capability {
+	return r.capability
+}
+
+func TestCapability(t *testing.T) {
+	mgr := &NamespaceManager{nsm: map[string]*Namespace{}}
+	require.Zero(t, mgr.Capability())
+	// The capability is unknown.
+	mgr.nsm["a"] = &Namespace{name: "a", router: &mockCapabilityRouter{}}
+	require.Zero(t, mgr.Capability())
+	// There's no default namespace.
+	mgr.nsm["b"] = &Namespace{name: "b", router: &mockCapabilityRouter{capability: pnet.ClientDeprecateEOF | pnet.ClientSessionTrack}}
+	require.Equal(t, pnet.ClientDeprecateEOF|pnet.ClientSessionTrack, mgr.Capability())
+	mgr.nsm["default"] = &Namespace{name: "default", router: &mockCapabilityRouter{capability: pnet.ClientDeprecateEOF | pnet.ClientCompress}}
+	require.Equal(t, pnet.ClientDeprecateEOF, mgr.Capability())
+}
@@ -7,15 +7,31 @@
 package namespace
 
 import (
+	"crypto/tls"
+
+	"github.com/pingcap/tiproxy/lib/config"
+	"github.com/pingcap/tiproxy/lib/util/errors"
 	"github.com/pingcap/tiproxy/pkg/balance/observer"
 	"github.com/pingcap/tiproxy/pkg/balance/router"
+	pnet "github.com/pingcap/tiproxy/pkg/proxy/net"
+	"github.com/pingcap/tiproxy/pkg/proxy/proxyprotocol"
 )
 
 type Namespace struct {
-	name   string
-	user   string
-	bo     observer.BackendObserver
-	router router.Router
+	name      string
+	user      string
+	proxyTLVs []config.ProxyTLVRule
+	tls       *tlsPolicy
+	// nil means allowing all clients.
+	ipFilter *pnet.IPFilter
+	// nil means the backends authenticate the clients.
+	localUsers map[string]*config.LocalUser
+	bo         observer.BackendObserver
+	router     router.Router
+	migration  config.MigrationDeadline
+	compress   config.BackendCompression
+	limits     config.QueryLimits
+	loadData   config.LoadDataPolicy
 }
 
 func (n *Namespace) Name() string {
@@ -26,11 +42,83 @@ func (n *Namespace) User() string {
 	return n.user
 }
 
+// MatchProxyTLV returns whether the connection with the PROXY protocol TLVs can access the namespace.
+// It always returns true if the namespace has no TLV rules.
+func (n *Namespace) MatchProxyTLV(tlvs []proxyprotocol.ProxyTlv) bool {
+	if len(n.proxyTLVs) == 0 {
+		return true
+	}
+	for i := range n.proxyTLVs {
+		for _, tlv := range tlvs {
+			if n.proxyTLVs[i].Match(uint8(tlv.Typ), tlv.Content) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CheckClientAddr checks whether the client address is allowed by the namespace.
+func (n *Namespace) CheckClientAddr(addr string) error {
+	if !n.ipFilter.Allow(addr) {
+		return errors.Wrapf(ErrHostNotAllowed, "client %s, namespace %s", addr, n.name)
+	}
+	return nil
+}
+
+// VerifyTLS checks whether the client connection satisfies the TLS requirements of the namespace.
+// state is nil if the client doesn't enable TLS. It returns the subject of the verified client certificate.
+func (n *Namespace) VerifyTLS(user string, state *tls.ConnectionState) (string, error) {
+	if n.tls == nil {
+		return "", nil
+	}
+	return n.tls.verify(user, state)
+}
+
+// GetLocalUser returns the account stored in the proxy.
+// enabled is false if the namespace has no local accounts and the backends authenticate the clients.
+func (n *Namespace) GetLocalUser(name string) (user *config.LocalUser, enabled bool) {
+	if n.localUsers == nil {
+		return nil, false
+	}
+	return n.localUsers[name], true
+}
+
+// RestrictsUsers returns whether the namespace authenticates the clients by local accounts or restricts
+// the users by TLS settings.
+func (n *Namespace) RestrictsUsers() bool {
+	return n.localUsers != nil || (n.tls != nil && n.tls.restrictsUsers())
+}
+
+// MigrationDeadline returns the configurations of forced migration.
+func (n *Namespace) MigrationDeadline() config.MigrationDeadline {
+	return n.migration
+}
+
+// BackendCompression returns the compression configurations between the proxy and the backends.
+func (n *Namespace) BackendCompression() config.BackendCompression {
+	return n.compress
+}
+
+// QueryLimits returns the limits of the requests and the result sets.
+func (n *Namespace) QueryLimits() config.QueryLimits {
+	return n.limits
+}
+
 func (n *Namespace) GetRouter() router.Router {
 	return n.router
 }
 
+func (n *Namespace) HealthHistory() map[string][]observer.HealthEvent {
+	return n.bo.HealthHistory()
+}
+
 func (n *Namespace) Close() {
 	n.router.Close()
 	n.bo.Close()
 }
+
+// LoadDataPolicy returns the restrictions of `LOAD DATA LOCAL INFILE`.
+func (n *Namespace) LoadDataPolicy() config.LoadDataPolicy {
+	return n.loadData
+}
@@ -0,0 +1,143 @@
+// Copyright 2024 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package namespace
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+
+	"github.com/pingcap/tiproxy/lib/config"
+	"github.com/pingcap/tiproxy/lib/util/errors"
+	"github.com/pingcap/tiproxy/lib/util/security"
+	"go.uber.org/zap"
+)
+
+// tlsPolicy restricts the client connections of a namespace.
+type tlsPolicy struct {
+	requireTLS      bool
+	requireTLSUsers map[string]struct{}
+	// 0 means no limit.
+	minVersion uint16
+	// nil means no limit.
+	cipherSuites map[uint16]struct{}
+	// nil means not verifying client certificates.
+	clientCAs *x509.CertPool
+	// empty means not mapping certificate identities to users.
+	certUsers []config.CertUserRule
+}
+
+func newTLSPolicy(cfg *config.FrontendNamespace, logger *zap.Logger) (*tlsPolicy, error) {
+	policy := &tlsPolicy{
+		requireTLS: cfg.RequireTLS,
+		certUsers:  cfg.CertUsers,
+	}
+	if len(cfg.RequireTLSUsers) > 0 {
+		policy.requireTLSUsers = make(map[string]struct{}, len(cfg.RequireTLSUsers))
+		for _, user := range cfg.RequireTLSUsers {
+			policy.requireTLSUsers[user] = struct{}{}
+		}
+	}
+	if len(cfg.Security.MinTLSVersion) > 0 {
+		policy.minVersion = security.GetMinTLSVer(cfg.Security.MinTLSVersion, logger)
+	}
+	cipherSuites, err := security.ParseCipherSuites(cfg.Security.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	if len(cipherSuites) > 0 {
+		policy.cipherSuites = make(map[uint16]struct{}, len(cipherSuites))
+		for _, id := range cipherSuites {
+			policy.cipherSuites[id] = struct{}{}
+		}
+	}
+	if cfg.Security.HasCA() {
+		caPEM, err := os.ReadFile(cfg.Security.CA)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read CA")
+		}
+		policy.clientCAs = x509.NewCertPool()
+		if !policy.clientCAs.AppendCertsFromPEM(caPEM) {
+			return nil, errors.Errorf("failed to append CA %s", cfg.Security.CA)
+		}
+	}
+	return policy, nil
+}
+
+// verify checks the TLS connection state of the client against the policy.
+// state is nil if the client doesn't enable TLS.
+// It returns the subject of the client certificate if the certificate is verified.
+func (p *tlsPolicy) verify(user string, state *tls.ConnectionState) (string, error) {
+	if state == nil {
+		if p.requireTLS || len(p.certUsers) > 0 {
+			return "", ErrInsecureTransport
+		}
+		if _, ok := p.requireTLSUsers[user]; ok {
+			return "", errors.Wrapf(ErrInsecureTransport, "user %s", user)
+		}
+		return "", nil
+	}
+	if p.minVersion > 0 && state.Version < p.minVersion {
+		return "", errors.Wrapf(ErrTLSPolicy, "TLS version %s is lower than %s", tls.VersionName(state.Version), tls.VersionName(p.minVersion))
+	}
+	// Cipher suites are not configurable in TLS 1.3.
+	if p.cipherSuites != nil && state.Version < tls.VersionTLS13 {
+		if _, ok := p.cipherSuites[state.CipherSuite]; !ok {
+			return "", errors.Wrapf(ErrTLSPolicy, "cipher suite %s is not allowed", tls.CipherSuiteName(state.CipherSuite))
+		}
+	}
+	if p.clientCAs == nil && len(p.certUsers) == 0 {
+		return "", nil
+	}
+	if len(state.PeerCertificates) == 0 {
+		return "", errors.Wrapf(ErrTLSPolicy, "client certificate is required")
+	}
+	cert := state.PeerCertificates[0]
+	if p.clientCAs != nil {
+		opts := x509.VerifyOptions{
+			Roots:         p.clientCAs,
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		for _, cert := range state.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		if _, err := cert.Verify(opts); err != nil {
+			return "", errors.Wrap(ErrTLSPolicy, err)
+		}
+	}
+	if len(p.certUsers) > 0 && !p.matchCertUser(cert, user) {
+		return "", errors.Wrapf(ErrCertIdentity, "the client certificate %s can not log in as user %s", cert.Subject.String(), user)
+	}
+	return cert.Subject.String(), nil
+}
+
+// restrictsUsers returns whether the policy depends on the user of the connection.
+func (p *tlsPolicy) restrictsUsers() bool {
+	return len(p.requireTLSUsers) > 0 || len(p.certUsers) > 0
+}
+
+// matchCertUser returns whether any identity (subject CN or SAN) of the certificate can log in as the user.
+func (p *tlsPolicy) matchCertUser(cert *x509.Certificate, user string) bool {
+	identities := make([]string, 0, 1+len(cert.DNSNames)+len(cert.EmailAddresses)+len(cert.URIs)+len(cert.IPAddresses))
+	if len(cert.Subject.CommonName) > 0 {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+	identities = append(identities, cert.DNSNames...)
+	identities = append(identities, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		identities = append(identities, ip.String())
+	}
+	for i := range p.certUsers {
+		for _, identity := range identities {
+			if p.certUsers[i].Match(identity, user) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+// Copyright 2024 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package namespace
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tiproxy/lib/config"
+	"github.com/pingcap/tiproxy/lib/util/logger"
+	"github.com/pingcap/tiproxy/lib/util/security"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSPolicy(t *testing.T) {
+	lg, _ := logger.CreateLoggerForTest(t)
+	dir := t.TempDir()
+	certPath, keyPath, caPath := filepath.Join(dir, "cert"), filepath.Join(dir, "key"), filepath.Join(dir, "ca")
+	require.NoError(t, security.CreateTLSCertificates(lg, certPath, keyPath, caPath, 0, time.Hour))
+	certPEM, err := os.ReadFile(certPath)
+	require.NoError(t, err)
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+
+	otherDir := t.TempDir()
+	otherCAPath := filepath.Join(otherDir, "ca")
+	require.NoError(t, security.CreateTLSCertificates(lg, filepath.Join(otherDir, "cert"), filepath.Join(otherDir, "key"), otherCAPath, 0, time.Hour))
+
+	tls12 := &tls.ConnectionState{Version: tls.VersionTLS12, CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	tls13 := &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256}
+	withCert := &tls.ConnectionState{Version: tls.VersionTLS13, PeerCertificates: []*x509.Certificate{cert}}
+	tests := []struct {
+		cfg     config.FrontendNamespace
+		user    string
+		state   *tls.ConnectionState
+		err     error
+		subject string
+	}{
+		{
+			state: nil,
+		},
+		{
+			cfg:   config.FrontendNamespace{RequireTLS: true},
+			state: nil,
+			err:   ErrInsecureTransport,
+		},
+		{
+			cfg:   config.FrontendNamespace{RequireTLS: true},
+			state: tls12,
+		},
+		{
+			cfg:   config.FrontendNamespace{RequireTLSUsers: []string{"root"}},
+			user:  "root",
+			state: nil,
+			err:   ErrInsecureTransport,
+		},
+		{
+			cfg:   config.FrontendNamespace{RequireTLSUsers: []string{"root"}},
+			user:  "app",
+			state: nil,
+		},
+		{
+			cfg:   config.FrontendNamespace{Security: config.TLSConfig{MinTLSVersion: "v1.3"}},
+			state: tls12,
+			err:   ErrTLSPolicy,
+		},
+		{
+			cfg:   config.FrontendNamespace{Security: config.TLSConfig{MinTLSVersion: "v1.3"}},
+			state: tls13,
+		},
+		{
+			cfg:   config.FrontendNamespace{Security: config.TLSConfig{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}}},
+			state: tls12,
+			err:   ErrTLSPolicy,
+		},
+		{
+			cfg:   config.FrontendNamespace{Security: config.TLSConfig{CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}}},
+			state: tls12,
+		},
+		{
+			cfg:   config.FrontendNamespace{Security: config.TLSConfig{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}}},
+			state: tls13,
+		},
+		{
+			cfg:   config.FrontendNamespace{Security: config.TLSConfig{CA: caPath}},
+			state: tls13,
+			err:   ErrTLSPolicy,
+		},
+		{
+			cfg:   config.FrontendNamespace{Security: config.TLSConfig{CA: otherCAPath}},
+			state: withCert,
+			err:   ErrTLSPolicy,
+		},
+		{
+			cfg:     config.FrontendNamespace{Security: config.TLSConfig{CA: caPath}},
+			state:   withCert,
+			subject: cert.Subject.String(),
+		},
+		{
+			cfg:     config.FrontendNamespace{CertUsers: []config.CertUserRule{{Identity: "127.0.0.1", Users: []string{"app"}}}},
+			user:    "app",
+			state:   withCert,
+			subject: cert.Subject.String(),
+		},
+		{
+			cfg:   config.FrontendNamespace{CertUsers: []config.CertUserRule{{Identity: "127.0.0.1", Users: []string{"app"}}}},
+			user:  "root",
+			state: withCert,
+			err:   ErrCertIdentity,
+		},
+		{
+			cfg:   config.FrontendNamespace{CertUsers: []config.CertUserRule{{Identity: "127.0.0.1", Users: []string{"app"}}}},
+			user:  "app",
+			state: tls13,
+			err:   ErrTLSPolicy,
+		},
+		{
+			cfg:   config.FrontendNamespace{CertUsers: []config.CertUserRule{{Identity: "127.0.0.1", Users: []string{"app"}}}},
+			user:  "app",
+			state: nil,
+			err:   ErrInsecureTransport,
+		},
+	}
+
+	for i, test := range tests {
+		policy, err := newTLSPolicy(&test.cfg, lg)
+		require.NoError(t, err, "case %d", i)
+		subject, err := policy.verify(test.user, test.state)
+		if test.err != nil {
+			require.ErrorIs(t, err, test.err, "case %d", i)
+		} else {
+			require.NoError(t, err, "case %d", i)
+		}
+		require.Equal(t, test.subject, subject, "case %d", i)
+		require.Equal(t, len(test.cfg.RequireTLSUsers) > 0 || len(test.cfg.CertUsers) > 0, policy.restrictsUsers(), "case %d", i)
+	}
+
+	_, err = newTLSPolicy(&config.FrontendNamespace{Security: config.TLSConfig{CipherSuites: []string{"unknown"}}}, lg)
+	require.Error(t, err)
+}
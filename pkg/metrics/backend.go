@@ -36,6 +36,14 @@ var (
 			Help:      "Counter of getting backend.",
 		}, []string{LblRes})
 
+	TLSSessionCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: ModuleProxy,
+			Subsystem: LabelBackend,
+			Name:      "tls_session_cache",
+			Help:      "Counter of the TLS handshakes to each backend that hit or miss the session cache.",
+		}, []string{LblBackend, LblRes})
+
 	PingBackendGauge = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: ModuleProxy,
@@ -44,6 +52,14 @@ var (
 			Help:      "Time (s) of pinging the SQL port of each backend.",
 		}, []string{LblBackend})
 
+	ProbeSQLGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: ModuleProxy,
+			Subsystem: LabelBackend,
+			Name:      "probe_sql_duration_seconds",
+			Help:      "Time (s) of running the probe query on each backend.",
+		}, []string{LblBackend})
+
 	HealthCheckCycleGauge = prometheus.NewGauge(
 		prometheus.GaugeOpts{
 			Namespace: ModuleProxy,
@@ -100,10 +100,15 @@ func registerProxyMetrics() {
 	prometheus.MustRegister(QueryTotalCounter)
 	prometheus.MustRegister(QueryDurationHistogram)
 	prometheus.MustRegister(HandshakeDurationHistogram)
+	prometheus.MustRegister(LoadDataBytesCounter)
+	prometheus.MustRegister(LoadDataRowsCounter)
+	prometheus.MustRegister(LoadDataDurationHistogram)
 	prometheus.MustRegister(BackendStatusGauge)
 	prometheus.MustRegister(GetBackendHistogram)
 	prometheus.MustRegister(GetBackendCounter)
+	prometheus.MustRegister(TLSSessionCounter)
 	prometheus.MustRegister(PingBackendGauge)
+	prometheus.MustRegister(ProbeSQLGauge)
 	prometheus.MustRegister(BackendConnGauge)
 	prometheus.MustRegister(HealthCheckCycleGauge)
 	prometheus.MustRegister(MigrateCounter)
@@ -112,6 +117,8 @@ func registerProxyMetrics() {
 	prometheus.MustRegister(InboundPacketsCounter)
 	prometheus.MustRegister(OutboundBytesCounter)
 	prometheus.MustRegister(OutboundPacketsCounter)
+	prometheus.MustRegister(UncompressedBytesCounter)
+	prometheus.MustRegister(CompressedBytesCounter)
 }
 
 // ReadCounter reads the value from the counter. It is only used for testing.
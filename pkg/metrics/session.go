@@ -39,4 +39,29 @@ var (
 			Help:      "Bucketed histogram of processing time (s) of handshakes.",
 			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 29), // 0.5ms ~ 1.5days
 		}, []string{LblBackend})
+
+	LoadDataBytesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: ModuleProxy,
+			Subsystem: LabelSession,
+			Name:      "load_data_bytes",
+			Help:      "Counter of file bytes sent by LOAD DATA LOCAL INFILE.",
+		}, []string{LblBackend})
+
+	LoadDataRowsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: ModuleProxy,
+			Subsystem: LabelSession,
+			Name:      "load_data_rows",
+			Help:      "Counter of rows affected by LOAD DATA LOCAL INFILE.",
+		}, []string{LblBackend})
+
+	LoadDataDurationHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: ModuleProxy,
+			Subsystem: LabelSession,
+			Name:      "load_data_duration_seconds",
+			Help:      "Bucketed histogram of time (s) of sending files by LOAD DATA LOCAL INFILE.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 29), // 0.5ms ~ 1.5days
+		}, []string{LblBackend})
 )
@@ -5,6 +5,11 @@ package metrics
 
 import "github.com/prometheus/client_golang/prometheus"
 
+const (
+	LblAlgorithm = "algorithm"
+	LblDirection = "direction"
+)
+
 var (
 	InboundBytesCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -37,4 +42,20 @@ var (
 			Name:      "outbound_packets",
 			Help:      "Counter of packets to backends.",
 		}, []string{LblBackend})
+
+	UncompressedBytesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: ModuleProxy,
+			Subsystem: LabelTraffic,
+			Name:      "uncompressed_bytes",
+			Help:      "Counter of bytes before compression or after decompression in the compressed protocol.",
+		}, []string{LblAlgorithm, LblDirection})
+
+	CompressedBytesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: ModuleProxy,
+			Subsystem: LabelTraffic,
+			Name:      "compressed_bytes",
+			Help:      "Counter of bytes transferred in the compressed protocol, including the compressed headers.",
+		}, []string{LblAlgorithm, LblDirection})
 )
@@ -0,0 +1,116 @@
+// Copyright 2024 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package authwebhook
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/pingcap/tiproxy/lib/util/errors"
+	"github.com/pingcap/tiproxy/pkg/proxy/backend"
+	pnet "github.com/pingcap/tiproxy/pkg/proxy/net"
+	"github.com/pingcap/tiproxy/pkg/proxy/proxyprotocol"
+	"go.uber.org/zap"
+)
+
+var _ backend.HandshakeHandler = (*HandshakeHandler)(nil)
+
+// HandshakeHandler asks the webhook to authorize the client after the wrapped handler accepts the handshake response.
+// The other hooks are delegated to the wrapped handler.
+type HandshakeHandler struct {
+	backend.HandshakeHandler
+	webhook *Webhook
+}
+
+func NewHandshakeHandler(handler backend.HandshakeHandler, webhook *Webhook) *HandshakeHandler {
+	return &HandshakeHandler{
+		HandshakeHandler: handler,
+		webhook:          webhook,
+	}
+}
+
+func (h *HandshakeHandler) HandleHandshakeResp(ctx backend.ConnContext, resp *pnet.HandshakeResp) error {
+	if err := h.HandshakeHandler.HandleHandshakeResp(ctx, resp); err != nil {
+		return err
+	}
+	decision, err := h.webhook.Authorize(ctx.Context(), newRequest(ctx, resp))
+	if err != nil {
+		if h.webhook.failOpen {
+			h.webhook.logger.Warn("auth webhook fails, allow the client", zap.String("user", resp.User),
+				zap.String("client_addr", ctx.ClientAddr()), zap.Error(err))
+			return nil
+		}
+		h.webhook.logger.Warn("auth webhook fails, reject the client", zap.String("user", resp.User),
+			zap.String("client_addr", ctx.ClientAddr()), zap.Error(err))
+		return errors.Wrap(ErrUnavailable, mysql.NewError(mysql.ER_ACCESS_DENIED_ERROR, "Access denied because the auth webhook is unavailable"))
+	}
+	if !decision.Allow {
+		if len(decision.Message) > 0 {
+			return mysql.NewError(mysql.ER_ACCESS_DENIED_ERROR, decision.Message)
+		}
+		usingPassword := "NO"
+		if len(resp.AuthData) > 0 {
+			usingPassword = "YES"
+		}
+		return mysql.NewDefaultError(mysql.ER_ACCESS_DENIED_ERROR, resp.User, clientHost(ctx.ClientAddr()), usingPassword)
+	}
+	// The webhook only authorizes the user in the handshake response.
+	ctx.SetValue(backend.ConnContextKeyDenyChangeUser, true)
+	if len(decision.Namespace) > 0 {
+		ctx.SetValue(backend.ConnContextKeyNamespaceName, decision.Namespace)
+	}
+	if len(decision.initSQL) > 0 {
+		ctx.SetValue(backend.ConnContextKeyInitSQL, decision.initSQL)
+	}
+	return nil
+}
+
+func newRequest(ctx backend.ConnContext, resp *pnet.HandshakeResp) *Request {
+	req := &Request{
+		User:       resp.User,
+		DB:         resp.DB,
+		ClientAddr: ctx.ClientAddr(),
+		Attrs:      resp.Attrs,
+	}
+	req.ListenerAddr, _ = ctx.Value(backend.ConnContextKeyConnAddr).(string)
+	if state, ok := ctx.Value(backend.ConnContextKeyTLSState).(tls.ConnectionState); ok {
+		req.TLS = newTLSInfo(&state)
+	}
+	tlvs, _ := ctx.Value(backend.ConnContextKeyProxyTLV).([]proxyprotocol.ProxyTlv)
+	for _, tlv := range tlvs {
+		req.ProxyTLVs = append(req.ProxyTLVs, ProxyTLV{Type: int(tlv.Typ), Value: tlv.Content})
+	}
+	return req
+}
+
+func newTLSInfo(state *tls.ConnectionState) *TLSInfo {
+	info := &TLSInfo{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ServerName:  state.ServerName,
+	}
+	if len(state.PeerCertificates) == 0 {
+		return info
+	}
+	cert := state.PeerCertificates[0]
+	info.Subject = cert.Subject.String()
+	info.Issuer = cert.Issuer.String()
+	info.DNSNames = cert.DNSNames
+	info.Emails = cert.EmailAddresses
+	for _, uri := range cert.URIs {
+		info.URIs = append(info.URIs, uri.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		info.IPs = append(info.IPs, ip.String())
+	}
+	return info
+}
+
+func clientHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
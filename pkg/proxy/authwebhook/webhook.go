@@ -0,0 +1,282 @@
+// Copyright 2024 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package authwebhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingcap/tiproxy/lib/config"
+	"github.com/pingcap/tiproxy/lib/util/errors"
+	"github.com/pingcap/tiproxy/lib/util/security"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultTimeout = 3 * time.Second
+	// maxCacheSize limits the memory of the cache in case there are too many distinct clients.
+	maxCacheSize = 10000
+	// maxRespSize limits the size of the response body.
+	maxRespSize = 1 << 20
+)
+
+var (
+	ErrUnavailable     = errors.New("the auth webhook is unavailable")
+	ErrInvalidDecision = errors.New("invalid decision from the auth webhook")
+
+	sessionVarNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+)
+
+// Request is the JSON body posted to the webhook.
+type Request struct {
+	User string `json:"user"`
+	DB   string `json:"db,omitempty"`
+	// ClientAddr is the address of the client, which is the source address in the PROXY header if it's enabled.
+	ClientAddr string `json:"client_addr"`
+	// ListenerAddr is the address of the listener that accepts the client.
+	ListenerAddr string            `json:"listener_addr,omitempty"`
+	Attrs        map[string]string `json:"attrs,omitempty"`
+	TLS          *TLSInfo          `json:"tls,omitempty"`
+	ProxyTLVs    []ProxyTLV        `json:"proxy_tlvs,omitempty"`
+}
+
+// TLSInfo describes the TLS connection and the identity in the client certificate.
+type TLSInfo struct {
+	Version     string   `json:"version"`
+	CipherSuite string   `json:"cipher_suite"`
+	ServerName  string   `json:"server_name,omitempty"`
+	Subject     string   `json:"subject,omitempty"`
+	Issuer      string   `json:"issuer,omitempty"`
+	DNSNames    []string `json:"dns_names,omitempty"`
+	Emails      []string `json:"emails,omitempty"`
+	URIs        []string `json:"uris,omitempty"`
+	IPs         []string `json:"ips,omitempty"`
+}
+
+// ProxyTLV is a TLV in the PROXY protocol header. The value is encoded in base64.
+type ProxyTLV struct {
+	Type  int    `json:"type"`
+	Value []byte `json:"value"`
+}
+
+// Decision is the JSON body responded by the webhook.
+type Decision struct {
+	Allow bool `json:"allow"`
+	// Message is sent to the client if the client is denied.
+	Message string `json:"message,omitempty"`
+	// Namespace routes the client to the backends of the namespace.
+	Namespace string `json:"namespace,omitempty"`
+	// SessionVars are set on the backend session after the client is authenticated.
+	// The values can be strings, numbers, or booleans.
+	SessionVars map[string]any `json:"session_vars,omitempty"`
+	// initSQL is built from SessionVars.
+	initSQL string
+}
+
+type cacheEntry struct {
+	decision *Decision
+	expire   time.Time
+}
+
+// Webhook posts the handshake information to an external HTTP(S) service to authorize the clients.
+type Webhook struct {
+	sync.Mutex
+	logger   *zap.Logger
+	client   *http.Client
+	url      string
+	timeout  time.Duration
+	ttl      time.Duration
+	failOpen bool
+	cache    map[[sha256.Size]byte]cacheEntry
+}
+
+func NewWebhook(logger *zap.Logger, cfg config.AuthWebhook) (*Webhook, error) {
+	tlsConfig, err := security.BuildClientTLSConfig(logger, cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	timeout := defaultTimeout
+	if cfg.TimeoutMs > 0 {
+		timeout = time.Duration(cfg.TimeoutMs) * time.Millisecond
+	}
+	return &Webhook{
+		logger: logger,
+		client: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: tlsConfig,
+			},
+		},
+		url:      cfg.URL,
+		timeout:  timeout,
+		ttl:      time.Duration(cfg.CacheTTLMs) * time.Millisecond,
+		failOpen: cfg.FailOpen,
+		cache:    make(map[[sha256.Size]byte]cacheEntry),
+	}, nil
+}
+
+// Authorize returns the decision of the client. The decision may come from the cache.
+func (w *Webhook) Authorize(ctx context.Context, req *Request) (*Decision, error) {
+	key := cacheKey(req)
+	if decision := w.getCache(key); decision != nil {
+		return decision, nil
+	}
+	decision, err := w.post(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	w.setCache(key, decision)
+	return decision, nil
+}
+
+func (w *Webhook) post(ctx context.Context, req *Request) (*Decision, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(httpReq)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected http status %d", resp.StatusCode)
+	}
+	decoder := json.NewDecoder(io.LimitReader(resp.Body, maxRespSize))
+	decoder.UseNumber()
+	var decision Decision
+	if err := decoder.Decode(&decision); err != nil {
+		return nil, errors.Wrap(ErrInvalidDecision, err)
+	}
+	if decision.initSQL, err = buildInitSQL(decision.SessionVars); err != nil {
+		return nil, err
+	}
+	return &decision, nil
+}
+
+func (w *Webhook) getCache(key [sha256.Size]byte) *Decision {
+	if w.ttl <= 0 {
+		return nil
+	}
+	w.Lock()
+	defer w.Unlock()
+	entry, ok := w.cache[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expire) {
+		delete(w.cache, key)
+		return nil
+	}
+	return entry.decision
+}
+
+func (w *Webhook) setCache(key [sha256.Size]byte, decision *Decision) {
+	if w.ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	w.Lock()
+	defer w.Unlock()
+	if len(w.cache) >= maxCacheSize {
+		for k, entry := range w.cache {
+			if now.After(entry.expire) {
+				delete(w.cache, k)
+			}
+		}
+		if len(w.cache) >= maxCacheSize {
+			w.cache = make(map[[sha256.Size]byte]cacheEntry)
+		}
+	}
+	w.cache[key] = cacheEntry{decision: decision, expire: now.Add(w.ttl)}
+}
+
+// cacheKey identifies the clients that share the same decision.
+// Connection attributes and client ports are excluded because they usually differ between connections.
+func cacheKey(req *Request) [sha256.Size]byte {
+	var b strings.Builder
+	write := func(s string) {
+		b.WriteString(strconv.Itoa(len(s)))
+		b.WriteByte(':')
+		b.WriteString(s)
+	}
+	write(req.User)
+	write(req.DB)
+	write(clientHost(req.ClientAddr))
+	write(req.ListenerAddr)
+	if req.TLS != nil {
+		write(req.TLS.Subject)
+		write(req.TLS.Issuer)
+	}
+	for _, tlv := range req.ProxyTLVs {
+		write(strconv.Itoa(tlv.Type))
+		write(string(tlv.Value))
+	}
+	return sha256.Sum256([]byte(b.String()))
+}
+
+// buildInitSQL builds the statement that sets the session variables.
+func buildInitSQL(vars map[string]any) (string, error) {
+	if len(vars) == 0 {
+		return "", nil
+	}
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		if !sessionVarNameRegex.MatchString(name) {
+			return "", errors.Wrapf(ErrInvalidDecision, "invalid session variable name %s", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString("SET ")
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString("SESSION `")
+		b.WriteString(name)
+		b.WriteString("` = ")
+		switch v := vars[name].(type) {
+		case string:
+			// A hex literal needs no escaping, so it's safe even if NO_BACKSLASH_ESCAPES is set.
+			b.WriteString("X'")
+			b.WriteString(hex.EncodeToString([]byte(v)))
+			b.WriteString("'")
+		case json.Number:
+			if _, err := strconv.ParseFloat(v.String(), 64); err != nil {
+				return "", errors.Wrapf(ErrInvalidDecision, "invalid value of session variable %s", name)
+			}
+			b.WriteString(v.String())
+		case bool:
+			if v {
+				b.WriteString("ON")
+			} else {
+				b.WriteString("OFF")
+			}
+		default:
+			return "", errors.Wrapf(ErrInvalidDecision, "invalid value of session variable %s", name)
+		}
+	}
+	return b.String(), nil
+}
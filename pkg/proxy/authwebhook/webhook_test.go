@@ -0,0 +1,186 @@
+// Copyright 2024 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package authwebhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/pingcap/tiproxy/lib/config"
+	"github.com/pingcap/tiproxy/lib/util/errors"
+	"github.com/pingcap/tiproxy/lib/util/logger"
+	"github.com/pingcap/tiproxy/pkg/proxy/backend"
+	pnet "github.com/pingcap/tiproxy/pkg/proxy/net"
+	"github.com/pingcap/tiproxy/pkg/proxy/proxyprotocol"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type mockConnContext struct {
+	ctx    context.Context
+	values map[any]any
+}
+
+func newMockConnContext() *mockConnContext {
+	return &mockConnContext{ctx: context.Background(), values: make(map[any]any)}
+}
+
+func (cc *mockConnContext) Context() context.Context      { return cc.ctx }
+func (cc *mockConnContext) ClientAddr() string            { return "10.0.0.1:34567" }
+func (cc *mockConnContext) ServerAddr() string            { return "" }
+func (cc *mockConnContext) ClientInBytes() uint64         { return 0 }
+func (cc *mockConnContext) ClientOutBytes() uint64        { return 0 }
+func (cc *mockConnContext) UpdateLogger(...zap.Field)     {}
+func (cc *mockConnContext) SetValue(key, val any)         { cc.values[key] = val }
+func (cc *mockConnContext) Value(key any) any             { return cc.values[key] }
+func (cc *mockConnContext) valueString(key any) string    { s, _ := cc.values[key].(string); return s }
+func (cc *mockConnContext) hasValue(key any) (found bool) { _, found = cc.values[key]; return }
+
+func newTestHandler(t *testing.T, cfg config.AuthWebhook, handle func(req *Request) (int, string)) (*HandshakeHandler, *atomic.Int32) {
+	var count atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count.Add(1)
+		var req Request
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		code, body := handle(&req)
+		w.WriteHeader(code)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	cfg.URL = server.URL
+	lg, _ := logger.CreateLoggerForTest(t)
+	webhook, err := NewWebhook(lg, cfg)
+	require.NoError(t, err)
+	return NewHandshakeHandler(backend.NewDefaultHandshakeHandler(nil), webhook), &count
+}
+
+func TestDecision(t *testing.T) {
+	handler, _ := newTestHandler(t, config.AuthWebhook{}, func(req *Request) (int, string) {
+		switch req.User {
+		case "allow":
+			return http.StatusOK, `{"allow": true, "namespace": "tenant1", "session_vars": {"sql_mode": "ANSI", "tidb_mem_quota_query": 1024, "autocommit": false, "tidb_session_alias": "a'b\\c"}}`
+		case "deny_msg":
+			return http.StatusOK, `{"allow": false, "message": "tenant is suspended"}`
+		default:
+			return http.StatusOK, `{"allow": false}`
+		}
+	})
+
+	cctx := newMockConnContext()
+	require.NoError(t, handler.HandleHandshakeResp(cctx, &pnet.HandshakeResp{User: "allow"}))
+	require.Equal(t, "tenant1", cctx.valueString(backend.ConnContextKeyNamespaceName))
+	require.Equal(t, "SET SESSION `autocommit` = OFF, SESSION `sql_mode` = X'414e5349', SESSION `tidb_mem_quota_query` = 1024, SESSION `tidb_session_alias` = X'6127625c63'",
+		cctx.valueString(backend.ConnContextKeyInitSQL))
+	require.True(t, cctx.hasValue(backend.ConnContextKeyDenyChangeUser))
+
+	cctx = newMockConnContext()
+	err := handler.HandleHandshakeResp(cctx, &pnet.HandshakeResp{User: "deny_msg"})
+	var myErr *mysql.MyError
+	require.True(t, errors.As(err, &myErr))
+	require.Equal(t, uint16(mysql.ER_ACCESS_DENIED_ERROR), myErr.Code)
+	require.Equal(t, "tenant is suspended", myErr.Message)
+	require.False(t, cctx.hasValue(backend.ConnContextKeyNamespaceName))
+
+	err = handler.HandleHandshakeResp(newMockConnContext(), &pnet.HandshakeResp{User: "deny", AuthData: []byte("123")})
+	require.True(t, errors.As(err, &myErr))
+	require.Equal(t, "Access denied for user 'deny'@'10.0.0.1' (using password: YES)", myErr.Message)
+}
+
+func TestRequest(t *testing.T) {
+	var received *Request
+	handler, _ := newTestHandler(t, config.AuthWebhook{}, func(req *Request) (int, string) {
+		received = req
+		return http.StatusOK, `{"allow": true}`
+	})
+	cctx := newMockConnContext()
+	cctx.SetValue(backend.ConnContextKeyConnAddr, "0.0.0.0:6000")
+	cctx.SetValue(backend.ConnContextKeyProxyTLV, []proxyprotocol.ProxyTlv{{Typ: proxyprotocol.ProxyTlvUniqueID, Content: []byte("abc")}})
+	resp := &pnet.HandshakeResp{User: "u1", DB: "db1", Attrs: map[string]string{"_client_name": "libmysql"}}
+	require.NoError(t, handler.HandleHandshakeResp(cctx, resp))
+	require.Equal(t, &Request{
+		User:         "u1",
+		DB:           "db1",
+		ClientAddr:   "10.0.0.1:34567",
+		ListenerAddr: "0.0.0.0:6000",
+		Attrs:        map[string]string{"_client_name": "libmysql"},
+		ProxyTLVs:    []ProxyTLV{{Type: int(proxyprotocol.ProxyTlvUniqueID), Value: []byte("abc")}},
+	}, received)
+	require.False(t, cctx.hasValue(backend.ConnContextKeyNamespaceName))
+	require.False(t, cctx.hasValue(backend.ConnContextKeyInitSQL))
+}
+
+func TestCache(t *testing.T) {
+	handler, count := newTestHandler(t, config.AuthWebhook{CacheTTLMs: 300}, func(req *Request) (int, string) {
+		return http.StatusOK, `{"allow": true, "namespace": "tenant1"}`
+	})
+	for i := 0; i < 3; i++ {
+		require.NoError(t, handler.HandleHandshakeResp(newMockConnContext(), &pnet.HandshakeResp{User: "u1"}))
+	}
+	require.EqualValues(t, 1, count.Load())
+	require.NoError(t, handler.HandleHandshakeResp(newMockConnContext(), &pnet.HandshakeResp{User: "u2"}))
+	require.EqualValues(t, 2, count.Load())
+	require.Eventually(t, func() bool {
+		require.NoError(t, handler.HandleHandshakeResp(newMockConnContext(), &pnet.HandshakeResp{User: "u1"}))
+		return count.Load() > 2
+	}, 3*time.Second, 100*time.Millisecond)
+}
+
+func TestFailOpen(t *testing.T) {
+	responses := []struct {
+		code int
+		body string
+	}{
+		{http.StatusInternalServerError, ""},
+		{http.StatusOK, "not json"},
+		{http.StatusOK, `{"allow": true, "session_vars": {"a=1;drop table t": 1}}`},
+		{http.StatusOK, `{"allow": true, "session_vars": {"a": [1]}}`},
+	}
+	for i, resp := range responses {
+		for _, failOpen := range []bool{true, false} {
+			handler, _ := newTestHandler(t, config.AuthWebhook{FailOpen: failOpen}, func(req *Request) (int, string) {
+				return resp.code, resp.body
+			})
+			cctx := newMockConnContext()
+			err := handler.HandleHandshakeResp(cctx, &pnet.HandshakeResp{User: "u1"})
+			if failOpen {
+				require.NoError(t, err, "case %d", i)
+			} else {
+				require.ErrorIs(t, err, ErrUnavailable, "case %d", i)
+				// The client receives an access denied error.
+				var myErr *mysql.MyError
+				require.True(t, errors.As(err, &myErr), "case %d", i)
+				require.Equal(t, uint16(mysql.ER_ACCESS_DENIED_ERROR), myErr.Code, "case %d", i)
+			}
+			require.False(t, cctx.hasValue(backend.ConnContextKeyInitSQL), "case %d", i)
+		}
+	}
+
+	// The webhook times out.
+	handler, _ := newTestHandler(t, config.AuthWebhook{TimeoutMs: 100}, func(req *Request) (int, string) {
+		time.Sleep(time.Second)
+		return http.StatusOK, `{"allow": true}`
+	})
+	require.ErrorIs(t, handler.HandleHandshakeResp(newMockConnContext(), &pnet.HandshakeResp{User: "u1"}), ErrUnavailable)
+
+	// The connection is closed during the handshake.
+	cctx := newMockConnContext()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cctx.ctx = ctx
+	require.ErrorIs(t, handler.HandleHandshakeResp(cctx, &pnet.HandshakeResp{User: "u1"}), ErrUnavailable)
+}
+
+func TestWebhookUnreachable(t *testing.T) {
+	lg, _ := logger.CreateLoggerForTest(t)
+	webhook, err := NewWebhook(lg, config.AuthWebhook{URL: "http://127.0.0.1:1", TimeoutMs: 100})
+	require.NoError(t, err)
+	_, err = webhook.Authorize(context.Background(), &Request{User: "u1"})
+	require.Error(t, err)
+}
@@ -6,14 +6,21 @@ package backend
 import (
 	"bytes"
 	"context"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
 	"encoding/binary"
+	"hash"
 	"net"
 	"strings"
 
 	"github.com/go-mysql-org/go-mysql/mysql"
 	"github.com/pingcap/tidb/util/hack"
+	"github.com/pingcap/tiproxy/lib/config"
 	"github.com/pingcap/tiproxy/lib/util/errors"
+	"github.com/pingcap/tiproxy/lib/util/security"
 	pnet "github.com/pingcap/tiproxy/pkg/proxy/net"
 	"github.com/pingcap/tiproxy/pkg/proxy/proxyprotocol"
 	"go.uber.org/zap"
@@ -27,11 +34,41 @@ const ER_INVALID_SEQUENCE = 8052
 // SupportedServerCapabilities is the default supported capabilities. Other server capabilities are not supported.
 // TiDB supports ClientDeprecateEOF since v6.3.0.
 // TiDB supports ClientCompress and ClientZstdCompressionAlgorithm since v7.2.0.
+// ClientQueryAttributes is stripped from the requests if the backend doesn't support it.
+// ClientSessionTrack is requested from the backends that support it, and the session state changes are only relayed to
+// the clients that negotiate it.
 const SupportedServerCapabilities = pnet.ClientLongPassword | pnet.ClientFoundRows | pnet.ClientConnectWithDB |
 	pnet.ClientODBC | pnet.ClientLocalFiles | pnet.ClientInteractive | pnet.ClientLongFlag | pnet.ClientSSL |
 	pnet.ClientTransactions | pnet.ClientReserved | pnet.ClientSecureConnection | pnet.ClientMultiStatements |
 	pnet.ClientMultiResults | pnet.ClientPluginAuth | pnet.ClientConnectAttrs | pnet.ClientPluginAuthLenencClientData |
-	pnet.ClientCompress | pnet.ClientZstdCompressionAlgorithm | requiredFrontendCaps | defRequiredBackendCaps
+	pnet.ClientCompress | pnet.ClientZstdCompressionAlgorithm | pnet.ClientSessionTrack | pnet.ClientQueryAttributes |
+	requiredFrontendCaps | defRequiredBackendCaps
+
+// clientOnlyCaps are negotiated between the proxy and the client, regardless of the backends.
+// The proxy handles TLS, compression and authentication with the client by itself, and strips query attributes for the backends.
+const clientOnlyCaps = requiredFrontendCaps | pnet.ClientSSL | pnet.ClientCompress | pnet.ClientZstdCompressionAlgorithm |
+	pnet.ClientSecureConnection | pnet.ClientPluginAuth | pnet.ClientPluginAuthLenencClientData | pnet.ClientConnectAttrs |
+	pnet.ClientQueryAttributes
+
+// sessionCaps are the capabilities that the session relies on once they're negotiated with the backend,
+// so the session can't migrate to a backend that doesn't support them.
+const sessionCaps = pnet.ClientDeprecateEOF | pnet.ClientSessionTrack | pnet.ClientCompress | pnet.ClientZstdCompressionAlgorithm |
+	pnet.ClientMultiStatements | pnet.ClientMultiResults | pnet.ClientPSMultiResults | pnet.ClientLocalFiles | pnet.ClientFoundRows
+
+// compressCaps are the capabilities of the compression algorithms.
+const compressCaps = pnet.ClientCompress | pnet.ClientZstdCompressionAlgorithm
+
+// defaultZstdLevel is the zstd level used by MySQL clients if it's not specified.
+const defaultZstdLevel = 3
+
+// negotiateCapability returns the capabilities advertised to the client, which excludes the ones that the backends don't support.
+// backendCapability is 0 if it's unknown.
+func negotiateCapability(proxyCapability, backendCapability pnet.Capability) pnet.Capability {
+	if backendCapability == 0 {
+		return proxyCapability
+	}
+	return proxyCapability & (backendCapability | clientOnlyCaps)
+}
 
 // Authenticator handshakes with the client and the backend.
 type Authenticator struct {
@@ -40,34 +77,123 @@ type Authenticator struct {
 	user              string
 	attrs             map[string]string
 	capability        pnet.Capability
+	backendCapability pnet.Capability // the capability negotiated with the backend
 	zstdLevel         int
 	collation         uint8
 	proxyProtocol     bool
+	proxyVersion      proxyprotocol.ProxyVersion
 	requireBackendTLS bool
+	// requireSecureTransport rejects the clients that don't enable TLS.
+	requireSecureTransport bool
+	// acceptProxyProtocol means the client address is known after reading the PROXY header.
+	acceptProxyProtocol bool
+	ipFilters           []*pnet.IPFilter
+	// rsaKey returns the RSA key pair to exchange caching_sha2_password passwords with the clients that don't enable TLS.
+	rsaKey func() *rsa.PrivateKey
+	// backendCompress and the levels are the compression requested from the backends.
+	// They follow the client unless the namespace sets the backend compression.
+	backendCompress  pnet.Capability
+	backendZlibLevel int
+	backendZstdLevel int
 }
 
 func NewAuthenticator(config *BCConfig) *Authenticator {
 	auth := &Authenticator{
-		proxyProtocol:     config.ProxyProtocol,
-		requireBackendTLS: config.RequireBackendTLS,
+		proxyProtocol:          config.ProxyProtocol,
+		proxyVersion:           config.ProxyVersion,
+		requireBackendTLS:      config.RequireBackendTLS,
+		requireSecureTransport: config.RequireSecureTransport,
+		acceptProxyProtocol:    config.AcceptProxyProtocol,
+		ipFilters:              config.IPFilters,
+		rsaKey:                 config.RSAKey,
+	}
+	if auth.proxyVersion != proxyprotocol.ProxyVersion1 {
+		auth.proxyVersion = proxyprotocol.ProxyVersion2
 	}
 	GenerateSalt(&auth.salt)
 	return auth
 }
 
 func (auth *Authenticator) writeProxyProtocol(clientIO, backendIO *pnet.PacketIO) error {
-	if auth.proxyProtocol {
-		proxy := clientIO.Proxy()
-		if proxy == nil {
-			proxy = &proxyprotocol.Proxy{
-				SrcAddress: clientIO.RemoteAddr(),
-				DstAddress: backendIO.RemoteAddr(),
-				Version:    proxyprotocol.ProxyVersion2,
-			}
+	if !auth.proxyProtocol {
+		return nil
+	}
+	// The connection is started by the proxy itself, such as the health check.
+	if clientIO == nil {
+		backendIO.EnableProxyClient(&proxyprotocol.Proxy{
+			SrcAddress: backendIO.LocalAddr(),
+			DstAddress: backendIO.RemoteAddr(),
+			Version:    auth.proxyVersion,
+			Command:    proxyprotocol.ProxyCommandLocal,
+		})
+		return nil
+	}
+	writeProxyHeader(auth.newProxyHeader(clientIO), backendIO)
+	return nil
+}
+
+// newProxyHeader builds the PROXY header sent to the backends on behalf of the client.
+// It returns nil if the PROXY protocol is disabled. The DstAddress is nil if it should be the backend address.
+func (auth *Authenticator) newProxyHeader(clientIO *pnet.PacketIO) *proxyprotocol.Proxy {
+	if !auth.proxyProtocol {
+		return nil
+	}
+	upstream := clientIO.Proxy()
+	var proxy *proxyprotocol.Proxy
+	// The upstream proxy may send a LOCAL or UNKNOWN header without addresses.
+	if upstream == nil || upstream.SrcAddress == nil {
+		proxy = &proxyprotocol.Proxy{
+			SrcAddress: clientIO.RemoteAddr(),
+		}
+		// The addresses must be in the same family. For Unix sockets, the destination is the socket the client connects to.
+		if localAddr, ok := clientIO.LocalAddr().(*net.UnixAddr); ok {
+			proxy.DstAddress = localAddr
+		}
+		// forward the TLVs from the upstream proxy
+		if upstream != nil {
+			proxy.TLV = upstream.TLV
 		}
-		// either from another proxy or directly from clients, we are acting as a proxy
-		proxy.Command = proxyprotocol.ProxyCommandProxy
-		backendIO.EnableProxyClient(proxy)
+	} else {
+		// The header of the client is shared by all the backend connections, so modify a copy.
+		copied := *upstream
+		proxy = &copied
+	}
+	// either from another proxy or directly from clients, we are acting as a proxy
+	proxy.Version = auth.proxyVersion
+	proxy.Command = proxyprotocol.ProxyCommandProxy
+	return proxy
+}
+
+// writeProxyHeader sends the PROXY header built by newProxyHeader to the backend.
+func writeProxyHeader(proxy *proxyprotocol.Proxy, backendIO *pnet.PacketIO) {
+	if proxy == nil {
+		return
+	}
+	copied := *proxy
+	if copied.DstAddress == nil {
+		copied.DstAddress = backendIO.RemoteAddr()
+	}
+	backendIO.EnableProxyClient(&copied)
+}
+
+// verifyMigrationCaps checks whether the new backend supports the capabilities that the session relies on.
+func (auth *Authenticator) verifyMigrationCaps(backendCapability pnet.Capability) error {
+	required := auth.backendCapability & sessionCaps
+	if auth.capability&pnet.ClientSessionTrack == 0 {
+		// The proxy requests it by itself, so the session doesn't rely on it.
+		required &^= pnet.ClientSessionTrack
+	}
+	if missing := required &^ backendCapability; missing != 0 {
+		return errors.Wrapf(ErrBackendCap, "the new backend doesn't support %s", missing)
+	}
+	return nil
+}
+
+// verifySessionCaps checks whether the first backend supports the capabilities negotiated with the client.
+// The proxy negotiates the compression with the backend by itself, so it's not required.
+func (auth *Authenticator) verifySessionCaps(backendCapability pnet.Capability) error {
+	if missing := auth.capability & sessionCaps &^ compressCaps &^ backendCapability; missing != 0 {
+		return errors.Wrapf(ErrBackendCap, "the backend doesn't support %s", missing)
 	}
 	return nil
 }
@@ -88,8 +214,11 @@ func (auth *Authenticator) verifyBackendCaps(logger *zap.Logger, backendCapabili
 
 type backendIOGetter func(ctx context.Context, cctx ConnContext, resp *pnet.HandshakeResp) (*pnet.PacketIO, error)
 
+// backendInitializer initializes the backend session after the backend accepts the client.
+type backendInitializer func(backendIO *pnet.PacketIO) error
+
 func (auth *Authenticator) handshakeFirstTime(ctx context.Context, logger *zap.Logger, cctx ConnContext, clientIO *pnet.PacketIO, handshakeHandler HandshakeHandler,
-	getBackendIO backendIOGetter, frontendTLSConfig, backendTLSConfig *tls.Config) error {
+	getBackendIO backendIOGetter, initBackend backendInitializer, frontendTLSConfig, backendTLSConfig *tls.Config) error {
 	clientIO.ResetSequence()
 
 	proxyCapability := handshakeHandler.GetCapability()
@@ -97,6 +226,12 @@ func (auth *Authenticator) handshakeFirstTime(ctx context.Context, logger *zap.L
 		proxyCapability ^= pnet.ClientSSL
 	}
 
+	// Reject the denied clients before the handshake if the client address is already known.
+	if !auth.acceptProxyProtocol {
+		if err := auth.checkClientAddr(logger, clientIO); err != nil {
+			return err
+		}
+	}
 	cid, _ := cctx.Value(ConnContextKeyConnID).(uint64)
 	if err := clientIO.WriteInitialHandshake(proxyCapability, auth.salt, pnet.AuthNativePassword, handshakeHandler.GetServerVersion(), cid); err != nil {
 		return err
@@ -122,6 +257,17 @@ func (auth *Authenticator) handshakeFirstTime(ctx context.Context, logger *zap.L
 			binary.LittleEndian.PutUint32(pkt, frontendCapability.Uint32())
 		}
 	}
+	// The PROXY header is read along with the first packet.
+	// Check the client address after the TLS handshake so that the client can read the error.
+	if auth.acceptProxyProtocol {
+		if err := auth.checkClientAddr(logger, clientIO); err != nil {
+			return err
+		}
+	}
+	if !isSSL && auth.requireSecureTransport {
+		logger.Warn("the listener requires secure transport but the client doesn't enable TLS")
+		return rejectInsecureTransport(clientIO, ErrClientNoTLS)
+	}
 	if commonCaps := frontendCapability & requiredFrontendCaps; commonCaps != requiredFrontendCaps {
 		logger.Error("require frontend capabilities", zap.Stringer("common", commonCaps), zap.Stringer("required", requiredFrontendCaps))
 		if writeErr := clientIO.WriteErrPacket(mysql.NewDefaultError(mysql.ER_NOT_SUPPORTED_AUTH_MODE)); writeErr != nil {
@@ -144,6 +290,15 @@ func (auth *Authenticator) handshakeFirstTime(ctx context.Context, logger *zap.L
 	if isSSL {
 		cctx.SetValue(ConnContextKeyTLSState, clientIO.TLSConnectionState())
 	}
+	// The proxy header has been read along with the first packet.
+	if proxy := clientIO.Proxy(); proxy != nil && len(proxy.TLV) > 0 {
+		cctx.SetValue(ConnContextKeyProxyTLV, proxy.TLV)
+		if uniqueID, ok := proxyprotocol.FindTLV(proxy.TLV, proxyprotocol.ProxyTlvUniqueID); ok {
+			field := zap.String("proxy_unique_id", string(uniqueID))
+			logger = logger.With(field)
+			cctx.UpdateLogger(field)
+		}
+	}
 	clientResp, err := pnet.ParseHandshakeResponse(pkt)
 	var warning *errors.Warning
 	if errors.As(err, &warning) {
@@ -152,6 +307,14 @@ func (auth *Authenticator) handshakeFirstTime(ctx context.Context, logger *zap.L
 		return err
 	}
 	if err = handshakeHandler.HandleHandshakeResp(cctx, clientResp); err != nil {
+		// The handler rejects the client with a MySQL error, e.g. access denied.
+		var myErr *mysql.MyError
+		if errors.As(err, &myErr) {
+			if writeErr := clientIO.WriteErrPacket(myErr); writeErr != nil {
+				return writeErr
+			}
+			return errors.Wrap(ErrClientAuthFail, err)
+		}
 		return errors.Wrap(ErrProxyErr, err)
 	}
 	auth.user = clientResp.User
@@ -159,12 +322,60 @@ func (auth *Authenticator) handshakeFirstTime(ctx context.Context, logger *zap.L
 	auth.collation = clientResp.Collation
 	auth.attrs = clientResp.Attrs
 	auth.zstdLevel = clientResp.ZstdLevel
+	auth.backendCompress, auth.backendZlibLevel, auth.backendZstdLevel = auth.capability&compressCaps, 0, auth.zstdLevel
+
+	localUser, localAuth, err := handshakeHandler.GetLocalUser(cctx, clientResp)
+	if err != nil {
+		if errors.Is(err, ErrClientNoTLS) {
+			logger.Warn("the namespace requires secure transport but the client doesn't enable TLS", zap.Error(err))
+			return rejectInsecureTransport(clientIO, err)
+		}
+		if errors.Is(err, ErrClientHostDenied) {
+			logger.Warn("the namespace doesn't allow the client address", zap.Error(err))
+			return rejectHost(clientIO, err)
+		}
+		return errors.Wrap(ErrProxyErr, err)
+	}
+	// The proxy authenticates the client by itself.
+	// If the account is mapped to a backend user, the client is verified before connecting to the backend.
+	// Otherwise, the client is verified with the auth switch request of the backend so that the client
+	// scrambles the password only once.
+	mapBackendUser := false
+	var pendingLocalUser *config.LocalUser
+	if localAuth {
+		switch {
+		case localUser == nil:
+			err := denyLocalAuth(clientIO, clientResp.User, clientResp.AuthData)
+			logger.Warn("authenticate the client with the local account failed", zap.Error(err))
+			return err
+		case len(localUser.BackendUser) > 0:
+			if err := auth.authenticateLocally(clientIO, clientResp, localUser); err != nil {
+				logger.Warn("authenticate the client with the local account failed", zap.Error(err))
+				return err
+			}
+			mapBackendUser = true
+			auth.user = localUser.BackendUser
+		default:
+			pendingLocalUser = localUser
+		}
+	}
+
+	auth.setBackendCompression(cctx)
+	auth.setLoadDataPolicy(cctx)
 
 RECONNECT:
 
 	// In case of testing, backendIO is passed manually that we don't want to bother with the routing logic.
 	backendIO, err := getBackendIO(ctx, cctx, clientResp)
 	if err != nil {
+		if errors.Is(err, ErrClientNoTLS) {
+			logger.Warn("the namespace requires secure transport but the client doesn't enable TLS", zap.Error(err))
+			return rejectInsecureTransport(clientIO, err)
+		}
+		if errors.Is(err, ErrClientHostDenied) {
+			logger.Warn("the namespace doesn't allow the client address", zap.Error(err))
+			return rejectHost(clientIO, err)
+		}
 		return err
 	}
 	backendIO.ResetSequence()
@@ -188,17 +399,24 @@ RECONNECT:
 	if err := auth.verifyBackendCaps(logger, backendCapability); err != nil {
 		return err
 	}
+	// The advertised capabilities exclude the ones unsupported by the backends in the health check,
+	// but the backend may be upgraded or the client may be routed to another namespace.
+	if err := auth.verifySessionCaps(backendCapability); err != nil {
+		logger.Warn("backend does not support capabilities negotiated with the client", zap.Error(err))
+		if writeErr := clientIO.WriteErrPacket(mysql.NewError(mysql.ER_UNKNOWN_ERROR, err.Error())); writeErr != nil {
+			return writeErr
+		}
+		return err
+	}
+	auth.backendCapability = auth.backendCaps() & backendCapability
 
-	if common := proxyCapability & backendCapability; (proxyCapability^common)&^pnet.ClientSSL != 0 {
-		// TODO: need to do negotiation with backend
-		// 1. proxyCapability &= backendCapability
-		// 2. binary.LittleEndian.PutUint32(backendHandshake, proxyCapability.Uint32())
-		//
-		// it should exchange caps with the backend
-		// but TiDB does not send all of its supported capabilities
-		// thus we must ignore server capabilities
-		// however, I will log something
-		logger.Debug("backend does not support capabilities from proxy", zap.Stringer("common", common), zap.Stringer("proxy", proxyCapability^common), zap.Stringer("backend", backendCapability^common))
+	// The client has been authenticated, so log in to the backend with the mapped service account.
+	if mapBackendUser {
+		capability, err := auth.loginWithPassword(backendIO, backendTLSConfig, serverPkt, backendCapability, localUser.BackendPassword)
+		if err != nil {
+			return err
+		}
+		return auth.finishHandshake(clientIO, backendIO, nil, capability, initBackend)
 	}
 
 	// forward client handshake resp
@@ -213,6 +431,7 @@ RECONNECT:
 
 	// forward other packets
 	pluginName := ""
+	var salt []byte
 	pktIdx := 0
 loop:
 	for {
@@ -221,6 +440,15 @@ loop:
 			return err
 		}
 		var packetErr *mysql.MyError
+		if serverPkt[0] == pnet.OKHeader.Byte() {
+			if pendingLocalUser != nil {
+				// The backend never asked for the password, so the client is not verified.
+				err := denyLocalAuth(clientIO, clientResp.User, clientResp.AuthData)
+				logger.Warn("the backend accepts the client without verifying the local account", zap.Error(err))
+				return err
+			}
+			return auth.finishHandshake(clientIO, backendIO, serverPkt, auth.backendCaps()&backendCapability, initBackend)
+		}
 		if serverPkt[0] == pnet.ErrHeader.Byte() {
 			packetErr = pnet.ParseErrorPacket(serverPkt)
 			if handshakeHandler.HandleHandshakeErr(cctx, packetErr) {
@@ -240,25 +468,35 @@ loop:
 		}
 
 		pktIdx++
-		switch serverPkt[0] {
-		case pnet.OKHeader.Byte():
-			if err := setCompress(clientIO, auth.capability, auth.zstdLevel); err != nil {
-				return errors.Wrap(ErrClientHandshake, err)
-			}
-			if err := setCompress(backendIO, auth.capability&backendCapability, auth.zstdLevel); err != nil {
-				return errors.Wrap(ErrBackendHandshake, err)
+		// The other packets are AuthSwitchRequest or AuthMoreData.
+		if serverPkt[0] == pnet.AuthSwitchHeader.Byte() {
+			pluginName, salt = parseAuthSwitchRequest(serverPkt)
+			if pendingLocalUser != nil {
+				if err := auth.verifyLocalSwitchResp(clientIO, backendIO, clientResp.User, pendingLocalUser, pluginName, salt); err != nil {
+					logger.Warn("authenticate the client with the local account failed", zap.Error(err))
+					return err
+				}
+				pendingLocalUser = nil
+				continue loop
 			}
-			return nil
-		default: // mysql.AuthSwitchRequest, ShaCommand
-			if serverPkt[0] == pnet.AuthSwitchHeader.Byte() {
-				pluginName = string(serverPkt[1 : bytes.IndexByte(serverPkt[1:], 0)+1])
-			} else if serverPkt[0] == 1 && pluginName == pnet.AuthCachingSha2Password && len(serverPkt) == 2 && serverPkt[1] == 3 {
+		} else if serverPkt[0] == pnet.ShaCommand && pluginName == pnet.AuthCachingSha2Password && len(serverPkt) == 2 {
+			switch serverPkt[1] {
+			case pnet.FastAuthOK:
 				// caching_sha2_password fast path
 				continue loop
+			case pnet.FastAuthFail:
+				// The client without TLS encrypts the password with the RSA public key of the proxy,
+				// so that the proxy can encrypt the password again for the backend.
+				if rsaKey := auth.getRSAKey(); rsaKey != nil && auth.capability&pnet.ClientSSL == 0 {
+					if err := forwardSha2Password(clientIO, backendIO, salt, rsaKey); err != nil {
+						return err
+					}
+					continue loop
+				}
 			}
-			if _, err = forwardMsg(clientIO, backendIO); err != nil {
-				return err
-			}
+		}
+		if _, err = forwardMsg(clientIO, backendIO); err != nil {
+			return err
 		}
 	}
 }
@@ -272,38 +510,241 @@ func forwardMsg(srcIO, destIO *pnet.PacketIO) (data []byte, err error) {
 	return
 }
 
-func (auth *Authenticator) handshakeSecondTime(logger *zap.Logger, clientIO, backendIO *pnet.PacketIO, backendTLSConfig *tls.Config, sessionToken string) error {
+// handshakeSecondTime returns the capability negotiated with the new backend.
+// The caller updates backendCapability after the session is migrated to the new backend successfully.
+func (auth *Authenticator) handshakeSecondTime(logger *zap.Logger, clientIO, backendIO *pnet.PacketIO, backendTLSConfig *tls.Config, sessionToken string) (pnet.Capability, error) {
 	if len(sessionToken) == 0 {
-		return errors.Wrapf(ErrBackendHandshake, "session token is empty")
+		return 0, errors.Wrapf(ErrBackendHandshake, "session token is empty")
 	}
-
-	// write proxy header
-	if err := auth.writeProxyProtocol(clientIO, backendIO); err != nil {
-		return err
+	backendCapability, enableTLS, err := auth.prepareSecondTime(logger, auth.newProxyHeader(clientIO), backendIO, backendTLSConfig)
+	if err != nil {
+		return 0, err
 	}
+	return auth.authSecondTime(backendIO, backendCapability, enableTLS, sessionToken)
+}
+
+// prepareSecondTime connects to the new backend until it expects the handshake response.
+// It doesn't need the session token, so it can be done before the session is ready for migration.
+// proxy is the PROXY header built by newProxyHeader, so that it doesn't read the client connection.
+func (auth *Authenticator) prepareSecondTime(logger *zap.Logger, proxy *proxyprotocol.Proxy, backendIO *pnet.PacketIO, backendTLSConfig *tls.Config) (pnet.Capability, bool, error) {
+	writeProxyHeader(proxy, backendIO)
 
 	_, backendCapability, err := auth.readInitialHandshake(backendIO)
 	if err != nil {
-		return err
+		return 0, false, err
 	}
 
 	if err := auth.verifyBackendCaps(logger, backendCapability); err != nil {
-		return err
+		return 0, false, err
 	}
 
-	if err = auth.writeAuthHandshake(
-		backendIO, backendTLSConfig, backendCapability,
+	enableTLS, err := auth.startTLS(backendIO, backendTLSConfig, backendCapability, pnet.ClientPluginAuth)
+	if err != nil {
+		return 0, false, err
+	}
+	return backendCapability, enableTLS, nil
+}
+
+// authSecondTime authenticates with the session token on the backend prepared by prepareSecondTime.
+func (auth *Authenticator) authSecondTime(backendIO *pnet.PacketIO, backendCapability pnet.Capability, enableTLS bool, sessionToken string) (pnet.Capability, error) {
+	if len(sessionToken) == 0 {
+		return 0, errors.Wrapf(ErrBackendHandshake, "session token is empty")
+	}
+	if err := auth.verifyMigrationCaps(backendCapability); err != nil {
+		return 0, err
+	}
+
+	if err := auth.writeHandshakeResp(
+		backendIO, backendCapability, enableTLS,
 		pnet.AuthTiDBSessionToken, hack.Slice(sessionToken), pnet.ClientPluginAuth,
 	); err != nil {
-		return err
+		return 0, err
+	}
+
+	err := auth.handleSecondAuthResult(backendIO)
+	if err == nil {
+		if err = setCompress(backendIO, auth.backendCaps()&backendCapability, auth.backendZlibLevel, auth.backendZstdLevel); err != nil {
+			return 0, errors.Wrap(ErrBackendHandshake, err)
+		}
+		return auth.backendCaps() & backendCapability, nil
+	}
+	return 0, errors.Wrap(ErrBackendHandshake, err)
+}
+
+// handshakeWithPassword logs in to the backend with the password. It's used by the proxy itself to connect to the backend,
+// such as the SQL-level health check, so the password must be known by the proxy.
+func (auth *Authenticator) handshakeWithPassword(logger *zap.Logger, backendIO *pnet.PacketIO, backendTLSConfig *tls.Config, password string) (pnet.Capability, error) {
+	if err := auth.writeProxyProtocol(nil, backendIO); err != nil {
+		return 0, err
+	}
+
+	serverPkt, backendCapability, err := auth.readInitialHandshake(backendIO)
+	if err != nil {
+		return 0, err
+	}
+	if err := auth.verifyBackendCaps(logger, backendCapability); err != nil {
+		return 0, err
+	}
+	return auth.loginWithPassword(backendIO, backendTLSConfig, serverPkt, backendCapability, password)
+}
+
+// loginWithPassword sends the handshake response with the password after reading the initial handshake from the backend.
+func (auth *Authenticator) loginWithPassword(backendIO *pnet.PacketIO, backendTLSConfig *tls.Config, serverPkt []byte,
+	backendCapability pnet.Capability, password string) (pnet.Capability, error) {
+	salt, authPlugin, err := pnet.ParseInitialHandshakeAuth(serverPkt)
+	if err != nil {
+		return 0, errors.Wrap(ErrBackendHandshake, err)
+	}
+	if authPlugin != pnet.AuthCachingSha2Password {
+		authPlugin = pnet.AuthNativePassword
+	}
+	if err := auth.writeAuthHandshake(
+		backendIO, backendTLSConfig, backendCapability,
+		authPlugin, scramblePassword(authPlugin, salt, password), pnet.ClientPluginAuth|pnet.ClientSecureConnection,
+	); err != nil {
+		return 0, err
+	}
+
+	for {
+		data, err := backendIO.ReadPacket()
+		if err != nil {
+			return 0, errors.Wrap(ErrBackendHandshake, err)
+		}
+		switch data[0] {
+		case pnet.OKHeader.Byte():
+			return auth.backendCaps() & backendCapability, nil
+		case pnet.ErrHeader.Byte():
+			return 0, errors.Wrap(ErrBackendHandshake, pnet.ParseErrorPacket(data))
+		case pnet.AuthSwitchHeader.Byte():
+			authPlugin, salt = parseAuthSwitchRequest(data)
+			if authPlugin != pnet.AuthNativePassword && authPlugin != pnet.AuthCachingSha2Password {
+				return 0, errors.Wrapf(ErrBackendHandshake, "unsupported auth plugin %s", authPlugin)
+			}
+			err = backendIO.WritePacket(scramblePassword(authPlugin, salt, password), true)
+		case pnet.ShaCommand:
+			if len(data) < 2 {
+				return 0, errors.Wrap(ErrBackendHandshake, mysql.ErrMalformPacket)
+			}
+			if data[1] != pnet.FastAuthFail {
+				// fast auth succeeds and an OK packet follows
+				continue
+			}
+			err = writeSha2Password(backendIO, salt, password)
+		default:
+			return 0, errors.Wrapf(mysql.ErrMalformPacket, "read unexpected command: %#x", data[0])
+		}
+		if err != nil {
+			return 0, errors.Wrap(ErrBackendHandshake, err)
+		}
+	}
+}
+
+// authenticateLocally verifies the password of the client with the account stored in the proxy.
+func (auth *Authenticator) authenticateLocally(clientIO *pnet.PacketIO, resp *pnet.HandshakeResp, user *config.LocalUser) error {
+	authData := resp.AuthData
+	authPlugin := localAuthPlugin(user)
+	// Ask the client to scramble the password with the auth plugin of the account.
+	if resp.AuthPlugin != authPlugin {
+		if err := clientIO.WriteSwitchRequest(authPlugin, auth.salt); err != nil {
+			return err
+		}
+		var err error
+		if authData, err = clientIO.ReadPacket(); err != nil {
+			return err
+		}
+	}
+	hash, err := user.AuthHash()
+	if err != nil {
+		return errors.Wrap(ErrProxyErr, err)
+	}
+	if !verifyScramble(authPlugin, auth.salt[:], authData, hash) {
+		return denyLocalAuth(clientIO, resp.User, authData)
 	}
+	// caching_sha2_password clients expect the result of the fast authentication before the OK packet.
+	if authPlugin == pnet.AuthCachingSha2Password && len(authData) > 0 {
+		if err := clientIO.WritePacket([]byte{pnet.ShaCommand, pnet.FastAuthOK}, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	if err = auth.handleSecondAuthResult(backendIO); err == nil {
-		if err = setCompress(backendIO, auth.capability&backendCapability, auth.zstdLevel); err != nil {
-			return errors.Wrap(ErrBackendHandshake, err)
+// finishHandshake initializes the backend session and then sends the OK packet to the client,
+// so that the client can't send any command before the session is initialized.
+// okPkt is the OK packet from the backend, or nil if the proxy logs in to the backend by itself.
+func (auth *Authenticator) finishHandshake(clientIO, backendIO *pnet.PacketIO, okPkt []byte, backendCapability pnet.Capability,
+	initBackend backendInitializer) error {
+	if err := setCompress(backendIO, backendCapability, auth.backendZlibLevel, auth.backendZstdLevel); err != nil {
+		return errors.Wrap(ErrBackendHandshake, err)
+	}
+	if initBackend != nil {
+		if err := initBackend(backendIO); err != nil {
+			return err
 		}
 	}
-	return errors.Wrap(ErrBackendHandshake, err)
+	var err error
+	if okPkt != nil {
+		if backendCapability&pnet.ClientSessionTrack > 0 && auth.capability&pnet.ClientSessionTrack == 0 {
+			if okPkt, err = pnet.RemoveSessionState(okPkt); err != nil {
+				return errors.Wrap(ErrBackendHandshake, err)
+			}
+		}
+		err = clientIO.WritePacket(okPkt, true)
+	} else {
+		err = clientIO.WriteOKPacket(mysql.SERVER_STATUS_AUTOCOMMIT, pnet.OKHeader)
+	}
+	if err != nil {
+		return err
+	}
+	if err := setCompress(clientIO, auth.capability, 0, auth.zstdLevel); err != nil {
+		return errors.Wrap(ErrClientHandshake, err)
+	}
+	return nil
+}
+
+// verifyLocalSwitchResp reads the response of the auth switch request that the backend sent to the client,
+// verifies it with the account stored in the proxy, and then forwards it to the backend.
+func (auth *Authenticator) verifyLocalSwitchResp(clientIO, backendIO *pnet.PacketIO, username string, user *config.LocalUser,
+	authPlugin string, salt []byte) error {
+	authData, err := clientIO.ReadPacket()
+	if err != nil {
+		return err
+	}
+	hash, err := user.AuthHash()
+	if err != nil {
+		return errors.Wrap(ErrProxyErr, err)
+	}
+	// The client scrambles the password with the plugin of the backend account, which can't be verified
+	// with a local account of another plugin.
+	if authPlugin != localAuthPlugin(user) || !verifyScramble(authPlugin, salt, authData, hash) {
+		return denyLocalAuth(clientIO, username, authData)
+	}
+	return backendIO.WritePacket(authData, true)
+}
+
+// localAuthPlugin returns the auth plugin of the local account.
+func localAuthPlugin(user *config.LocalUser) string {
+	if len(user.AuthPlugin) == 0 {
+		return pnet.AuthNativePassword
+	}
+	return user.AuthPlugin
+}
+
+// denyLocalAuth sends an access denied error to the client whose password doesn't match the local account.
+func denyLocalAuth(clientIO *pnet.PacketIO, username string, authData []byte) error {
+	host := "localhost"
+	if addr, ok := clientIO.RemoteAddr().(*net.TCPAddr); ok {
+		host = addr.IP.String()
+	}
+	usingPassword := "NO"
+	if len(authData) > 0 {
+		usingPassword = "YES"
+	}
+	packetErr := mysql.NewDefaultError(mysql.ER_ACCESS_DENIED_ERROR, username, host, usingPassword)
+	if err := clientIO.WriteErrPacket(packetErr); err != nil {
+		return err
+	}
+	return errors.Wrap(ErrClientAuthFail, packetErr)
 }
 
 func (auth *Authenticator) readInitialHandshake(backendIO *pnet.PacketIO) (serverPkt []byte, capability pnet.Capability, err error) {
@@ -327,59 +768,93 @@ func (auth *Authenticator) writeAuthHandshake(
 	authData []byte,
 	authCap pnet.Capability,
 ) error {
+	enableTLS, err := auth.startTLS(backendIO, backendTLSConfig, backendCapability, authCap)
+	if err != nil {
+		return err
+	}
+	return auth.writeHandshakeResp(backendIO, backendCapability, enableTLS, authPlugin, authData, authCap)
+}
+
+// startTLS sends the SSL request and upgrades the backend connection to TLS if TLS is enabled.
+func (auth *Authenticator) startTLS(backendIO *pnet.PacketIO, backendTLSConfig *tls.Config, backendCapability, authCap pnet.Capability) (bool, error) {
 	// Always handshake with SSL enabled and enable auth_plugin.
+	var enableTLS bool
+	if auth.requireBackendTLS {
+		if backendTLSConfig == nil {
+			return false, ErrProxyNoTLS
+		}
+		enableTLS = true
+	} else {
+		// When client TLS is disabled, also disables proxy TLS.
+		enableTLS = auth.capability&pnet.ClientSSL != 0 && backendCapability&pnet.ClientSSL != 0 && backendTLSConfig != nil
+	}
+	if !enableTLS {
+		return false, nil
+	}
+
+	// The SSL request is the first 32 bytes of the handshake response, which only contain the capability and collation.
+	// It doesn't read the other auth info because it may be called during the session.
+	pkt := pnet.MakeHandshakeResponse(&pnet.HandshakeResp{
+		Capability: auth.backendCaps()&backendCapability | authCap | pnet.ClientSSL,
+		Collation:  auth.collation,
+	})
+	// write SSL Packet
+	if err := backendIO.WritePacket(pkt[:32], true); err != nil {
+		return false, errors.Wrap(ErrBackendHandshake, err)
+	}
+	// Send TLS / SSL request packet. The server must have supported TLS.
+	tcfg := backendTLSConfig.Clone()
+	addr := backendIO.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err == nil {
+		tcfg.ServerName = host
+	}
+	if tcfg.ClientSessionCache != nil {
+		// The server name may be shared by the backends on the same host, so cache the sessions by address.
+		tcfg.ClientSessionCache = security.SessionCacheWithKey(tcfg.ClientSessionCache, addr)
+	}
+	if err := backendIO.ClientTLSHandshake(tcfg); err != nil {
+		// tiproxy pp enabled, tidb pp disabled, tls enabled => tls handshake encounters unrecognized packet
+		// tiproxy pp disabled, tidb pp enabled, tls enabled => tls handshake encounters unrecognized packet
+		return false, errors.Wrap(ErrBackendPPV2, err)
+	}
+	if tcfg.ClientSessionCache != nil {
+		addTLSSessionMetrics(addr, backendIO.TLSConnectionState().DidResume)
+	}
+	return true, nil
+}
+
+func (auth *Authenticator) writeHandshakeResp(
+	backendIO *pnet.PacketIO,
+	backendCapability pnet.Capability,
+	enableTLS bool,
+	authPlugin string,
+	authData []byte,
+	authCap pnet.Capability,
+) error {
 	resp := &pnet.HandshakeResp{
 		User:       auth.user,
 		DB:         auth.dbname,
 		Attrs:      auth.attrs,
 		Collation:  auth.collation,
 		AuthData:   authData,
-		Capability: auth.capability&backendCapability | authCap,
+		Capability: auth.backendCaps()&backendCapability | authCap,
 		AuthPlugin: authPlugin,
-		ZstdLevel:  auth.zstdLevel,
+		ZstdLevel:  auth.backendZstdLevel,
 	}
 
 	if len(resp.Attrs) > 0 {
 		resp.Capability |= pnet.ClientConnectAttrs
 	}
 
-	var pkt []byte
-	var enableTLS bool
-	if auth.requireBackendTLS {
-		if backendTLSConfig == nil {
-			return ErrProxyNoTLS
-		}
-		enableTLS = true
-	} else {
-		// When client TLS is disabled, also disables proxy TLS.
-		enableTLS = auth.capability&pnet.ClientSSL != 0 && backendCapability&pnet.ClientSSL != 0 && backendTLSConfig != nil
-	}
 	if enableTLS {
 		resp.Capability |= pnet.ClientSSL
-		pkt = pnet.MakeHandshakeResponse(resp)
-		// write SSL Packet
-		if err := backendIO.WritePacket(pkt[:32], true); err != nil {
-			return errors.Wrap(ErrBackendHandshake, err)
-		}
-		// Send TLS / SSL request packet. The server must have supported TLS.
-		tcfg := backendTLSConfig.Clone()
-		addr := backendIO.RemoteAddr().String()
-		host, _, err := net.SplitHostPort(addr)
-		if err == nil {
-			tcfg.ServerName = host
-		}
-		if err := backendIO.ClientTLSHandshake(tcfg); err != nil {
-			// tiproxy pp enabled, tidb pp disabled, tls enabled => tls handshake encounters unrecognized packet
-			// tiproxy pp disabled, tidb pp enabled, tls enabled => tls handshake encounters unrecognized packet
-			return errors.Wrap(ErrBackendPPV2, err)
-		}
 	} else {
 		resp.Capability &= ^pnet.ClientSSL
-		pkt = pnet.MakeHandshakeResponse(resp)
 	}
 
 	// write handshake resp
-	if err := backendIO.WritePacket(pkt, true); err != nil {
+	if err := backendIO.WritePacket(pnet.MakeHandshakeResponse(resp), true); err != nil {
 		return errors.Wrap(ErrBackendHandshake, err)
 	}
 	return nil
@@ -420,14 +895,102 @@ func (auth *Authenticator) ConnInfo() []zap.Field {
 	return fields
 }
 
-func setCompress(packetIO *pnet.PacketIO, capability pnet.Capability, zstdLevel int) error {
-	algorithm := pnet.CompressionNone
+// setBackendCompression overwrites the backend compression with the configuration of the namespace.
+func (auth *Authenticator) setBackendCompression(cctx ConnContext) {
+	bc, _ := cctx.Value(ConnContextKeyBackendCompression).(config.BackendCompression)
+	switch bc.Algorithm {
+	case config.CompressionZstd:
+		auth.backendCompress, auth.backendZstdLevel = pnet.ClientZstdCompressionAlgorithm, bc.Level
+		if bc.Level == 0 {
+			// The level is sent to the backend in the handshake response, so it must be valid.
+			auth.backendZstdLevel = defaultZstdLevel
+		}
+	case config.CompressionZlib:
+		auth.backendCompress, auth.backendZlibLevel = pnet.ClientCompress, bc.Level
+	case config.CompressionNone:
+		auth.backendCompress = 0
+	}
+}
+
+// setLoadDataPolicy clears CLIENT_LOCAL_FILES if the namespace disables `LOAD DATA LOCAL INFILE`, so that the backends refuse it.
+// The capability is cleared for the client in the initial handshake only if all the namespaces disable it.
+func (auth *Authenticator) setLoadDataPolicy(cctx ConnContext) {
+	if lp, _ := cctx.Value(ConnContextKeyLoadData).(config.LoadDataPolicy); lp.DisableLocal {
+		auth.capability &^= pnet.ClientLocalFiles
+	}
+}
+
+// backendCaps returns the capabilities requested from the backends, whose compression may differ from the client.
+// ClientSessionTrack is always requested so that the proxy can track the session state. The changes are removed from
+// the OK packets if the client doesn't negotiate it.
+func (auth *Authenticator) backendCaps() pnet.Capability {
+	return auth.capability&^compressCaps | auth.backendCompress | pnet.ClientSessionTrack
+}
+
+// setCompress enables the compression algorithm chosen by the capability. 0 levels mean the default levels.
+func setCompress(packetIO *pnet.PacketIO, capability pnet.Capability, zlibLevel, zstdLevel int) error {
+	algorithm, level := pnet.CompressionNone, 0
 	if capability&pnet.ClientCompress > 0 {
-		algorithm = pnet.CompressionZlib
+		algorithm, level = pnet.CompressionZlib, zlibLevel
 	} else if capability&pnet.ClientZstdCompressionAlgorithm > 0 {
-		algorithm = pnet.CompressionZstd
+		algorithm, level = pnet.CompressionZstd, zstdLevel
+	}
+	return packetIO.SetCompressionAlgorithm(algorithm, level)
+}
+
+// scramblePassword encrypts the password with the salt by the auth plugin.
+func scramblePassword(authPlugin string, salt []byte, password string) []byte {
+	if authPlugin == pnet.AuthCachingSha2Password {
+		return mysql.CalcCachingSha2Password(salt, password)
+	}
+	return mysql.CalcPassword(salt, []byte(password))
+}
+
+// verifyScramble verifies the auth data sent by the client with the password hash stored in the proxy.
+// The hash is SHA1(SHA1(password)) for mysql_native_password and SHA256(SHA256(password)) for caching_sha2_password.
+func verifyScramble(authPlugin string, salt, authData, authHash []byte) bool {
+	if len(authHash) == 0 {
+		return len(authData) == 0
+	}
+	var h hash.Hash
+	switch authPlugin {
+	case pnet.AuthCachingSha2Password:
+		// authData = SHA256(password) XOR SHA256(SHA256(SHA256(password)) + salt)
+		h = sha256.New()
+		h.Write(authHash)
+		h.Write(salt)
+	default:
+		// authData = SHA1(password) XOR SHA1(salt + SHA1(SHA1(password)))
+		h = sha1.New()
+		h.Write(salt)
+		h.Write(authHash)
+	}
+	mask := h.Sum(nil)
+	if len(authData) != len(mask) {
+		return false
+	}
+	for i := range mask {
+		mask[i] ^= authData[i]
+	}
+	h.Reset()
+	h.Write(mask)
+	return subtle.ConstantTimeCompare(h.Sum(nil), authHash) == 1
+}
+
+// parseAuthSwitchRequest parses the auth plugin and the salt in the auth switch request.
+func parseAuthSwitchRequest(data []byte) (authPlugin string, salt []byte) {
+	data = data[1:]
+	end := bytes.IndexByte(data, 0)
+	if end < 0 {
+		return string(data), nil
 	}
-	return packetIO.SetCompressionAlgorithm(algorithm, zstdLevel)
+	authPlugin = string(data[:end])
+	salt = data[end+1:]
+	// the salt ends with [00]
+	if len(salt) > 0 && salt[len(salt)-1] == 0 {
+		salt = salt[:len(salt)-1]
+	}
+	return
 }
 
 // handleHandshakeError tries to recognize the error and report more friendly messages.
@@ -449,3 +1012,35 @@ func handleHandshakeError(pktIdx int, packetErr *mysql.MyError) error {
 	}
 	return errors.Wrap(ErrClientAuthFail, packetErr)
 }
+
+// checkClientAddr rejects the client if any IP filter denies its address.
+func (auth *Authenticator) checkClientAddr(logger *zap.Logger, clientIO *pnet.PacketIO) error {
+	addr := clientIO.RemoteAddr().String()
+	for _, filter := range auth.ipFilters {
+		if !filter.Allow(addr) {
+			logger.Warn("the client address is denied")
+			return rejectHost(clientIO, errors.Wrapf(ErrClientHostDenied, "client %s", addr))
+		}
+	}
+	return nil
+}
+
+// rejectHost sends ER_HOST_NOT_PRIVILEGED to the client whose address is denied.
+func rejectHost(clientIO *pnet.PacketIO, err error) error {
+	host := clientIO.RemoteAddr().String()
+	if h, _, splitErr := net.SplitHostPort(host); splitErr == nil {
+		host = h
+	}
+	if writeErr := clientIO.WriteErrPacket(mysql.NewDefaultError(mysql.ER_HOST_NOT_PRIVILEGED, host)); writeErr != nil {
+		return writeErr
+	}
+	return errors.Wrap(ErrClientHandshake, err)
+}
+
+// rejectInsecureTransport sends ER_SECURE_TRANSPORT_REQUIRED to the client that doesn't enable TLS.
+func rejectInsecureTransport(clientIO *pnet.PacketIO, err error) error {
+	if writeErr := clientIO.WriteErrPacket(mysql.NewError(errCodeSecureTransportRequired, ErrClientNoTLS.Error())); writeErr != nil {
+		return writeErr
+	}
+	return errors.Wrap(ErrClientHandshake, err)
+}
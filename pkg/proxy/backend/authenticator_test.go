@@ -4,10 +4,23 @@
 package backend
 
 import (
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
 	"strings"
 	"testing"
 
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/pingcap/tiproxy/lib/config"
+	"github.com/pingcap/tiproxy/lib/util/logger"
+	"github.com/pingcap/tiproxy/lib/util/security"
+	"github.com/pingcap/tiproxy/lib/util/waitgroup"
 	pnet "github.com/pingcap/tiproxy/pkg/proxy/net"
+	"github.com/pingcap/tiproxy/pkg/proxy/proxyprotocol"
 	"github.com/stretchr/testify/require"
 )
 
@@ -61,6 +74,14 @@ func TestUnsupportedCapability(t *testing.T) {
 				cfg.clientConfig.capability |= pnet.ClientPSMultiResults
 			},
 		},
+		{
+			func(cfg *testConfig) {
+				cfg.backendConfig.capability &= ^pnet.ClientMultiStatements
+			},
+			func(cfg *testConfig) {
+				cfg.backendConfig.capability |= pnet.ClientMultiStatements
+			},
+		},
 	}
 
 	tc := newTCPConnSuite(t)
@@ -76,6 +97,10 @@ func TestUnsupportedCapability(t *testing.T) {
 				require.ErrorIs(t, ts.mp.err, ErrBackendCap)
 				require.Equal(t, ErrBackendCap, ErrToClient(ts.mp.err))
 				require.Equal(t, SrcBackendHandshake, Error2Source(ts.mp.err))
+			} else if ts.mc.clientConfig.capability&ts.mp.capability&sessionCaps&^compressCaps&^ts.mb.backendConfig.capability != 0 {
+				// The client negotiated the capabilities that the backend doesn't support.
+				require.ErrorIs(t, ts.mp.err, ErrBackendCap)
+				require.NotNil(t, ts.mc.mysqlErr)
 			} else {
 				require.NoError(t, ts.mc.err)
 				require.NoError(t, ts.mp.err)
@@ -295,6 +320,34 @@ func TestEnableTLS(t *testing.T) {
 	}
 }
 
+func TestRequireSecureTransport(t *testing.T) {
+	tc := newTCPConnSuite(t)
+	for _, enableTLS := range []bool{false, true} {
+		ts, clean := newTestSuite(t, tc, func(cfg *testConfig) {
+			cfg.proxyConfig.bcConfig.RequireSecureTransport = true
+			if enableTLS {
+				cfg.clientConfig.capability |= pnet.ClientSSL
+			} else {
+				cfg.clientConfig.capability &= ^pnet.ClientSSL
+			}
+		})
+		ts.authenticateFirstTime(t, func(t *testing.T, ts *testSuite) {
+			if enableTLS {
+				require.NoError(t, ts.mp.err)
+				require.True(t, ts.mc.authSucceed)
+				return
+			}
+			require.ErrorIs(t, ts.mp.err, ErrClientNoTLS)
+			require.Equal(t, SrcClientHandshake, Error2Source(ts.mp.err))
+			require.False(t, ts.mc.authSucceed)
+			var myErr *mysql.MyError
+			require.ErrorAs(t, ts.mc.mysqlErr, &myErr)
+			require.EqualValues(t, errCodeSecureTransportRequired, myErr.Code)
+		})
+		clean()
+	}
+}
+
 // Even if auth fails, the auth data should be passed so that `using password` in the error message is correct.
 func TestAuthFail(t *testing.T) {
 	cfgs := []cfgOverrider{
@@ -421,6 +474,229 @@ func TestProxyProtocol(t *testing.T) {
 	}
 }
 
+func TestProxyTLV(t *testing.T) {
+	tlvs := []proxyprotocol.ProxyTlv{
+		{Typ: proxyprotocol.ProxyTlvUniqueID, Content: []byte("unique-id")},
+		{Typ: proxyprotocol.ProxyTlvAWS, Content: append([]byte{proxyprotocol.ProxyTlvAWSVPCEndpointID}, "vpce-123"...)},
+	}
+	for _, command := range []proxyprotocol.ProxyCommand{proxyprotocol.ProxyCommandProxy, proxyprotocol.ProxyCommandLocal} {
+		tc := newTCPConnSuite(t)
+		ts, clean := newTestSuite(t, tc, func(cfg *testConfig) {
+			cfg.proxyConfig.bcConfig.ProxyProtocol = true
+			cfg.backendConfig.proxyProtocol = true
+			cfg.clientConfig.proxy = &proxyprotocol.Proxy{
+				Version:    proxyprotocol.ProxyVersion2,
+				Command:    command,
+				SrcAddress: &net.TCPAddr{IP: net.ParseIP("10.0.0.1").To4(), Port: 34},
+				DstAddress: &net.TCPAddr{IP: net.ParseIP("10.0.0.2").To4(), Port: 4000},
+				TLV:        tlvs,
+			}
+		})
+		tc.proxyCIO.ApplyOpts(pnet.WithProxy)
+		ts.authenticateFirstTime(t, func(t *testing.T, ts *testSuite) {
+			require.NoError(t, ts.mp.err)
+			require.Equal(t, tlvs, ts.mp.Value(ConnContextKeyProxyTLV))
+			// the TLVs are forwarded to the backend
+			proxy := tc.backendIO.Proxy()
+			require.NotNil(t, proxy)
+			require.Equal(t, tlvs, proxy.TLV)
+			require.Equal(t, proxyprotocol.ProxyCommandProxy, proxy.Command)
+			// the header of the client is not modified
+			require.Equal(t, command, tc.proxyCIO.Proxy().Command)
+		})
+		clean()
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	clientAddr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1").To4(), Port: 34}
+	// The client connects to the proxy through IPv4 or IPv6 loopback.
+	loopback := []string{"127.0.0.0/8", "::1"}
+	tests := []struct {
+		allow         []string
+		deny          []string
+		proxyProtocol bool
+		succeed       bool
+	}{
+		{nil, loopback, false, false},
+		{[]string{"10.0.0.0/8"}, nil, false, false},
+		{loopback, []string{"10.0.0.1"}, false, true},
+		{loopback, nil, true, false},
+		{[]string{"10.0.0.0/8"}, []string{"10.0.0.1"}, true, false},
+		{[]string{"10.0.0.0/8"}, loopback, true, true},
+	}
+	tc := newTCPConnSuite(t)
+	for i, test := range tests {
+		filter, err := pnet.NewIPFilter(test.allow, test.deny)
+		require.NoError(t, err)
+		ts, clean := newTestSuite(t, tc, func(cfg *testConfig) {
+			cfg.proxyConfig.bcConfig.IPFilters = []*pnet.IPFilter{nil, filter}
+			if test.proxyProtocol {
+				cfg.proxyConfig.bcConfig.AcceptProxyProtocol = true
+				cfg.clientConfig.proxy = &proxyprotocol.Proxy{
+					Version:    proxyprotocol.ProxyVersion2,
+					Command:    proxyprotocol.ProxyCommandProxy,
+					SrcAddress: clientAddr,
+					DstAddress: &net.TCPAddr{IP: net.ParseIP("10.0.0.2").To4(), Port: 4000},
+				}
+			}
+		})
+		if test.proxyProtocol {
+			tc.proxyCIO.ApplyOpts(pnet.WithProxy)
+		}
+		ts.authenticateFirstTime(t, func(t *testing.T, ts *testSuite) {
+			if test.succeed {
+				require.NoError(t, ts.mp.err, "case %d", i)
+				require.True(t, ts.mc.authSucceed, "case %d", i)
+				return
+			}
+			require.ErrorIs(t, ts.mp.err, ErrClientHostDenied, "case %d", i)
+			require.Equal(t, SrcClientHandshake, Error2Source(ts.mp.err), "case %d", i)
+			var myErr *mysql.MyError
+			require.ErrorAs(t, ts.mc.mysqlErr, &myErr, "case %d", i)
+			require.EqualValues(t, mysql.ER_HOST_NOT_PRIVILEGED, myErr.Code, "case %d", i)
+		})
+		clean()
+	}
+}
+
+func TestLocalAuth(t *testing.T) {
+	nativeHash := sha1.Sum([]byte("pwd"))
+	nativeHash = sha1.Sum(nativeHash[:])
+	sha2Hash := sha256.Sum256([]byte("pwd"))
+	sha2Hash = sha256.Sum256(sha2Hash[:])
+	nativeUser := &config.LocalUser{User: mockUsername, AuthString: "*" + strings.ToUpper(hex.EncodeToString(nativeHash[:]))}
+	sha2User := &config.LocalUser{User: mockUsername, AuthPlugin: pnet.AuthCachingSha2Password, AuthString: hex.EncodeToString(sha2Hash[:])}
+	mappedUser := &config.LocalUser{User: mockUsername, AuthString: nativeUser.AuthString, BackendUser: "svc", BackendPassword: "svc_pwd"}
+	mappedSha2User := &config.LocalUser{User: mockUsername, AuthPlugin: pnet.AuthCachingSha2Password, AuthString: sha2User.AuthString, BackendUser: "svc", BackendPassword: "svc_pwd"}
+	backendKey, err := security.GenerateRSAKey(1024)
+	require.NoError(t, err)
+
+	tests := []struct {
+		user          *config.LocalUser
+		authPlugin    string
+		backendPlugin string
+		password      string
+		succeed       bool
+		// the user that logs in to the backend
+		backendUser string
+		// the number of auth switch requests received by the client
+		switches int
+	}{
+		{nativeUser, pnet.AuthNativePassword, pnet.AuthNativePassword, "pwd", true, mockUsername, 1},
+		{nativeUser, pnet.AuthCachingSha2Password, pnet.AuthNativePassword, "pwd", true, mockUsername, 1},
+		{nativeUser, pnet.AuthNativePassword, pnet.AuthNativePassword, "wrong", false, mockUsername, 1},
+		{sha2User, pnet.AuthNativePassword, pnet.AuthCachingSha2Password, "pwd", true, mockUsername, 1},
+		{sha2User, pnet.AuthCachingSha2Password, pnet.AuthCachingSha2Password, "wrong", false, mockUsername, 1},
+		// the local account and the backend account use different plugins
+		{sha2User, pnet.AuthCachingSha2Password, pnet.AuthNativePassword, "pwd", false, mockUsername, 1},
+		{nil, pnet.AuthNativePassword, pnet.AuthNativePassword, "pwd", false, "", 0},
+		{mappedUser, pnet.AuthNativePassword, pnet.AuthNativePassword, "pwd", true, "svc", 0},
+		{mappedUser, pnet.AuthCachingSha2Password, pnet.AuthNativePassword, "pwd", true, "svc", 1},
+		{mappedUser, pnet.AuthNativePassword, pnet.AuthNativePassword, "wrong", false, "", 0},
+		// the client expects the fast auth result before the OK packet
+		{mappedSha2User, pnet.AuthCachingSha2Password, pnet.AuthNativePassword, "pwd", true, "svc", 0},
+		{mappedSha2User, pnet.AuthNativePassword, pnet.AuthNativePassword, "pwd", true, "svc", 1},
+		{mappedSha2User, pnet.AuthCachingSha2Password, pnet.AuthNativePassword, "wrong", false, "", 0},
+	}
+	tc := newTCPConnSuite(t)
+	for i, test := range tests {
+		ts, clean := newTestSuite(t, tc, func(cfg *testConfig) {
+			cfg.proxyConfig.handler.getLocalUser = func(ctx ConnContext, resp *pnet.HandshakeResp) (*config.LocalUser, bool, error) {
+				return test.user, true, nil
+			}
+			cfg.clientConfig.authPlugin = test.authPlugin
+			cfg.clientConfig.password = test.password
+			cfg.clientConfig.capability &= ^pnet.ClientSSL
+			cfg.backendConfig.authPlugin = test.backendPlugin
+			cfg.backendConfig.rsaKey = backendKey
+		})
+		ts.authenticateFirstTime(t, func(t *testing.T, ts *testSuite) {
+			require.Equal(t, test.succeed, ts.mc.authSucceed, "case %d", i)
+			require.Equal(t, test.switches, ts.mc.authSwitches, "case %d", i)
+			require.Equal(t, test.backendUser, ts.mb.username, "case %d", i)
+			if !test.succeed {
+				require.ErrorIs(t, ts.mp.err, ErrClientAuthFail, "case %d", i)
+				var myErr *mysql.MyError
+				require.ErrorAs(t, ts.mc.mysqlErr, &myErr, "case %d", i)
+				require.EqualValues(t, mysql.ER_ACCESS_DENIED_ERROR, myErr.Code, "case %d", i)
+				return
+			}
+			require.NoError(t, ts.mp.err, "case %d", i)
+			require.NoError(t, ts.mc.err, "case %d", i)
+			if test.user.BackendUser != "" {
+				require.Equal(t, scramblePassword(pnet.AuthNativePassword, mockSalt[:], test.user.BackendPassword), ts.mb.authData, "case %d", i)
+			}
+		})
+		clean()
+	}
+}
+
+func TestVerifyScramble(t *testing.T) {
+	salt := mockSalt[:]
+	nativeHash := sha1.Sum([]byte("pwd"))
+	nativeHash = sha1.Sum(nativeHash[:])
+	require.True(t, verifyScramble(pnet.AuthNativePassword, salt, scramblePassword(pnet.AuthNativePassword, salt, "pwd"), nativeHash[:]))
+	require.False(t, verifyScramble(pnet.AuthNativePassword, salt, scramblePassword(pnet.AuthNativePassword, salt, "pwd1"), nativeHash[:]))
+	require.False(t, verifyScramble(pnet.AuthNativePassword, salt, nil, nativeHash[:]))
+
+	sha2Hash := sha256.Sum256([]byte("pwd"))
+	sha2Hash = sha256.Sum256(sha2Hash[:])
+	require.True(t, verifyScramble(pnet.AuthCachingSha2Password, salt, scramblePassword(pnet.AuthCachingSha2Password, salt, "pwd"), sha2Hash[:]))
+	require.False(t, verifyScramble(pnet.AuthCachingSha2Password, salt, scramblePassword(pnet.AuthCachingSha2Password, salt, "pwd1"), sha2Hash[:]))
+
+	// empty password
+	require.True(t, verifyScramble(pnet.AuthNativePassword, salt, nil, nil))
+	require.False(t, verifyScramble(pnet.AuthNativePassword, salt, []byte("1"), nil))
+}
+
+func TestSha2FullAuth(t *testing.T) {
+	proxyKey, err := security.GenerateRSAKey(1024)
+	require.NoError(t, err)
+	backendKey, err := security.GenerateRSAKey(1024)
+	require.NoError(t, err)
+	tests := []struct {
+		clientTLS  bool
+		backendTLS bool
+		proxyKey   *rsa.PrivateKey
+		// the password received by the backend
+		password []byte
+	}{
+		// the proxy decrypts the password and encrypts it again with the backend key
+		{false, false, proxyKey, []byte("pwd")},
+		// the proxy decrypts the password and sends it over TLS
+		{false, true, proxyKey, []byte("pwd\x00")},
+		// the client gets the backend key
+		{false, false, nil, []byte("pwd")},
+		// the client sends the password over TLS
+		{true, true, proxyKey, []byte("pwd\x00")},
+	}
+	tc := newTCPConnSuite(t)
+	for i, test := range tests {
+		ts, clean := newTestSuite(t, tc, func(cfg *testConfig) {
+			cfg.clientConfig.password = "pwd"
+			if test.clientTLS {
+				cfg.clientConfig.capability |= pnet.ClientSSL
+			} else {
+				cfg.clientConfig.capability &= ^pnet.ClientSSL
+			}
+			cfg.proxyConfig.bcConfig.RequireBackendTLS = test.backendTLS
+			if test.proxyKey != nil {
+				cfg.proxyConfig.bcConfig.RSAKey = func() *rsa.PrivateKey {
+					return test.proxyKey
+				}
+			}
+			cfg.backendConfig.rsaKey = backendKey
+		})
+		ts.authenticateFirstTime(t, func(t *testing.T, ts *testSuite) {
+			require.NoError(t, ts.mp.err, "case %d", i)
+			require.True(t, ts.mc.authSucceed, "case %d", i)
+			require.Equal(t, test.password, ts.mb.authData, "case %d", i)
+		})
+		clean()
+	}
+}
+
 func TestCompressProtocol(t *testing.T) {
 	cfgs := [][]cfgOverrider{
 		{
@@ -504,6 +780,56 @@ func TestCompressProtocol(t *testing.T) {
 	}
 }
 
+// The compression between the proxy and the backend can be set by the namespace regardless of the client.
+func TestBackendCompression(t *testing.T) {
+	tests := []struct {
+		compression config.BackendCompression
+		clientCap   pnet.Capability
+		backendCap  pnet.Capability
+		zstdLevel   int
+	}{
+		{config.BackendCompression{}, pnet.ClientZstdCompressionAlgorithm, pnet.ClientZstdCompressionAlgorithm, 1},
+		{config.BackendCompression{}, 0, 0, 0},
+		{config.BackendCompression{Algorithm: config.CompressionZstd, Level: 9}, 0, pnet.ClientZstdCompressionAlgorithm, 9},
+		{config.BackendCompression{Algorithm: config.CompressionZstd}, pnet.ClientCompress, pnet.ClientZstdCompressionAlgorithm, defaultZstdLevel},
+		{config.BackendCompression{Algorithm: config.CompressionZlib, Level: 1}, pnet.ClientZstdCompressionAlgorithm, pnet.ClientCompress, 0},
+		{config.BackendCompression{Algorithm: config.CompressionNone}, pnet.ClientCompress, 0, 0},
+	}
+
+	tc := newTCPConnSuite(t)
+	for i, test := range tests {
+		ts, clean := newTestSuite(t, tc, func(cfg *testConfig) {
+			cfg.clientConfig.capability = cfg.clientConfig.capability&^compressCaps | test.clientCap
+			cfg.clientConfig.zstdLevel = 1
+			cfg.backendConfig.capability |= compressCaps
+			cfg.backendConfig.respondType = responseTypeResultSet
+			cfg.backendConfig.columns = 2
+			cfg.backendConfig.rows = 100
+		})
+		ts.mp.SetValue(ConnContextKeyBackendCompression, test.compression)
+		checker := func(t *testing.T, ts *testSuite) {
+			msg := fmt.Sprintf("case %d", i)
+			require.Equal(t, test.clientCap, ts.mc.capability&compressCaps, msg)
+			require.Equal(t, test.backendCap, ts.mb.capability&compressCaps, msg)
+			if test.backendCap&pnet.ClientZstdCompressionAlgorithm != 0 {
+				require.Equal(t, test.zstdLevel, ts.mb.zstdLevel, msg)
+			}
+		}
+		// The mock client doesn't compress, so only forward commands when the client doesn't enable compression.
+		ts.authenticateFirstTime(t, nil)
+		checker(t, ts)
+		if test.clientCap == 0 {
+			ts.executeCmd(t, nil)
+		}
+		ts.authenticateSecondTime(t, nil)
+		checker(t, ts)
+		if test.clientCap == 0 {
+			ts.executeCmd(t, nil)
+		}
+		clean()
+	}
+}
+
 // After upgrading the backend, the backend capability may change.
 func TestUpgradeBackendCap(t *testing.T) {
 	cfgs := [][]cfgOverrider{
@@ -555,3 +881,151 @@ func TestUpgradeBackendCap(t *testing.T) {
 		clean()
 	}
 }
+
+func TestDowngradeBackendCap(t *testing.T) {
+	tests := []struct {
+		clientCap pnet.Capability
+		downgrade pnet.Capability
+		err       bool
+	}{
+		{downgrade: pnet.ClientCompress | pnet.ClientZstdCompressionAlgorithm, err: true},
+		{downgrade: pnet.ClientMultiStatements, err: true},
+		// The proxy handles query attributes for the backends without them.
+		{downgrade: pnet.ClientQueryAttributes},
+		// The session state is tracked by the proxy, but the client doesn't rely on it.
+		{downgrade: pnet.ClientSessionTrack},
+		{clientCap: pnet.ClientSessionTrack, downgrade: pnet.ClientSessionTrack, err: true},
+	}
+
+	tc := newTCPConnSuite(t)
+	for i, test := range tests {
+		ts, clean := newTestSuite(t, tc, func(cfg *testConfig) {
+			cfg.clientConfig.capability |= pnet.ClientCompress | pnet.ClientZstdCompressionAlgorithm | pnet.ClientQueryAttributes | test.clientCap
+			cfg.clientConfig.zstdLevel = 3
+			cfg.backendConfig.capability |= pnet.ClientQueryAttributes | pnet.ClientSessionTrack
+		})
+		ts.authenticateFirstTime(t, func(t *testing.T, ts *testSuite) {
+			// The session state is always requested from the backend.
+			require.NotZero(t, ts.mb.capability&pnet.ClientSessionTrack, "case %d", i)
+			require.Equal(t, test.clientCap&pnet.ClientSessionTrack, ts.mc.capability&pnet.ClientSessionTrack, "case %d", i)
+		})
+		ts.mb.backendConfig.capability &^= test.downgrade
+		ts.authenticateSecondTime(t, func(t *testing.T, ts *testSuite) {
+			if test.err {
+				require.ErrorIs(t, ts.mp.err, ErrBackendCap, "case %d", i)
+			} else {
+				require.NoError(t, ts.mp.err, "case %d", i)
+			}
+		})
+		clean()
+	}
+}
+
+func TestNegotiateCapability(t *testing.T) {
+	// The backend capability is unknown.
+	require.Equal(t, SupportedServerCapabilities, negotiateCapability(SupportedServerCapabilities, 0))
+	// The capabilities unsupported by the backends are not advertised, except the ones handled by the proxy.
+	backendCapability := SupportedServerCapabilities &^ (pnet.ClientDeprecateEOF | pnet.ClientSessionTrack | pnet.ClientSSL |
+		pnet.ClientCompress | pnet.ClientQueryAttributes)
+	require.Equal(t, SupportedServerCapabilities&^(pnet.ClientDeprecateEOF|pnet.ClientSessionTrack),
+		negotiateCapability(SupportedServerCapabilities, backendCapability))
+}
+
+func TestTLSSessionResumption(t *testing.T) {
+	tc := newTCPConnSuite(t)
+	tc.clientTLSConfig.ClientSessionCache = tls.NewLRUClientSessionCache(8)
+	// The server config is cloned for each connection, so the ticket keys must be set explicitly.
+	tc.backendTLSConfig.SetSessionTicketKeys([][32]byte{{1}})
+	ts, clean := newTestSuite(t, tc)
+	defer clean()
+	checkCounter := func(addr string, expectedHits, expectedMisses int) {
+		hits, err := readTLSSessionCounter(addr, true)
+		require.NoError(t, err)
+		require.Equal(t, expectedHits, hits)
+		misses, err := readTLSSessionCounter(addr, false)
+		require.NoError(t, err)
+		require.Equal(t, expectedMisses, misses)
+	}
+
+	// The first handshake misses the cache and the second one resumes the session.
+	ts.authenticateFirstTime(t, nil)
+	addr := tc.proxyBIO.RemoteAddr().String()
+	checkCounter(addr, 0, 1)
+	ts.authenticateSecondTime(t, nil)
+	checkCounter(addr, 1, 1)
+}
+
+func TestDisableLoadDataLocal(t *testing.T) {
+	tc := newTCPConnSuite(t)
+	for _, disable := range []bool{false, true} {
+		ts, clean := newTestSuite(t, tc)
+		ts.mp.SetValue(ConnContextKeyLoadData, config.LoadDataPolicy{DisableLocal: disable})
+		checker := func(t *testing.T, ts *testSuite) {
+			// The client still receives the capability because it's advertised before the namespace is known.
+			require.NotZero(t, ts.mc.capability&pnet.ClientLocalFiles)
+			require.Equal(t, disable, ts.mb.capability&pnet.ClientLocalFiles == 0)
+			require.Equal(t, disable, ts.mp.cmdProcessor.capability&pnet.ClientLocalFiles == 0)
+		}
+		ts.authenticateFirstTime(t, nil)
+		checker(t, ts)
+		ts.authenticateSecondTime(t, nil)
+		checker(t, ts)
+		clean()
+	}
+}
+
+func TestInitSQLBeforeOK(t *testing.T) {
+	tc := newTCPConnSuite(t)
+	for _, succeed := range []bool{true, false} {
+		ts, clean := newTestSuite(t, tc)
+		ts.mp.SetValue(ConnContextKeyInitSQL, "SET SESSION `sql_mode` = X'414e5349'")
+		var initSQL string
+		ts.runAndCheck(t, func(t *testing.T, ts *testSuite) {
+			require.Equal(t, "SET SESSION `sql_mode` = X'414e5349'", initSQL)
+			// The client doesn't receive OK if the session fails to be initialized.
+			require.Equal(t, succeed, ts.mc.authSucceed)
+			if succeed {
+				require.NoError(t, ts.mp.err)
+			} else {
+				require.ErrorIs(t, ts.mp.err, ErrBackendHandshake)
+			}
+		}, ts.mc.authenticate, func(packetIO *pnet.PacketIO) error {
+			if err := ts.mb.authenticate(packetIO); err != nil {
+				return err
+			}
+			packetIO.ResetSequence()
+			pkt, err := packetIO.ReadPacket()
+			if err != nil {
+				return err
+			}
+			initSQL = string(pkt[1:])
+			if succeed {
+				return packetIO.WriteOKPacket(0, pnet.OKHeader)
+			}
+			return packetIO.WriteErrPacket(mysql.NewDefaultError(mysql.ER_UNKNOWN_ERROR))
+		}, ts.mp.authenticateFirstTime)
+		clean()
+	}
+}
+
+// Test that an empty public key response from the backend is rejected instead of panicking.
+func TestSha2EmptyPublicKey(t *testing.T) {
+	lg, _ := logger.CreateLoggerForTest(t)
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		require.NoError(t, client.Close())
+		require.NoError(t, server.Close())
+	})
+	var wg waitgroup.WaitGroup
+	wg.Run(func() {
+		backendIO := pnet.NewPacketIO(server, lg, pnet.DefaultConnBufferSize)
+		data, err := backendIO.ReadPacket()
+		require.NoError(t, err)
+		require.Equal(t, []byte{pnet.RequestPublicKey}, data)
+		require.NoError(t, backendIO.WritePacket(nil, true))
+	})
+	backendIO := pnet.NewPacketIO(client, lg, pnet.DefaultConnBufferSize)
+	err := writeSha2Password(backendIO, []byte("salt"), "password")
+	require.ErrorIs(t, err, mysql.ErrMalformPacket)
+	wg.Wait()
+}
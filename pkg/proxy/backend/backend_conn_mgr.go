@@ -5,6 +5,7 @@ package backend
 
 import (
 	"context"
+	"crypto/rsa"
 	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
@@ -23,16 +24,19 @@ import (
 	"github.com/pingcap/tiproxy/lib/config"
 	"github.com/pingcap/tiproxy/lib/util/errors"
 	"github.com/pingcap/tiproxy/lib/util/waitgroup"
+	"github.com/pingcap/tiproxy/pkg/balance/observer"
 	"github.com/pingcap/tiproxy/pkg/balance/router"
 	pnet "github.com/pingcap/tiproxy/pkg/proxy/net"
+	"github.com/pingcap/tiproxy/pkg/proxy/proxyprotocol"
 	"github.com/pingcap/tiproxy/pkg/util/monotime"
 	"github.com/siddontang/go/hack"
 	"go.uber.org/zap"
 )
 
 var (
-	ErrCloseConnMgr    = errors.New("failed to close connection manager")
-	ErrTargetUnhealthy = errors.New("target backend becomes unhealthy")
+	ErrCloseConnMgr        = errors.New("failed to close connection manager")
+	ErrTargetUnhealthy     = errors.New("target backend becomes unhealthy")
+	ErrMigrationBufferFull = errors.New("the migration buffer is full")
 )
 
 const (
@@ -44,6 +48,8 @@ const (
 	CheckBackendInterval = time.Minute
 	// TickerInterval is the interval for checking backend status.
 	TickerInterval = 5 * time.Second
+	// MigrationBufferSize is the maximum size of the long data and cursor rows buffered for session migration.
+	MigrationBufferSize = 16 * 1024 * 1024
 )
 
 const (
@@ -83,7 +89,22 @@ type BCConfig struct {
 	ConnectTimeout       time.Duration
 	ConnBufferSize       int
 	ProxyProtocol        bool
-	RequireBackendTLS    bool
+	// MigrationBufferSize limits the long data and cursor rows buffered by each connection for session migration.
+	MigrationBufferSize int
+	// ProxyVersion is the header version sent to backends. It's v2 by default.
+	ProxyVersion proxyprotocol.ProxyVersion
+	// AcceptProxyProtocol means parsing PROXY headers from clients.
+	AcceptProxyProtocol bool
+	// ProxyTrustedCIDRs are the peers whose proxy headers are honoured. Empty means trusting all peers.
+	ProxyTrustedCIDRs proxyprotocol.TrustedCIDRs
+	// RequireSecureTransport rejects the clients that don't enable TLS.
+	RequireSecureTransport bool
+	RequireBackendTLS      bool
+	// IPFilters reject the clients whose addresses are denied by any of them. A nil filter allows all clients.
+	IPFilters []*pnet.IPFilter
+	// RSAKey returns the RSA key pair to exchange caching_sha2_password passwords with the clients that don't enable TLS.
+	// If it's nil, the key exchange is relayed between the client and the backend.
+	RSAKey func() *rsa.PrivateKey
 }
 
 func (cfg *BCConfig) check() {
@@ -96,6 +117,9 @@ func (cfg *BCConfig) check() {
 	if cfg.ConnectTimeout == time.Duration(0) {
 		cfg.ConnectTimeout = ConnectTimeout
 	}
+	if cfg.MigrationBufferSize == 0 {
+		cfg.MigrationBufferSize = MigrationBufferSize
+	}
 }
 
 // BackendConnManager migrates a session from one BackendConnection to another.
@@ -121,6 +145,12 @@ type BackendConnManager struct {
 	curBackend     router.BackendInst
 	// Redirect() sets it without lock. It will be set to nil after migration.
 	redirectInfo atomic.Pointer[router.BackendInst]
+	// redirectTime is when the pending redirection is notified, which is used to force migration after the deadline.
+	redirectTime atomic.Int64
+	// txnRolledBack means the transaction is rolled back by force and the client should be told on the next command.
+	txnRolledBack bool
+	// preparedBackend is the connection to the redirection target established before the session is redirect-able.
+	preparedBackend *preparedBackend
 	// redirectResCh is used to notify the event receiver asynchronously.
 	redirectResCh chan *redirectResult
 	// GracefulClose() sets it without lock.
@@ -129,6 +159,8 @@ type BackendConnManager struct {
 	lastActiveTime monotime.Time
 	// The traffic recorded last time.
 	inBytes, inPackets, outBytes, outPackets uint64
+	// connCtx is the context of the client connection, which is returned by ConnContext.Context.
+	connCtx context.Context
 	// cancelFunc is used to cancel the signal processing goroutine.
 	cancelFunc context.CancelFunc
 	clientIO   *pnet.PacketIO
@@ -159,6 +191,7 @@ func NewBackendConnManager(logger *zap.Logger, handshakeHandler HandshakeHandler
 		redirectResCh:  make(chan *redirectResult, 1),
 		quitSource:     SrcNone,
 	}
+	mgr.cmdProcessor.maxBufferSize = config.MigrationBufferSize
 	mgr.ctxmap.m = make(map[any]any)
 	mgr.SetValue(ConnContextKeyConnID, connectionID)
 	return mgr
@@ -177,13 +210,22 @@ func (mgr *BackendConnManager) Connect(ctx context.Context, clientIO *pnet.Packe
 
 	mgr.backendTLS = backendTLSConfig
 	mgr.clientIO = clientIO
+	mgr.connCtx = ctx
 
 	if mgr.closeStatus.Load() >= statusNotifyClose {
 		mgr.quitSource = SrcProxyQuit
 		return errors.New("graceful shutdown before connecting")
 	}
 	startTime := monotime.Now()
-	err := mgr.authenticator.handshakeFirstTime(ctx, mgr.logger.Named("authenticator"), mgr, clientIO, mgr.handshakeHandler, mgr.getBackendIO, frontendTLSConfig, backendTLSConfig)
+	err := mgr.authenticator.handshakeFirstTime(ctx, mgr.logger.Named("authenticator"), mgr, clientIO, mgr.handshakeHandler, mgr.getBackendIO, mgr.execInitSQL, frontendTLSConfig, backendTLSConfig)
+	if err == nil {
+		mgr.cmdProcessor.capability = mgr.authenticator.capability
+		mgr.cmdProcessor.backendCapability = mgr.authenticator.backendCapability
+		mgr.cmdProcessor.sessionState.DB = mgr.authenticator.dbname
+		mgr.setQueryLimits()
+		mgr.setLoadDataPolicy()
+		mgr.cmdProcessor.denyChangeUser, _ = mgr.Value(ConnContextKeyDenyChangeUser).(bool)
+	}
 	if err != nil {
 		src := Error2Source(err)
 		mgr.handshakeHandler.OnHandshake(mgr, mgr.ServerAddr(), err, src)
@@ -192,14 +234,18 @@ func (mgr *BackendConnManager) Connect(ctx context.Context, clientIO *pnet.Packe
 			clientIO.WriteUserError(clientErr)
 		}
 		mgr.quitSource = src
+		// The dial errors are already reported in getBackendIO.
+		if mgr.curBackend != nil && src.GetSourceComp() == CompBackend {
+			mgr.onBackendFailure(mgr.curBackend.Addr(), observer.TrafficErrHandshake, err)
+		}
 		return err
 	}
 	mgr.handshakeHandler.OnHandshake(mgr, mgr.ServerAddr(), nil, SrcNone)
+	mgr.onBackendSuccess(mgr.ServerAddr())
 	endTime := monotime.Now()
 	addHandshakeMetrics(mgr.ServerAddr(), time.Duration(endTime-startTime))
 	mgr.updateTraffic(mgr.backendIO.Load())
 
-	mgr.cmdProcessor.capability = mgr.authenticator.capability
 	childCtx, cancelFunc := context.WithCancel(ctx)
 	mgr.cancelFunc = cancelFunc
 	mgr.lastActiveTime = endTime
@@ -242,6 +288,7 @@ func (mgr *BackendConnManager) getBackendIO(ctx context.Context, cctx ConnContex
 			cn, err = net.DialTimeout("tcp", addr, DialTimeout)
 			selector.Finish(mgr, err == nil)
 			if err != nil {
+				r.OnBackendFailure(addr, observer.TrafficErrDial, err)
 				return nil, errors.Wrap(ErrBackendHandshake, errors.Wrapf(err, "dial backend %s error", addr))
 			}
 
@@ -288,10 +335,11 @@ func (mgr *BackendConnManager) ExecuteCmd(ctx context.Context, request []byte) (
 		mgr.handshakeHandler.OnTraffic(mgr)
 		now := monotime.Now()
 		if err != nil && errors.Is(err, ErrBackendConn) {
-			cmd, data := pnet.Command(request[0]), request[1:]
+			mgr.onBackendFailure(mgr.ServerAddr(), observer.TrafficErrRead, err)
+			cmd := pnet.Command(request[0])
 			var query string
 			if cmd == pnet.ComQuery {
-				query = parser.Normalize(pnet.ParseQueryPacket(data))
+				query = parser.Normalize(mgr.cmdProcessor.parseQuery(request))
 				if len(query) > 256 {
 					query = query[:256]
 				}
@@ -314,10 +362,24 @@ func (mgr *BackendConnManager) ExecuteCmd(ctx context.Context, request []byte) (
 	if mgr.closeStatus.Load() >= statusClosing {
 		return
 	}
+	// Tell the client that the transaction is rolled back instead of running the command in a new transaction.
+	if mgr.txnRolledBack {
+		switch cmd {
+		case pnet.ComQuit, pnet.ComStmtClose, pnet.ComStmtSendLongData:
+			// These commands have no response.
+		default:
+			mgr.txnRolledBack = false
+			// The connection is closed if the client can't receive the error.
+			if err = mgr.clientIO.WriteErrPacket(mysql.NewError(mysql.ER_UNKNOWN_ERROR, ErrTxnRolledBack.Error())); err != nil {
+				mgr.logger.Warn("notify the client of the rolled back transaction failed", zap.Error(err))
+			}
+			return
+		}
+	}
 	waitingRedirect := mgr.redirectInfo.Load() != nil
 	var holdRequest bool
 	backendIO := mgr.backendIO.Load()
-	holdRequest, err = mgr.cmdProcessor.executeCmd(request, mgr.clientIO, backendIO, waitingRedirect)
+	holdRequest, err = mgr.cmdProcessor.executeCmd(ctx, request, mgr.clientIO, backendIO, waitingRedirect)
 	if !holdRequest {
 		addCmdMetrics(cmd, backendIO.RemoteAddr().String(), startTime)
 		mgr.updateTraffic(backendIO)
@@ -353,17 +415,16 @@ func (mgr *BackendConnManager) ExecuteCmd(ctx context.Context, request []byte) (
 		}
 	}
 	// Even if it meets an MySQL error, it may have changed the status, such as when executing multi-statements.
-	if mgr.cmdProcessor.finishedTxn() {
-		if mgr.closeStatus.Load() == statusNotifyClose {
-			mgr.tryGracefulClose(ctx)
-		} else if waitingRedirect {
-			mgr.tryRedirect(ctx)
-		}
+	// Closing the connection waits for the cursors to be fetched, but migration only waits until the proxy can buffer them.
+	if mgr.closeStatus.Load() == statusNotifyClose {
+		mgr.tryGracefulClose(ctx)
+	} else if waitingRedirect {
+		mgr.tryRedirect(ctx)
 	}
 	// Execute the held request no matter redirection succeeds or not.
 	if holdRequest && mgr.closeStatus.Load() < statusNotifyClose {
 		backendIO = mgr.backendIO.Load()
-		_, err = mgr.cmdProcessor.executeCmd(request, mgr.clientIO, backendIO, false)
+		_, err = mgr.cmdProcessor.executeCmd(ctx, request, mgr.clientIO, backendIO, false)
 		addCmdMetrics(cmd, backendIO.RemoteAddr().String(), startTime)
 		mgr.updateTraffic(backendIO)
 		if err != nil && !pnet.IsMySQLError(err) {
@@ -395,6 +456,19 @@ func (mgr *BackendConnManager) getEventReceiver() router.ConnEventReceiver {
 	return *eventReceiver
 }
 
+// onBackendFailure reports the failure of real traffic to the router for passive health check.
+func (mgr *BackendConnManager) onBackendFailure(addr string, errType observer.TrafficErrType, err error) {
+	if eventReceiver := mgr.getEventReceiver(); eventReceiver != nil {
+		eventReceiver.OnBackendFailure(addr, errType, err)
+	}
+}
+
+func (mgr *BackendConnManager) onBackendSuccess(addr string) {
+	if eventReceiver := mgr.getEventReceiver(); eventReceiver != nil {
+		eventReceiver.OnBackendSuccess(addr)
+	}
+}
+
 func (mgr *BackendConnManager) initSessionStates(backendIO *pnet.PacketIO, sessionStates string) error {
 	// Do not lock here because the caller already locks.
 	sessionStates = strings.ReplaceAll(sessionStates, "\\", "\\\\")
@@ -404,6 +478,22 @@ func (mgr *BackendConnManager) initSessionStates(backendIO *pnet.PacketIO, sessi
 	return err
 }
 
+// execInitSQL executes the statement set by the HandshakeHandler, such as setting session variables.
+// It runs before the client receives the OK packet so that the client never sees the uninitialized session.
+// The session variables are migrated along with the session states, so it only runs on the first backend.
+func (mgr *BackendConnManager) execInitSQL(backendIO *pnet.PacketIO) error {
+	sql, _ := mgr.Value(ConnContextKeyInitSQL).(string)
+	if len(sql) == 0 {
+		return nil
+	}
+	// The handshake hasn't finished, so the capability is not set yet.
+	mgr.cmdProcessor.backendCapability = mgr.authenticator.backendCapability
+	if _, _, err := mgr.cmdProcessor.query(backendIO, sql); err != nil {
+		return errors.Wrap(ErrBackendHandshake, errors.Wrapf(err, "execute init sql failed"))
+	}
+	return nil
+}
+
 func (mgr *BackendConnManager) querySessionStates(backendIO *pnet.PacketIO) (sessionStates, sessionToken string, err error) {
 	// Do not lock here because the caller already locks.
 	var result *mysql.Resultset
@@ -423,6 +513,9 @@ func (mgr *BackendConnManager) querySessionStates(backendIO *pnet.PacketIO) (ses
 // - Check if the backend is still alive.
 func (mgr *BackendConnManager) processSignals(ctx context.Context) {
 	checkBackendTicker := time.NewTicker(mgr.config.TickerInterval)
+	// The deadline may be shorter than the ticker interval, so a timer is armed once the redirection is notified.
+	var deadlineTimer *time.Timer
+	var deadlineCh <-chan time.Time
 	for {
 		select {
 		case s := <-mgr.signalReceived:
@@ -435,19 +528,40 @@ func (mgr *BackendConnManager) processSignals(ctx context.Context) {
 					mgr.tryGracefulClose(ctx)
 				case signalTypeRedirect:
 					mgr.tryRedirect(ctx)
+					// Connect to the target in advance to reduce the latency of the redirection after the transaction.
+					mgr.startPreparingBackend(ctx)
+					if remaining, ok := mgr.migrationDeadline(); ok && mgr.redirectInfo.Load() != nil {
+						if deadlineTimer != nil {
+							deadlineTimer.Stop()
+						}
+						deadlineTimer = time.NewTimer(remaining)
+						deadlineCh = deadlineTimer.C
+					}
 				}
 			}()
 		case rs := <-mgr.redirectResCh:
 			mgr.notifyRedirectResult(ctx, rs)
+		case <-deadlineCh:
+			deadlineCh = nil
+			func() {
+				mgr.processLock.Lock()
+				defer mgr.processLock.Unlock()
+				mgr.checkMigrationDeadline(ctx)
+			}()
 		case <-checkBackendTicker.C:
 			func() {
 				mgr.checkBackendActive()
 				mgr.processLock.Lock()
 				defer mgr.processLock.Unlock()
 				mgr.setKeepAlive()
+				mgr.checkPreparedBackend()
+				mgr.checkMigrationDeadline(ctx)
 			}()
 		case <-ctx.Done():
 			checkBackendTicker.Stop()
+			if deadlineTimer != nil {
+				deadlineTimer.Stop()
+			}
 			return
 		}
 	}
@@ -463,7 +577,7 @@ func (mgr *BackendConnManager) tryRedirect(ctx context.Context) {
 	if backendInst == nil {
 		return
 	}
-	if !mgr.cmdProcessor.finishedTxn() {
+	if !mgr.cmdProcessor.canMigrate() {
 		return
 	}
 
@@ -474,6 +588,8 @@ func (mgr *BackendConnManager) tryRedirect(ctx context.Context) {
 	defer func() {
 		// The `mgr` won't be notified again before it calls `OnRedirectSucceed`, so simply `StorePointer` is also fine.
 		mgr.redirectInfo.Store(nil)
+		// The prepared connection is either used or useless now.
+		mgr.releasePreparedBackend()
 		// Notifying may block. Notify the receiver asynchronously to:
 		// - Reduce the latency of session migration
 		// - Avoid the risk of deadlock
@@ -484,9 +600,19 @@ func (mgr *BackendConnManager) tryRedirect(ctx context.Context) {
 		rs.err = ErrTargetUnhealthy
 		return
 	}
+	// Refuse the target before querying session states if the health check already knows its capability.
+	if capability := (*backendInst).Capability(); capability != 0 {
+		if rs.err = mgr.authenticator.verifyMigrationCaps(capability); rs.err != nil {
+			return
+		}
+	}
 	backendIO := mgr.backendIO.Load()
 	var sessionStates, sessionToken string
-	if sessionStates, sessionToken, rs.err = mgr.querySessionStates(backendIO); rs.err != nil {
+	// The cursors can't be migrated, so drain them before querying the session states.
+	if rs.err = mgr.cmdProcessor.drainCursors(backendIO); rs.err == nil {
+		sessionStates, sessionToken, rs.err = mgr.querySessionStates(backendIO)
+	}
+	if rs.err != nil {
 		// If the backend connection is closed, also close the client connection.
 		// Otherwise, if the client is idle, the mgr will keep retrying.
 		if errors.Is(rs.err, net.ErrClosed) || pnet.IsDisconnectError(rs.err) || errors.Is(rs.err, os.ErrDeadlineExceeded) {
@@ -505,25 +631,53 @@ func (mgr *BackendConnManager) tryRedirect(ctx context.Context) {
 		return
 	}
 
-	var cn net.Conn
-	cn, rs.err = net.DialTimeout("tcp", rs.to, DialTimeout)
-	if rs.err != nil {
-		mgr.handshakeHandler.OnHandshake(mgr, rs.to, rs.err, SrcBackendNetwork)
-		return
+	var newBackendIO *pnet.PacketIO
+	var backendCapability pnet.Capability
+	prevBackendCapability := mgr.cmdProcessor.backendCapability
+	if pb := mgr.takePreparedBackend(*backendInst); pb != nil {
+		newBackendIO = pb.backendIO
+		if backendCapability, rs.err = mgr.authenticator.authSecondTime(newBackendIO, pb.capability, pb.enableTLS, sessionToken); rs.err != nil {
+			// The prepared connection may be closed by the backend while waiting, so connect again.
+			mgr.logger.Warn("authenticate on the prepared backend connection failed, connect again", zap.String("backend_addr", rs.to), zap.Error(rs.err))
+			if ignoredErr := newBackendIO.Close(); ignoredErr != nil && !pnet.IsDisconnectError(ignoredErr) {
+				mgr.logger.Warn("close prepared backend connection failed", zap.String("backend_addr", rs.to), zap.Error(ignoredErr))
+			}
+			newBackendIO = nil
+		}
 	}
-	newBackendIO := pnet.NewPacketIO(cn, mgr.logger, mgr.config.ConnBufferSize, pnet.WithRemoteAddr(rs.to, cn.RemoteAddr()), pnet.WithWrapError(ErrBackendConn))
-
-	if rs.err = mgr.authenticator.handshakeSecondTime(mgr.logger, mgr.clientIO, newBackendIO, mgr.backendTLS, sessionToken); rs.err == nil {
-		rs.err = mgr.initSessionStates(newBackendIO, sessionStates)
+	if newBackendIO == nil {
+		var cn net.Conn
+		cn, rs.err = net.DialTimeout("tcp", rs.to, DialTimeout)
+		if rs.err != nil {
+			mgr.handshakeHandler.OnHandshake(mgr, rs.to, rs.err, SrcBackendNetwork)
+			mgr.onBackendFailure(rs.to, observer.TrafficErrDial, rs.err)
+			return
+		}
+		newBackendIO = pnet.NewPacketIO(cn, mgr.logger, mgr.config.ConnBufferSize, pnet.WithRemoteAddr(rs.to, cn.RemoteAddr()), pnet.WithWrapError(ErrBackendConn))
+		backendCapability, rs.err = mgr.authenticator.handshakeSecondTime(mgr.logger, mgr.clientIO, newBackendIO, mgr.backendTLS, sessionToken)
+	}
+	if rs.err == nil {
+		// The statement to restore the session states is sent in the format that the new backend expects.
+		mgr.cmdProcessor.backendCapability = backendCapability
+		if rs.err = mgr.initSessionStates(newBackendIO, sessionStates); rs.err == nil {
+			// The long data isn't included in the session states.
+			rs.err = mgr.cmdProcessor.replayLongData(newBackendIO)
+		}
 	} else {
-		mgr.handshakeHandler.OnHandshake(mgr, newBackendIO.RemoteAddr().String(), rs.err, Error2Source(rs.err))
+		src := Error2Source(rs.err)
+		mgr.handshakeHandler.OnHandshake(mgr, newBackendIO.RemoteAddr().String(), rs.err, src)
+		if src.GetSourceComp() == CompBackend {
+			mgr.onBackendFailure(rs.to, observer.TrafficErrHandshake, rs.err)
+		}
 	}
 	if rs.err != nil {
+		mgr.cmdProcessor.backendCapability = prevBackendCapability
 		if ignoredErr := newBackendIO.Close(); ignoredErr != nil && !pnet.IsDisconnectError(ignoredErr) {
 			mgr.logger.Error("close new backend connection failed", zap.Error(ignoredErr))
 		}
 		return
 	}
+	mgr.authenticator.backendCapability = backendCapability
 	mgr.updateTraffic(backendIO)
 	mgr.inBytes, mgr.inPackets, mgr.outBytes, mgr.outPackets = 0, 0, 0, 0
 	mgr.updateTraffic(newBackendIO)
@@ -534,6 +688,76 @@ func (mgr *BackendConnManager) tryRedirect(ctx context.Context) {
 	mgr.curBackend = *backendInst
 	mgr.setKeepAlive()
 	mgr.handshakeHandler.OnHandshake(mgr, mgr.ServerAddr(), nil, SrcNone)
+	mgr.onBackendSuccess(rs.to)
+}
+
+// setQueryLimits applies the limits of the namespace to the requests and the result sets.
+func (mgr *BackendConnManager) setQueryLimits() {
+	ql, _ := mgr.Value(ConnContextKeyQueryLimits).(config.QueryLimits)
+	if ql.MaxRequestBytes > 0 {
+		mgr.clientIO.ApplyOpts(pnet.WithMaxPacketSize(ql.MaxRequestBytes))
+	}
+	mgr.cmdProcessor.maxResultRows = ql.MaxResultRows
+	mgr.cmdProcessor.maxResultBytes = ql.MaxResultBytes
+}
+
+// setLoadDataPolicy applies the restrictions of the namespace to LOAD DATA LOCAL INFILE.
+// CLIENT_LOCAL_FILES is already cleared by the authenticator if the namespace disables it.
+func (mgr *BackendConnManager) setLoadDataPolicy() {
+	lp, _ := mgr.Value(ConnContextKeyLoadData).(config.LoadDataPolicy)
+	mgr.cmdProcessor.maxLoadBytes = lp.MaxBytes
+	mgr.cmdProcessor.loadBytesPerSecond = lp.MaxBytesPerSecond
+}
+
+// migrationDeadline returns the remaining time before the migration deadline of the pending redirection.
+// It returns false if the namespace doesn't set the deadline.
+func (mgr *BackendConnManager) migrationDeadline() (time.Duration, bool) {
+	md, _ := mgr.Value(ConnContextKeyMigrationDeadline).(config.MigrationDeadline)
+	if md.DeadlineMs <= 0 {
+		return 0, false
+	}
+	return time.Duration(md.DeadlineMs)*time.Millisecond - monotime.Since(monotime.Time(mgr.redirectTime.Load())), true
+}
+
+// checkMigrationDeadline forces the session to migrate or closes it if it's still not redirect-able after the deadline.
+// NOTE: processLock should be held before calling this function.
+func (mgr *BackendConnManager) checkMigrationDeadline(ctx context.Context) {
+	if mgr.closeStatus.Load() >= statusNotifyClose || ctx.Err() != nil {
+		return
+	}
+	backendInst := mgr.redirectInfo.Load()
+	if backendInst == nil || mgr.cmdProcessor.canMigrate() {
+		return
+	}
+	if remaining, ok := mgr.migrationDeadline(); !ok || remaining > 0 {
+		return
+	}
+	md, _ := mgr.Value(ConnContextKeyMigrationDeadline).(config.MigrationDeadline)
+	from, to := mgr.ServerAddr(), (*backendInst).Addr()
+	switch md.Action {
+	case config.MigrationActionClose:
+		mgr.logger.Warn("close the session because it's not migrated before the deadline", zap.String("from", from), zap.String("to", to))
+		addForcedMigrateMetrics(from, to, config.MigrationActionClose)
+		mgr.quitSource = SrcProxyQuit
+		// Closing clientIO will cause the whole connection to be closed.
+		if err := mgr.clientIO.GracefulClose(); err != nil {
+			mgr.logger.Warn("graceful close client IO error", zap.Stringer("client_addr", mgr.clientIO.RemoteAddr()), zap.Error(err))
+		}
+		mgr.closeStatus.CompareAndSwap(statusActive, statusClosing)
+	default:
+		// Rolling back doesn't help if the session is blocked by prepared statements.
+		if mgr.cmdProcessor.serverStatus&StatusInTrans == 0 {
+			return
+		}
+		if _, _, err := mgr.cmdProcessor.query(mgr.backendIO.Load(), "ROLLBACK"); err != nil {
+			mgr.logger.Warn("roll back the transaction before the forced migration failed", zap.Error(err))
+			return
+		}
+		mgr.logger.Warn("the transaction is rolled back because the session is not migrated before the deadline", zap.String("from", from), zap.String("to", to))
+		addForcedMigrateMetrics(from, to, config.MigrationActionRollback)
+		mgr.txnRolledBack = true
+		mgr.tryRedirect(ctx)
+	}
 }
 
 // The original db in the auth info may be dropped during the session, so we need to authenticate with the current db.
@@ -547,6 +771,7 @@ func (mgr *BackendConnManager) updateAuthInfoFromSessionStates(sessionStates []b
 	// The currentDBKey may be omitted if it's empty. In this case, we still need to update it.
 	if currentDB, ok := statesMap[currentDBKey].(string); ok {
 		mgr.authenticator.updateCurrentDB(currentDB)
+		mgr.cmdProcessor.sessionState.DB = currentDB
 	}
 	return nil
 }
@@ -558,7 +783,9 @@ func (mgr *BackendConnManager) Redirect(backendInst router.BackendInst) bool {
 	if mgr.closeStatus.Load() >= statusNotifyClose {
 		return false
 	}
-	mgr.redirectInfo.Store(&backendInst)
+	if mgr.redirectInfo.Swap(&backendInst) == nil {
+		mgr.redirectTime.Store(int64(monotime.Now()))
+	}
 	// Generally, it won't wait because the caller won't send another signal before the previous one finishes.
 	mgr.signalReceived <- signalTypeRedirect
 	return true
@@ -631,6 +858,12 @@ func (mgr *BackendConnManager) checkBackendActive() {
 	}
 }
 
+// QueryAttrs returns the query attributes sent by the client with the current command.
+// It's only valid during ExecuteCmd, such as in HandshakeHandler.OnTraffic.
+func (mgr *BackendConnManager) QueryAttrs() []pnet.QueryAttr {
+	return mgr.cmdProcessor.QueryAttrs()
+}
+
 func (mgr *BackendConnManager) ClientAddr() string {
 	if mgr.clientIO == nil {
 		return ""
@@ -694,6 +927,7 @@ func (mgr *BackendConnManager) Close() error {
 		mgr.cancelFunc()
 		mgr.cancelFunc = nil
 	}
+	mgr.releasePreparedBackend()
 
 	// OnConnClose may read ServerAddr(), so call it before closing backendIO.
 	handErr := mgr.handshakeHandler.OnConnClose(mgr, mgr.quitSource)
@@ -758,6 +992,14 @@ func (mgr *BackendConnManager) setQuitSourceByErr(err error) {
 	mgr.quitSource = Error2Source(err)
 }
 
+// Context implements ConnContext.Context.
+func (mgr *BackendConnManager) Context() context.Context {
+	if mgr.connCtx == nil {
+		return context.Background()
+	}
+	return mgr.connCtx
+}
+
 // UpdateLogger add fields to the logger.
 // Note: it should be called within the lock.
 func (mgr *BackendConnManager) UpdateLogger(fields ...zap.Field) {
@@ -0,0 +1,136 @@
+// Copyright 2023 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+
+	"github.com/pingcap/tiproxy/lib/util/errors"
+	"github.com/pingcap/tiproxy/pkg/balance/router"
+	pnet "github.com/pingcap/tiproxy/pkg/proxy/net"
+	"github.com/pingcap/tiproxy/pkg/proxy/proxyprotocol"
+	"go.uber.org/zap"
+)
+
+// preparedBackend is the connection to the redirection target that is established before the session is redirect-able.
+// Dialing and upgrading to TLS don't need the session token, so they're done in the background once the redirection
+// signal arrives, and only authentication and session states are left when the transaction finishes.
+type preparedBackend struct {
+	inst router.BackendInst
+	// cancel interrupts the preparation when the prepared connection is abandoned.
+	cancel context.CancelFunc
+	// done is closed after the preparation finishes, and then the fields below are read-only.
+	done       chan struct{}
+	backendIO  *pnet.PacketIO
+	capability pnet.Capability
+	enableTLS  bool
+	err        error
+}
+
+func (pb *preparedBackend) close(logger *zap.Logger) {
+	pb.cancel()
+	<-pb.done
+	if pb.backendIO == nil {
+		return
+	}
+	if err := pb.backendIO.Close(); err != nil && !pnet.IsDisconnectError(err) && !errors.Is(err, net.ErrClosed) {
+		logger.Warn("close prepared backend connection failed", zap.String("backend_addr", pb.inst.Addr()), zap.Error(err))
+	}
+}
+
+// startPreparingBackend connects to the redirection target in the background if the session is not redirect-able now.
+// NOTE: processLock should be held before calling this function.
+func (mgr *BackendConnManager) startPreparingBackend(ctx context.Context) {
+	if mgr.closeStatus.Load() >= statusNotifyClose || ctx.Err() != nil {
+		return
+	}
+	backendInst := mgr.redirectInfo.Load()
+	if backendInst == nil || !(*backendInst).Healthy() {
+		return
+	}
+	if pb := mgr.preparedBackend; pb != nil {
+		if pb.inst.Addr() == (*backendInst).Addr() {
+			return
+		}
+		// The target is changed.
+		mgr.releasePreparedBackend()
+	}
+	pctx, cancel := context.WithCancel(ctx)
+	pb := &preparedBackend{
+		inst:   *backendInst,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	mgr.preparedBackend = pb
+	// The session may change the capability, the collation, and the logger during the preparation,
+	// so the goroutine reads a snapshot of them.
+	auth := *mgr.authenticator
+	proxy := mgr.authenticator.newProxyHeader(mgr.clientIO)
+	logger, backendTLS := mgr.logger, mgr.backendTLS
+	mgr.wg.RunWithRecover(func() {
+		defer close(pb.done)
+		mgr.prepareBackend(pctx, pb, &auth, proxy, logger, backendTLS)
+	}, nil, logger)
+}
+
+// prepareBackend runs without processLock, so it must not touch the states that may be changed by the session.
+func (mgr *BackendConnManager) prepareBackend(ctx context.Context, pb *preparedBackend, auth *Authenticator, proxy *proxyprotocol.Proxy,
+	logger *zap.Logger, backendTLS *tls.Config) {
+	addr := pb.inst.Addr()
+	dialer := net.Dialer{Timeout: DialTimeout}
+	cn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		pb.err = errors.Wrapf(err, "dial backend %s error", addr)
+		return
+	}
+	// Closing the connection interrupts the handshake once the prepared connection is abandoned.
+	stop := context.AfterFunc(ctx, func() {
+		_ = cn.Close()
+	})
+	defer stop()
+	pb.backendIO = pnet.NewPacketIO(cn, logger, mgr.config.ConnBufferSize, pnet.WithRemoteAddr(addr, cn.RemoteAddr()), pnet.WithWrapError(ErrBackendConn))
+	pb.capability, pb.enableTLS, pb.err = auth.prepareSecondTime(logger, proxy, pb.backendIO, backendTLS)
+}
+
+// takePreparedBackend returns the prepared connection to backendInst, waiting for the preparation if it's still running.
+// It returns nil if there's no usable prepared connection and the caller should connect by itself.
+// NOTE: processLock should be held before calling this function.
+func (mgr *BackendConnManager) takePreparedBackend(backendInst router.BackendInst) *preparedBackend {
+	pb := mgr.preparedBackend
+	if pb == nil {
+		return nil
+	}
+	if pb.inst.Addr() != backendInst.Addr() {
+		mgr.releasePreparedBackend()
+		return nil
+	}
+	<-pb.done
+	if pb.err != nil {
+		mgr.logger.Warn("prepare the new backend connection failed, connect again", zap.String("backend_addr", pb.inst.Addr()), zap.Error(pb.err))
+		mgr.releasePreparedBackend()
+		return nil
+	}
+	mgr.preparedBackend = nil
+	return pb
+}
+
+// releasePreparedBackend abandons the prepared connection.
+// NOTE: processLock should be held before calling this function.
+func (mgr *BackendConnManager) releasePreparedBackend() {
+	if pb := mgr.preparedBackend; pb != nil {
+		mgr.preparedBackend = nil
+		pb.close(mgr.logger)
+	}
+}
+
+// checkPreparedBackend abandons the prepared connection if the target becomes unhealthy.
+// NOTE: processLock should be held before calling this function.
+func (mgr *BackendConnManager) checkPreparedBackend() {
+	if pb := mgr.preparedBackend; pb != nil && !pb.inst.Healthy() {
+		mgr.logger.Info("abandon the prepared backend connection because the backend is unhealthy", zap.String("backend_addr", pb.inst.Addr()))
+		mgr.releasePreparedBackend()
+	}
+}
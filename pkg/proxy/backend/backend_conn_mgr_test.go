@@ -13,10 +13,14 @@ import (
 	"testing"
 	"time"
 
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/pingcap/tiproxy/lib/config"
 	"github.com/pingcap/tiproxy/lib/util/errors"
 	"github.com/pingcap/tiproxy/lib/util/logger"
 	"github.com/pingcap/tiproxy/lib/util/waitgroup"
+	"github.com/pingcap/tiproxy/pkg/balance/observer"
 	"github.com/pingcap/tiproxy/pkg/balance/router"
+	"github.com/pingcap/tiproxy/pkg/manager/namespace"
 	pnet "github.com/pingcap/tiproxy/pkg/proxy/net"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
@@ -34,12 +38,15 @@ type event struct {
 }
 
 type mockEventReceiver struct {
-	eventCh chan event
+	sync.Mutex
+	eventCh  chan event
+	failures map[observer.TrafficErrType]int
 }
 
 func newMockEventReceiver() *mockEventReceiver {
 	return &mockEventReceiver{
-		eventCh: make(chan event, 1),
+		eventCh:  make(chan event, 1),
+		failures: make(map[observer.TrafficErrType]int),
 	}
 }
 
@@ -69,6 +76,21 @@ func (mer *mockEventReceiver) OnConnClosed(from string, conn router.Redirectable
 	return nil
 }
 
+func (mer *mockEventReceiver) OnBackendFailure(addr string, errType observer.TrafficErrType, err error) {
+	mer.Lock()
+	mer.failures[errType]++
+	mer.Unlock()
+}
+
+func (mer *mockEventReceiver) OnBackendSuccess(addr string) {
+}
+
+func (mer *mockEventReceiver) getFailures(errType observer.TrafficErrType) int {
+	mer.Lock()
+	defer mer.Unlock()
+	return mer.failures[errType]
+}
+
 func (mer *mockEventReceiver) checkEvent(t *testing.T, eventName int) {
 	e := <-mer.eventCh
 	require.Equal(t, eventName, e.eventName)
@@ -95,6 +117,10 @@ func (mbi *mockBackendInst) Healthy() bool {
 	return mbi.healthy.Load()
 }
 
+func (mbi *mockBackendInst) Capability() pnet.Capability {
+	return 0
+}
+
 func (mbi *mockBackendInst) setHealthy(healthy bool) {
 	mbi.healthy.Store(healthy)
 }
@@ -248,6 +274,12 @@ func (ts *backendMgrTester) checkConnClosed4Proxy(_, _ *pnet.PacketIO) error {
 	return nil
 }
 
+func (ts *backendMgrTester) getPreparedBackend() *preparedBackend {
+	ts.mp.processLock.Lock()
+	defer ts.mp.processLock.Unlock()
+	return ts.mp.preparedBackend
+}
+
 func (ts *backendMgrTester) runTests(runners []runner) {
 	for _, runner := range runners {
 		ts.runAndCheck(ts.t, nil, runner.client, runner.backend, runner.proxy)
@@ -514,6 +546,538 @@ func TestRedirectFail(t *testing.T) {
 	ts.runTests(runners)
 }
 
+// Test that the session with open cursors or pending long data can be redirected.
+func TestRedirectWithPreparedStmts(t *testing.T) {
+	ts := newBackendMgrTester(t)
+	runners := []runner{
+		// 1st handshake
+		{
+			client:  ts.mc.authenticate,
+			proxy:   ts.firstHandshake4Proxy,
+			backend: ts.handshake4Backend,
+		},
+		// open a cursor
+		{
+			client: func(packetIO *pnet.PacketIO) error {
+				ts.mc.cmd = pnet.ComStmtExecute
+				ts.mc.prepStmtID = 1
+				return ts.mc.request(packetIO)
+			},
+			proxy: ts.forwardCmd4Proxy,
+			backend: func(packetIO *pnet.PacketIO) error {
+				ts.mb.respondType = responseTypeResultSet
+				ts.mb.columns = 1
+				ts.mb.status = pnet.ServerStatusCursorExists
+				return ts.mb.respond(packetIO)
+			},
+		},
+		// send long data to another statement
+		{
+			client: func(packetIO *pnet.PacketIO) error {
+				ts.mc.cmd = pnet.ComStmtSendLongData
+				ts.mc.prepStmtID = 2
+				ts.mc.dataBytes = []byte{0, 0, 'a'}
+				return ts.mc.request(packetIO)
+			},
+			proxy: ts.forwardCmd4Proxy,
+			backend: func(packetIO *pnet.PacketIO) error {
+				ts.mb.respondType = responseTypeNone
+				return ts.mb.respond(packetIO)
+			},
+		},
+		// the cursor is drained and the long data is replayed
+		{
+			proxy: func(clientIO, backendIO *pnet.PacketIO) error {
+				require.False(t, ts.mp.cmdProcessor.finishedTxn())
+				return ts.redirectSucceed4Proxy(clientIO, backendIO)
+			},
+			backend: func(packetIO *pnet.PacketIO) error {
+				// respond to COM_STMT_FETCH
+				ts.mb.respondType = responseTypeRow
+				ts.mb.rows = 2
+				ts.mb.status = pnet.ServerStatusLastRowSend
+				require.NoError(t, ts.mb.respond(packetIO))
+				// respond to COM_STMT_RESET
+				require.NoError(t, ts.respondWithNoTxn4Backend(packetIO))
+				require.NoError(t, ts.redirectSucceed4Backend(packetIO))
+				ts.tc.backendIO.ResetSequence()
+				pkt, err := ts.tc.backendIO.ReadPacket()
+				require.NoError(t, err)
+				require.Equal(t, []byte{pnet.ComStmtSendLongData.Byte(), 2, 0, 0, 0, 0, 0, 'a'}, pkt)
+				return nil
+			},
+		},
+		// fetch from the buffer without touching the backend
+		{
+			client: func(packetIO *pnet.PacketIO) error {
+				ts.mc.cmd = pnet.ComStmtFetch
+				ts.mc.prepStmtID = 1
+				ts.mc.dataBytes = pnet.DumpUint32(nil, 10)
+				return ts.mc.request(packetIO)
+			},
+			proxy: func(clientIO, backendIO *pnet.PacketIO) error {
+				require.NoError(t, ts.forwardCmd4Proxy(clientIO, backendIO))
+				require.NotContains(t, ts.mp.cmdProcessor.preparedStmtStatus, 1)
+				require.Empty(t, ts.mp.cmdProcessor.cursors)
+				return nil
+			},
+		},
+		// execute the statement with the long data
+		{
+			client: func(packetIO *pnet.PacketIO) error {
+				ts.mc.cmd = pnet.ComStmtExecute
+				ts.mc.prepStmtID = 2
+				ts.mc.dataBytes = nil
+				return ts.mc.request(packetIO)
+			},
+			proxy: func(clientIO, backendIO *pnet.PacketIO) error {
+				require.NoError(t, ts.forwardCmd4Proxy(clientIO, backendIO))
+				require.True(t, ts.mp.cmdProcessor.finishedTxn())
+				require.Equal(t, 0, ts.mp.cmdProcessor.bufferSize)
+				return nil
+			},
+			backend: ts.respondWithNoTxn4Backend,
+		},
+	}
+	ts.runTests(runners)
+}
+
+// Test that the session stays on the current backend if the cursor can't be buffered.
+func TestRedirectWithLargeCursor(t *testing.T) {
+	ts := newBackendMgrTester(t)
+	ts.mp.cmdProcessor.maxBufferSize = 1
+	runners := []runner{
+		// 1st handshake
+		{
+			client:  ts.mc.authenticate,
+			proxy:   ts.firstHandshake4Proxy,
+			backend: ts.handshake4Backend,
+		},
+		// open a cursor
+		{
+			client: func(packetIO *pnet.PacketIO) error {
+				ts.mc.cmd = pnet.ComStmtExecute
+				ts.mc.prepStmtID = 1
+				return ts.mc.request(packetIO)
+			},
+			proxy: ts.forwardCmd4Proxy,
+			backend: func(packetIO *pnet.PacketIO) error {
+				ts.mb.respondType = responseTypeResultSet
+				ts.mb.columns = 1
+				ts.mb.status = pnet.ServerStatusCursorExists
+				return ts.mb.respond(packetIO)
+			},
+		},
+		// the buffer is full after the first fetch
+		{
+			proxy: ts.redirectFail4Proxy,
+			backend: func(packetIO *pnet.PacketIO) error {
+				ts.mb.respondType = responseTypeRow
+				ts.mb.rows = 2
+				ts.mb.status = pnet.ServerStatusCursorExists
+				return ts.mb.respond(packetIO)
+			},
+		},
+		// the buffered rows are fetched first
+		{
+			client: func(packetIO *pnet.PacketIO) error {
+				ts.mc.cmd = pnet.ComStmtFetch
+				ts.mc.prepStmtID = 1
+				ts.mc.dataBytes = pnet.DumpUint32(nil, 10)
+				return ts.mc.request(packetIO)
+			},
+			proxy: func(clientIO, backendIO *pnet.PacketIO) error {
+				require.NoError(t, ts.forwardCmd4Proxy(clientIO, backendIO))
+				require.Contains(t, ts.mp.cmdProcessor.preparedStmtStatus, 1)
+				require.Equal(t, 0, ts.mp.cmdProcessor.bufferSize)
+				return nil
+			},
+		},
+		// the remaining rows are fetched from the backend
+		{
+			client: ts.mc.request,
+			proxy: func(clientIO, backendIO *pnet.PacketIO) error {
+				require.NoError(t, ts.forwardCmd4Proxy(clientIO, backendIO))
+				require.True(t, ts.mp.cmdProcessor.finishedTxn())
+				return nil
+			},
+			backend: func(packetIO *pnet.PacketIO) error {
+				ts.mb.status = pnet.ServerStatusLastRowSend
+				return ts.mb.respond(packetIO)
+			},
+		},
+	}
+	ts.runTests(runners)
+}
+
+// Test that the transaction is rolled back and the session is migrated after the deadline.
+func TestMigrationDeadlineRollback(t *testing.T) {
+	ts := newBackendMgrTester(t, func(config *testConfig) {
+		config.proxyConfig.bcConfig.TickerInterval = time.Millisecond
+	})
+	addr := ts.tc.backendListener.Addr().String()
+	prevCount, err := readForcedMigrateCounter(addr, addr, config.MigrationActionRollback)
+	require.NoError(t, err)
+	runners := []runner{
+		// 1st handshake
+		{
+			client: ts.mc.authenticate,
+			proxy: func(clientIO, backendIO *pnet.PacketIO) error {
+				require.NoError(t, ts.firstHandshake4Proxy(clientIO, backendIO))
+				ts.mp.SetValue(ConnContextKeyMigrationDeadline, config.MigrationDeadline{DeadlineMs: 1})
+				return nil
+			},
+			backend: ts.handshake4Backend,
+		},
+		// start a transaction to make it unredirect-able
+		{
+			client:  ts.mc.request,
+			proxy:   ts.forwardCmd4Proxy,
+			backend: ts.startTxn4Backend,
+		},
+		// the transaction is rolled back after the deadline
+		{
+			proxy: func(clientIO, backendIO *pnet.PacketIO) error {
+				backend1 := ts.mp.backendIO.Load()
+				ts.mp.Redirect(newMockBackendInst(ts))
+				ts.mp.getEventReceiver().(*mockEventReceiver).checkEvent(t, eventSucceed)
+				require.NotEqual(t, backend1, ts.mp.backendIO.Load())
+				return nil
+			},
+			backend: func(packetIO *pnet.PacketIO) error {
+				// respond to ROLLBACK
+				require.NoError(t, ts.respondWithNoTxn4Backend(packetIO))
+				return ts.redirectSucceed4Backend(packetIO)
+			},
+		},
+		// the next command returns an error
+		{
+			client: ts.mc.request,
+			proxy: func(clientIO, backendIO *pnet.PacketIO) error {
+				clientIO.ResetSequence()
+				request, err := clientIO.ReadPacket()
+				require.NoError(t, err)
+				return ts.mp.ExecuteCmd(context.Background(), request)
+			},
+		},
+		// the following commands are forwarded
+		{
+			client: func(packetIO *pnet.PacketIO) error {
+				require.NotNil(t, ts.mc.mysqlErr)
+				require.Contains(t, ts.mc.mysqlErr.Error(), ErrTxnRolledBack.Error())
+				ts.mc.mysqlErr = nil
+				return ts.mc.request(packetIO)
+			},
+			proxy:   ts.forwardCmd4Proxy,
+			backend: ts.respondWithNoTxn4Backend,
+		},
+	}
+	ts.runTests(runners)
+	require.Nil(t, ts.mc.mysqlErr)
+	count, err := readForcedMigrateCounter(addr, addr, config.MigrationActionRollback)
+	require.NoError(t, err)
+	require.Equal(t, prevCount+1, count)
+}
+
+// Test that the rest of the result is discarded and the session is kept once the result set exceeds the limits.
+func TestResultExceedsLimits(t *testing.T) {
+	ts := newBackendMgrTester(t)
+	runners := []runner{
+		// 1st handshake
+		{
+			client: ts.mc.authenticate,
+			proxy: func(clientIO, backendIO *pnet.PacketIO) error {
+				ts.mp.SetValue(ConnContextKeyQueryLimits, config.QueryLimits{MaxRequestBytes: 1024, MaxResultRows: 5})
+				require.NoError(t, ts.firstHandshake4Proxy(clientIO, backendIO))
+				require.EqualValues(t, 5, ts.mp.cmdProcessor.maxResultRows)
+				return nil
+			},
+			backend: ts.handshake4Backend,
+		},
+	}
+	ts.runTests(runners)
+
+	// The rest of the result set is not forwarded, so the sequences don't match.
+	ts.runAndCheck(t, func(t *testing.T, ts *testSuite) {
+		require.NoError(t, ts.mc.err)
+		require.NoError(t, ts.mb.err)
+		// The MySQL error is sent to the client and the session is kept.
+		require.NoError(t, ts.mp.err)
+		require.Equal(t, statusActive, ts.mp.closeStatus.Load())
+		require.NotNil(t, ts.mc.mysqlErr)
+		require.Contains(t, ts.mc.mysqlErr.Error(), ErrResultTooLarge.Error())
+	}, ts.mc.request, func(packetIO *pnet.PacketIO) error {
+		ts.mb.respondType = responseTypeResultSet
+		ts.mb.columns = 1
+		ts.mb.rows = 10
+		ts.mb.stmtNum = 2
+		return ts.mb.respond(packetIO)
+	}, ts.forwardCmd4Proxy)
+
+	// The session is still available.
+	ts.mc.mysqlErr = nil
+	ts.mb.stmtNum = 1
+	runners = []runner{
+		{
+			client:  ts.mc.request,
+			proxy:   ts.forwardCmd4Proxy,
+			backend: ts.respondWithNoTxn4Backend,
+		},
+	}
+	ts.runTests(runners)
+	require.Nil(t, ts.mc.mysqlErr)
+}
+
+// Test that the session is closed after the deadline, even if the deadline is shorter than the ticker interval.
+func TestMigrationDeadlineClose(t *testing.T) {
+	ts := newBackendMgrTester(t, func(config *testConfig) {
+		config.proxyConfig.bcConfig.TickerInterval = time.Hour
+	})
+	addr := ts.tc.backendListener.Addr().String()
+	prevCount, err := readForcedMigrateCounter(addr, addr, config.MigrationActionClose)
+	require.NoError(t, err)
+	runners := []runner{
+		// 1st handshake
+		{
+			client: ts.mc.authenticate,
+			proxy: func(clientIO, backendIO *pnet.PacketIO) error {
+				require.NoError(t, ts.firstHandshake4Proxy(clientIO, backendIO))
+				ts.mp.SetValue(ConnContextKeyMigrationDeadline, config.MigrationDeadline{DeadlineMs: 1, Action: config.MigrationActionClose})
+				return nil
+			},
+			backend: ts.handshake4Backend,
+		},
+		// start a transaction to make it unredirect-able
+		{
+			client:  ts.mc.request,
+			proxy:   ts.forwardCmd4Proxy,
+			backend: ts.startTxn4Backend,
+		},
+		// the session is closed after the deadline
+		{
+			proxy: func(clientIO, backendIO *pnet.PacketIO) error {
+				ts.mp.Redirect(newMockBackendInst(ts))
+				require.NoError(t, ts.checkConnClosed4Proxy(clientIO, backendIO))
+				require.Equal(t, SrcProxyQuit, ts.mp.QuitSource())
+				return nil
+			},
+		},
+	}
+	ts.runTests(runners)
+	count, err := readForcedMigrateCounter(addr, addr, config.MigrationActionClose)
+	require.NoError(t, err)
+	require.Equal(t, prevCount+1, count)
+}
+
+// Test that the new backend is connected before the transaction finishes and the session is migrated to it.
+func TestRedirectWithPreparedBackend(t *testing.T) {
+	ts := newBackendMgrTester(t)
+	var preparedIO *pnet.PacketIO
+	authCh := make(chan error, 1)
+	runners := []runner{
+		// 1st handshake
+		{
+			client:  ts.mc.authenticate,
+			proxy:   ts.firstHandshake4Proxy,
+			backend: ts.handshake4Backend,
+		},
+		// start a transaction to make it unredirect-able
+		{
+			client:  ts.mc.request,
+			proxy:   ts.forwardCmd4Proxy,
+			backend: ts.startTxn4Backend,
+		},
+		// the new backend is connected but the session is not redirected
+		{
+			proxy: func(clientIO, backendIO *pnet.PacketIO) error {
+				backend1 := ts.mp.backendIO.Load()
+				ts.mp.Redirect(newMockBackendInst(ts))
+				var pb *preparedBackend
+				require.Eventually(t, func() bool {
+					if pb = ts.getPreparedBackend(); pb == nil {
+						return false
+					}
+					select {
+					case <-pb.done:
+						return true
+					default:
+						return false
+					}
+				}, 3*time.Second, 10*time.Millisecond)
+				require.NoError(t, pb.err)
+				require.Equal(t, backend1, ts.mp.backendIO.Load())
+				return nil
+			},
+			backend: func(packetIO *pnet.PacketIO) error {
+				conn, err := ts.tc.backendListener.Accept()
+				require.NoError(t, err)
+				preparedIO = pnet.NewPacketIO(conn, ts.lg, pnet.DefaultConnBufferSize)
+				// The authentication finishes after the transaction.
+				go func() {
+					authCh <- ts.mb.authenticate(preparedIO)
+				}()
+				return nil
+			},
+		},
+		// finish the transaction and the session is redirected to the prepared backend
+		{
+			client: ts.mc.request,
+			proxy:  ts.redirectAfterCmd4Proxy,
+			backend: func(packetIO *pnet.PacketIO) error {
+				// respond to the client request
+				require.NoError(t, ts.respondWithNoTxn4Backend(packetIO))
+				// respond to `SHOW SESSION STATES`
+				ts.mb.respondType = responseTypeResultSet
+				require.NoError(t, ts.mb.respond(packetIO))
+				require.NoError(t, <-authCh)
+				// respond to `SET SESSION STATES`
+				ts.tc.backendIO = preparedIO
+				require.NoError(t, ts.respondWithNoTxn4Backend(preparedIO))
+				// previous connection is closed
+				_, err := packetIO.ReadPacket()
+				require.True(t, pnet.IsDisconnectError(err))
+				return nil
+			},
+		},
+	}
+	ts.runTests(runners)
+	require.Nil(t, ts.getPreparedBackend())
+}
+
+// Test that the proxy connects again if the prepared backend connection is closed before the session is redirected.
+func TestRedirectWithClosedPreparedBackend(t *testing.T) {
+	ts := newBackendMgrTester(t)
+	var preparedConn net.Conn
+	authCh := make(chan error, 1)
+	runners := []runner{
+		// 1st handshake
+		{
+			client:  ts.mc.authenticate,
+			proxy:   ts.firstHandshake4Proxy,
+			backend: ts.handshake4Backend,
+		},
+		// start a transaction to make it unredirect-able
+		{
+			client:  ts.mc.request,
+			proxy:   ts.forwardCmd4Proxy,
+			backend: ts.startTxn4Backend,
+		},
+		// the new backend is connected but the session is not redirected
+		{
+			proxy: func(clientIO, backendIO *pnet.PacketIO) error {
+				ts.mp.Redirect(newMockBackendInst(ts))
+				require.Eventually(t, func() bool {
+					pb := ts.getPreparedBackend()
+					if pb == nil {
+						return false
+					}
+					select {
+					case <-pb.done:
+						return true
+					default:
+						return false
+					}
+				}, 3*time.Second, 10*time.Millisecond)
+				return nil
+			},
+			backend: func(packetIO *pnet.PacketIO) error {
+				var err error
+				preparedConn, err = ts.tc.backendListener.Accept()
+				require.NoError(t, err)
+				preparedIO := pnet.NewPacketIO(preparedConn, ts.lg, pnet.DefaultConnBufferSize)
+				go func() {
+					authCh <- ts.mb.authenticate(preparedIO)
+				}()
+				return nil
+			},
+		},
+		// the prepared connection is closed and the session is redirected to a new connection
+		{
+			client: ts.mc.request,
+			proxy:  ts.redirectAfterCmd4Proxy,
+			backend: func(packetIO *pnet.PacketIO) error {
+				require.NoError(t, preparedConn.Close())
+				<-authCh
+				// respond to the client request
+				require.NoError(t, ts.respondWithNoTxn4Backend(packetIO))
+				// respond to `SHOW SESSION STATES`
+				ts.mb.respondType = responseTypeResultSet
+				require.NoError(t, ts.mb.respond(packetIO))
+				conn, err := ts.tc.backendListener.Accept()
+				require.NoError(t, err)
+				newIO := pnet.NewPacketIO(conn, ts.lg, pnet.DefaultConnBufferSize)
+				require.NoError(t, ts.mb.authenticate(newIO))
+				// respond to `SET SESSION STATES`
+				ts.tc.backendIO = newIO
+				require.NoError(t, ts.respondWithNoTxn4Backend(newIO))
+				// previous connection is closed
+				_, err = packetIO.ReadPacket()
+				require.True(t, pnet.IsDisconnectError(err))
+				return nil
+			},
+		},
+	}
+	ts.runTests(runners)
+	require.Nil(t, ts.getPreparedBackend())
+}
+
+// Test that the prepared backend connection is abandoned once the target becomes unhealthy.
+func TestAbandonPreparedBackend(t *testing.T) {
+	ts := newBackendMgrTester(t, func(config *testConfig) {
+		config.proxyConfig.bcConfig.TickerInterval = time.Millisecond
+	})
+	backendInst := newMockBackendInst(ts)
+	runners := []runner{
+		// 1st handshake
+		{
+			client:  ts.mc.authenticate,
+			proxy:   ts.firstHandshake4Proxy,
+			backend: ts.handshake4Backend,
+		},
+		// start a transaction to make it unredirect-able
+		{
+			client:  ts.mc.request,
+			proxy:   ts.forwardCmd4Proxy,
+			backend: ts.startTxn4Backend,
+		},
+		// the prepared connection is closed after the target becomes unhealthy
+		{
+			proxy: func(clientIO, backendIO *pnet.PacketIO) error {
+				ts.mp.Redirect(backendInst)
+				require.Eventually(t, func() bool {
+					return ts.getPreparedBackend() != nil
+				}, 3*time.Second, 10*time.Millisecond)
+				backendInst.setHealthy(false)
+				require.Eventually(t, func() bool {
+					return ts.getPreparedBackend() == nil
+				}, 3*time.Second, 10*time.Millisecond)
+				return nil
+			},
+			backend: func(packetIO *pnet.PacketIO) error {
+				conn, err := ts.tc.backendListener.Accept()
+				require.NoError(t, err)
+				preparedIO := pnet.NewPacketIO(conn, ts.lg, pnet.DefaultConnBufferSize)
+				// The proxy closes the connection before authentication, so the error is ignored.
+				_ = ts.mb.authenticate(preparedIO)
+				return preparedIO.Close()
+			},
+		},
+		// finish the transaction and the redirection fails
+		{
+			client: ts.mc.request,
+			proxy: func(clientIO, backendIO *pnet.PacketIO) error {
+				backend1 := ts.mp.backendIO.Load()
+				require.NoError(t, ts.forwardCmd4Proxy(clientIO, backendIO))
+				ts.mp.getEventReceiver().(*mockEventReceiver).checkEvent(t, eventFail)
+				require.Equal(t, backend1, ts.mp.backendIO.Load())
+				return nil
+			},
+			backend: ts.respondWithNoTxn4Backend,
+		},
+	}
+	ts.runTests(runners)
+}
+
 // Test that the proxy sends the right handshake info after COM_CHANGE_USER and COM_SET_OPTION.
 func TestSpecialCmds(t *testing.T) {
 	ts := newBackendMgrTester(t)
@@ -790,6 +1354,33 @@ func TestHandlerReturnError(t *testing.T) {
 			errMsg:     ErrProxyNoBackend.Error(),
 			quitSource: SrcProxyNoBackend,
 		},
+		{
+			cfg: func(config *testConfig) {
+				config.proxyConfig.handler.getRouter = func(ctx ConnContext, resp *pnet.HandshakeResp) (router.Router, error) {
+					return nil, errors.Wrap(ErrClientNoTLS, namespace.ErrInsecureTransport)
+				}
+			},
+			errMsg:     ErrClientNoTLS.Error(),
+			quitSource: SrcClientHandshake,
+		},
+		{
+			cfg: func(config *testConfig) {
+				config.proxyConfig.handler.getRouter = func(ctx ConnContext, resp *pnet.HandshakeResp) (router.Router, error) {
+					return nil, errors.Wrap(ErrClientHostDenied, namespace.ErrHostNotAllowed)
+				}
+			},
+			errMsg:     "is not allowed to connect",
+			quitSource: SrcClientHandshake,
+		},
+		{
+			cfg: func(config *testConfig) {
+				config.proxyConfig.handler.handleHandshakeResp = func(ctx ConnContext, resp *pnet.HandshakeResp) error {
+					return mysql.NewError(mysql.ER_ACCESS_DENIED_ERROR, "denied by policy")
+				}
+			},
+			errMsg:     "denied by policy",
+			quitSource: SrcClientAuthFail,
+		},
 	}
 	for _, test := range tests {
 		ts := newBackendMgrTester(t, test.cfg)
@@ -1331,6 +1922,8 @@ func TestDisconnectLog(t *testing.T) {
 				require.True(t, pnet.IsDisconnectError(ts.mc.err))
 				require.ErrorIs(t, ts.mp.err, ErrBackendConn)
 				require.True(t, strings.Contains(ts.mp.text.String(), "select ?"))
+				// the read error is reported for passive health check
+				require.Equal(t, 1, ts.mp.getEventReceiver().(*mockEventReceiver).getFailures(observer.TrafficErrRead))
 			},
 		},
 	}
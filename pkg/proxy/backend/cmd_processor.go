@@ -6,6 +6,8 @@ package backend
 import (
 	"encoding/binary"
 
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/pingcap/tiproxy/lib/util/errors"
 	pnet "github.com/pingcap/tiproxy/pkg/proxy/net"
 	"go.uber.org/zap"
 )
@@ -17,30 +19,85 @@ const (
 	StatusPrepareWaitFetch
 )
 
+// SessionState is the session state tracked from the session state changes in OK packets.
+// The changes only exist when both the client and the backend support CLIENT_SESSION_TRACK.
+type SessionState struct {
+	// DB is also tracked from COM_INIT_DB and COM_CHANGE_USER in case the session state changes are unavailable.
+	DB string
+	// SysVars only contains the system variables reported by the backend.
+	SysVars            map[string]string
+	GTIDs              string
+	TxnCharacteristics string
+	TxnState           string
+}
+
 // CmdProcessor maintains the transaction and prepared statement status and decides whether the session can be redirected.
 type CmdProcessor struct {
 	// Each prepared statement has an independent status.
 	preparedStmtStatus map[int]uint32
-	capability         pnet.Capability
+	// stmtParams is used to parse the query attributes in COM_STMT_EXECUTE.
+	stmtParams map[int]*pnet.StmtParams
+	capability pnet.Capability
+	// backendCapability is the capability negotiated with the current backend.
+	backendCapability pnet.Capability
 	// Only includes in_trans or quit status.
 	serverStatus uint32
-	logger       *zap.Logger
+	sessionState SessionState
+	// longData and cursors are buffered so that the session can be migrated with pending long data or open cursors.
+	longData map[int]*longDataBuffer
+	cursors  map[int]*cursorBuffer
+	// bufferSize is the total size of longData and cursors, which is limited by maxBufferSize.
+	bufferSize    int
+	maxBufferSize int
+	// maxResultRows and maxResultBytes limit each result set forwarded to the client. 0 means no limit.
+	maxResultRows  int64
+	maxResultBytes int64
+	// maxLoadBytes limits the file of each LOAD DATA LOCAL INFILE and loadBytesPerSecond throttles it. 0 means no limit.
+	maxLoadBytes       int64
+	loadBytesPerSecond int64
+	// denyChangeUser rejects COM_CHANGE_USER because it bypasses the authentication of the proxy.
+	denyChangeUser bool
+	// queryAttrs are the query attributes of the current command.
+	queryAttrs []pnet.QueryAttr
+	logger     *zap.Logger
 }
 
 func NewCmdProcessor(logger *zap.Logger) *CmdProcessor {
 	return &CmdProcessor{
 		serverStatus:       0,
 		preparedStmtStatus: make(map[int]uint32),
+		stmtParams:         make(map[int]*pnet.StmtParams),
+		longData:           make(map[int]*longDataBuffer),
+		cursors:            make(map[int]*cursorBuffer),
 		logger:             logger,
 	}
 }
 
 func (cp *CmdProcessor) handleOKPacket(request, response []byte) uint16 {
-	status := pnet.ParseOKPacket(response)
+	// The session state changes are requested from the backend even if the client doesn't negotiate them.
+	status, changes, err := pnet.ParseOKPacketWithSessionState(response, cp.backendCapability)
+	if err != nil {
+		// The packet is still forwarded to the client, so just ignore the changes.
+		cp.logger.Warn("parse session state changes encounters error", zap.Error(err))
+	}
 	cp.updateServerStatus(request, status)
+	cp.updateSessionState(request, changes)
 	return status
 }
 
+// writeOKPacket writes the OK packet of the backend to the client.
+// The session state changes are removed if the client doesn't negotiate CLIENT_SESSION_TRACK.
+func (cp *CmdProcessor) writeOKPacket(clientIO *pnet.PacketIO, response []byte, flush bool) error {
+	if cp.backendCapability&pnet.ClientSessionTrack > 0 && cp.capability&pnet.ClientSessionTrack == 0 {
+		if pkt, err := pnet.RemoveSessionState(response); err != nil {
+			cp.logger.Warn("remove session state changes encounters error", zap.Error(err))
+		} else {
+			response = pkt
+		}
+	}
+	return clientIO.WritePacket(response, flush)
+}
+
 func (cp *CmdProcessor) handleErrorPacket(data []byte) error {
 	return pnet.ParseErrorPacket(data)
 }
@@ -75,6 +132,7 @@ func (cp *CmdProcessor) updatePrepStmtStatus(request []byte, serverStatus uint16
 		stmtID = int(binary.LittleEndian.Uint32(request[1:5]))
 	case pnet.ComResetConnection, pnet.ComChangeUser:
 		cp.preparedStmtStatus = make(map[int]uint32)
+		cp.stmtParams = make(map[int]*pnet.StmtParams)
 		return
 	default:
 		return
@@ -98,6 +156,142 @@ func (cp *CmdProcessor) updatePrepStmtStatus(request []byte, serverStatus uint16
 	}
 }
 
+func (cp *CmdProcessor) updateSessionState(request []byte, changes []pnet.SessionStateChange) {
+	switch pnet.Command(request[0]) {
+	case pnet.ComInitDB:
+		cp.sessionState.DB = string(request[1:])
+	case pnet.ComResetConnection, pnet.ComChangeUser:
+		// The system variables are reset to the global values.
+		cp.sessionState.SysVars = nil
+		cp.sessionState.TxnCharacteristics = ""
+	}
+	for _, change := range changes {
+		switch change.Type {
+		case pnet.SessionTrackSystemVariables:
+			if cp.sessionState.SysVars == nil {
+				cp.sessionState.SysVars = make(map[string]string)
+			}
+			cp.sessionState.SysVars[change.Name] = change.Value
+		case pnet.SessionTrackSchema:
+			cp.sessionState.DB = change.Value
+		case pnet.SessionTrackGtids:
+			cp.sessionState.GTIDs = change.Value
+		case pnet.SessionTrackTransactionCharacteristics:
+			cp.sessionState.TxnCharacteristics = change.Value
+		case pnet.SessionTrackTransactionState:
+			cp.sessionState.TxnState = change.Value
+		}
+	}
+}
+
+// SessionState returns a copy of the tracked session state.
+func (cp *CmdProcessor) SessionState() SessionState {
+	state := cp.sessionState
+	if len(state.SysVars) > 0 {
+		state.SysVars = make(map[string]string, len(cp.sessionState.SysVars))
+		for name, value := range cp.sessionState.SysVars {
+			state.SysVars[name] = value
+		}
+	}
+	return state
+}
+
+// handleQueryAttrs parses the query attributes in COM_QUERY and COM_STMT_EXECUTE.
+// It returns the request without attributes if the backend doesn't support CLIENT_QUERY_ATTRIBUTES.
+// The parse errors are ignored if the backend supports it, because the backend reports them by itself.
+func (cp *CmdProcessor) handleQueryAttrs(request []byte) ([]byte, error) {
+	cp.queryAttrs = nil
+	if cp.capability&pnet.ClientQueryAttributes == 0 {
+		return request, nil
+	}
+	var (
+		attrs    []pnet.QueryAttr
+		stripped []byte
+		err      error
+	)
+	switch pnet.Command(request[0]) {
+	case pnet.ComQuery:
+		var query []byte
+		if attrs, query, err = pnet.ParseQueryAttrs(request); err == nil {
+			stripped = append([]byte{request[0]}, query...)
+		}
+	case pnet.ComStmtExecute:
+		if len(request) < 5 {
+			err = errors.WithStack(mysql.ErrMalformPacket)
+			break
+		}
+		params, ok := cp.stmtParams[int(binary.LittleEndian.Uint32(request[1:5]))]
+		if !ok {
+			// The statement doesn't exist and the backend will report an error.
+			return request, nil
+		}
+		attrs, stripped, err = pnet.ParseStmtExecuteAttrs(request, params)
+		// The long data is consumed by the execution.
+		params.LongData = nil
+	default:
+		return request, nil
+	}
+	if cp.backendCapability&pnet.ClientQueryAttributes > 0 {
+		if err != nil {
+			cp.logger.Debug("parse query attributes encounters error", zap.Error(err))
+		} else {
+			cp.queryAttrs = attrs
+		}
+		return request, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cp.queryAttrs = attrs
+	return stripped, nil
+}
+
+// updateStmtParams maintains the parameter information of the prepared statements, which is used to parse the query attributes.
+func (cp *CmdProcessor) updateStmtParams(request []byte) {
+	cmd := pnet.Command(request[0])
+	switch cmd {
+	case pnet.ComStmtSendLongData, pnet.ComStmtReset, pnet.ComStmtClose:
+	default:
+		return
+	}
+	if len(request) < 5 {
+		return
+	}
+	stmtID := int(binary.LittleEndian.Uint32(request[1:5]))
+	params, ok := cp.stmtParams[stmtID]
+	if !ok {
+		return
+	}
+	switch cmd {
+	case pnet.ComStmtSendLongData:
+		if len(request) >= 7 {
+			if params.LongData == nil {
+				params.LongData = make(map[int]struct{})
+			}
+			params.LongData[int(binary.LittleEndian.Uint16(request[5:7]))] = struct{}{}
+		}
+	case pnet.ComStmtReset:
+		params.LongData = nil
+	case pnet.ComStmtClose:
+		delete(cp.stmtParams, stmtID)
+	}
+}
+
+// QueryAttrs returns the query attributes of the current command.
+func (cp *CmdProcessor) QueryAttrs() []pnet.QueryAttr {
+	return cp.queryAttrs
+}
+
+// parseQuery returns the statement in the COM_QUERY packet.
+func (cp *CmdProcessor) parseQuery(request []byte) string {
+	if cp.capability&pnet.ClientQueryAttributes > 0 {
+		if _, query, err := pnet.ParseQueryAttrs(request); err == nil {
+			return pnet.ParseQueryPacket(query)
+		}
+	}
+	return pnet.ParseQueryPacket(request[1:])
+}
+
 func (cp *CmdProcessor) finishedTxn() bool {
 	if cp.serverStatus&(StatusInTrans|StatusQuit) > 0 {
 		return false
@@ -4,21 +4,23 @@
 package backend
 
 import (
+	"context"
 	"encoding/binary"
 	"strings"
+	"time"
 
 	"github.com/go-mysql-org/go-mysql/mysql"
 	"github.com/pingcap/tidb/parser"
 	"github.com/pingcap/tiproxy/lib/util/errors"
 	pnet "github.com/pingcap/tiproxy/pkg/proxy/net"
-	"github.com/siddontang/go/hack"
+	"github.com/pingcap/tiproxy/pkg/util/monotime"
 	"go.uber.org/zap"
 )
 
 // executeCmd forwards requests and responses between the client and the backend.
 // holdRequest: should the proxy send the request to the new backend.
 // err: unexpected errors or MySQL errors.
-func (cp *CmdProcessor) executeCmd(request []byte, clientIO, backendIO *pnet.PacketIO, waitingRedirect bool) (holdRequest bool, err error) {
+func (cp *CmdProcessor) executeCmd(ctx context.Context, request []byte, clientIO, backendIO *pnet.PacketIO, waitingRedirect bool) (holdRequest bool, err error) {
 	backendIO.ResetSequence()
 	if waitingRedirect && cp.needHoldRequest(request) {
 		var response []byte
@@ -34,11 +36,31 @@ func (cp *CmdProcessor) executeCmd(request []byte, clientIO, backendIO *pnet.Pac
 		}
 		return true, err
 	}
-	return false, cp.forwardCommand(clientIO, backendIO, request)
+	return false, cp.forwardCommand(ctx, clientIO, backendIO, request)
 }
 
-func (cp *CmdProcessor) forwardCommand(clientIO, backendIO *pnet.PacketIO, request []byte) error {
+func (cp *CmdProcessor) forwardCommand(ctx context.Context, clientIO, backendIO *pnet.PacketIO, request []byte) error {
 	cmd := pnet.Command(request[0])
+	if cmd == pnet.ComChangeUser && cp.denyChangeUser {
+		return cp.denyChangeUserCmd(clientIO)
+	}
+	request, err := cp.handleQueryAttrs(request)
+	if err != nil {
+		// The attributes can't be stripped for the backend, so reject the request and keep the session.
+		cp.logger.Debug("reject the request with malformed query attributes", zap.Error(err))
+		myErr := mysql.NewDefaultError(mysql.ER_MALFORMED_PACKET)
+		if writeErr := clientIO.WriteErrPacket(myErr); writeErr != nil {
+			return writeErr
+		}
+		return myErr
+	}
+	cp.updateStmtParams(request)
+	if cmd == pnet.ComStmtFetch {
+		if served, err := cp.fetchFromBuffer(clientIO, request); served {
+			return err
+		}
+	}
+	cp.releaseStmtBuffers(request)
 	// ComChangeUser is special: we need to modify the packet before forwarding.
 	if cmd != pnet.ComChangeUser {
 		if err := backendIO.WritePacket(request, true); err != nil {
@@ -51,7 +73,7 @@ func (cp *CmdProcessor) forwardCommand(clientIO, backendIO *pnet.PacketIO, reque
 	case pnet.ComStmtFetch:
 		return cp.forwardFetchCmd(clientIO, backendIO, request)
 	case pnet.ComQuery, pnet.ComStmtExecute, pnet.ComProcessInfo:
-		return cp.forwardQueryCmd(clientIO, backendIO, request)
+		return cp.forwardQueryCmd(ctx, clientIO, backendIO, request)
 	case pnet.ComStmtClose:
 		return cp.forwardCloseCmd(request)
 	case pnet.ComStmtSendLongData:
@@ -67,23 +89,26 @@ func (cp *CmdProcessor) forwardCommand(clientIO, backendIO *pnet.PacketIO, reque
 	}
 
 	// For other commands, an OK / Error / EOF packet is expected.
-	response, err := forwardOnePacket(clientIO, backendIO, true)
+	response, err := backendIO.ReadPacket()
 	if err != nil {
 		return err
 	}
 	switch response[0] {
 	case pnet.OKHeader.Byte():
 		cp.handleOKPacket(request, response)
-		return nil
+		return cp.writeOKPacket(clientIO, response, true)
 	case pnet.ErrHeader.Byte():
+		if err := clientIO.WritePacket(response, true); err != nil {
+			return err
+		}
 		return cp.handleErrorPacket(response)
 	case pnet.EOFHeader.Byte():
 		if cp.capability&pnet.ClientDeprecateEOF == 0 {
 			cp.handleEOFPacket(request, response)
-		} else {
-			cp.handleOKPacket(request, response)
+			return clientIO.WritePacket(response, true)
 		}
-		return nil
+		cp.handleOKPacket(request, response)
+		return cp.writeOKPacket(clientIO, response, true)
 	}
 	// impossible here
 	return errors.Errorf("unexpected response, cmd:%d resp:%d", cmd, response[0])
@@ -96,33 +121,90 @@ func forwardOnePacket(destIO, srcIO *pnet.PacketIO, flush bool) (data []byte, er
 	return data, destIO.WritePacket(data, flush)
 }
 
-func (cp *CmdProcessor) forwardUntilResultEnd(clientIO, backendIO *pnet.PacketIO, request []byte) (uint16, error) {
+// forwardUntilResultEnd forwards the rows until the end of the result set.
+// If checkLimits is true, it stops forwarding once the rows exceed the limits and discards the rest of the rows.
+func (cp *CmdProcessor) forwardUntilResultEnd(clientIO, backendIO *pnet.PacketIO, request []byte, checkLimits bool) (uint16, error) {
 	var serverStatus uint16
-	err := backendIO.ForwardUntil(clientIO, func(firstByte byte, length int) (end, needData bool) {
-		switch {
-		case pnet.IsErrorPacket(firstByte):
-			return true, true
-		case cp.capability&pnet.ClientDeprecateEOF == 0:
-			return pnet.IsEOFPacket(firstByte, length), true
-		default:
-			return pnet.IsResultSetOKPacket(firstByte, length), true
+	var rows, bytes int64
+	for {
+		var largeRow, finished bool
+		err := backendIO.ForwardUntil(clientIO, func(firstByte byte, length int) (end, needData bool, err error) {
+			switch {
+			case pnet.IsErrorPacket(firstByte):
+				return true, true, nil
+			case cp.capability&pnet.ClientDeprecateEOF == 0:
+				end = pnet.IsEOFPacket(firstByte, length)
+			default:
+				end = pnet.IsResultSetOKPacket(firstByte, length)
+			}
+			if end || !checkLimits {
+				return end, true, nil
+			}
+			rows++
+			// The row is split into multiple packets, so read the whole row to count its bytes.
+			if largeRow = length >= pnet.MaxPayloadLen; largeRow {
+				return true, true, nil
+			}
+			bytes += int64(length) + 4
+			return false, true, cp.checkResultLimits(rows, bytes)
+		}, func(response []byte) error {
+			if largeRow {
+				bytes += int64(len(response)) + 4*int64(len(response)/pnet.MaxPayloadLen+1)
+				if err := cp.checkResultLimits(rows, bytes); err != nil {
+					return err
+				}
+				return clientIO.WritePacket(response, false)
+			}
+			finished = true
+			switch {
+			case pnet.IsErrorPacket(response[0]):
+				if err := clientIO.WritePacket(response, true); err != nil {
+					return err
+				}
+				return cp.handleErrorPacket(response)
+			case cp.capability&pnet.ClientDeprecateEOF == 0:
+				serverStatus = cp.handleEOFPacket(request, response)
+				return clientIO.WritePacket(response, true)
+			default:
+				serverStatus = cp.handleOKPacket(request, response)
+				return cp.writeOKPacket(clientIO, response, true)
+			}
+		})
+		if errors.Is(err, ErrResultTooLarge) {
+			// The backend can't receive the next command until the result set ends.
+			var discardErr error
+			if serverStatus, discardErr = cp.discardRows(backendIO, request); discardErr != nil {
+				return serverStatus, discardErr
+			}
+			return serverStatus, err
+		}
+		if err != nil || finished {
+			return serverStatus, err
+		}
+	}
+}
+
+// discardRows reads the rest of the rows until the end of the result set without forwarding them.
+func (cp *CmdProcessor) discardRows(backendIO *pnet.PacketIO, request []byte) (uint16, error) {
+	for {
+		response, err := backendIO.ReadPacket()
+		if err != nil {
+			return 0, err
 		}
-	}, func(response []byte) error {
 		switch {
 		case pnet.IsErrorPacket(response[0]):
-			if err := clientIO.Flush(); err != nil {
-				return err
-			}
-			return cp.handleErrorPacket(response)
+			// Subsequent statements won't be executed even if it's a multi-statement.
+			return 0, nil
 		case cp.capability&pnet.ClientDeprecateEOF == 0:
-			serverStatus = cp.handleEOFPacket(request, response)
-			return clientIO.Flush()
+			if pnet.IsEOFPacket(response[0], len(response)) {
+				return cp.handleEOFPacket(request, response), nil
+			}
 		default:
-			serverStatus = cp.handleOKPacket(request, response)
-			return clientIO.Flush()
+			if pnet.IsResultSetOKPacket(response[0], len(response)) {
+				return cp.handleOKPacket(request, response), nil
+			}
 		}
-	})
-	return serverStatus, err
+	}
 }
 
 func (cp *CmdProcessor) forwardPrepareCmd(clientIO, backendIO *pnet.PacketIO) error {
@@ -136,6 +218,9 @@ func (cp *CmdProcessor) forwardPrepareCmd(clientIO, backendIO *pnet.PacketIO) er
 		// See https://mariadb.com/kb/en/com_stmt_prepare/
 		numColumns := binary.LittleEndian.Uint16(response[5:])
 		numParams := binary.LittleEndian.Uint16(response[7:])
+		if cp.capability&pnet.ClientQueryAttributes > 0 {
+			cp.stmtParams[int(binary.LittleEndian.Uint32(response[1:5]))] = &pnet.StmtParams{NumParams: int(numParams)}
+		}
 		expectedPackets := int(numColumns) + int(numParams)
 		if cp.capability&pnet.ClientDeprecateEOF == 0 {
 			if numColumns > 0 {
@@ -148,9 +233,9 @@ func (cp *CmdProcessor) forwardPrepareCmd(clientIO, backendIO *pnet.PacketIO) er
 		// Ignore this status because PREPARE doesn't affect status.
 		if expectedPackets > 0 {
 			i := 0
-			err = backendIO.ForwardUntil(clientIO, func(firstByte byte, firstPktLen int) (end, needData bool) {
+			err = backendIO.ForwardUntil(clientIO, func(firstByte byte, firstPktLen int) (end, needData bool, err error) {
 				i++
-				return i >= expectedPackets, false
+				return i >= expectedPackets, false, nil
 			}, nil)
 			if err != nil {
 				return err
@@ -168,46 +253,60 @@ func (cp *CmdProcessor) forwardPrepareCmd(clientIO, backendIO *pnet.PacketIO) er
 }
 
 func (cp *CmdProcessor) forwardFetchCmd(clientIO, backendIO *pnet.PacketIO, request []byte) error {
-	_, err := cp.forwardUntilResultEnd(clientIO, backendIO, request)
+	serverStatus, err := cp.forwardUntilResultEnd(clientIO, backendIO, request, true)
+	if errors.Is(err, ErrResultTooLarge) {
+		return cp.abortQuery(clientIO, backendIO, request, serverStatus, err)
+	}
 	return err
 }
 
 func (cp *CmdProcessor) forwardFieldListCmd(clientIO, backendIO *pnet.PacketIO, request []byte) error {
-	_, err := cp.forwardUntilResultEnd(clientIO, backendIO, request)
+	_, err := cp.forwardUntilResultEnd(clientIO, backendIO, request, false)
 	return err
 }
 
-func (cp *CmdProcessor) forwardQueryCmd(clientIO, backendIO *pnet.PacketIO, request []byte) error {
+func (cp *CmdProcessor) forwardQueryCmd(ctx context.Context, clientIO, backendIO *pnet.PacketIO, request []byte) error {
 	for {
 		var serverStatus uint16
 		var first byte
-		err := backendIO.ForwardUntil(clientIO, func(firstByte byte, _ int) (end, needData bool) {
+		err := backendIO.ForwardUntil(clientIO, func(firstByte byte, _ int) (end, needData bool, err error) {
 			first = firstByte
-			switch firstByte {
-			case pnet.OKHeader.Byte(), pnet.ErrHeader.Byte():
-				return true, true
-			default:
-				return true, false
+			// TiDB refuses the load if CLIENT_LOCAL_FILES is cleared, but a backend may still ask for the file.
+			// Stop before forwarding the request because the client may send the file even if the namespace disables it.
+			if firstByte == pnet.LocalInFileHeader.Byte() && cp.capability&pnet.ClientLocalFiles == 0 {
+				return false, false, ErrLoadDataDisabled
 			}
+			// The column count of the result set is needed to skip the columns when counting rows.
+			return true, true, nil
 		}, func(response []byte) error {
 			var err error
 			switch first {
 			case pnet.OKHeader.Byte():
 				serverStatus = cp.handleOKPacket(request, response)
-				err = clientIO.Flush()
+				return cp.writeOKPacket(clientIO, response, true)
 			case pnet.ErrHeader.Byte():
-				if err = clientIO.Flush(); err != nil {
+				if err = clientIO.WritePacket(response, true); err != nil {
 					return err
 				}
 				// Subsequent statements won't be executed even if it's a multi-statement.
 				return cp.handleErrorPacket(response)
-			case pnet.LocalInFileHeader.Byte():
-				serverStatus, err = cp.forwardLoadInFile(clientIO, backendIO, request)
-			default:
-				serverStatus, err = cp.forwardResultSet(clientIO, backendIO, request)
+			}
+			if err = clientIO.WritePacket(response, false); err != nil {
+				return err
+			}
+			if first == pnet.LocalInFileHeader.Byte() {
+				serverStatus, err = cp.forwardLoadInFile(ctx, clientIO, backendIO, request)
+			} else {
+				serverStatus, err = cp.forwardResultSet(clientIO, backendIO, request, response)
 			}
 			return err
 		})
+		if errors.Is(err, ErrLoadDataDisabled) {
+			return cp.rejectLoadInFile(clientIO, backendIO, request)
+		}
+		if errors.Is(err, ErrResultTooLarge) || errors.Is(err, ErrLoadDataTooLarge) {
+			return cp.abortQuery(clientIO, backendIO, request, serverStatus, err)
+		}
 		if err != nil {
 			return err
 		}
@@ -219,15 +318,29 @@ func (cp *CmdProcessor) forwardQueryCmd(clientIO, backendIO *pnet.PacketIO, requ
 	return nil
 }
 
-func (cp *CmdProcessor) forwardLoadInFile(clientIO, backendIO *pnet.PacketIO, request []byte) (serverStatus uint16, err error) {
+func (cp *CmdProcessor) forwardLoadInFile(ctx context.Context, clientIO, backendIO *pnet.PacketIO, request []byte) (serverStatus uint16, err error) {
 	if err = clientIO.Flush(); err != nil {
 		return
 	}
+	startTime := monotime.Now()
+	var bytes, rows int64
+	defer func() {
+		duration := monotime.Since(startTime)
+		addLoadDataMetrics(backendIO.RemoteAddr().String(), bytes, rows, duration)
+		cp.logger.Debug("load data finished", zap.Int64("bytes", bytes), zap.Duration("duration", duration), zap.Int64("rows", rows), zap.Error(err))
+	}()
 	// The client sends file data until an empty packet.
 	for {
 		var data []byte
 		// Do not call PacketIO.ForwardUntil. It peeks 5 bytes but there may be only 4 bytes here.
-		if data, err = forwardOnePacket(backendIO, clientIO, false); err != nil {
+		if data, err = clientIO.ReadPacket(); err != nil {
+			return
+		}
+		bytes += int64(len(data))
+		if cp.maxLoadBytes > 0 && bytes > cp.maxLoadBytes {
+			return cp.discardLoadInFile(clientIO, backendIO, request, data)
+		}
+		if err = backendIO.WritePacket(data, false); err != nil {
 			return
 		}
 		if len(data) == 0 {
@@ -236,43 +349,203 @@ func (cp *CmdProcessor) forwardLoadInFile(clientIO, backendIO *pnet.PacketIO, re
 			}
 			break
 		}
+		if err = cp.throttleLoad(ctx, backendIO, bytes, monotime.Since(startTime)); err != nil {
+			return
+		}
 	}
 	var response []byte
-	if response, err = forwardOnePacket(clientIO, backendIO, true); err != nil {
+	if response, err = backendIO.ReadPacket(); err != nil {
 		return
 	}
 	switch response[0] {
 	case pnet.OKHeader.Byte():
-		return cp.handleOKPacket(request, response), nil
+		affectedRows, _, _ := pnet.ParseLengthEncodedInt(response[1:])
+		rows = int64(affectedRows)
+		serverStatus = cp.handleOKPacket(request, response)
+		return serverStatus, cp.writeOKPacket(clientIO, response, true)
 	case pnet.ErrHeader.Byte():
+		if err = clientIO.WritePacket(response, true); err != nil {
+			return
+		}
 		return serverStatus, cp.handleErrorPacket(response)
 	}
 	// impossible here
 	return serverStatus, errors.Errorf("unexpected response, cmd:%d resp:%d", pnet.ComQuery, response[0])
 }
 
-func (cp *CmdProcessor) forwardResultSet(clientIO, backendIO *pnet.PacketIO, request []byte) (uint16, error) {
+// discardLoadInFile discards the rest of the file once it exceeds the limit, and then ends the file for the backend
+// so that the backend can receive the next command. The data that has been sent may still be loaded by the backend.
+func (cp *CmdProcessor) discardLoadInFile(clientIO, backendIO *pnet.PacketIO, request, data []byte) (serverStatus uint16, err error) {
+	loadErr := errors.Wrapf(ErrLoadDataTooLarge, "the file has more than %d bytes", cp.maxLoadBytes)
+	for len(data) > 0 {
+		if data, err = clientIO.ReadPacket(); err != nil {
+			return
+		}
+	}
+	if err = backendIO.WritePacket(nil, true); err != nil {
+		return
+	}
+	var response []byte
+	if response, err = backendIO.ReadPacket(); err != nil {
+		return
+	}
+	switch response[0] {
+	case pnet.OKHeader.Byte():
+		serverStatus = cp.handleOKPacket(request, response)
+	case pnet.ErrHeader.Byte():
+		// Subsequent statements won't be executed even if it's a multi-statement.
+	default:
+		return serverStatus, errors.Errorf("unexpected response, cmd:%d resp:%d", pnet.ComQuery, response[0])
+	}
+	return serverStatus, loadErr
+}
+
+// throttleLoad waits until the file data sent to the backend is within the bandwidth limit.
+// The wait is interrupted once the connection is canceled because the caller holds the process lock.
+func (cp *CmdProcessor) throttleLoad(ctx context.Context, backendIO *pnet.PacketIO, bytes int64, elapsed time.Duration) error {
+	if cp.loadBytesPerSecond <= 0 {
+		return nil
+	}
+	expected := time.Duration(float64(bytes) / float64(cp.loadBytesPerSecond) * float64(time.Second))
+	if expected <= elapsed {
+		return nil
+	}
+	// Send the buffered data before waiting so that the backend isn't blocked by the proxy.
+	if err := backendIO.Flush(); err != nil {
+		return err
+	}
+	timer := time.NewTimer(expected - elapsed)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	case <-timer.C:
+		return nil
+	}
+}
+
+// rejectLoadInFile answers the file request of the backend with an empty file instead of forwarding it to the client,
+// and then returns an error to the client. The remaining results of the query are discarded so that the session is kept.
+func (cp *CmdProcessor) rejectLoadInFile(clientIO, backendIO *pnet.PacketIO, request []byte) error {
+	if err := cp.discardResults(backendIO, request); err != nil {
+		return err
+	}
+	myErr := mysql.NewError(mysql.ER_NOT_ALLOWED_COMMAND, ErrLoadDataDisabled.Error())
+	if err := clientIO.WriteErrPacket(myErr); err != nil {
+		return err
+	}
+	return errors.Wrap(ErrLoadDataDisabled, myErr)
+}
+
+// abortQuery discards the remaining results of the query whose result set or file exceeds the limits,
+// and then returns an error to the client. The forwarded rows are followed by the error, which is valid in the MySQL protocol.
+func (cp *CmdProcessor) abortQuery(clientIO, backendIO *pnet.PacketIO, request []byte, serverStatus uint16, err error) error {
+	cp.logger.Warn("abort the query because it exceeds the limit of the namespace", zap.String("backend_addr", backendIO.RemoteAddr().String()), zap.Error(err))
+	if serverStatus&pnet.ServerMoreResultsExists > 0 {
+		if discardErr := cp.discardResults(backendIO, request); discardErr != nil {
+			return discardErr
+		}
+	}
+	myErr := mysql.NewError(mysql.ER_UNKNOWN_ERROR, err.Error())
+	if writeErr := clientIO.WriteErrPacket(myErr); writeErr != nil {
+		return writeErr
+	}
+	return errors.Wrap(err, myErr)
+}
+
+// discardResults reads the results of the query until no more results exist, without forwarding them.
+// The file requests are answered with empty files.
+func (cp *CmdProcessor) discardResults(backendIO *pnet.PacketIO, request []byte) error {
+	for {
+		response, err := backendIO.ReadPacket()
+		if err != nil {
+			return err
+		}
+		var serverStatus uint16
+		switch response[0] {
+		case pnet.LocalInFileHeader.Byte():
+			// An empty packet indicates the end of the file.
+			if err = backendIO.WritePacket(nil, true); err != nil {
+				return err
+			}
+			continue
+		case pnet.OKHeader.Byte():
+			serverStatus = cp.handleOKPacket(request, response)
+		case pnet.ErrHeader.Byte():
+			// Subsequent statements won't be executed even if it's a multi-statement.
+		default:
+			if serverStatus, err = cp.discardResultSet(backendIO, request, response); err != nil {
+				return err
+			}
+		}
+		if serverStatus&pnet.ServerMoreResultsExists == 0 {
+			return nil
+		}
+	}
+}
+
+// discardResultSet reads the columns and rows after the column count packet without forwarding them.
+func (cp *CmdProcessor) discardResultSet(backendIO *pnet.PacketIO, request, columnCount []byte) (uint16, error) {
+	if cp.capability&pnet.ClientDeprecateEOF == 0 {
+		serverStatus, err := cp.discardRows(backendIO, request)
+		if err != nil || serverStatus&pnet.ServerStatusCursorExists > 0 {
+			return serverStatus, err
+		}
+	} else {
+		columns, _, _ := pnet.ParseLengthEncodedInt(columnCount)
+		for i := uint64(0); i < columns; i++ {
+			if _, err := backendIO.ReadPacket(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return cp.discardRows(backendIO, request)
+}
+
+// forwardResultSet forwards the columns and rows after the column count packet.
+func (cp *CmdProcessor) forwardResultSet(clientIO, backendIO *pnet.PacketIO, request, columnCount []byte) (uint16, error) {
 	if cp.capability&pnet.ClientDeprecateEOF == 0 {
 		var serverStatus uint16
 		// read columns
-		err := backendIO.ForwardUntil(clientIO, func(firstByte byte, firstPktLen int) (end, needData bool) {
-			return pnet.IsEOFPacket(firstByte, firstPktLen), true
+		err := backendIO.ForwardUntil(clientIO, func(firstByte byte, firstPktLen int) (end, needData bool, err error) {
+			return pnet.IsEOFPacket(firstByte, firstPktLen), true, nil
 		}, func(response []byte) error {
 			serverStatus = binary.LittleEndian.Uint16(response[3:])
 			// If a cursor exists, only columns are sent this time. The client will then send COM_STMT_FETCH to fetch rows.
 			// Otherwise, columns and rows are both sent once.
 			if serverStatus&pnet.ServerStatusCursorExists > 0 {
 				serverStatus = cp.handleEOFPacket(request, response)
-				return clientIO.Flush()
+				return clientIO.WritePacket(response, true)
 			}
-			return nil
+			return clientIO.WritePacket(response, false)
 		})
 		if err != nil || serverStatus&pnet.ServerStatusCursorExists > 0 {
 			return serverStatus, err
 		}
+	} else if columns, _, _ := pnet.ParseLengthEncodedInt(columnCount); columns > 0 {
+		// Forward the columns separately so that they are not counted as rows.
+		var i uint64
+		err := backendIO.ForwardUntil(clientIO, func(firstByte byte, firstPktLen int) (end, needData bool, err error) {
+			i++
+			return i >= columns, false, nil
+		}, nil)
+		if err != nil {
+			return 0, err
+		}
 	}
 	// Deprecate EOF or no cursor.
-	return cp.forwardUntilResultEnd(clientIO, backendIO, request)
+	return cp.forwardUntilResultEnd(clientIO, backendIO, request, true)
+}
+
+// checkResultLimits returns an error if the rows forwarded to the client exceed the limits.
+func (cp *CmdProcessor) checkResultLimits(rows, bytes int64) error {
+	if cp.maxResultRows > 0 && rows > cp.maxResultRows {
+		return errors.Wrapf(ErrResultTooLarge, "the result set has more than %d rows", cp.maxResultRows)
+	}
+	if cp.maxResultBytes > 0 && bytes > cp.maxResultBytes {
+		return errors.Wrapf(ErrResultTooLarge, "the result set has more than %d bytes", cp.maxResultBytes)
+	}
+	return nil
 }
 
 func (cp *CmdProcessor) forwardCloseCmd(request []byte) error {
@@ -283,6 +556,7 @@ func (cp *CmdProcessor) forwardCloseCmd(request []byte) error {
 
 func (cp *CmdProcessor) forwardSendLongDataCmd(request []byte) error {
 	// No packet is sent to the client for COM_STMT_SEND_LONG_DATA.
+	cp.bufferLongData(request)
 	cp.updatePrepStmtStatus(request, 0)
 	return nil
 }
@@ -306,14 +580,19 @@ func (cp *CmdProcessor) forwardChangeUserCmd(clientIO, backendIO *pnet.PacketIO,
 	}
 
 	for {
-		response, err := forwardOnePacket(clientIO, backendIO, true)
+		response, err := backendIO.ReadPacket()
 		if err != nil {
 			return err
 		}
-		switch response[0] {
-		case pnet.OKHeader.Byte():
+		if response[0] == pnet.OKHeader.Byte() {
+			cp.sessionState.DB = req.DB
 			cp.handleOKPacket(request, response)
-			return nil
+			return cp.writeOKPacket(clientIO, response, true)
+		}
+		if err = clientIO.WritePacket(response, true); err != nil {
+			return err
+		}
+		switch response[0] {
 		case pnet.ErrHeader.Byte():
 			return cp.handleErrorPacket(response)
 		default:
@@ -325,6 +604,15 @@ func (cp *CmdProcessor) forwardChangeUserCmd(clientIO, backendIO *pnet.PacketIO,
 	}
 }
 
+// denyChangeUserCmd rejects COM_CHANGE_USER without forwarding it, so the session stays the same.
+func (cp *CmdProcessor) denyChangeUserCmd(clientIO *pnet.PacketIO) error {
+	myErr := mysql.NewError(mysql.ER_ACCESS_DENIED_ERROR, "COM_CHANGE_USER is not allowed because the proxy authenticates the users")
+	if err := clientIO.WriteErrPacket(myErr); err != nil {
+		return err
+	}
+	return myErr
+}
+
 func (cp *CmdProcessor) forwardStatisticsCmd(clientIO, backendIO *pnet.PacketIO) error {
 	// It just sends a string.
 	_, err := forwardOnePacket(clientIO, backendIO, true)
@@ -344,9 +632,8 @@ func (cp *CmdProcessor) forwardQuitCmd() error {
 // The application may always omit `COMMIT` and thus the session can never be redirected.
 // We can send a `COMMIT` statement to the current backend and then forward the `BEGIN` statement to the new backend.
 func (cp *CmdProcessor) needHoldRequest(request []byte) bool {
-	cmd, data := pnet.Command(request[0]), request[1:]
 	// BEGIN/START TRANSACTION statements cannot be prepared.
-	if cmd != pnet.ComQuery {
+	if pnet.Command(request[0]) != pnet.ComQuery {
 		return false
 	}
 	// Hold request only when it's waiting for the end of the transaction.
@@ -357,11 +644,7 @@ func (cp *CmdProcessor) needHoldRequest(request []byte) bool {
 	if cp.hasPendingPreparedStmts() {
 		return false
 	}
-	if len(data) > 0 && data[len(data)-1] == 0 {
-		data = data[:len(data)-1]
-	}
-	query := hack.String(data)
-	return isBeginStmt(query)
+	return isBeginStmt(cp.parseQuery(request))
 }
 
 func isBeginStmt(query string) bool {
@@ -0,0 +1,251 @@
+// Copyright 2023 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"encoding/binary"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/pingcap/tiproxy/lib/util/errors"
+	pnet "github.com/pingcap/tiproxy/pkg/proxy/net"
+)
+
+// drainFetchRows is the number of rows fetched in each COM_STMT_FETCH when draining a cursor.
+// The buffer size is checked after each fetch, so it also bounds how much the buffer may exceed the limit.
+const drainFetchRows = 100
+
+// longDataBuffer holds the COM_STMT_SEND_LONG_DATA packets of a statement, which are replayed on the new backend.
+type longDataBuffer struct {
+	packets [][]byte
+	// overflow means some packets are dropped because the buffer is full, so the session can't be migrated.
+	overflow bool
+}
+
+// cursorBuffer holds the rows drained from the cursor of a statement, which serve the following COM_STMT_FETCH.
+type cursorBuffer struct {
+	rows [][]byte
+	// serverStatus is the status of the last fetch, excluding SERVER_STATUS_LAST_ROW_SENT.
+	serverStatus uint16
+	// drained means all the rows are in the buffer and the cursor on the backend is closed.
+	drained bool
+}
+
+// bufferLongData saves a copy of COM_STMT_SEND_LONG_DATA until the statement is executed, reset, or closed.
+func (cp *CmdProcessor) bufferLongData(request []byte) {
+	if len(request) < 5 {
+		return
+	}
+	stmtID := int(binary.LittleEndian.Uint32(request[1:5]))
+	buf, ok := cp.longData[stmtID]
+	if !ok {
+		buf = &longDataBuffer{}
+		cp.longData[stmtID] = buf
+	}
+	if buf.overflow {
+		return
+	}
+	if cp.bufferSize+len(request) > cp.maxBufferSize {
+		cp.releaseLongData(stmtID)
+		cp.longData[stmtID] = &longDataBuffer{overflow: true}
+		return
+	}
+	buf.packets = append(buf.packets, request)
+	cp.bufferSize += len(request)
+}
+
+// releaseStmtBuffers drops the buffered data that is invalidated by the request.
+func (cp *CmdProcessor) releaseStmtBuffers(request []byte) {
+	switch pnet.Command(request[0]) {
+	case pnet.ComStmtExecute, pnet.ComStmtReset, pnet.ComStmtClose:
+		if len(request) < 5 {
+			return
+		}
+		stmtID := int(binary.LittleEndian.Uint32(request[1:5]))
+		cp.releaseLongData(stmtID)
+		cp.releaseCursor(stmtID)
+	case pnet.ComResetConnection, pnet.ComChangeUser:
+		cp.longData = make(map[int]*longDataBuffer)
+		cp.cursors = make(map[int]*cursorBuffer)
+		cp.bufferSize = 0
+	}
+}
+
+func (cp *CmdProcessor) releaseLongData(stmtID int) {
+	if buf, ok := cp.longData[stmtID]; ok {
+		for _, pkt := range buf.packets {
+			cp.bufferSize -= len(pkt)
+		}
+		delete(cp.longData, stmtID)
+	}
+}
+
+func (cp *CmdProcessor) releaseCursor(stmtID int) {
+	if buf, ok := cp.cursors[stmtID]; ok {
+		for _, row := range buf.rows {
+			cp.bufferSize -= len(row)
+		}
+		delete(cp.cursors, stmtID)
+	}
+}
+
+// canMigrate returns whether the session can be migrated to another backend.
+// Different from finishedTxn, open cursors and pending long data don't block migration as long as the proxy can buffer them.
+func (cp *CmdProcessor) canMigrate() bool {
+	if cp.serverStatus&(StatusInTrans|StatusQuit) > 0 {
+		return false
+	}
+	for stmtID, status := range cp.preparedStmtStatus {
+		switch status {
+		case StatusPrepareWaitExecute:
+			if buf, ok := cp.longData[stmtID]; !ok || buf.overflow {
+				return false
+			}
+		case StatusPrepareWaitFetch:
+			// Wait for the client to fetch the buffered rows before draining more.
+			if buf, ok := cp.cursors[stmtID]; (!ok || !buf.drained) && cp.bufferSize >= cp.maxBufferSize {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// drainCursors fetches the remaining rows of the open cursors into the buffer and closes the cursors,
+// because the cursors can't be migrated along with the session states.
+// If the buffer is full, the fetched rows are kept and the session stays on the current backend.
+func (cp *CmdProcessor) drainCursors(backendIO *pnet.PacketIO) error {
+	for stmtID, status := range cp.preparedStmtStatus {
+		if status != StatusPrepareWaitFetch {
+			continue
+		}
+		buf, ok := cp.cursors[stmtID]
+		if !ok {
+			buf = &cursorBuffer{}
+			cp.cursors[stmtID] = buf
+		}
+		for !buf.drained {
+			if cp.bufferSize >= cp.maxBufferSize {
+				return errors.Wrapf(ErrMigrationBufferFull, "draining the cursor of statement %d exceeds %d bytes", stmtID, cp.maxBufferSize)
+			}
+			if err := cp.fetchIntoBuffer(backendIO, stmtID, buf); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (cp *CmdProcessor) fetchIntoBuffer(backendIO *pnet.PacketIO, stmtID int, buf *cursorBuffer) error {
+	request := make([]byte, 0, 9)
+	request = append(request, pnet.ComStmtFetch.Byte())
+	request = pnet.DumpUint32(request, uint32(stmtID))
+	request = pnet.DumpUint32(request, drainFetchRows)
+	backendIO.ResetSequence()
+	if err := backendIO.WritePacket(request, true); err != nil {
+		return err
+	}
+	for {
+		response, err := backendIO.ReadPacket()
+		if err != nil {
+			return err
+		}
+		var serverStatus uint16
+		switch {
+		case pnet.IsErrorPacket(response[0]):
+			return cp.handleErrorPacket(response)
+		case cp.capability&pnet.ClientDeprecateEOF == 0 && pnet.IsEOFPacket(response[0], len(response)):
+			serverStatus = binary.LittleEndian.Uint16(response[3:])
+		case cp.capability&pnet.ClientDeprecateEOF > 0 && pnet.IsResultSetOKPacket(response[0], len(response)):
+			serverStatus = pnet.ParseOKPacket(response)
+		default:
+			buf.rows = append(buf.rows, response)
+			cp.bufferSize += len(response)
+			continue
+		}
+		// The buffered rows end with an OK or EOF packet generated by the proxy, which has no session state changes.
+		buf.serverStatus = serverStatus &^ (pnet.ServerStatusLastRowSend | pnet.ServerSessionStateChanged)
+		if serverStatus&pnet.ServerStatusLastRowSend > 0 {
+			buf.drained = true
+			return cp.resetStmt(backendIO, stmtID)
+		}
+		return nil
+	}
+}
+
+// resetStmt closes the cursor on the backend. The statement status seen by the client doesn't change.
+func (cp *CmdProcessor) resetStmt(backendIO *pnet.PacketIO, stmtID int) error {
+	request := make([]byte, 0, 5)
+	request = append(request, pnet.ComStmtReset.Byte())
+	request = pnet.DumpUint32(request, uint32(stmtID))
+	backendIO.ResetSequence()
+	if err := backendIO.WritePacket(request, true); err != nil {
+		return err
+	}
+	response, err := backendIO.ReadPacket()
+	if err != nil {
+		return err
+	}
+	switch response[0] {
+	case pnet.OKHeader.Byte():
+		return nil
+	case pnet.ErrHeader.Byte():
+		return cp.handleErrorPacket(response)
+	}
+	return errors.WithStack(mysql.ErrMalformPacket)
+}
+
+// replayLongData sends the buffered long data to the new backend. COM_STMT_SEND_LONG_DATA has no response.
+func (cp *CmdProcessor) replayLongData(backendIO *pnet.PacketIO) error {
+	for _, buf := range cp.longData {
+		for _, pkt := range buf.packets {
+			backendIO.ResetSequence()
+			if err := backendIO.WritePacket(pkt, false); err != nil {
+				return err
+			}
+		}
+	}
+	return backendIO.Flush()
+}
+
+// fetchFromBuffer serves COM_STMT_FETCH with the buffered rows.
+// It returns false if no rows are buffered and the request should be forwarded to the backend.
+func (cp *CmdProcessor) fetchFromBuffer(clientIO *pnet.PacketIO, request []byte) (bool, error) {
+	if len(request) < 9 {
+		return false, nil
+	}
+	stmtID := int(binary.LittleEndian.Uint32(request[1:5]))
+	buf, ok := cp.cursors[stmtID]
+	if !ok {
+		return false, nil
+	}
+	if len(buf.rows) == 0 && !buf.drained {
+		// The rows that are not drained are still on the backend.
+		delete(cp.cursors, stmtID)
+		return false, nil
+	}
+	numRows := int(binary.LittleEndian.Uint32(request[5:9]))
+	if numRows > len(buf.rows) {
+		numRows = len(buf.rows)
+	}
+	for _, row := range buf.rows[:numRows] {
+		if err := clientIO.WritePacket(row, false); err != nil {
+			return true, err
+		}
+		cp.bufferSize -= len(row)
+	}
+	buf.rows = buf.rows[numRows:]
+	serverStatus := buf.serverStatus | pnet.ServerStatusCursorExists
+	if len(buf.rows) == 0 && buf.drained {
+		serverStatus |= pnet.ServerStatusLastRowSend
+		delete(cp.cursors, stmtID)
+	}
+	var err error
+	if cp.capability&pnet.ClientDeprecateEOF > 0 {
+		err = clientIO.WriteOKPacket(serverStatus, pnet.EOFHeader)
+	} else {
+		err = clientIO.WriteEOFPacket(serverStatus)
+	}
+	cp.updateServerStatus(request, serverStatus)
+	return true, err
+}
@@ -4,8 +4,14 @@
 package backend
 
 import (
+	"context"
+	"net"
 	"testing"
+	"time"
 
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/pingcap/tiproxy/lib/util/logger"
+	"github.com/pingcap/tiproxy/lib/util/waitgroup"
 	pnet "github.com/pingcap/tiproxy/pkg/proxy/net"
 	"github.com/stretchr/testify/require"
 )
@@ -1100,3 +1106,390 @@ func TestQueryError(t *testing.T) {
 		clean()
 	}
 }
+
+func TestSessionState(t *testing.T) {
+	lg, _ := logger.CreateLoggerForTest(t)
+	cp := NewCmdProcessor(lg)
+	// The proxy tracks the session state even if the client doesn't negotiate CLIENT_SESSION_TRACK.
+	cp.capability = defaultTestBackendCapability &^ pnet.ClientSessionTrack
+	cp.backendCapability = defaultTestBackendCapability | pnet.ClientSessionTrack
+	makeOK := func(changes ...pnet.SessionStateChange) []byte {
+		var state []byte
+		for _, change := range changes {
+			var value []byte
+			switch change.Type {
+			case pnet.SessionTrackSystemVariables:
+				value = pnet.DumpLengthEncodedString(pnet.DumpLengthEncodedString(nil, []byte(change.Name)), []byte(change.Value))
+			case pnet.SessionTrackGtids:
+				value = pnet.DumpLengthEncodedString([]byte{0}, []byte(change.Value))
+			default:
+				value = pnet.DumpLengthEncodedString(nil, []byte(change.Value))
+			}
+			state = pnet.DumpLengthEncodedString(append(state, change.Type), value)
+		}
+		status := pnet.ServerStatusAutocommit
+		if len(changes) > 0 {
+			status |= pnet.ServerSessionStateChanged
+		}
+		data := []byte{pnet.OKHeader.Byte(), 0, 0, byte(status), byte(status >> 8), 0, 0, 0}
+		if len(changes) > 0 {
+			data = pnet.DumpLengthEncodedString(data, state)
+		}
+		return data
+	}
+
+	query := []byte{pnet.ComQuery.Byte()}
+	cp.handleOKPacket(query, makeOK(
+		pnet.SessionStateChange{Type: pnet.SessionTrackSystemVariables, Name: "sql_mode", Value: "ANSI"},
+		pnet.SessionStateChange{Type: pnet.SessionTrackSchema, Value: "db1"},
+		pnet.SessionStateChange{Type: pnet.SessionTrackGtids, Value: "3e11fa47:1-5"},
+		pnet.SessionStateChange{Type: pnet.SessionTrackTransactionCharacteristics, Value: "SET TRANSACTION READ ONLY;"},
+		pnet.SessionStateChange{Type: pnet.SessionTrackTransactionState, Value: "________"},
+	))
+	state := cp.SessionState()
+	require.Equal(t, SessionState{
+		DB:                 "db1",
+		SysVars:            map[string]string{"sql_mode": "ANSI"},
+		GTIDs:              "3e11fa47:1-5",
+		TxnCharacteristics: "SET TRANSACTION READ ONLY;",
+		TxnState:           "________",
+	}, state)
+	// The returned state is a copy.
+	state.SysVars["sql_mode"] = ""
+	require.Equal(t, "ANSI", cp.SessionState().SysVars["sql_mode"])
+
+	// COM_INIT_DB updates the DB even if the backend doesn't report it.
+	cp.handleOKPacket(append([]byte{pnet.ComInitDB.Byte()}, "db2"...), makeOK())
+	require.Equal(t, "db2", cp.SessionState().DB)
+
+	// COM_RESET_CONNECTION resets the system variables.
+	cp.handleOKPacket([]byte{pnet.ComResetConnection.Byte()}, makeOK())
+	state = cp.SessionState()
+	require.Equal(t, "db2", state.DB)
+	require.Empty(t, state.SysVars)
+	require.Empty(t, state.TxnCharacteristics)
+
+	// The changes are removed from the OK packets sent to the client that doesn't negotiate CLIENT_SESSION_TRACK.
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		require.NoError(t, client.Close())
+		require.NoError(t, server.Close())
+	})
+	clientIO := pnet.NewPacketIO(server, lg, pnet.DefaultConnBufferSize)
+	peerIO := pnet.NewPacketIO(client, lg, pnet.DefaultConnBufferSize)
+	for _, clientTrack := range []bool{false, true} {
+		cp.capability = defaultTestBackendCapability &^ pnet.ClientSessionTrack
+		if clientTrack {
+			cp.capability |= pnet.ClientSessionTrack
+		}
+		ok := makeOK(pnet.SessionStateChange{Type: pnet.SessionTrackSchema, Value: "db3"})
+		var wg waitgroup.WaitGroup
+		wg.Run(func() {
+			require.NoError(t, cp.writeOKPacket(clientIO, ok, true))
+		})
+		pkt, err := peerIO.ReadPacket()
+		require.NoError(t, err)
+		wg.Wait()
+		if clientTrack {
+			require.Equal(t, ok, pkt)
+		} else {
+			require.Equal(t, []byte{pnet.OKHeader.Byte(), 0, 0, byte(pnet.ServerStatusAutocommit), 0, 0, 0}, pkt)
+		}
+		clientIO.ResetSequence()
+		peerIO.ResetSequence()
+	}
+
+	// The changes are ignored if CLIENT_SESSION_TRACK is not negotiated with the backend.
+	cp.backendCapability &^= pnet.ClientSessionTrack
+	cp.handleOKPacket(query, makeOK(pnet.SessionStateChange{Type: pnet.SessionTrackSchema, Value: "db4"}))
+	require.Equal(t, "db2", cp.SessionState().DB)
+}
+
+func TestQueryAttrs(t *testing.T) {
+	lg, _ := logger.CreateLoggerForTest(t)
+	cp := NewCmdProcessor(lg)
+	cp.capability = defaultTestBackendCapability | pnet.ClientQueryAttributes
+	// parameter_count = 1, parameter_set_count = 1, null_bitmap = 0, new_params_bind_flag = 1, type = string, name = "a", value = "b"
+	query := []byte{pnet.ComQuery.Byte(), 1, 1, 0, 1, 0xfe, 0, 1, 'a', 1, 'b'}
+	query = append(query, "select 1"...)
+	stmtExecute := []byte{pnet.ComStmtExecute.Byte(), 1, 0, 0, 0, 0, 1, 0, 0, 0, 1, 0, 1, 0xfe, 0, 1, 'a', 1, 'b'}
+
+	// The attributes are forwarded to the backend that supports them.
+	cp.backendCapability = cp.capability
+	cp.stmtParams[1] = &pnet.StmtParams{}
+	for _, request := range [][]byte{query, stmtExecute} {
+		forwarded, err := cp.handleQueryAttrs(request)
+		require.NoError(t, err)
+		require.Equal(t, request, forwarded)
+		require.Len(t, cp.QueryAttrs(), 1)
+		require.Equal(t, "a", cp.QueryAttrs()[0].Name)
+		require.Equal(t, "b", cp.QueryAttrs()[0].String())
+	}
+	require.Equal(t, "select 1", cp.parseQuery(query))
+
+	// The attributes are stripped for the backend that doesn't support them.
+	cp.backendCapability = defaultTestBackendCapability
+	forwarded, err := cp.handleQueryAttrs(query)
+	require.NoError(t, err)
+	require.Equal(t, append([]byte{pnet.ComQuery.Byte()}, "select 1"...), forwarded)
+	forwarded, err = cp.handleQueryAttrs(stmtExecute)
+	require.NoError(t, err)
+	require.Equal(t, stmtExecute[:10], forwarded)
+	require.Len(t, cp.QueryAttrs(), 1)
+
+	// The statement is closed.
+	cp.updateStmtParams([]byte{pnet.ComStmtClose.Byte(), 1, 0, 0, 0})
+	forwarded, err = cp.handleQueryAttrs(stmtExecute)
+	require.NoError(t, err)
+	require.Equal(t, stmtExecute, forwarded)
+	require.Empty(t, cp.QueryAttrs())
+
+	// The malformed attributes are passed to the backend that supports them.
+	malformed := []byte{pnet.ComQuery.Byte(), 5, 1}
+	cp.backendCapability = cp.capability
+	forwarded, err = cp.handleQueryAttrs(malformed)
+	require.NoError(t, err)
+	require.Equal(t, malformed, forwarded)
+	require.Empty(t, cp.QueryAttrs())
+
+	// The malformed attributes can't be stripped, so the request is rejected but the session is kept.
+	cp.backendCapability = defaultTestBackendCapability
+	_, err = cp.handleQueryAttrs(malformed)
+	require.Error(t, err)
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		require.NoError(t, client.Close())
+		require.NoError(t, server.Close())
+	})
+	clientIO, peerIO := pnet.NewPacketIO(client, lg, pnet.DefaultConnBufferSize), pnet.NewPacketIO(server, lg, pnet.DefaultConnBufferSize)
+	var wg waitgroup.WaitGroup
+	wg.Run(func() {
+		err := cp.forwardCommand(context.Background(), clientIO, nil, malformed)
+		require.True(t, pnet.IsMySQLError(err))
+	})
+	response, err := peerIO.ReadPacket()
+	require.NoError(t, err)
+	require.EqualValues(t, mysql.ER_MALFORMED_PACKET, pnet.ParseErrorPacket(response).Code)
+	wg.Wait()
+
+	// The client doesn't send attributes.
+	cp.capability = defaultTestBackendCapability
+	forwarded, err = cp.handleQueryAttrs(query)
+	require.NoError(t, err)
+	require.Equal(t, query, forwarded)
+	require.Empty(t, cp.QueryAttrs())
+}
+
+func TestMigrationBuffer(t *testing.T) {
+	lg, _ := logger.CreateLoggerForTest(t)
+	cp := NewCmdProcessor(lg)
+	cp.maxBufferSize = 16
+	longData := []byte{pnet.ComStmtSendLongData.Byte(), 1, 0, 0, 0, 0, 0, 'a', 'b', 'c'}
+	execute := []byte{pnet.ComStmtExecute.Byte(), 1, 0, 0, 0, 0, 1, 0, 0, 0}
+
+	// The long data is buffered.
+	require.NoError(t, cp.forwardSendLongDataCmd(longData))
+	require.False(t, cp.finishedTxn())
+	require.True(t, cp.canMigrate())
+	require.Equal(t, len(longData), cp.bufferSize)
+
+	// The buffer overflows.
+	require.NoError(t, cp.forwardSendLongDataCmd(longData))
+	require.False(t, cp.canMigrate())
+	require.Equal(t, 0, cp.bufferSize)
+
+	// The long data is consumed by the execution.
+	cp.releaseStmtBuffers(execute)
+	cp.updatePrepStmtStatus(execute, 0)
+	require.Empty(t, cp.longData)
+	require.True(t, cp.canMigrate())
+
+	// The cursor can be migrated until the buffer is full.
+	cp.updatePrepStmtStatus(execute, pnet.ServerStatusCursorExists)
+	require.False(t, cp.finishedTxn())
+	require.True(t, cp.canMigrate())
+	cp.cursors[1] = &cursorBuffer{rows: [][]byte{make([]byte, 16)}}
+	cp.bufferSize = 16
+	require.False(t, cp.canMigrate())
+	cp.cursors[1].drained = true
+	require.True(t, cp.canMigrate())
+
+	// COM_RESET_CONNECTION clears the buffers.
+	cp.releaseStmtBuffers([]byte{pnet.ComResetConnection.Byte()})
+	require.Empty(t, cp.cursors)
+	require.Equal(t, 0, cp.bufferSize)
+}
+
+// Test that the proxy stops forwarding the result set once it exceeds the limits and the session is kept.
+func TestResultLimits(t *testing.T) {
+	tests := []struct {
+		maxRows  int64
+		maxBytes int64
+		stmtNum  int
+		exceed   bool
+	}{
+		{maxRows: 100},
+		{maxRows: 99, exceed: true},
+		{maxBytes: 1 << 20},
+		{maxBytes: 100, exceed: true},
+		// The remaining results are discarded.
+		{maxRows: 99, stmtNum: 2, exceed: true},
+		{maxRows: 100, stmtNum: 3},
+	}
+	for _, capability := range []pnet.Capability{defaultTestBackendCapability &^ pnet.ClientDeprecateEOF, defaultTestBackendCapability | pnet.ClientDeprecateEOF} {
+		for i, test := range tests {
+			tc := newTCPConnSuite(t)
+			ts, clean := newTestSuite(t, tc, func(cfg *testConfig) {
+				cfg.clientConfig.capability = capability
+				cfg.proxyConfig.capability = capability
+				cfg.backendConfig.capability = capability
+				cfg.backendConfig.columns = 2
+				cfg.backendConfig.rows = 100
+				cfg.backendConfig.respondType = responseTypeResultSet
+				if test.stmtNum > 0 {
+					cfg.backendConfig.stmtNum = test.stmtNum
+				}
+			})
+			ts.mp.cmdProcessor.maxResultRows = test.maxRows
+			ts.mp.cmdProcessor.maxResultBytes = test.maxBytes
+			ts.runAndCheck(t, func(t *testing.T, ts *testSuite) {
+				require.NoError(t, ts.mc.err, "case %d", i)
+				require.NoError(t, ts.mb.err, "case %d", i)
+				if test.exceed {
+					require.ErrorIs(t, ts.mp.err, ErrResultTooLarge, "case %d", i)
+					require.True(t, pnet.IsMySQLError(ts.mp.err), "case %d", i)
+					require.ErrorContains(t, ts.mc.mysqlErr, ErrResultTooLarge.Error(), "case %d", i)
+				} else {
+					require.NoError(t, ts.mp.err, "case %d", i)
+					require.Nil(t, ts.mc.mysqlErr, "case %d", i)
+				}
+			}, ts.mc.request, ts.mb.respond, ts.mp.processCmd)
+			clean()
+		}
+	}
+}
+
+// Test that the row split into multiple packets is counted by its whole size.
+func TestLargeRowLimits(t *testing.T) {
+	lg, _ := logger.CreateLoggerForTest(t)
+	cp := NewCmdProcessor(lg)
+	cp.capability = defaultTestBackendCapability
+	// The first packet of the row is within the limit, but the whole row is not.
+	cp.maxResultBytes = pnet.MaxPayloadLen + 8
+	client, clientPeer := net.Pipe()
+	backend, backendPeer := net.Pipe()
+	t.Cleanup(func() {
+		for _, conn := range []net.Conn{client, clientPeer, backend, backendPeer} {
+			require.NoError(t, conn.Close())
+		}
+	})
+	clientIO, clientPeerIO := pnet.NewPacketIO(client, lg, pnet.DefaultConnBufferSize), pnet.NewPacketIO(clientPeer, lg, pnet.DefaultConnBufferSize)
+	backendIO, backendPeerIO := pnet.NewPacketIO(backend, lg, pnet.DefaultConnBufferSize), pnet.NewPacketIO(backendPeer, lg, pnet.DefaultConnBufferSize)
+	var wg waitgroup.WaitGroup
+	wg.Run(func() {
+		row := pnet.DumpLengthEncodedString(nil, make([]byte, pnet.MaxPayloadLen))
+		require.NoError(t, backendPeerIO.WritePacket(row, false))
+		require.NoError(t, backendPeerIO.WriteOKPacket(0, pnet.EOFHeader))
+	})
+	wg.Run(func() {
+		err := cp.forwardFetchCmd(clientIO, backendIO, []byte{pnet.ComStmtFetch.Byte(), 1, 0, 0, 0, 1, 0, 0, 0})
+		require.ErrorIs(t, err, ErrResultTooLarge)
+		require.True(t, pnet.IsMySQLError(err))
+	})
+	// The row is discarded and only the error is forwarded.
+	response, err := clientPeerIO.ReadPacket()
+	require.NoError(t, err)
+	require.True(t, pnet.IsErrorPacket(response[0]))
+	wg.Wait()
+}
+
+func TestLoadDataPolicy(t *testing.T) {
+	tests := []struct {
+		disable        bool
+		stmtNum        int
+		maxBytes       int64
+		bytesPerSecond int64
+		err            error
+	}{
+		{},
+		{maxBytes: 300},
+		{maxBytes: 299, err: ErrLoadDataTooLarge},
+		{disable: true, err: ErrLoadDataDisabled},
+		{disable: true, stmtNum: 2, err: ErrLoadDataDisabled},
+		{bytesPerSecond: 3000},
+	}
+	for i, test := range tests {
+		tc := newTCPConnSuite(t)
+		ts, clean := newTestSuite(t, tc, func(cfg *testConfig) {
+			cfg.clientConfig.cmd = pnet.ComQuery
+			cfg.clientConfig.filePkts = 3
+			cfg.clientConfig.dataBytes = make([]byte, 100)
+			cfg.backendConfig.respondType = responseTypeLoadFile
+			if test.stmtNum > 0 {
+				cfg.backendConfig.stmtNum = test.stmtNum
+			}
+			if test.disable {
+				cfg.proxyConfig.capability &^= pnet.ClientLocalFiles
+			}
+		})
+		ts.mp.cmdProcessor.maxLoadBytes = test.maxBytes
+		ts.mp.cmdProcessor.loadBytesPerSecond = test.bytesPerSecond
+		startTime := time.Now()
+		ts.runAndCheck(t, func(t *testing.T, ts *testSuite) {
+			require.NoError(t, ts.mc.err, "case %d", i)
+			if test.err != nil {
+				require.ErrorIs(t, ts.mp.err, test.err, "case %d", i)
+				require.ErrorContains(t, ts.mc.mysqlErr, test.err.Error(), "case %d", i)
+				// The load is refused without breaking the session.
+				require.True(t, pnet.IsMySQLError(ts.mp.err), "case %d", i)
+				require.NoError(t, ts.mb.err, "case %d", i)
+				return
+			}
+			require.NoError(t, ts.mp.err, "case %d", i)
+			require.NoError(t, ts.mb.err, "case %d", i)
+			require.Nil(t, ts.mc.mysqlErr, "case %d", i)
+			if test.bytesPerSecond > 0 {
+				// 300 bytes at 3000 bytes per second.
+				require.GreaterOrEqual(t, time.Since(startTime), 90*time.Millisecond, "case %d", i)
+			}
+		}, ts.mc.request, ts.mb.respond, ts.mp.processCmd)
+		clean()
+	}
+}
+
+func TestThrottleLoadCanceled(t *testing.T) {
+	lg, _ := logger.CreateLoggerForTest(t)
+	cp := NewCmdProcessor(lg)
+	cp.loadBytesPerSecond = 1
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		require.NoError(t, client.Close())
+		require.NoError(t, server.Close())
+	})
+	backendIO := pnet.NewPacketIO(client, lg, pnet.DefaultConnBufferSize)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// It would wait for 100 seconds if it's not interrupted.
+	startTime := time.Now()
+	require.ErrorIs(t, cp.throttleLoad(ctx, backendIO, 100, 0), context.Canceled)
+	require.Less(t, time.Since(startTime), 10*time.Second)
+}
+
+func TestDenyChangeUser(t *testing.T) {
+	tc := newTCPConnSuite(t)
+	ts, clean := newTestSuite(t, tc, func(cfg *testConfig) {
+		cfg.clientConfig.cmd = pnet.ComChangeUser
+		cfg.clientConfig.username = "another"
+	})
+	ts.mp.cmdProcessor.denyChangeUser = true
+	// The backend doesn't receive the request.
+	ts.runAndCheck(t, func(t *testing.T, ts *testSuite) {
+		require.True(t, pnet.IsMySQLError(ts.mp.err))
+		require.NoError(t, ts.mc.err)
+		var myErr *mysql.MyError
+		require.ErrorAs(t, ts.mc.mysqlErr, &myErr)
+		require.EqualValues(t, mysql.ER_ACCESS_DENIED_ERROR, myErr.Code)
+		require.Empty(t, ts.mb.username)
+	}, ts.mc.request, nil, ts.mp.processCmd)
+	clean()
+}
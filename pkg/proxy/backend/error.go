@@ -17,11 +17,16 @@ var (
 	ErrBackendConn = errors.New("this is an error from the backend connection")
 )
 
+// errCodeSecureTransportRequired is ER_SECURE_TRANSPORT_REQUIRED in MySQL.
+const errCodeSecureTransportRequired = 3159
+
 // These errors are used to track internal errors.
 var (
 	ErrClientCap        = errors.New("Verify client capability failed, please upgrade the client")
 	ErrClientHandshake  = errors.New("Fails to handshake with the client")
+	ErrClientNoTLS      = errors.New("Connections using insecure transport are prohibited, please enable TLS")
 	ErrClientAuthFail   = errors.New("Authentication fails")
+	ErrClientHostDenied = errors.New("Host is not allowed to connect to TiProxy")
 	ErrProxyErr         = errors.New("Other serverless error")
 	ErrProxyNoBackend   = errors.New("No available TiDB instances, please make sure TiDB is available")
 	ErrProxyNoTLS       = errors.New("Require TLS enabled on TiProxy when require-backend-tls=true")
@@ -29,6 +34,10 @@ var (
 	ErrBackendHandshake = errors.New("TiProxy fails to connect to TiDB, please make sure TiDB is available")
 	ErrBackendNoTLS     = errors.New("Require TLS enabled on TiDB when require-backend-tls=true")
 	ErrBackendPPV2      = errors.New("TiProxy fails to connect to TiDB, please make sure TiDB proxy-protocol is set correctly. If this error still exists, please contact PingCAP")
+	ErrTxnRolledBack    = errors.New("The transaction is rolled back because the session is not migrated to another TiDB before the deadline")
+	ErrResultTooLarge   = errors.New("The rest of the result is discarded because the result set exceeds the limit of TiProxy")
+	ErrLoadDataDisabled = errors.New("LOAD DATA LOCAL INFILE is disabled by TiProxy")
+	ErrLoadDataTooLarge = errors.New("The rest of the file is discarded because the file of LOAD DATA LOCAL INFILE exceeds the limit of TiProxy")
 )
 
 // ErrToClient returns the error that needs to be sent to the client.
@@ -4,11 +4,16 @@
 package backend
 
 import (
+	"context"
+	"crypto/tls"
+
 	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/pingcap/tiproxy/lib/config"
 	"github.com/pingcap/tiproxy/lib/util/errors"
 	"github.com/pingcap/tiproxy/pkg/balance/router"
 	"github.com/pingcap/tiproxy/pkg/manager/namespace"
 	pnet "github.com/pingcap/tiproxy/pkg/proxy/net"
+	"github.com/pingcap/tiproxy/pkg/proxy/proxyprotocol"
 	"go.uber.org/zap"
 )
 
@@ -20,7 +25,32 @@ type ConnContextKey string
 const (
 	ConnContextKeyTLSState ConnContextKey = "tls-state"
 	ConnContextKeyConnID   ConnContextKey = "conn-id"
+	// ConnContextKeyConnAddr is the address of the listener that accepts the connection.
 	ConnContextKeyConnAddr ConnContextKey = "conn-addr"
+	// ConnContextKeyListener is the settings (*config.ProxyListener) of the listener that accepts the connection.
+	ConnContextKeyListener ConnContextKey = "listener"
+	// ConnContextKeyProxyTLV is the TLVs ([]proxyprotocol.ProxyTlv) in the PROXY protocol header sent by the client.
+	ConnContextKeyProxyTLV ConnContextKey = "proxy-tlv"
+	// ConnContextKeyClientCertSubject is the subject (string) of the client certificate verified by the namespace.
+	ConnContextKeyClientCertSubject ConnContextKey = "client-cert-subject"
+	// ConnContextKeyNamespaceName is the namespace (string) chosen by HandshakeHandler.HandleHandshakeResp.
+	// It takes precedence over the other ways to find the namespace.
+	ConnContextKeyNamespaceName ConnContextKey = "namespace-name"
+	// ConnContextKeyInitSQL is the statement (string) executed on the first backend after the client is authenticated.
+	ConnContextKeyInitSQL ConnContextKey = "init-sql"
+	// ConnContextKeyMigrationDeadline decides what to do if the session can't be migrated in time (config.MigrationDeadline).
+	ConnContextKeyMigrationDeadline ConnContextKey = "migration-deadline"
+	// ConnContextKeyBackendCompression is the compression between the proxy and the backends (config.BackendCompression).
+	ConnContextKeyBackendCompression ConnContextKey = "backend-compression"
+	// ConnContextKeyQueryLimits limits the requests and the result sets of the connection (config.QueryLimits).
+	ConnContextKeyQueryLimits ConnContextKey = "query-limits"
+	// ConnContextKeyLoadData restricts `LOAD DATA LOCAL INFILE` of the connection (config.LoadDataPolicy).
+	ConnContextKeyLoadData ConnContextKey = "load-data"
+	// ConnContextKeyDenyChangeUser rejects COM_CHANGE_USER (bool) because the proxy authenticates or restricts the
+	// clients by users, while COM_CHANGE_USER is authenticated by the backend only.
+	ConnContextKeyDenyChangeUser ConnContextKey = "deny-change-user"
+	// connContextKeyNamespace caches the namespace (*namespace.Namespace) of the connection during the handshake.
+	connContextKeyNamespace ConnContextKey = "namespace"
 )
 
 var _ HandshakeHandler = (*DefaultHandshakeHandler)(nil)
@@ -29,6 +59,8 @@ var _ HandshakeHandler = (*CustomHandshakeHandler)(nil)
 // ConnContext saves the connection attributes that are read by HandshakeHandler.
 // These interfaces should not request for locks because HandshakeHandler already holds the lock.
 type ConnContext interface {
+	// Context is canceled once the connection is closed, so that the hooks won't block the connection.
+	Context() context.Context
 	ClientAddr() string
 	ServerAddr() string
 	ClientInBytes() uint64
@@ -44,6 +76,9 @@ type HandshakeHandler interface {
 	HandleHandshakeResp(ctx ConnContext, resp *pnet.HandshakeResp) error
 	HandleHandshakeErr(ctx ConnContext, err *mysql.MyError) bool // return true means retry connect
 	GetRouter(ctx ConnContext, resp *pnet.HandshakeResp) (router.Router, error)
+	// GetLocalUser returns the account stored in the proxy to authenticate the client.
+	// enabled is false if the proxy doesn't authenticate the client and relays the auth exchange to the backend.
+	GetLocalUser(ctx ConnContext, resp *pnet.HandshakeResp) (user *config.LocalUser, enabled bool, err error)
 	OnHandshake(ctx ConnContext, to string, err error, src ErrorSource)
 	OnConnClose(ctx ConnContext, src ErrorSource) error
 	OnTraffic(ctx ConnContext)
@@ -70,15 +105,89 @@ func (handler *DefaultHandshakeHandler) HandleHandshakeErr(ctx ConnContext, err
 }
 
 func (handler *DefaultHandshakeHandler) GetRouter(ctx ConnContext, resp *pnet.HandshakeResp) (router.Router, error) {
-	ns, ok := handler.nsManager.GetNamespaceByUser(resp.User)
+	ns, err := handler.getNamespace(ctx, resp)
+	if err != nil {
+		return nil, err
+	}
+	return ns.GetRouter(), nil
+}
+
+func (handler *DefaultHandshakeHandler) GetLocalUser(ctx ConnContext, resp *pnet.HandshakeResp) (*config.LocalUser, bool, error) {
+	// The handler may be embedded by another handler that routes without namespaces.
+	if handler.nsManager == nil {
+		return nil, false, nil
+	}
+	ns, err := handler.getNamespace(ctx, resp)
+	if err != nil {
+		return nil, false, err
+	}
+	user, enabled := ns.GetLocalUser(resp.User)
+	return user, enabled, nil
+}
+
+// getNamespace finds the namespace of the connection and checks whether the connection can access it.
+// The namespace is cached in the context so that it's checked only once during the handshake.
+func (handler *DefaultHandshakeHandler) getNamespace(ctx ConnContext, resp *pnet.HandshakeResp) (*namespace.Namespace, error) {
+	if ns, ok := ctx.Value(connContextKeyNamespace).(*namespace.Namespace); ok {
+		return ns, nil
+	}
+	tlvs, _ := ctx.Value(ConnContextKeyProxyTLV).([]proxyprotocol.ProxyTlv)
+	if name, _ := ctx.Value(ConnContextKeyNamespaceName).(string); len(name) > 0 {
+		ns, ok := handler.nsManager.GetNamespace(name)
+		if !ok {
+			return nil, errors.Errorf("namespace %s is not found", name)
+		}
+		return handler.checkNamespace(ctx, resp, ns, tlvs)
+	}
+	ns, ok := handler.nsManager.GetNamespaceByProxyTLV(tlvs)
 	if !ok {
-		ns, ok = handler.nsManager.GetNamespace("default")
+		ns, ok = handler.nsManager.GetNamespaceByUser(resp.User)
+	}
+	if !ok {
+		defaultNamespace := "default"
+		if listener, _ := ctx.Value(ConnContextKeyListener).(*config.ProxyListener); listener != nil && listener.Namespace != "" {
+			defaultNamespace = listener.Namespace
+		}
+		ns, ok = handler.nsManager.GetNamespace(defaultNamespace)
 	}
 	if !ok {
 		return nil, errors.New("failed to find a namespace")
 	}
+	return handler.checkNamespace(ctx, resp, ns, tlvs)
+}
+
+// checkNamespace checks whether the connection can access the namespace and caches the namespace in the context.
+func (handler *DefaultHandshakeHandler) checkNamespace(ctx ConnContext, resp *pnet.HandshakeResp, ns *namespace.Namespace, tlvs []proxyprotocol.ProxyTlv) (*namespace.Namespace, error) {
+	if err := ns.CheckClientAddr(ctx.ClientAddr()); err != nil {
+		return nil, errors.Wrap(ErrClientHostDenied, err)
+	}
+	if !ns.MatchProxyTLV(tlvs) {
+		return nil, errors.Errorf("the PROXY protocol TLVs are not allowed by namespace %s", ns.Name())
+	}
+	var tlsState *tls.ConnectionState
+	if state, ok := ctx.Value(ConnContextKeyTLSState).(tls.ConnectionState); ok {
+		tlsState = &state
+	}
+	subject, err := ns.VerifyTLS(resp.User, tlsState)
+	if errors.Is(err, namespace.ErrInsecureTransport) {
+		return nil, errors.Wrap(ErrClientNoTLS, err)
+	} else if err != nil {
+		return nil, err
+	}
+	if len(subject) > 0 {
+		ctx.SetValue(ConnContextKeyClientCertSubject, subject)
+		ctx.UpdateLogger(zap.String("cert_subject", subject))
+	}
 	ctx.UpdateLogger(zap.String("ns", ns.Name()))
-	return ns.GetRouter(), nil
+	ctx.SetValue(ConnContextKeyMigrationDeadline, ns.MigrationDeadline())
+	ctx.SetValue(ConnContextKeyBackendCompression, ns.BackendCompression())
+	ctx.SetValue(ConnContextKeyQueryLimits, ns.QueryLimits())
+	ctx.SetValue(ConnContextKeyLoadData, ns.LoadDataPolicy())
+	if ns.RestrictsUsers() {
+		ctx.SetValue(ConnContextKeyDenyChangeUser, true)
+	}
+	ctx.SetValue(connContextKeyNamespace, ns)
+	return ns, nil
 }
 
 func (handler *DefaultHandshakeHandler) OnHandshake(ConnContext, string, error, ErrorSource) {
@@ -92,7 +201,17 @@ func (handler *DefaultHandshakeHandler) OnConnClose(ConnContext, ErrorSource) er
 }
 
 func (handler *DefaultHandshakeHandler) GetCapability() pnet.Capability {
-	return SupportedServerCapabilities
+	capability := SupportedServerCapabilities
+	if handler.nsManager == nil {
+		return capability
+	}
+	// The capability is sent before getting the router, so exclude the ones unsupported by any namespace.
+	capability = negotiateCapability(capability, handler.nsManager.Capability())
+	// The clients won't send any file if no namespace allows it.
+	if handler.nsManager.LocalLoadDisabled() {
+		capability &^= pnet.ClientLocalFiles
+	}
+	return capability
 }
 
 func (handler *DefaultHandshakeHandler) GetServerVersion() string {
@@ -110,6 +229,7 @@ func (handler *DefaultHandshakeHandler) GetServerVersion() string {
 
 type CustomHandshakeHandler struct {
 	getRouter           func(ctx ConnContext, resp *pnet.HandshakeResp) (router.Router, error)
+	getLocalUser        func(ctx ConnContext, resp *pnet.HandshakeResp) (*config.LocalUser, bool, error)
 	onHandshake         func(ConnContext, string, error, ErrorSource)
 	onTraffic           func(ConnContext)
 	onConnClose         func(ConnContext, ErrorSource) error
@@ -126,6 +246,13 @@ func (h *CustomHandshakeHandler) GetRouter(ctx ConnContext, resp *pnet.Handshake
 	return nil, errors.New("no router")
 }
 
+func (h *CustomHandshakeHandler) GetLocalUser(ctx ConnContext, resp *pnet.HandshakeResp) (*config.LocalUser, bool, error) {
+	if h.getLocalUser != nil {
+		return h.getLocalUser(ctx, resp)
+	}
+	return nil, false, nil
+}
+
 func (h *CustomHandshakeHandler) OnHandshake(ctx ConnContext, addr string, err error, src ErrorSource) {
 	if h.onHandshake != nil {
 		h.onHandshake(ctx, addr, err, src)
@@ -120,3 +120,38 @@ func addGetBackendMetrics(duration time.Duration, succeed bool) {
 	}
 	metrics.GetBackendCounter.WithLabelValues(lbl).Inc()
 }
+
+// addTLSSessionMetrics records whether the TLS session to the backend is resumed from the session cache.
+func addTLSSessionMetrics(addr string, resumed bool) {
+	lbl := "hit"
+	if !resumed {
+		lbl = "miss"
+	}
+	metrics.TLSSessionCounter.WithLabelValues(addr, lbl).Inc()
+}
+
+// Only used for testing, no need to optimize.
+func readTLSSessionCounter(addr string, resumed bool) (int, error) {
+	lbl := "hit"
+	if !resumed {
+		lbl = "miss"
+	}
+	return metrics.ReadCounter(metrics.TLSSessionCounter.WithLabelValues(addr, lbl))
+}
+
+// addForcedMigrateMetrics records the action taken when the session can't be migrated before the deadline.
+// The migration result after rolling back is still recorded by the router.
+func addForcedMigrateMetrics(from, to, action string) {
+	metrics.MigrateCounter.WithLabelValues(from, to, "forced_"+action).Inc()
+}
+
+func readForcedMigrateCounter(from, to, action string) (int, error) {
+	return metrics.ReadCounter(metrics.MigrateCounter.WithLabelValues(from, to, "forced_"+action))
+}
+
+// addLoadDataMetrics records the statistics of a LOAD DATA LOCAL INFILE.
+func addLoadDataMetrics(addr string, bytes, rows int64, duration time.Duration) {
+	metrics.LoadDataBytesCounter.WithLabelValues(addr).Add(float64(bytes))
+	metrics.LoadDataRowsCounter.WithLabelValues(addr).Add(float64(rows))
+	metrics.LoadDataDurationHistogram.WithLabelValues(addr).Observe(duration.Seconds())
+}
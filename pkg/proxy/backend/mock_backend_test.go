@@ -4,17 +4,21 @@
 package backend
 
 import (
+	"crypto/rsa"
 	"crypto/tls"
 	"encoding/binary"
 
 	"github.com/go-mysql-org/go-mysql/mysql"
 	"github.com/pingcap/tiproxy/lib/util/errors"
+	"github.com/pingcap/tiproxy/lib/util/security"
 	pnet "github.com/pingcap/tiproxy/pkg/proxy/net"
 )
 
 type backendConfig struct {
-	salt          [20]byte
-	tlsConfig     *tls.Config
+	salt      [20]byte
+	tlsConfig *tls.Config
+	// rsaKey answers the public key requests in caching_sha2_password
+	rsaKey        *rsa.PrivateKey
 	authPlugin    string
 	sessionStates string
 	columns       int
@@ -105,6 +109,23 @@ func (mb *mockBackend) authenticate(packetIO *pnet.PacketIO) error {
 	return mb.verifyPassword(packetIO, resp)
 }
 
+// exchangePassword sends the public key and decrypts the password.
+func (mb *mockBackend) exchangePassword(packetIO *pnet.PacketIO) ([]byte, error) {
+	pubPEM, err := security.EncodeRSAPublicKey(&mb.rsaKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if err = packetIO.WritePacket(append([]byte{pnet.ShaCommand}, pubPEM...), true); err != nil {
+		return nil, err
+	}
+	encrypted, err := packetIO.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+	password, err := decryptPassword(encrypted, mb.salt[:], mb.rsaKey)
+	return []byte(password), err
+}
+
 func (mb *mockBackend) verifyPassword(packetIO *pnet.PacketIO, resp *pnet.HandshakeResp) error {
 	if resp.AuthPlugin != pnet.AuthTiDBSessionToken {
 		var err error
@@ -122,13 +143,18 @@ func (mb *mockBackend) verifyPassword(packetIO *pnet.PacketIO, resp *pnet.Handsh
 			if mb.authData, err = packetIO.ReadPacket(); err != nil {
 				return err
 			}
+			if mb.rsaKey != nil && len(mb.authData) == 1 && mb.authData[0] == pnet.RequestPublicKey {
+				if mb.authData, err = mb.exchangePassword(packetIO); err != nil {
+					return err
+				}
+			}
 		}
 	}
 	if mb.authSucceed {
 		if err := packetIO.WriteOKPacket(mb.status, pnet.OKHeader); err != nil {
 			return err
 		}
-		if err := setCompress(packetIO, mb.capability, mb.zstdLevel); err != nil {
+		if err := setCompress(packetIO, mb.capability, 0, mb.zstdLevel); err != nil {
 			return err
 		}
 	} else {
@@ -7,7 +7,11 @@ import (
 	"crypto/tls"
 	"encoding/binary"
 
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/pingcap/tiproxy/lib/util/errors"
+	"github.com/pingcap/tiproxy/lib/util/security"
 	pnet "github.com/pingcap/tiproxy/pkg/proxy/net"
+	"github.com/pingcap/tiproxy/pkg/proxy/proxyprotocol"
 )
 
 type clientConfig struct {
@@ -20,12 +24,16 @@ type clientConfig struct {
 	attrs      map[string]string
 	dataBytes  []byte
 	authData   []byte
+	// if password is set, authData is scrambled from the password and the salt sent by the server
+	password   string
 	filePkts   int
 	prepStmtID int
 	capability pnet.Capability
 	collation  uint8
 	cmd        pnet.Command
 	zstdLevel  int
+	// the PROXY protocol header sent before the handshake response
+	proxy *proxyprotocol.Proxy
 	// for both auth and cmd
 	abnormalExit bool
 }
@@ -51,6 +59,7 @@ type mockClient struct {
 	*clientConfig
 	// Outputs that received from the server and will be checked by the test.
 	authSucceed   bool
+	authSwitches  int
 	mysqlErr      error
 	serverVersion string
 }
@@ -65,21 +74,37 @@ func (mc *mockClient) authenticate(packetIO *pnet.PacketIO) error {
 	if mc.abnormalExit {
 		return packetIO.Close()
 	}
+	if mc.proxy != nil {
+		packetIO.EnableProxyClient(mc.proxy)
+	}
 	pkt, err := packetIO.ReadPacket()
 	if err != nil {
 		return err
 	}
+	// The proxy may reject the client before the handshake.
+	if pkt[0] == pnet.ErrHeader.Byte() {
+		mc.mysqlErr = pnet.ParseErrorPacket(pkt)
+		return nil
+	}
 	serverCap, connid, serverVersion := pnet.ParseInitialHandshake(pkt)
 	mc.capability = mc.capability & serverCap
 	mc.serverVersion = serverVersion
 	mc.connid = connid
 
+	authData := mc.authData
+	if len(mc.password) > 0 {
+		salt, _, err := pnet.ParseInitialHandshakeAuth(pkt)
+		if err != nil {
+			return err
+		}
+		authData = scramblePassword(mc.authPlugin, salt, mc.password)
+	}
 	resp := &pnet.HandshakeResp{
 		User:       mc.username,
 		DB:         mc.dbName,
 		AuthPlugin: mc.authPlugin,
 		Attrs:      mc.attrs,
-		AuthData:   mc.authData,
+		AuthData:   authData,
 		Capability: mc.capability,
 		Collation:  mc.collation,
 		ZstdLevel:  mc.zstdLevel,
@@ -100,6 +125,8 @@ func (mc *mockClient) authenticate(packetIO *pnet.PacketIO) error {
 }
 
 func (mc *mockClient) writePassword(packetIO *pnet.PacketIO) error {
+	var salt []byte
+	authPlugin, sha2Result := mc.authPlugin, false
 	for {
 		serverPkt, err := packetIO.ReadPacket()
 		if err != nil {
@@ -107,6 +134,11 @@ func (mc *mockClient) writePassword(packetIO *pnet.PacketIO) error {
 		}
 		switch serverPkt[0] {
 		case pnet.OKHeader.Byte():
+			// libmysqlclient fails if the server doesn't send the result of caching_sha2_password.
+			if authPlugin == pnet.AuthCachingSha2Password && len(mc.password) > 0 && !sha2Result {
+				mc.authSucceed = false
+				return errors.New("missing the caching_sha2_password auth result")
+			}
 			mc.authSucceed = true
 			return nil
 		case pnet.ErrHeader.Byte():
@@ -114,13 +146,51 @@ func (mc *mockClient) writePassword(packetIO *pnet.PacketIO) error {
 			mc.mysqlErr = pnet.ParseErrorPacket(serverPkt)
 			return nil
 		case pnet.AuthSwitchHeader.Byte(), pnet.ShaCommand:
-			if err := packetIO.WritePacket(mc.authData, true); err != nil {
+			if serverPkt[0] == pnet.ShaCommand {
+				sha2Result = true
+				if len(serverPkt) == 2 && serverPkt[1] == pnet.FastAuthOK {
+					continue
+				}
+			}
+			authData := mc.authData
+			if serverPkt[0] == pnet.AuthSwitchHeader.Byte() {
+				mc.authSwitches++
+				authPlugin, salt = parseAuthSwitchRequest(serverPkt)
+			}
+			if len(mc.password) > 0 {
+				if serverPkt[0] == pnet.AuthSwitchHeader.Byte() {
+					authData = scramblePassword(authPlugin, salt, mc.password)
+				} else if authData, err = mc.sha2FullAuth(packetIO, salt); err != nil {
+					return err
+				}
+			}
+			if err := packetIO.WritePacket(authData, true); err != nil {
 				return err
 			}
 		}
 	}
 }
 
+// sha2FullAuth returns the password for the caching_sha2_password full authentication.
+// Without TLS, it requests the RSA public key from the server and encrypts the password.
+func (mc *mockClient) sha2FullAuth(packetIO *pnet.PacketIO, salt []byte) ([]byte, error) {
+	if mc.capability&pnet.ClientSSL > 0 {
+		return append([]byte(mc.password), 0), nil
+	}
+	if err := packetIO.WritePacket([]byte{pnet.RequestPublicKey}, true); err != nil {
+		return nil, err
+	}
+	pkt, err := packetIO.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+	pub, err := security.ParseRSAPublicKey(pkt[1:])
+	if err != nil {
+		return nil, err
+	}
+	return mysql.EncryptPassword(mc.password, salt, pub)
+}
+
 // request sends commands except prepared statements commands.
 func (mc *mockClient) request(packetIO *pnet.PacketIO) error {
 	if mc.abnormalExit {
@@ -335,6 +405,7 @@ func (mc *mockClient) readResultSet(packetIO *pnet.PacketIO) error {
 			if pkt[0] == pnet.OKHeader.Byte() {
 				serverStatus = binary.LittleEndian.Uint16(pkt[3:])
 			} else {
+				mc.mysqlErr = pnet.ParseErrorPacket(pkt)
 				return nil
 			}
 		default:
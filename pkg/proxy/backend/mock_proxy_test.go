@@ -64,15 +64,21 @@ func (mp *mockProxy) authenticateFirstTime(clientIO, backendIO *pnet.PacketIO) e
 	if err := mp.authenticator.handshakeFirstTime(context.Background(), mp.logger, mp, clientIO, mp.handshakeHandler,
 		func(ctx context.Context, cctx ConnContext, resp *pnet.HandshakeResp) (*pnet.PacketIO, error) {
 			return backendIO, nil
-		}, mp.frontendTLSConfig, mp.backendTLSConfig); err != nil {
+		}, mp.execInitSQL, mp.frontendTLSConfig, mp.backendTLSConfig); err != nil {
 		return err
 	}
 	mp.cmdProcessor.capability = mp.authenticator.capability
+	mp.cmdProcessor.backendCapability = mp.authenticator.backendCapability
 	return nil
 }
 
 func (mp *mockProxy) authenticateSecondTime(clientIO, backendIO *pnet.PacketIO) error {
-	return mp.authenticator.handshakeSecondTime(mp.logger, clientIO, backendIO, mp.backendTLSConfig, mp.sessionToken)
+	backendCapability, err := mp.authenticator.handshakeSecondTime(mp.logger, clientIO, backendIO, mp.backendTLSConfig, mp.sessionToken)
+	if err == nil {
+		mp.authenticator.backendCapability = backendCapability
+		mp.cmdProcessor.backendCapability = backendCapability
+	}
+	return err
 }
 
 func (mp *mockProxy) processCmd(clientIO, backendIO *pnet.PacketIO) error {
@@ -81,12 +87,12 @@ func (mp *mockProxy) processCmd(clientIO, backendIO *pnet.PacketIO) error {
 	if err != nil {
 		return err
 	}
-	if mp.holdRequest, err = mp.cmdProcessor.executeCmd(request, clientIO, backendIO, mp.waitRedirect); err != nil {
+	if mp.holdRequest, err = mp.cmdProcessor.executeCmd(context.Background(), request, clientIO, backendIO, mp.waitRedirect); err != nil {
 		return err
 	}
 	// Pretend to redirect the held request to the new backend. The backend must respond for another loop.
 	if mp.holdRequest {
-		_, err = mp.cmdProcessor.executeCmd(request, clientIO, backendIO, false)
+		_, err = mp.cmdProcessor.executeCmd(context.Background(), request, clientIO, backendIO, false)
 	}
 	return err
 }
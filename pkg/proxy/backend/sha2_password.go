@@ -0,0 +1,104 @@
+// Copyright 2024 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"crypto/rsa"
+	"crypto/sha1"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/pingcap/tiproxy/lib/util/errors"
+	"github.com/pingcap/tiproxy/lib/util/security"
+	pnet "github.com/pingcap/tiproxy/pkg/proxy/net"
+)
+
+func (auth *Authenticator) getRSAKey() *rsa.PrivateKey {
+	if auth.rsaKey == nil {
+		return nil
+	}
+	return auth.rsaKey()
+}
+
+// forwardSha2Password handles the caching_sha2_password full authentication for the client that doesn't enable TLS.
+// The FastAuthFail packet has been sent to the client. The client requests the public key of the proxy and sends
+// the encrypted password. The proxy decrypts the password and sends it to the backend.
+func forwardSha2Password(clientIO, backendIO *pnet.PacketIO, salt []byte, rsaKey *rsa.PrivateKey) error {
+	pkt, err := clientIO.ReadPacket()
+	if err != nil {
+		return err
+	}
+	// The client may already have the public key, e.g. by `--server-public-key-path`.
+	if len(pkt) == 1 && pkt[0] == pnet.RequestPublicKey {
+		pubPEM, err := security.EncodeRSAPublicKey(&rsaKey.PublicKey)
+		if err != nil {
+			return errors.Wrap(ErrClientHandshake, err)
+		}
+		if err := clientIO.WritePacket(append([]byte{pnet.ShaCommand}, pubPEM...), true); err != nil {
+			return err
+		}
+		if pkt, err = clientIO.ReadPacket(); err != nil {
+			return err
+		}
+	}
+	password, err := decryptPassword(pkt, salt, rsaKey)
+	if err != nil {
+		return errors.Wrap(ErrClientHandshake, err)
+	}
+	if err := writeSha2Password(backendIO, salt, password); err != nil {
+		return errors.Wrap(ErrBackendHandshake, err)
+	}
+	return nil
+}
+
+// writeSha2Password sends the password to the backend for the caching_sha2_password full authentication.
+// The password is sent in plain text over TLS, or encrypted with the public key of the backend otherwise.
+func writeSha2Password(backendIO *pnet.PacketIO, salt []byte, password string) error {
+	if backendIO.TLSConnectionState().HandshakeComplete {
+		return backendIO.WritePacket(append([]byte(password), 0), true)
+	}
+	if err := backendIO.WritePacket([]byte{pnet.RequestPublicKey}, true); err != nil {
+		return err
+	}
+	pkt, err := backendIO.ReadPacket()
+	if err != nil {
+		return err
+	}
+	if len(pkt) == 0 {
+		return errors.WithStack(mysql.ErrMalformPacket)
+	}
+	if pkt[0] == pnet.ErrHeader.Byte() {
+		return pnet.ParseErrorPacket(pkt)
+	}
+	if pkt[0] != pnet.ShaCommand {
+		return errors.Wrapf(mysql.ErrMalformPacket, "read unexpected command: %#x", pkt[0])
+	}
+	pub, err := security.ParseRSAPublicKey(pkt[1:])
+	if err != nil {
+		return err
+	}
+	encrypted, err := mysql.EncryptPassword(password, salt, pub)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return backendIO.WritePacket(encrypted, true)
+}
+
+// decryptPassword decrypts the password encrypted by mysql.EncryptPassword.
+func decryptPassword(data, salt []byte, rsaKey *rsa.PrivateKey) (string, error) {
+	if len(salt) == 0 {
+		return "", errors.New("empty salt")
+	}
+	plain, err := rsa.DecryptOAEP(sha1.New(), nil, rsaKey, data, nil)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	for i := range plain {
+		plain[i] ^= salt[i%len(salt)]
+	}
+	// the password ends with [00]
+	if len(plain) == 0 || plain[len(plain)-1] != 0 {
+		return "", errors.New("invalid password format")
+	}
+	return string(plain[:len(plain)-1]), nil
+}
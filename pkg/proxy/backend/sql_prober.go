@@ -0,0 +1,90 @@
+// Copyright 2024 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+
+	"github.com/pingcap/tiproxy/lib/config"
+	"github.com/pingcap/tiproxy/lib/util/errors"
+	"github.com/pingcap/tiproxy/pkg/balance/observer"
+	pnet "github.com/pingcap/tiproxy/pkg/proxy/net"
+	"go.uber.org/zap"
+)
+
+// sqlProbeCapability is the client capability used by the SQL prober.
+// Compression and multi-statements are unnecessary for a probe query.
+const sqlProbeCapability = requiredFrontendCaps | defRequiredBackendCaps | pnet.ClientLongPassword | pnet.ClientLongFlag |
+	pnet.ClientSSL | pnet.ClientTransactions | pnet.ClientSecureConnection | pnet.ClientPluginAuth
+
+var _ observer.SQLProber = (*SQLProber)(nil)
+
+// SQLProber logs in to the backends with the health check user and runs the probe query.
+// It goes through the same authentication path as client connections, so a backend that can't serve
+// client connections also fails the probe.
+type SQLProber struct {
+	logger *zap.Logger
+	config *BCConfig
+	// backendTLSConfig returns the latest TLS config because the certs may be rotated.
+	backendTLSConfig func() *tls.Config
+}
+
+func NewSQLProber(logger *zap.Logger, config *BCConfig, backendTLSConfig func() *tls.Config) *SQLProber {
+	config.check()
+	return &SQLProber{
+		logger:           logger,
+		config:           config,
+		backendTLSConfig: backendTLSConfig,
+	}
+}
+
+// Probe implements observer.SQLProber interface.
+func (sp *SQLProber) Probe(ctx context.Context, addr string, cfg *config.HealthCheck) error {
+	ctx, cancel := context.WithTimeout(ctx, cfg.SQLTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	cn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "dial backend failed")
+	}
+	backendIO := pnet.NewPacketIO(cn, sp.logger, sp.config.ConnBufferSize, pnet.WithRemoteAddr(addr, cn.RemoteAddr()), pnet.WithWrapError(ErrBackendConn))
+	defer func() {
+		if ignoredErr := backendIO.Close(); ignoredErr != nil && !pnet.IsDisconnectError(ignoredErr) {
+			sp.logger.Warn("close connection in sql probe failed", zap.Error(ignoredErr))
+		}
+	}()
+	// The deadline covers the whole probe, including the handshake and the query.
+	deadline, _ := ctx.Deadline()
+	if err = cn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	auth := NewAuthenticator(sp.config)
+	auth.user = cfg.SQLUser
+	auth.capability = sqlProbeCapability
+	auth.collation = pnet.Collation
+	var tlsConfig *tls.Config
+	if sp.backendTLSConfig != nil {
+		tlsConfig = sp.backendTLSConfig()
+	}
+	capability, err := auth.handshakeWithPassword(sp.logger, backendIO, tlsConfig, cfg.SQLPassword)
+	if err != nil {
+		return err
+	}
+
+	cp := NewCmdProcessor(sp.logger)
+	cp.capability = capability
+	cp.backendCapability = capability
+	if _, _, err = cp.query(backendIO, cfg.SQLQuery); err != nil {
+		return errors.Wrapf(err, "run probe query failed")
+	}
+	// Quit gracefully so that the backend doesn't log it as an abnormal disconnection.
+	backendIO.ResetSequence()
+	if err = backendIO.WritePacket([]byte{pnet.ComQuit.Byte()}, true); err != nil && !pnet.IsDisconnectError(err) {
+		sp.logger.Debug("write quit in sql probe failed", zap.Error(err))
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2024 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/pingcap/tiproxy/lib/config"
+	"github.com/pingcap/tiproxy/lib/util/logger"
+	"github.com/pingcap/tiproxy/lib/util/security"
+	"github.com/pingcap/tiproxy/lib/util/waitgroup"
+	pnet "github.com/pingcap/tiproxy/pkg/proxy/net"
+	"github.com/pingcap/tiproxy/pkg/testkit"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLProber(t *testing.T) {
+	lg, _ := logger.CreateLoggerForTest(t)
+	stls, ctls, err := security.CreateTLSConfigForTest()
+	require.NoError(t, err)
+	cfg := config.NewDefaultHealthCheckConfig()
+	cfg.SQLUser = "probe"
+	cfg.SQLPassword = "123456"
+	rsaKey, err := security.GenerateRSAKey(1024)
+	require.NoError(t, err)
+
+	tests := []struct {
+		authPlugin  string
+		tls         bool
+		rsaKey      *rsa.PrivateKey
+		authSucceed bool
+		respondType respondType
+		authData    []byte
+		errMsg      string
+	}{
+		{
+			authPlugin:  pnet.AuthNativePassword,
+			authSucceed: true,
+			respondType: responseTypeResultSet,
+			authData:    mysql.CalcPassword(mockSalt[:], []byte(cfg.SQLPassword)),
+		},
+		{
+			authPlugin:  pnet.AuthCachingSha2Password,
+			tls:         true,
+			authSucceed: true,
+			respondType: responseTypeResultSet,
+			authData:    append([]byte(cfg.SQLPassword), 0),
+		},
+		{
+			// The full authentication of caching_sha2_password encrypts the password with the backend key without TLS.
+			authPlugin:  pnet.AuthCachingSha2Password,
+			rsaKey:      rsaKey,
+			authSucceed: true,
+			respondType: responseTypeResultSet,
+			authData:    []byte(cfg.SQLPassword),
+		},
+		{
+			authPlugin:  pnet.AuthNativePassword,
+			authSucceed: false,
+			errMsg:      "Access denied",
+		},
+		{
+			authPlugin:  pnet.AuthNativePassword,
+			authSucceed: true,
+			respondType: responseTypeErr,
+			errMsg:      "run probe query failed",
+		},
+	}
+
+	for i, test := range tests {
+		listener, addr := testkit.StartListener(t, "")
+		bcfg := newBackendConfig()
+		bcfg.authPlugin = test.authPlugin
+		bcfg.rsaKey = test.rsaKey
+		bcfg.authSucceed = test.authSucceed
+		bcfg.respondType = test.respondType
+		bcfg.columns = 1
+		bcfg.rows = 1
+		if test.tls {
+			bcfg.tlsConfig = stls
+		} else {
+			bcfg.capability &= ^pnet.ClientSSL
+		}
+		mb := newMockBackend(bcfg)
+		var wg waitgroup.WaitGroup
+		wg.Run(func() {
+			conn, err := listener.Accept()
+			require.NoError(t, err)
+			backendIO := pnet.NewPacketIO(conn, lg, pnet.DefaultConnBufferSize)
+			if err = mb.authenticate(backendIO); err == nil && mb.authSucceed {
+				_ = mb.respond(backendIO)
+			}
+			_ = backendIO.Close()
+		})
+
+		prober := NewSQLProber(lg, &BCConfig{}, func() *tls.Config {
+			return ctls
+		})
+		err := prober.Probe(context.Background(), addr, cfg)
+		wg.Wait()
+		require.NoError(t, listener.Close())
+		if len(test.errMsg) > 0 {
+			require.ErrorContains(t, err, test.errMsg, "case %d", i)
+			continue
+		}
+		require.NoError(t, err, "case %d", i)
+		require.Equal(t, cfg.SQLUser, mb.username, "case %d", i)
+		require.Equal(t, test.authData, mb.authData, "case %d", i)
+	}
+}
+
+func TestSQLProberTimeout(t *testing.T) {
+	lg, _ := logger.CreateLoggerForTest(t)
+	cfg := config.NewDefaultHealthCheckConfig()
+	cfg.SQLUser = "probe"
+	cfg.SQLTimeout = 100 * time.Millisecond
+	// The backend accepts the connection but never responds.
+	listener, addr := testkit.StartListener(t, "")
+	prober := NewSQLProber(lg, &BCConfig{}, nil)
+	startTime := time.Now()
+	require.Error(t, prober.Probe(context.Background(), addr, cfg))
+	require.Less(t, time.Since(startTime), 5*time.Second)
+	require.NoError(t, listener.Close())
+}
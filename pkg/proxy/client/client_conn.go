@@ -8,6 +8,8 @@ import (
 	"crypto/tls"
 	"net"
 
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/pingcap/tiproxy/lib/config"
 	"github.com/pingcap/tiproxy/lib/util/errors"
 	"github.com/pingcap/tiproxy/pkg/metrics"
 	"github.com/pingcap/tiproxy/pkg/proxy/backend"
@@ -24,13 +26,14 @@ type ClientConnection struct {
 }
 
 func NewClientConnection(logger *zap.Logger, conn net.Conn, frontendTLSConfig *tls.Config, backendTLSConfig *tls.Config,
-	hsHandler backend.HandshakeHandler, connID uint64, addr string, bcConfig *backend.BCConfig) *ClientConnection {
+	hsHandler backend.HandshakeHandler, connID uint64, listener *config.ProxyListener, bcConfig *backend.BCConfig) *ClientConnection {
 	bemgr := backend.NewBackendConnManager(logger.Named("be"), hsHandler, connID, bcConfig)
-	bemgr.SetValue(backend.ConnContextKeyConnAddr, addr)
+	bemgr.SetValue(backend.ConnContextKeyConnAddr, listener.Addr)
+	bemgr.SetValue(backend.ConnContextKeyListener, listener)
 	opts := make([]pnet.PacketIOption, 0, 2)
 	opts = append(opts, pnet.WithWrapError(backend.ErrClientConn))
-	if bcConfig.ProxyProtocol {
-		opts = append(opts, pnet.WithProxy)
+	if bcConfig.AcceptProxyProtocol {
+		opts = append(opts, pnet.WithTrustedProxy(bcConfig.ProxyTrustedCIDRs))
 	}
 	pkt := pnet.NewPacketIO(conn, logger, bcConfig.ConnBufferSize, opts...)
 	return &ClientConnection{
@@ -71,6 +74,12 @@ func (cc *ClientConnection) processMsg(ctx context.Context) error {
 		cc.pkt.ResetSequence()
 		clientPkt, err := cc.pkt.ReadPacket()
 		if err != nil {
+			if errors.Is(err, pnet.ErrPacketTooLarge) {
+				// Like MySQL, return an error and close the connection because the rest of the packet is not read.
+				if writeErr := cc.pkt.WriteErrPacket(mysql.NewDefaultError(mysql.ER_NET_PACKET_TOO_LARGE)); writeErr != nil {
+					cc.logger.Warn("writing error to client failed", zap.Error(writeErr))
+				}
+			}
 			return err
 		}
 		err = cc.connMgr.ExecuteCmd(ctx, clientPkt)
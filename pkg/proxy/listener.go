@@ -0,0 +1,55 @@
+// Copyright 2023 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package proxy
+
+import (
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pingcap/tiproxy/lib/config"
+	"github.com/pingcap/tiproxy/lib/util/errors"
+)
+
+const dialStaleSocketTimeout = time.Second
+
+// listen listens on a TCP address or a Unix socket like `unix:///tmp/tiproxy.sock`.
+func listen(addr string, perm os.FileMode) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, config.UnixSocketAddrPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		_ = ln.Close()
+		return nil, errors.Wrapf(err, "chmod unix socket %s", path)
+	}
+	return ln, nil
+}
+
+// removeStaleSocket removes the socket file left by a previous process that exited abnormally.
+// It refuses to remove the file if it's not a socket or another process is still listening on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return errors.Errorf("%s already exists and is not a unix socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, dialStaleSocketTimeout); err == nil {
+		_ = conn.Close()
+		return errors.Errorf("unix socket %s is in use by another process", path)
+	}
+	return errors.WithStack(os.Remove(path))
+}
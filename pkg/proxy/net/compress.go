@@ -11,6 +11,8 @@ import (
 	"github.com/go-mysql-org/go-mysql/mysql"
 	"github.com/klauspost/compress/zstd"
 	"github.com/pingcap/tiproxy/lib/util/errors"
+	"github.com/pingcap/tiproxy/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 )
 
@@ -26,6 +28,16 @@ const (
 	CompressionZstd
 )
 
+func (ca CompressAlgorithm) String() string {
+	switch ca {
+	case CompressionZlib:
+		return "zlib"
+	case CompressionZstd:
+		return "zstd"
+	}
+	return "none"
+}
+
 const (
 	// maxCompressedSize is the max uncompressed data size for a compressed packet.
 	// Packets bigger than maxCompressedSize will be split into multiple compressed packets.
@@ -36,14 +48,16 @@ const (
 	// Packets smaller than minCompressSize won't be compressed.
 	// MySQL and MySQL Connector/J are both 50.
 	minCompressSize = 50
-	// defaultZlibLevel is the compression level for zlib. MySQL is 6.
+	// zlibCompressionLevel is the default compression level for zlib. MySQL is 6.
 	zlibCompressionLevel = 6
 )
 
-func (p *PacketIO) SetCompressionAlgorithm(algorithm CompressAlgorithm, zstdLevel int) error {
+// SetCompressionAlgorithm enables the compressed protocol. level is the compression level of the algorithm
+// and 0 means the default level.
+func (p *PacketIO) SetCompressionAlgorithm(algorithm CompressAlgorithm, level int) error {
 	switch algorithm {
 	case CompressionZlib, CompressionZstd:
-		p.readWriter = newCompressedReadWriter(p.readWriter, algorithm, zstdLevel, p.logger)
+		p.readWriter = newCompressedReadWriter(p.readWriter, algorithm, level, p.logger)
 	case CompressionNone:
 	default:
 		return errors.Wrapf(mysql.ErrMalformPacket, "Unknown compression algorithm %d", algorithm)
@@ -61,19 +75,32 @@ type compressedReadWriter struct {
 	logger      *zap.Logger
 	rwStatus    rwStatus
 	zstdLevel   zstd.EncoderLevel
+	zlibLevel   int
 	header      []byte
 	sequence    uint8
+	// The counters of the bytes before and after compression, whose ratio is the compression ratio.
+	readBytes, readCompressedBytes   prometheus.Counter
+	writeBytes, writeCompressedBytes prometheus.Counter
 }
 
-func newCompressedReadWriter(rw packetReadWriter, algorithm CompressAlgorithm, zstdLevel int, logger *zap.Logger) *compressedReadWriter {
-	return &compressedReadWriter{
-		packetReadWriter: rw,
-		algorithm:        algorithm,
-		zstdLevel:        zstd.EncoderLevelFromZstd(zstdLevel),
-		logger:           logger,
-		rwStatus:         rwNone,
-		header:           make([]byte, 7),
+func newCompressedReadWriter(rw packetReadWriter, algorithm CompressAlgorithm, level int, logger *zap.Logger) *compressedReadWriter {
+	crw := &compressedReadWriter{
+		packetReadWriter:     rw,
+		algorithm:            algorithm,
+		zstdLevel:            zstd.EncoderLevelFromZstd(level),
+		zlibLevel:            zlibCompressionLevel,
+		logger:               logger,
+		rwStatus:             rwNone,
+		header:               make([]byte, 7),
+		readBytes:            metrics.UncompressedBytesCounter.WithLabelValues(algorithm.String(), "read"),
+		readCompressedBytes:  metrics.CompressedBytesCounter.WithLabelValues(algorithm.String(), "read"),
+		writeBytes:           metrics.UncompressedBytesCounter.WithLabelValues(algorithm.String(), "write"),
+		writeCompressedBytes: metrics.CompressedBytesCounter.WithLabelValues(algorithm.String(), "write"),
+	}
+	if algorithm == CompressionZlib && level >= zlib.BestSpeed && level <= zlib.BestCompression {
+		crw.zlibLevel = level
 	}
+	return crw
 }
 
 func (crw *compressedReadWriter) ResetSequence() {
@@ -142,8 +169,10 @@ func (crw *compressedReadWriter) readFromConn() error {
 	crw.sequence++
 	compressedLength := int(uint32(crw.header[0]) | uint32(crw.header[1])<<8 | uint32(crw.header[2])<<16)
 	uncompressedLength := int(uint32(crw.header[4]) | uint32(crw.header[5])<<8 | uint32(crw.header[6])<<16)
+	crw.readCompressedBytes.Add(float64(len(crw.header) + compressedLength))
 
 	if uncompressedLength == 0 {
+		crw.readBytes.Add(float64(compressedLength))
 		// If the data is uncompressed, the uncompressed length is 0 and compressed length is the data length
 		// after the compressed header.
 		crw.readBuffer.Grow(compressedLength)
@@ -160,6 +189,7 @@ func (crw *compressedReadWriter) readFromConn() error {
 		if err = crw.uncompress(data, uncompressedLength); err != nil {
 			return err
 		}
+		crw.readBytes.Add(float64(uncompressedLength))
 	}
 	return nil
 }
@@ -203,6 +233,7 @@ func (crw *compressedReadWriter) Flush() error {
 	// after the compressed header.
 	uncompressedLength := 0
 	compressedLength := len(data)
+	crw.writeBytes.Add(float64(len(data)))
 	if len(data) >= minCompressSize {
 		// If the data is compressed, the compressed length is the length of data after the compressed header and
 		// the uncompressed length is the length of data after decompression.
@@ -212,6 +243,7 @@ func (crw *compressedReadWriter) Flush() error {
 		}
 		compressedLength = len(data)
 	}
+	crw.writeCompressedBytes.Add(float64(len(crw.header) + compressedLength))
 
 	crw.header[0] = byte(compressedLength)
 	crw.header[1] = byte(compressedLength >> 8)
@@ -268,7 +300,7 @@ func (crw *compressedReadWriter) compress(data []byte) ([]byte, error) {
 	var compressWriter io.WriteCloser
 	switch crw.algorithm {
 	case CompressionZlib:
-		compressWriter, err = zlib.NewWriterLevel(&compressedPacket, zlibCompressionLevel)
+		compressWriter, err = zlib.NewWriterLevel(&compressedPacket, crw.zlibLevel)
 	case CompressionZstd:
 		compressWriter, err = zstd.NewWriter(&compressedPacket, zstd.WithEncoderLevel(crw.zstdLevel))
 	}
@@ -13,33 +13,38 @@ import (
 	"testing"
 
 	"github.com/pingcap/tiproxy/lib/util/logger"
+	"github.com/pingcap/tiproxy/pkg/metrics"
 	"github.com/pingcap/tiproxy/pkg/testkit"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
 )
 
 // Test read/write with zlib compression.
 func TestCompressZlib(t *testing.T) {
 	sizes := []int{minCompressSize - 1, 1024, maxCompressedSize, maxCompressedSize + 1, maxCompressedSize * 2}
+	levels := []int{0, 1, 9}
 	lg, _ := logger.CreateLoggerForTest(t)
-	testkit.TestTCPConn(t,
-		func(t *testing.T, c net.Conn) {
-			crw := newCompressedReadWriter(newBasicReadWriter(c, DefaultConnBufferSize), CompressionZlib, 0, lg)
-			written := crw.OutBytes()
-			for _, size := range sizes {
-				fillAndWrite(t, crw, 'a', size)
-				require.NoError(t, crw.Flush())
-				// Check compressed bytes.
-				outBytes := crw.OutBytes()
-				checkWrittenByteSize(t, outBytes-written, size)
-				written = outBytes
-			}
-		},
-		func(t *testing.T, c net.Conn) {
-			crw := newCompressedReadWriter(newBasicReadWriter(c, DefaultConnBufferSize), CompressionZlib, 0, lg)
-			for _, size := range sizes {
-				readAndCheck(t, crw, 'a', size)
-			}
-		}, 1)
+	for _, level := range levels {
+		testkit.TestTCPConn(t,
+			func(t *testing.T, c net.Conn) {
+				crw := newCompressedReadWriter(newBasicReadWriter(c, DefaultConnBufferSize), CompressionZlib, level, lg)
+				written := crw.OutBytes()
+				for _, size := range sizes {
+					fillAndWrite(t, crw, 'a', size)
+					require.NoError(t, crw.Flush())
+					// Check compressed bytes.
+					outBytes := crw.OutBytes()
+					checkWrittenByteSize(t, outBytes-written, size)
+					written = outBytes
+				}
+			},
+			func(t *testing.T, c net.Conn) {
+				crw := newCompressedReadWriter(newBasicReadWriter(c, DefaultConnBufferSize), CompressionZlib, level, lg)
+				for _, size := range sizes {
+					readAndCheck(t, crw, 'a', size)
+				}
+			}, 1)
+	}
 }
 
 // Test read/write with zstd compression.
@@ -325,3 +330,35 @@ func BenchmarkUncompress(b *testing.B) {
 		uncompress(b, res)
 	}
 }
+
+// Test that the compression ratio is exported by the metrics.
+func TestCompressMetrics(t *testing.T) {
+	readCounter := func(counter *prometheus.CounterVec, direction string) int {
+		val, err := metrics.ReadCounter(counter.WithLabelValues(CompressionZstd.String(), direction))
+		require.NoError(t, err)
+		return val
+	}
+	size := 1024
+	lg, _ := logger.CreateLoggerForTest(t)
+	var written uint64
+	testkit.TestTCPConn(t,
+		func(t *testing.T, c net.Conn) {
+			writeBytes := readCounter(metrics.UncompressedBytesCounter, "write")
+			writeCompressedBytes := readCounter(metrics.CompressedBytesCounter, "write")
+			crw := newCompressedReadWriter(newBasicReadWriter(c, DefaultConnBufferSize), CompressionZstd, 0, lg)
+			fillAndWrite(t, crw, 'a', size)
+			require.NoError(t, crw.Flush())
+			written = crw.OutBytes()
+			require.Equal(t, size, readCounter(metrics.UncompressedBytesCounter, "write")-writeBytes)
+			require.Equal(t, int(written), readCounter(metrics.CompressedBytesCounter, "write")-writeCompressedBytes)
+		},
+		func(t *testing.T, c net.Conn) {
+			readBytes := readCounter(metrics.UncompressedBytesCounter, "read")
+			readCompressedBytes := readCounter(metrics.CompressedBytesCounter, "read")
+			crw := newCompressedReadWriter(newBasicReadWriter(c, DefaultConnBufferSize), CompressionZstd, 0, lg)
+			readAndCheck(t, crw, 'a', size)
+			require.Equal(t, size, readCounter(metrics.UncompressedBytesCounter, "read")-readBytes)
+			require.Equal(t, int(crw.InBytes()), readCounter(metrics.CompressedBytesCounter, "read")-readCompressedBytes)
+		}, 1)
+	require.Less(t, int(written), size)
+}
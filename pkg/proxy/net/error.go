@@ -20,6 +20,8 @@ var (
 	ErrFlushConn    = errors.New("failed to flush the connection")
 	ErrCloseConn    = errors.New("failed to close the connection")
 	ErrHandshakeTLS = errors.New("failed to complete tls handshake")
+	// ErrPacketTooLarge is returned when the packet exceeds the size set by WithMaxPacketSize.
+	ErrPacketTooLarge = errors.New("got a packet bigger than the max allowed size")
 )
 
 // IsDisconnectError returns whether the error is caused by peer disconnection.
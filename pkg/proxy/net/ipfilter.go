@@ -0,0 +1,69 @@
+// Copyright 2024 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package net
+
+import (
+	"net"
+
+	"github.com/pingcap/tiproxy/pkg/proxy/proxyprotocol"
+)
+
+// IPFilter filters the clients by their IP addresses.
+// A client is rejected if it matches the denylist, or the allowlist is not empty and it doesn't match the allowlist.
+// The addresses without IPs, such as Unix sockets, are not filtered.
+type IPFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewIPFilter parses CIDRs like `10.0.0.0/8`. A plain IP is treated as a single-host CIDR.
+// It returns nil if both lists are empty, and a nil filter allows all clients.
+func NewIPFilter(allow, deny []string) (*IPFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	var err error
+	filter := &IPFilter{}
+	if filter.allow, err = proxyprotocol.ParseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if filter.deny, err = proxyprotocol.ParseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// Allow returns whether the client with the address like `10.0.0.1:34567` is allowed to connect.
+func (f *IPFilter) Allow(addr string) bool {
+	if f == nil {
+		return true
+	}
+	ip, ok := addrIP(addr)
+	if !ok {
+		return true
+	}
+	if matchCIDRs(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || matchCIDRs(f.allow, ip)
+}
+
+func matchCIDRs(ipNets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range ipNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP returns the IP of the address. ok is false if the address has no IP.
+func addrIP(addr string) (ip net.IP, ok bool) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, false
+	}
+	ip = net.ParseIP(host)
+	return ip, ip != nil
+}
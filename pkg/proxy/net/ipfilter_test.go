@@ -0,0 +1,48 @@
+// Copyright 2024 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package net
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPFilter(t *testing.T) {
+	_, err := NewIPFilter([]string{"10.0.0.0/33"}, nil)
+	require.Error(t, err)
+	_, err = NewIPFilter(nil, []string{"abc"})
+	require.Error(t, err)
+
+	filter, err := NewIPFilter(nil, nil)
+	require.NoError(t, err)
+	require.Nil(t, filter)
+	require.True(t, filter.Allow("1.1.1.1:3306"))
+
+	filter, err = NewIPFilter([]string{"10.0.0.0/8", "192.168.1.1", "fe80::/64"}, []string{"10.0.0.0/24", "fe80::1"})
+	require.NoError(t, err)
+	tests := []struct {
+		addr  string
+		allow bool
+	}{
+		{"10.1.2.3:1", true},
+		{"10.0.0.3:1", false},
+		{"11.1.2.3:1", false},
+		{"192.168.1.1:1", true},
+		{"192.168.1.2:1", false},
+		{"[fe80::2]:1", true},
+		{"[fe80::1]:1", false},
+		{"[fe81::2]:1", false},
+		{"/tmp/tiproxy.sock", true},
+		{"", true},
+	}
+	for i, test := range tests {
+		require.Equal(t, test.allow, filter.Allow(test.addr), "case %d", i)
+	}
+
+	filter, err = NewIPFilter(nil, []string{"10.0.0.1"})
+	require.NoError(t, err)
+	require.False(t, filter.Allow("10.0.0.1:1"))
+	require.True(t, filter.Allow("10.0.0.2:1"))
+}
@@ -17,8 +17,11 @@ import (
 )
 
 const (
-	ShaCommand   = 1
-	FastAuthFail = 4
+	ShaCommand = 1
+	// RequestPublicKey is sent by the client to request the RSA public key of the server in caching_sha2_password.
+	RequestPublicKey = 2
+	FastAuthOK       = 3
+	FastAuthFail     = 4
 )
 
 var (
@@ -55,6 +58,63 @@ func ParseInitialHandshake(data []byte) (Capability, uint64, string) {
 	return Capability(capability), uint64(connid), serverVersion
 }
 
+// ParseInitialHandshakeAuth parses the salt and the auth plugin in the initial handshake received from the server.
+// The packet comes from the network, so every field is checked before it's read.
+func ParseInitialHandshakeAuth(data []byte) (salt []byte, authPlugin string, err error) {
+	if len(data) < 2 {
+		return nil, "", errors.Wrapf(gomysql.ErrMalformPacket, "initial handshake is too short")
+	}
+	end := bytes.IndexByte(data[1:], 0)
+	if end < 0 {
+		return nil, "", errors.Wrapf(gomysql.ErrMalformPacket, "server version is not terminated")
+	}
+	// skip min version and connection id
+	pos := 1 + end + 1 + 4
+	if pos+8 > len(data) {
+		return nil, "", errors.Wrapf(gomysql.ErrMalformPacket, "initial handshake is too short for the salt")
+	}
+	// salt first part
+	salt = append(salt, data[pos:pos+8]...)
+	// skip salt first part, filter and capability lower 2 bytes
+	pos += 8 + 1 + 2
+	if len(data) <= pos {
+		return salt, "", nil
+	}
+	// skip server charset + status + capability upper 2 bytes
+	pos += 1 + 2 + 2
+	if pos >= len(data) {
+		return nil, "", errors.Wrapf(gomysql.ErrMalformPacket, "initial handshake is too short for the salt length")
+	}
+	saltLen := int(data[pos])
+	// skip auth data len and reserved
+	pos += 1 + 10
+	if pos > len(data) {
+		return nil, "", errors.Wrapf(gomysql.ErrMalformPacket, "initial handshake is too short for the reserved bytes")
+	}
+	// salt second part, the length is max(13, saltLen - 8), including the trailing [00]
+	rest := 13
+	if saltLen-8 > rest {
+		rest = saltLen - 8
+	}
+	if pos+rest > len(data) {
+		rest = len(data) - pos
+	}
+	salt = append(salt, data[pos:pos+rest]...)
+	if len(salt) > 0 && salt[len(salt)-1] == 0 {
+		salt = salt[:len(salt)-1]
+	}
+	pos += rest
+	// auth plugin
+	if pos < len(data) {
+		if end := bytes.IndexByte(data[pos:], 0); end >= 0 {
+			authPlugin = string(data[pos : pos+end])
+		} else {
+			authPlugin = string(data[pos:])
+		}
+	}
+	return salt, authPlugin, nil
+}
+
 // HandshakeResp indicates the response read from the client.
 type HandshakeResp struct {
 	Attrs      map[string]string
@@ -358,23 +418,39 @@ func ParseChangeUser(data []byte, capability Capability) (*ChangeUserReq, error)
 	return req, err
 }
 
-// ReadServerVersion only reads server version.
-func ReadServerVersion(conn net.Conn) (string, error) {
+// ReadServerHandshake reads the server version and the capability from the initial handshake.
+// The capability is 0 if the packet is too short to contain it.
+func ReadServerHandshake(conn net.Conn) (string, Capability, error) {
 	c := packet.NewConn(conn)
 	data, err := c.ReadPacket()
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
-	if data[0] == ErrHeader.Byte() {
-		return "", errors.New("read initial handshake error")
+	if len(data) == 0 || data[0] == ErrHeader.Byte() {
+		return "", 0, errors.New("read initial handshake error")
 	}
 	pos := 1
-	version := data[pos : pos+bytes.IndexByte(data[pos:], 0x00)]
-	return string(version), nil
+	end := bytes.IndexByte(data[pos:], 0x00)
+	if end < 0 {
+		return "", 0, errors.Wrapf(gomysql.ErrMalformPacket, "server version is not terminated")
+	}
+	version := data[pos : pos+end]
+	// skip server version, connection id, salt first part and filter
+	pos += len(version) + 1 + 4 + 8 + 1
+	if len(data) < pos+2 {
+		return string(version), 0, nil
+	}
+	capability := Capability(binary.LittleEndian.Uint16(data[pos:]))
+	// skip charset and status
+	pos += 2 + 1 + 2
+	if len(data) >= pos+2 {
+		capability |= Capability(binary.LittleEndian.Uint16(data[pos:])) << 16
+	}
+	return string(version), capability, nil
 }
 
-// WriteServerVersion only writes server version. It's only used for testing.
-func WriteServerVersion(conn net.Conn, serverVersion string) error {
+// WriteServerHandshake only writes the server version and the capability. It's only used for testing.
+func WriteServerHandshake(conn net.Conn, serverVersion string, capability Capability) error {
 	data := make([]byte, 0, 128)
 	data = append(data, []byte{0, 0, 0, 0}...)
 	// min version 10
@@ -382,6 +458,12 @@ func WriteServerVersion(conn net.Conn, serverVersion string) error {
 	// server version[NUL]
 	data = append(data, serverVersion...)
 	data = append(data, 0)
+	// connection id, salt first part and filter
+	data = append(data, make([]byte, 4+8+1)...)
+	data = binary.LittleEndian.AppendUint16(data, uint16(capability))
+	// charset and status
+	data = append(data, 0, 0, 0)
+	data = binary.LittleEndian.AppendUint16(data, uint16(capability>>16))
 	c := packet.NewConn(conn)
 	return c.WritePacket(data)
 }
@@ -397,6 +479,138 @@ func ParseOKPacket(data []byte) uint16 {
 	return binary.LittleEndian.Uint16(data[pos:])
 }
 
+// Session state change types in OK packets.
+// Ref https://dev.mysql.com/doc/dev/mysql-server/latest/mysql__com_8h.html#a26b8d8ac5a1ea37aa2fa1ad8dcd34e6e.
+const (
+	SessionTrackSystemVariables byte = iota
+	SessionTrackSchema
+	SessionTrackStateChange
+	SessionTrackGtids
+	SessionTrackTransactionCharacteristics
+	SessionTrackTransactionState
+)
+
+// SessionStateChange is an entry of the session state changes in an OK packet.
+type SessionStateChange struct {
+	Type byte
+	// Name is only set for system variables.
+	Name  string
+	Value string
+}
+
+// ParseOKPacketWithSessionState returns the status and the session state changes of an OK packet.
+// The changes only exist when CLIENT_SESSION_TRACK is negotiated and SERVER_SESSION_STATE_CHANGED is set.
+func ParseOKPacketWithSessionState(data []byte, capability Capability) (uint16, []SessionStateChange, error) {
+	status := ParseOKPacket(data)
+	if capability&ClientSessionTrack == 0 || status&ServerSessionStateChanged == 0 {
+		return status, nil, nil
+	}
+	pos := 1
+	pos += SkipLengthEncodedInt(data[pos:])
+	pos += SkipLengthEncodedInt(data[pos:])
+	// skip status and warnings
+	pos += 4
+	if pos >= len(data) {
+		return status, nil, nil
+	}
+	// skip info
+	_, _, n, err := ParseLengthEncodedBytes(data[pos:])
+	if err != nil {
+		return status, nil, errors.Wrap(gomysql.ErrMalformPacket, err)
+	}
+	pos += n
+	if pos >= len(data) {
+		return status, nil, nil
+	}
+	stateInfo, _, _, err := ParseLengthEncodedBytes(data[pos:])
+	if err != nil {
+		return status, nil, errors.Wrap(gomysql.ErrMalformPacket, err)
+	}
+	changes, err := parseSessionStateChanges(stateInfo)
+	return status, changes, err
+}
+
+// RemoveSessionState converts an OK packet in the CLIENT_SESSION_TRACK format into the format without it.
+// The info is kept while the session state changes and SERVER_SESSION_STATE_CHANGED are removed.
+func RemoveSessionState(data []byte) ([]byte, error) {
+	pos := 1
+	pos += SkipLengthEncodedInt(data[pos:])
+	pos += SkipLengthEncodedInt(data[pos:])
+	if pos+4 > len(data) {
+		return nil, errors.WithStack(gomysql.ErrMalformPacket)
+	}
+	status := binary.LittleEndian.Uint16(data[pos:])
+	pkt := make([]byte, 0, len(data))
+	pkt = append(pkt, data[:pos]...)
+	pkt = DumpUint16(pkt, status&^ServerSessionStateChanged)
+	// warnings
+	pkt = append(pkt, data[pos+2:pos+4]...)
+	pos += 4
+	if pos < len(data) {
+		info, _, _, err := ParseLengthEncodedBytes(data[pos:])
+		if err != nil {
+			return nil, errors.Wrap(gomysql.ErrMalformPacket, err)
+		}
+		pkt = append(pkt, info...)
+	}
+	return pkt, nil
+}
+
+func parseSessionStateChanges(data []byte) ([]SessionStateChange, error) {
+	var changes []SessionStateChange
+	for len(data) > 0 {
+		typ := data[0]
+		if len(data) < 2 {
+			return nil, gomysql.ErrMalformPacket
+		}
+		value, _, n, err := ParseLengthEncodedBytes(data[1:])
+		if err != nil {
+			return nil, errors.Wrap(gomysql.ErrMalformPacket, err)
+		}
+		data = data[1+n:]
+		change := SessionStateChange{Type: typ}
+		switch typ {
+		case SessionTrackSystemVariables:
+			if len(value) == 0 {
+				return nil, gomysql.ErrMalformPacket
+			}
+			name, _, n, err := ParseLengthEncodedBytes(value)
+			if err != nil || n >= len(value) {
+				return nil, gomysql.ErrMalformPacket
+			}
+			val, _, _, err := ParseLengthEncodedBytes(value[n:])
+			if err != nil {
+				return nil, errors.Wrap(gomysql.ErrMalformPacket, err)
+			}
+			change.Name, change.Value = string(name), string(val)
+		case SessionTrackGtids:
+			// The first byte is the encoding specification.
+			if len(value) < 2 {
+				return nil, gomysql.ErrMalformPacket
+			}
+			val, _, _, err := ParseLengthEncodedBytes(value[1:])
+			if err != nil {
+				return nil, errors.Wrap(gomysql.ErrMalformPacket, err)
+			}
+			change.Value = string(val)
+		case SessionTrackSchema, SessionTrackStateChange, SessionTrackTransactionCharacteristics, SessionTrackTransactionState:
+			if len(value) == 0 {
+				return nil, gomysql.ErrMalformPacket
+			}
+			val, _, _, err := ParseLengthEncodedBytes(value)
+			if err != nil {
+				return nil, errors.Wrap(gomysql.ErrMalformPacket, err)
+			}
+			change.Value = string(val)
+		default:
+			// Unknown types are skipped so that newer servers are still supported.
+			continue
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
 // ParseErrorPacket transforms an error packet into a MyError object.
 func ParseErrorPacket(data []byte) *gomysql.MyError {
 	e := new(gomysql.MyError)
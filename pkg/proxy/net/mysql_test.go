@@ -4,9 +4,11 @@
 package net
 
 import (
+	"net"
 	"testing"
 
 	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/packet"
 	"github.com/pingcap/tiproxy/lib/util/errors"
 	"github.com/pingcap/tiproxy/lib/util/logger"
 	"github.com/stretchr/testify/require"
@@ -72,3 +74,149 @@ func TestMySQLError(t *testing.T) {
 	require.True(t, errors.Is(errors.Wrap(ErrHandshakeTLS, myerr), ErrHandshakeTLS))
 	require.True(t, errors.Is(errors.Wrap(myerr, ErrHandshakeTLS), ErrHandshakeTLS))
 }
+
+func TestParseInitialHandshake(t *testing.T) {
+	var salt [20]byte
+	for i := range salt {
+		salt[i] = byte(i + 1)
+	}
+	testPipeConn(t,
+		func(t *testing.T, cli *PacketIO) {
+			data, err := cli.ReadPacket()
+			require.NoError(t, err)
+			capability, connID, serverVersion := ParseInitialHandshake(data)
+			require.Equal(t, ClientPluginAuth|ClientSecureConnection, capability)
+			require.Equal(t, uint64(100), connID)
+			require.Equal(t, ServerVersion, serverVersion)
+			authSalt, authPlugin, err := ParseInitialHandshakeAuth(data)
+			require.NoError(t, err)
+			require.Equal(t, salt[:], authSalt)
+			require.Equal(t, AuthCachingSha2Password, authPlugin)
+			// Truncated packets return errors instead of panicking.
+			for i := 0; i < len(data); i++ {
+				_, _, _ = ParseInitialHandshakeAuth(data[:i])
+			}
+			for _, i := range []int{0, 1, 10, 20} {
+				_, _, err = ParseInitialHandshakeAuth(data[:i])
+				require.ErrorIs(t, err, mysql.ErrMalformPacket, "length %d", i)
+			}
+		},
+		func(t *testing.T, srv *PacketIO) {
+			require.NoError(t, srv.WriteInitialHandshake(ClientPluginAuth|ClientSecureConnection, salt, AuthCachingSha2Password, ServerVersion, 100))
+		},
+		1,
+	)
+}
+
+func TestReadServerHandshake(t *testing.T) {
+	tests := []struct {
+		data       []byte
+		version    string
+		capability Capability
+		hasErr     bool
+	}{
+		{
+			data:   []byte{},
+			hasErr: true,
+		},
+		{
+			data:   []byte{ErrHeader.Byte(), 0, 0},
+			hasErr: true,
+		},
+		{
+			data:   []byte{10, '8', '.', '0'},
+			hasErr: true,
+		},
+		{
+			data:    []byte{10, '8', '.', '0', 0},
+			version: "8.0",
+		},
+	}
+	for i, test := range tests {
+		cli, srv := net.Pipe()
+		go func() {
+			_ = packet.NewConn(srv).WritePacket(append([]byte{0, 0, 0, 0}, test.data...))
+		}()
+		version, capability, err := ReadServerHandshake(cli)
+		if test.hasErr {
+			require.Error(t, err, "case %d", i)
+		} else {
+			require.NoError(t, err, "case %d", i)
+			require.Equal(t, test.version, version, "case %d", i)
+			require.Equal(t, test.capability, capability, "case %d", i)
+		}
+		require.NoError(t, cli.Close())
+		require.NoError(t, srv.Close())
+	}
+
+	// The full handshake contains the capability.
+	cli, srv := net.Pipe()
+	go func() {
+		_ = WriteServerHandshake(srv, "8.0", ClientDeprecateEOF|ClientSessionTrack)
+	}()
+	version, capability, err := ReadServerHandshake(cli)
+	require.NoError(t, err)
+	require.Equal(t, "8.0", version)
+	require.Equal(t, ClientDeprecateEOF|ClientSessionTrack, capability)
+	require.NoError(t, cli.Close())
+	require.NoError(t, srv.Close())
+}
+
+func TestParseSessionStateChanges(t *testing.T) {
+	var state []byte
+	state = append(state, SessionTrackSystemVariables)
+	state = DumpLengthEncodedString(state, DumpLengthEncodedString(DumpLengthEncodedString(nil, []byte("autocommit")), []byte("OFF")))
+	state = append(state, SessionTrackSchema)
+	state = DumpLengthEncodedString(state, DumpLengthEncodedString(nil, []byte("db1")))
+	state = append(state, SessionTrackGtids)
+	state = DumpLengthEncodedString(state, DumpLengthEncodedString([]byte{0}, []byte("3e11fa47:1-5")))
+	state = append(state, SessionTrackTransactionState)
+	state = DumpLengthEncodedString(state, DumpLengthEncodedString(nil, []byte("T_______")))
+	// unknown type
+	state = append(state, 100)
+	state = DumpLengthEncodedString(state, []byte("abc"))
+
+	makeOK := func(status uint16, info []byte, state []byte) []byte {
+		data := []byte{OKHeader.Byte(), 0, 0, byte(status), byte(status >> 8), 0, 0}
+		data = DumpLengthEncodedString(data, info)
+		if state != nil {
+			data = DumpLengthEncodedString(data, state)
+		}
+		return data
+	}
+
+	status, changes, err := ParseOKPacketWithSessionState(makeOK(ServerStatusInTrans|ServerSessionStateChanged, []byte("info"), state), ClientSessionTrack)
+	require.NoError(t, err)
+	require.Equal(t, ServerStatusInTrans|ServerSessionStateChanged, status)
+	require.Equal(t, []SessionStateChange{
+		{Type: SessionTrackSystemVariables, Name: "autocommit", Value: "OFF"},
+		{Type: SessionTrackSchema, Value: "db1"},
+		{Type: SessionTrackGtids, Value: "3e11fa47:1-5"},
+		{Type: SessionTrackTransactionState, Value: "T_______"},
+	}, changes)
+
+	// Not negotiated or not changed.
+	_, changes, err = ParseOKPacketWithSessionState(makeOK(ServerSessionStateChanged, nil, state), 0)
+	require.NoError(t, err)
+	require.Empty(t, changes)
+	_, changes, err = ParseOKPacketWithSessionState(makeOK(ServerStatusAutocommit, nil, nil), ClientSessionTrack)
+	require.NoError(t, err)
+	require.Empty(t, changes)
+
+	// Malformed.
+	_, _, err = ParseOKPacketWithSessionState(makeOK(ServerSessionStateChanged, nil, []byte{SessionTrackSchema, 5, 1}), ClientSessionTrack)
+	require.ErrorIs(t, err, mysql.ErrMalformPacket)
+
+	// Remove the session state for the clients that don't negotiate CLIENT_SESSION_TRACK.
+	pkt, err := RemoveSessionState(makeOK(ServerStatusInTrans|ServerSessionStateChanged, []byte("info"), state))
+	require.NoError(t, err)
+	require.Equal(t, []byte{OKHeader.Byte(), 0, 0, byte(ServerStatusInTrans), 0, 0, 0, 'i', 'n', 'f', 'o'}, pkt)
+	require.Equal(t, ServerStatusInTrans, ParseOKPacket(pkt))
+	pkt, err = RemoveSessionState([]byte{OKHeader.Byte(), 0, 0, byte(ServerStatusAutocommit), 0, 0, 0})
+	require.NoError(t, err)
+	require.Equal(t, []byte{OKHeader.Byte(), 0, 0, byte(ServerStatusAutocommit), 0, 0, 0}, pkt)
+	_, err = RemoveSessionState([]byte{OKHeader.Byte(), 0, 0, 0})
+	require.ErrorIs(t, err, mysql.ErrMalformPacket)
+	_, err = RemoveSessionState(append([]byte{OKHeader.Byte(), 0, 0, 0, 0, 0, 0}, 5, 'a'))
+	require.ErrorIs(t, err, mysql.ErrMalformPacket)
+}
@@ -201,6 +201,8 @@ type PacketIO struct {
 	header        [4]byte // reuse memory to reduce allocation
 	inPackets     uint64
 	outPackets    uint64
+	// maxPacketSize limits the size of the (possibly multi-packet) payload read by ReadPacket.
+	maxPacketSize int
 }
 
 func NewPacketIO(conn net.Conn, lg *zap.Logger, bufferSize int, opts ...PacketIOption) *PacketIO {
@@ -243,7 +245,8 @@ func (p *PacketIO) GetSequence() uint8 {
 	return p.readWriter.Sequence()
 }
 
-func (p *PacketIO) readOnePacket() ([]byte, bool, error) {
+// readOnePacket reads a packet, and size is the size of the previous packets in the same payload.
+func (p *PacketIO) readOnePacket(size int) ([]byte, bool, error) {
 	if err := ReadFull(p.readWriter, p.header[:]); err != nil {
 		return nil, false, errors.Wrap(ErrReadConn, err)
 	}
@@ -254,6 +257,10 @@ func (p *PacketIO) readOnePacket() ([]byte, bool, error) {
 	p.readWriter.SetSequence(sequence + 1)
 
 	length := int(p.header[0]) | int(p.header[1])<<8 | int(p.header[2])<<16
+	// Check before reading the data so that the memory is not allocated.
+	if p.maxPacketSize > 0 && size+length > p.maxPacketSize {
+		return nil, false, errors.Wrapf(ErrPacketTooLarge, "the packet is bigger than %d bytes", p.maxPacketSize)
+	}
 	data := make([]byte, length)
 	if err := ReadFull(p.readWriter, data); err != nil {
 		return nil, false, errors.Wrap(ErrReadConn, err)
@@ -267,7 +274,7 @@ func (p *PacketIO) ReadPacket() (data []byte, err error) {
 	p.readWriter.BeginRW(rwRead)
 	for more := true; more; {
 		var buf []byte
-		buf, more, err = p.readOnePacket()
+		buf, more, err = p.readOnePacket(len(data))
 		if err != nil {
 			err = p.wrapErr(err)
 			return
@@ -328,7 +335,11 @@ func (p *PacketIO) WritePacket(data []byte, flush bool) (err error) {
 	return nil
 }
 
-func (p *PacketIO) ForwardUntil(dest *PacketIO, isEnd func(firstByte byte, firstPktLen int) (end, needData bool),
+// ForwardUntil forwards the packets to dest until isEnd returns true, and then calls process with the last packet.
+// isEnd is called before forwarding each packet, and forwarding stops without forwarding the packet if it returns an error.
+// If isEnd requires the data of the last packet, the packet is not forwarded and process is responsible for writing it,
+// so that it can be rewritten before being sent to dest.
+func (p *PacketIO) ForwardUntil(dest *PacketIO, isEnd func(firstByte byte, firstPktLen int) (end, needData bool, err error),
 	process func(response []byte) error) error {
 	p.readWriter.BeginRW(rwRead)
 	dest.readWriter.BeginRW(rwWrite)
@@ -339,7 +350,10 @@ func (p *PacketIO) ForwardUntil(dest *PacketIO, isEnd func(firstByte byte, first
 			return p.wrapErr(errors.Wrap(ErrReadConn, err))
 		}
 		length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
-		end, needData := isEnd(header[4], length)
+		end, needData, err := isEnd(header[4], length)
+		if err != nil {
+			return err
+		}
 		var data []byte
 		// Just call ReadFrom if the caller doesn't need the data, even if it's the last packet.
 		if end && needData {
@@ -348,9 +362,6 @@ func (p *PacketIO) ForwardUntil(dest *PacketIO, isEnd func(firstByte byte, first
 			if err != nil {
 				return p.wrapErr(errors.Wrap(ErrReadConn, err))
 			}
-			if err := dest.WritePacket(data, false); err != nil {
-				return p.wrapErr(errors.Wrap(ErrWriteConn, err))
-			}
 		} else {
 			for {
 				sequence, pktSequence := header[3], p.readWriter.Sequence()
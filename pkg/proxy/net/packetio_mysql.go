@@ -54,7 +54,7 @@ func (p *PacketIO) WriteInitialHandshake(capability Capability, salt [20]byte, a
 	return p.WritePacket(data, true)
 }
 
-// WriteSwitchRequest writes a switch request to the client. It's only for testing.
+// WriteSwitchRequest writes a switch request to the client.
 func (p *PacketIO) WriteSwitchRequest(authPlugin string, salt [20]byte) error {
 	length := 1 + len(authPlugin) + 1 + len(salt) + 1
 	data := make([]byte, 0, length)
@@ -100,7 +100,7 @@ func (p *PacketIO) WriteErrPacket(merr *mysql.MyError) error {
 	return p.WritePacket(data, true)
 }
 
-// WriteOKPacket writes an OK packet. It's only for testing.
+// WriteOKPacket writes an OK packet.
 func (p *PacketIO) WriteOKPacket(status uint16, header Header) error {
 	data := make([]byte, 0, 7)
 	data = append(data, header.Byte())
@@ -111,7 +111,7 @@ func (p *PacketIO) WriteOKPacket(status uint16, header Header) error {
 	return p.WritePacket(data, true)
 }
 
-// WriteEOFPacket writes an EOF packet. It's only for testing.
+// WriteEOFPacket writes an EOF packet.
 func (p *PacketIO) WriteEOFPacket(status uint16) error {
 	data := make([]byte, 0, 5)
 	data = append(data, EOFHeader.Byte())
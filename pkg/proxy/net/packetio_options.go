@@ -12,7 +12,14 @@ import (
 type PacketIOption = func(*PacketIO)
 
 func WithProxy(pi *PacketIO) {
-	pi.EnableProxyServer()
+	pi.EnableProxyServer(nil)
+}
+
+// WithTrustedProxy parses proxy headers only from the trusted peers.
+func WithTrustedProxy(trusted proxyprotocol.TrustedCIDRs) func(pi *PacketIO) {
+	return func(pi *PacketIO) {
+		pi.EnableProxyServer(trusted)
+	}
 }
 
 func WithWrapError(err error) func(pi *PacketIO) {
@@ -21,6 +28,13 @@ func WithWrapError(err error) func(pi *PacketIO) {
 	}
 }
 
+// WithMaxPacketSize limits the size of the packets read by ReadPacket. 0 means no limit.
+func WithMaxPacketSize(size int) func(pi *PacketIO) {
+	return func(pi *PacketIO) {
+		pi.maxPacketSize = size
+	}
+}
+
 // WithRemoteAddr
 var _ proxyprotocol.AddressWrapper = &originAddr{}
 
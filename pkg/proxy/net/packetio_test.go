@@ -148,6 +148,29 @@ func TestTLS(t *testing.T) {
 	)
 }
 
+func TestMaxPacketSize(t *testing.T) {
+	sizes := []int{10, MaxPayloadLen, MaxPayloadLen + 10}
+	testTCPConn(t,
+		func(t *testing.T, cli *PacketIO) {
+			for _, size := range sizes {
+				require.NoError(t, cli.WritePacket(make([]byte, size), true))
+			}
+		},
+		func(t *testing.T, srv *PacketIO) {
+			srv.ApplyOpts(WithMaxPacketSize(MaxPayloadLen))
+			for _, size := range sizes[:2] {
+				data, err := srv.ReadPacket()
+				require.NoError(t, err)
+				require.Len(t, data, size)
+			}
+			// The second part of the multi-packet payload exceeds the limit.
+			_, err := srv.ReadPacket()
+			require.ErrorIs(t, err, ErrPacketTooLarge)
+		},
+		1,
+	)
+}
+
 func TestPacketIOClose(t *testing.T) {
 	testTCPConn(t,
 		func(t *testing.T, cli *PacketIO) {
@@ -333,7 +356,7 @@ func TestProxyTLSCompress(t *testing.T) {
 					ch <- nil
 				}, func(t *testing.T, srv *PacketIO) {
 					if enableProxy {
-						srv.EnableProxyServer()
+						srv.EnableProxyServer(nil)
 					}
 					read(srv)
 					if enableProxy {
@@ -434,7 +457,7 @@ func TestForwardUntil(t *testing.T) {
 	}
 	prepareServer := func(enableProxy, enableTLS, enableCompress bool, srv *PacketIO) {
 		if enableProxy {
-			srv.EnableProxyServer()
+			srv.EnableProxyServer(nil)
 		}
 		if enableTLS {
 			state, err := srv.ServerTLSHandshake(stls)
@@ -466,11 +489,11 @@ func TestForwardUntil(t *testing.T) {
 						func(t *testing.T, srv1 *PacketIO) {
 							prepareServer(enableProxy, enableTLS, enableCompress, srv1)
 							srv2 := <-srvCh
-							err := srv1.ForwardUntil(srv2, func(firstByte byte, firstPktLen int) (bool, bool) {
-								return firstByte == byte(loops) && firstPktLen == 1, true
+							err := srv1.ForwardUntil(srv2, func(firstByte byte, firstPktLen int) (bool, bool, error) {
+								return firstByte == byte(loops) && firstPktLen == 1, true, nil
 							}, func(response []byte) error {
 								require.Equal(t, []byte{byte(loops)}, response)
-								return srv2.Flush()
+								return srv2.WritePacket(response, true)
 							})
 							require.NoError(t, err)
 							exitCh <- struct{}{}
@@ -518,11 +541,11 @@ func TestForwardUntilLongData(t *testing.T) {
 			},
 			func(t *testing.T, srv1 *PacketIO) {
 				srv2 := <-srvCh
-				err := srv1.ForwardUntil(srv2, func(firstByte byte, firstPktLen int) (bool, bool) {
-					return firstByte >= byte(len(sizes)-1), true
+				err := srv1.ForwardUntil(srv2, func(firstByte byte, firstPktLen int) (bool, bool, error) {
+					return firstByte >= byte(len(sizes)-1), true, nil
 				}, func(response []byte) error {
 					require.Len(t, response, sizes[len(sizes)-1])
-					return srv2.Flush()
+					return srv2.WritePacket(response, true)
 				})
 				require.NoError(t, err)
 				sum := 0
@@ -623,15 +646,15 @@ func BenchmarkForwardUntil(b *testing.B) {
 	loops := 100
 	runForwardBenchmark(b, func(packetIO1, packetIO2 *PacketIO) {
 		j := 0
-		err := packetIO1.ForwardUntil(packetIO2, func(firstByte byte, firstPktLen int) (bool, bool) {
+		err := packetIO1.ForwardUntil(packetIO2, func(firstByte byte, firstPktLen int) (bool, bool, error) {
 			j++
 			if j == loops {
 				if err := packetIO2.Flush(); err != nil {
 					b.Fatal(err)
 				}
-				return true, false
+				return true, false, nil
 			}
-			return false, false
+			return false, false, nil
 		}, nil)
 		if err != nil {
 			b.Fatal(err)
@@ -5,6 +5,7 @@ package net
 
 import (
 	"bytes"
+	"io"
 	"net"
 	"sync/atomic"
 
@@ -16,8 +17,9 @@ func (p *PacketIO) EnableProxyClient(proxy *proxyprotocol.Proxy) {
 	p.readWriter = newProxyClient(p.readWriter, proxy)
 }
 
-func (p *PacketIO) EnableProxyServer() {
-	p.readWriter = newProxyServer(p.readWriter)
+// EnableProxyServer parses v1 or v2 headers from the trusted peers. An empty trusted list trusts all peers.
+func (p *PacketIO) EnableProxyServer(trusted proxyprotocol.TrustedCIDRs) {
+	p.readWriter = newProxyServer(p.readWriter, trusted)
 }
 
 // Proxy returned parsed proxy header from clients if any.
@@ -32,6 +34,7 @@ type proxyReadWriter struct {
 	proxyInited atomic.Bool
 	proxy       *proxyprotocol.Proxy
 	addr        net.Addr
+	trusted     proxyprotocol.TrustedCIDRs
 	client      bool
 }
 
@@ -44,9 +47,10 @@ func newProxyClient(rw packetReadWriter, proxy *proxyprotocol.Proxy) *proxyReadW
 	return prw
 }
 
-func newProxyServer(rw packetReadWriter) *proxyReadWriter {
+func newProxyServer(rw packetReadWriter, trusted proxyprotocol.TrustedCIDRs) *proxyReadWriter {
 	prw := &proxyReadWriter{
 		packetReadWriter: rw,
+		trusted:          trusted,
 		client:           false,
 	}
 	return prw
@@ -60,7 +64,7 @@ func (prw *proxyReadWriter) Read(b []byte) (int, error) {
 }
 
 func (prw *proxyReadWriter) readProxy() error {
-	// probe proxy V2
+	// probe proxy V1 and V2
 	if !prw.client && !prw.proxyInited.Load() {
 		// We don't know whether the client has enabled proxy protocol.
 		// If it doesn't, reading data of len(MagicV2) may block forever.
@@ -68,14 +72,18 @@ func (prw *proxyReadWriter) readProxy() error {
 		if err != nil {
 			return errors.Wrap(ErrReadConn, err)
 		}
-		if bytes.Equal(header[:], proxyprotocol.MagicV2[:4]) {
-			proxyHeader, err := prw.parseProxyV2()
-			if err != nil {
-				return errors.Wrap(ErrReadConn, err)
-			}
-			if proxyHeader != nil {
-				prw.proxy = proxyHeader
-			}
+		var proxyHeader *proxyprotocol.Proxy
+		switch {
+		case bytes.Equal(header[:], proxyprotocol.MagicV1[:4]):
+			proxyHeader, err = prw.parseProxy(proxyprotocol.MagicV1, proxyprotocol.ParseProxyV1)
+		case bytes.Equal(header[:], proxyprotocol.MagicV2[:4]):
+			proxyHeader, err = prw.parseProxy(proxyprotocol.MagicV2, proxyprotocol.ParseProxyV2)
+		}
+		if err != nil {
+			return errors.Wrap(ErrReadConn, err)
+		}
+		if proxyHeader != nil {
+			prw.proxy = proxyHeader
 		}
 		prw.proxyInited.Store(true)
 	}
@@ -123,23 +131,26 @@ func (prw *proxyReadWriter) DirectWrite(p []byte) (n int, err error) {
 	return prw.packetReadWriter.DirectWrite(p)
 }
 
-func (prw *proxyReadWriter) parseProxyV2() (*proxyprotocol.Proxy, error) {
-	rem, err := prw.packetReadWriter.Peek(len(proxyprotocol.MagicV2))
+func (prw *proxyReadWriter) parseProxy(magic []byte, parse func(io.Reader) (*proxyprotocol.Proxy, int, error)) (*proxyprotocol.Proxy, error) {
+	rem, err := prw.packetReadWriter.Peek(len(magic))
 	if err != nil {
 		return nil, errors.WithStack(errors.Wrap(ErrReadConn, err))
 	}
-	if !bytes.Equal(rem, proxyprotocol.MagicV2) {
+	if !bytes.Equal(rem, magic) {
 		return nil, nil
 	}
 
-	// yes, it is proxyV2
-	_, err = prw.packetReadWriter.Discard(len(proxyprotocol.MagicV2))
+	// yes, it is proxy protocol, but it's only honoured from trusted peers
+	if peer := prw.packetReadWriter.RemoteAddr(); !prw.trusted.Contains(peer) {
+		return nil, errors.Wrapf(proxyprotocol.ErrUntrustedPeer, "peer %s", peer.String())
+	}
+	_, err = prw.packetReadWriter.Discard(len(magic))
 	if err != nil {
 		return nil, errors.WithStack(errors.Wrap(ErrReadConn, err))
 	}
 
-	m, _, err := proxyprotocol.ParseProxyV2(prw.packetReadWriter)
-	if err == nil {
+	m, _, err := parse(prw.packetReadWriter)
+	if err == nil && m.SrcAddress != nil {
 		// set RemoteAddr in case of proxy.
 		prw.addr = m.SrcAddress
 	}
@@ -48,7 +48,7 @@ func TestProxyReadWrite(t *testing.T) {
 			require.NoError(t, prw.Flush())
 		},
 		func(t *testing.T, c net.Conn) {
-			prw := newProxyServer(newBasicReadWriter(c, DefaultConnBufferSize))
+			prw := newProxyServer(newBasicReadWriter(c, DefaultConnBufferSize), nil)
 			data := make([]byte, len(message))
 			n, err := prw.Read(data)
 			require.NoError(t, err)
@@ -58,6 +58,54 @@ func TestProxyReadWrite(t *testing.T) {
 		}, 1)
 }
 
+func TestProxyV1AndTrusted(t *testing.T) {
+	srcAddr := &net.TCPAddr{IP: net.ParseIP("192.168.1.1").To4(), Port: 34}
+	message := []byte("hello world")
+	trusted, err := proxyprotocol.ParseTrustedCIDRs([]string{"127.0.0.1"})
+	require.NoError(t, err)
+	untrusted, err := proxyprotocol.ParseTrustedCIDRs([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	tests := []struct {
+		version proxyprotocol.ProxyVersion
+		trusted proxyprotocol.TrustedCIDRs
+		err     error
+	}{
+		{proxyprotocol.ProxyVersion1, nil, nil},
+		{proxyprotocol.ProxyVersion1, trusted, nil},
+		{proxyprotocol.ProxyVersion1, untrusted, proxyprotocol.ErrUntrustedPeer},
+		{proxyprotocol.ProxyVersion2, trusted, nil},
+		{proxyprotocol.ProxyVersion2, untrusted, proxyprotocol.ErrUntrustedPeer},
+	}
+	for i, test := range tests {
+		testkit.TestTCPConn(t,
+			func(t *testing.T, c net.Conn) {
+				p := &proxyprotocol.Proxy{
+					Version:    test.version,
+					Command:    proxyprotocol.ProxyCommandProxy,
+					SrcAddress: srcAddr,
+					DstAddress: c.RemoteAddr(),
+				}
+				prw := newProxyClient(newBasicReadWriter(c, DefaultConnBufferSize), p)
+				_, err := prw.Write(message)
+				require.NoError(t, err)
+				require.NoError(t, prw.Flush())
+			},
+			func(t *testing.T, c net.Conn) {
+				prw := newProxyServer(newBasicReadWriter(c, DefaultConnBufferSize), test.trusted)
+				data := make([]byte, len(message))
+				_, err := io.ReadFull(prw, data)
+				if test.err != nil {
+					require.ErrorIs(t, err, test.err, "case %d", i)
+					return
+				}
+				require.NoError(t, err, "case %d", i)
+				require.Equal(t, message, data, "case %d", i)
+				require.Equal(t, test.version, prw.Proxy().Version, "case %d", i)
+				require.Equal(t, srcAddr.String(), prw.RemoteAddr().String(), "case %d", i)
+			}, 1)
+	}
+}
+
 func mockProxy(t *testing.T) (*net.TCPAddr, *proxyprotocol.Proxy) {
 	tcpaddr, err := net.ResolveTCPAddr("tcp", "192.168.1.1:34")
 	require.NoError(t, err)
@@ -0,0 +1,335 @@
+// Copyright 2024 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package net
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+
+	gomysql "github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/pingcap/tiproxy/lib/util/errors"
+)
+
+// CursorParamCountAvailable is set in the flags of COM_STMT_EXECUTE when the parameter count is sent.
+const CursorParamCountAvailable = 0x08
+
+// stmtExecuteHeaderLen is the length of the command, statement ID, flags and iteration count in COM_STMT_EXECUTE.
+const stmtExecuteHeaderLen = 10
+
+// QueryAttr is a query attribute sent with COM_QUERY or COM_STMT_EXECUTE when CLIENT_QUERY_ATTRIBUTES is negotiated.
+// Ref https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_com_query.html.
+type QueryAttr struct {
+	Name     string
+	Type     byte
+	Unsigned bool
+	// Value is the value in the binary protocol, and the length prefix of strings is removed. It's nil if the value is NULL.
+	Value []byte
+}
+
+// String returns the value in text. It returns an empty string if the value is NULL.
+func (attr QueryAttr) String() string {
+	data := attr.Value
+	if data == nil {
+		return ""
+	}
+	switch attr.Type {
+	case gomysql.MYSQL_TYPE_TINY:
+		if attr.Unsigned {
+			return strconv.FormatUint(uint64(data[0]), 10)
+		}
+		return strconv.FormatInt(int64(int8(data[0])), 10)
+	case gomysql.MYSQL_TYPE_SHORT, gomysql.MYSQL_TYPE_YEAR:
+		if attr.Unsigned {
+			return strconv.FormatUint(uint64(binary.LittleEndian.Uint16(data)), 10)
+		}
+		return strconv.FormatInt(int64(int16(binary.LittleEndian.Uint16(data))), 10)
+	case gomysql.MYSQL_TYPE_LONG, gomysql.MYSQL_TYPE_INT24:
+		if attr.Unsigned {
+			return strconv.FormatUint(uint64(binary.LittleEndian.Uint32(data)), 10)
+		}
+		return strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(data))), 10)
+	case gomysql.MYSQL_TYPE_LONGLONG:
+		if attr.Unsigned {
+			return strconv.FormatUint(binary.LittleEndian.Uint64(data), 10)
+		}
+		return strconv.FormatInt(int64(binary.LittleEndian.Uint64(data)), 10)
+	case gomysql.MYSQL_TYPE_FLOAT:
+		return strconv.FormatFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(data))), 'g', -1, 32)
+	case gomysql.MYSQL_TYPE_DOUBLE:
+		return strconv.FormatFloat(math.Float64frombits(binary.LittleEndian.Uint64(data)), 'g', -1, 64)
+	case gomysql.MYSQL_TYPE_DATE, gomysql.MYSQL_TYPE_DATETIME, gomysql.MYSQL_TYPE_TIMESTAMP:
+		return formatBinaryDateTime(data)
+	case gomysql.MYSQL_TYPE_TIME:
+		return formatBinaryTime(data)
+	}
+	return string(data)
+}
+
+func formatBinaryDateTime(data []byte) string {
+	var year, month, day, hour, minute, second, micro int
+	if len(data) >= 4 {
+		year, month, day = int(binary.LittleEndian.Uint16(data)), int(data[2]), int(data[3])
+	}
+	if len(data) >= 7 {
+		hour, minute, second = int(data[4]), int(data[5]), int(data[6])
+	}
+	if len(data) >= 11 {
+		micro = int(binary.LittleEndian.Uint32(data[7:]))
+	}
+	s := fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+	if len(data) >= 7 {
+		s += fmt.Sprintf(" %02d:%02d:%02d", hour, minute, second)
+	}
+	if len(data) >= 11 {
+		s += fmt.Sprintf(".%06d", micro)
+	}
+	return s
+}
+
+func formatBinaryTime(data []byte) string {
+	var negative bool
+	var days, hour, minute, second, micro int
+	if len(data) >= 8 {
+		negative = data[0] == 1
+		days = int(binary.LittleEndian.Uint32(data[1:]))
+		hour, minute, second = int(data[5]), int(data[6]), int(data[7])
+	}
+	if len(data) >= 12 {
+		micro = int(binary.LittleEndian.Uint32(data[8:]))
+	}
+	s := fmt.Sprintf("%02d:%02d:%02d", days*24+hour, minute, second)
+	if negative {
+		s = "-" + s
+	}
+	if len(data) >= 12 {
+		s += fmt.Sprintf(".%06d", micro)
+	}
+	return s
+}
+
+// StmtParams is the parameter information of a prepared statement that is needed to parse COM_STMT_EXECUTE.
+type StmtParams struct {
+	// NumParams is the parameter count returned by COM_STMT_PREPARE. The parameters after them are query attributes.
+	NumParams int
+	// LongData marks the parameters sent by COM_STMT_SEND_LONG_DATA, whose values are absent in COM_STMT_EXECUTE.
+	LongData map[int]struct{}
+	// Types are the types bound in the last execution. The client doesn't send the types again if they're unchanged.
+	Types []byte
+	// Names are the names bound in the last execution, which are sent along with the types.
+	Names []string
+}
+
+// ParseQueryAttrs parses the COM_QUERY packet sent with CLIENT_QUERY_ATTRIBUTES.
+// It returns the attributes and the query.
+func ParseQueryAttrs(request []byte) ([]QueryAttr, []byte, error) {
+	attrs, pos, err := parseQueryAttrs(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	return attrs, request[pos:], nil
+}
+
+// StripQueryAttrs removes the attributes in the COM_QUERY packet sent with CLIENT_QUERY_ATTRIBUTES.
+// The returned packet is expected by the backends without CLIENT_QUERY_ATTRIBUTES.
+func StripQueryAttrs(request []byte) ([]byte, error) {
+	_, pos, err := parseQueryAttrs(request)
+	if err != nil {
+		return nil, err
+	}
+	stripped := make([]byte, 0, 1+len(request)-pos)
+	stripped = append(stripped, request[0])
+	return append(stripped, request[pos:]...), nil
+}
+
+// MakeQueryPacket makes a COM_QUERY packet without attributes.
+func MakeQueryPacket(query string, capability Capability) []byte {
+	request := make([]byte, 0, 3+len(query))
+	request = append(request, ComQuery.Byte())
+	if capability&ClientQueryAttributes > 0 {
+		// parameter_count = 0, parameter_set_count = 1
+		request = append(request, 0, 1)
+	}
+	return append(request, query...)
+}
+
+func parseQueryAttrs(request []byte) (attrs []QueryAttr, pos int, err error) {
+	pos = 1
+	if len(request) < pos+2 {
+		return nil, 0, errors.WithStack(gomysql.ErrMalformPacket)
+	}
+	count, _, n := ParseLengthEncodedInt(request[pos:])
+	pos += n
+	if pos >= len(request) {
+		return nil, 0, errors.WithStack(gomysql.ErrMalformPacket)
+	}
+	// parameter_set_count is always 1
+	pos += SkipLengthEncodedInt(request[pos:])
+	if count == 0 {
+		return nil, pos, nil
+	}
+	if count > uint64(len(request)) {
+		return nil, 0, errors.WithStack(gomysql.ErrMalformPacket)
+	}
+	params := &StmtParams{}
+	attrs, _, n, err = parseBinaryParams(request[pos:], int(count), params, true)
+	if err != nil {
+		return nil, 0, err
+	}
+	return attrs, pos + n, nil
+}
+
+// ParseStmtExecuteAttrs parses the COM_STMT_EXECUTE packet sent with CLIENT_QUERY_ATTRIBUTES.
+// It returns the attributes and the packet without attributes, which is expected by the backends without CLIENT_QUERY_ATTRIBUTES.
+// The types in params are updated if the client sends new types.
+func ParseStmtExecuteAttrs(request []byte, params *StmtParams) ([]QueryAttr, []byte, error) {
+	if len(request) < stmtExecuteHeaderLen {
+		return nil, nil, errors.WithStack(gomysql.ErrMalformPacket)
+	}
+	// The parameter count is absent if the statement has no parameters and the client sends no attributes.
+	if len(request) == stmtExecuteHeaderLen {
+		return nil, request, nil
+	}
+	pos := stmtExecuteHeaderLen
+	count, _, n := ParseLengthEncodedInt(request[pos:])
+	pos += n
+	if count < uint64(params.NumParams) || count > uint64(len(request)) {
+		return nil, nil, errors.WithStack(gomysql.ErrMalformPacket)
+	}
+	stripped := make([]byte, 0, len(request))
+	stripped = append(stripped, request[:stmtExecuteHeaderLen]...)
+	stripped[5] &^= CursorParamCountAvailable
+	if count == 0 {
+		return nil, stripped, nil
+	}
+	values, valuesEnd, n, err := parseBinaryParams(request[pos:], int(count), params, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	attrs := values[params.NumParams:]
+	if params.NumParams == 0 {
+		return attrs, stripped, nil
+	}
+	// Rebuild the null bitmap, the types, and the values for the parameters of the statement.
+	data := request[pos : pos+n]
+	bitmapLen := (int(count) + 7) / 8
+	bitmap := make([]byte, (params.NumParams+7)/8)
+	for i := 0; i < params.NumParams; i++ {
+		if data[i/8]&(1<<(i%8)) > 0 {
+			bitmap[i/8] |= 1 << (i % 8)
+		}
+	}
+	stripped = append(stripped, bitmap...)
+	newParamsBound := data[bitmapLen]
+	stripped = append(stripped, newParamsBound)
+	if newParamsBound == 1 {
+		stripped = append(stripped, params.Types[:2*params.NumParams]...)
+	}
+	return attrs, append(stripped, data[valuesEnd[0]:valuesEnd[1]]...), nil
+}
+
+// parseBinaryParams parses the null bitmap, the types, the names, and the values of the parameters in the binary protocol.
+// The names are sent along with the types when CLIENT_QUERY_ATTRIBUTES is negotiated.
+// It returns all the parameters, the range of the values of the first params.NumParams parameters, and the parsed length.
+func parseBinaryParams(data []byte, count int, params *StmtParams, requireTypes bool) ([]QueryAttr, [2]int, int, error) {
+	var valuesRange [2]int
+	bitmapLen := (count + 7) / 8
+	if len(data) < bitmapLen+1 {
+		return nil, valuesRange, 0, errors.WithStack(gomysql.ErrMalformPacket)
+	}
+	bitmap := data[:bitmapLen]
+	pos := bitmapLen
+	newParamsBound := data[pos]
+	pos++
+	if newParamsBound == 1 {
+		types := make([]byte, 0, 2*count)
+		names := make([]string, 0, count)
+		for i := 0; i < count; i++ {
+			if len(data) < pos+2 {
+				return nil, valuesRange, 0, errors.WithStack(gomysql.ErrMalformPacket)
+			}
+			types = append(types, data[pos], data[pos+1])
+			pos += 2
+			if len(data) <= pos {
+				return nil, valuesRange, 0, errors.WithStack(gomysql.ErrMalformPacket)
+			}
+			name, _, n, err := ParseLengthEncodedBytes(data[pos:])
+			if err != nil {
+				return nil, valuesRange, 0, errors.Wrap(gomysql.ErrMalformPacket, err)
+			}
+			names = append(names, string(name))
+			pos += n
+		}
+		params.Types, params.Names = types, names
+	} else if requireTypes || len(params.Types) != 2*count {
+		// The types are not sent and not cached either.
+		return nil, valuesRange, 0, errors.Wrap(gomysql.ErrMalformPacket, errors.New("parameter types are unknown"))
+	}
+
+	values := make([]QueryAttr, 0, count)
+	valuesRange[0] = pos
+	for i := 0; i < count; i++ {
+		if i == params.NumParams {
+			valuesRange[1] = pos
+		}
+		attr := QueryAttr{
+			Name:     params.Names[i],
+			Type:     params.Types[2*i],
+			Unsigned: params.Types[2*i+1]&0x80 > 0,
+		}
+		_, longData := params.LongData[i]
+		if bitmap[i/8]&(1<<(i%8)) == 0 && !(longData && i < params.NumParams) {
+			value, n, err := parseBinaryValue(data[pos:], attr.Type)
+			if err != nil {
+				return nil, valuesRange, 0, err
+			}
+			attr.Value = value
+			pos += n
+		}
+		values = append(values, attr)
+	}
+	if count == params.NumParams {
+		valuesRange[1] = pos
+	}
+	return values, valuesRange, pos, nil
+}
+
+// parseBinaryValue returns the value in the binary protocol and its encoded length.
+func parseBinaryValue(data []byte, typ byte) ([]byte, int, error) {
+	var length int
+	switch typ {
+	case gomysql.MYSQL_TYPE_NULL:
+		return nil, 0, nil
+	case gomysql.MYSQL_TYPE_TINY:
+		length = 1
+	case gomysql.MYSQL_TYPE_SHORT, gomysql.MYSQL_TYPE_YEAR:
+		length = 2
+	case gomysql.MYSQL_TYPE_LONG, gomysql.MYSQL_TYPE_INT24, gomysql.MYSQL_TYPE_FLOAT:
+		length = 4
+	case gomysql.MYSQL_TYPE_LONGLONG, gomysql.MYSQL_TYPE_DOUBLE:
+		length = 8
+	case gomysql.MYSQL_TYPE_DATE, gomysql.MYSQL_TYPE_DATETIME, gomysql.MYSQL_TYPE_TIMESTAMP, gomysql.MYSQL_TYPE_TIME:
+		if len(data) < 1 || len(data) < 1+int(data[0]) {
+			return nil, 0, errors.WithStack(gomysql.ErrMalformPacket)
+		}
+		return data[1 : 1+data[0]], 1 + int(data[0]), nil
+	default:
+		if len(data) < 1 {
+			return nil, 0, errors.WithStack(gomysql.ErrMalformPacket)
+		}
+		value, _, n, err := ParseLengthEncodedBytes(data)
+		if err != nil {
+			return nil, 0, errors.Wrap(gomysql.ErrMalformPacket, err)
+		}
+		if value == nil {
+			value = []byte{}
+		}
+		return value, n, nil
+	}
+	if len(data) < length {
+		return nil, 0, errors.WithStack(gomysql.ErrMalformPacket)
+	}
+	return data[:length], length, nil
+}
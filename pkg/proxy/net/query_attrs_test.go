@@ -0,0 +1,152 @@
+// Copyright 2024 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package net
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/stretchr/testify/require"
+)
+
+type testParam struct {
+	name  string
+	typ   byte
+	value []byte
+}
+
+// dumpBinaryParams dumps the null bitmap, the types, the names and the values of the parameters.
+func dumpBinaryParams(params []testParam, bound bool) []byte {
+	data := make([]byte, (len(params)+7)/8)
+	for i, param := range params {
+		if param.value == nil {
+			data[i/8] |= 1 << (i % 8)
+		}
+	}
+	if !bound {
+		return append(data, 0)
+	}
+	data = append(data, 1)
+	for _, param := range params {
+		data = append(data, param.typ, 0)
+		data = DumpLengthEncodedString(data, []byte(param.name))
+	}
+	for _, param := range params {
+		data = append(data, param.value...)
+	}
+	return data
+}
+
+func TestQueryAttrs(t *testing.T) {
+	params := []testParam{
+		{name: "trace_id", typ: mysql.MYSQL_TYPE_STRING, value: DumpLengthEncodedString(nil, []byte("abc"))},
+		{name: "n", typ: mysql.MYSQL_TYPE_LONGLONG, value: binary.LittleEndian.AppendUint64(nil, 100)},
+		{name: "null", typ: mysql.MYSQL_TYPE_STRING},
+	}
+	request := []byte{ComQuery.Byte(), 3, 1}
+	request = append(request, dumpBinaryParams(params, true)...)
+	request = append(request, "select 1"...)
+	attrs, query, err := ParseQueryAttrs(request)
+	require.NoError(t, err)
+	require.Equal(t, "select 1", string(query))
+	require.Len(t, attrs, 3)
+	require.Equal(t, "trace_id", attrs[0].Name)
+	require.Equal(t, "abc", attrs[0].String())
+	require.Equal(t, "100", attrs[1].String())
+	require.Nil(t, attrs[2].Value)
+
+	stripped, err := StripQueryAttrs(request)
+	require.NoError(t, err)
+	require.Equal(t, append([]byte{ComQuery.Byte()}, "select 1"...), stripped)
+
+	// No attributes.
+	request = MakeQueryPacket("select 1", ClientQueryAttributes)
+	attrs, query, err = ParseQueryAttrs(request)
+	require.NoError(t, err)
+	require.Empty(t, attrs)
+	require.Equal(t, "select 1", string(query))
+	require.Equal(t, append([]byte{ComQuery.Byte()}, "select 1"...), MakeQueryPacket("select 1", 0))
+
+	// Malformed.
+	for _, request := range [][]byte{{ComQuery.Byte()}, {ComQuery.Byte(), 2, 1, 0, 1}, {ComQuery.Byte(), 1, 1, 0, 1, mysql.MYSQL_TYPE_LONG, 0, 0, 1}} {
+		_, _, err = ParseQueryAttrs(request)
+		require.ErrorIs(t, err, mysql.ErrMalformPacket)
+	}
+}
+
+func TestStmtExecuteAttrs(t *testing.T) {
+	header := []byte{ComStmtExecute.Byte(), 1, 0, 0, 0, CursorParamCountAvailable, 1, 0, 0, 0}
+	stmtParam := testParam{typ: mysql.MYSQL_TYPE_LONG, value: binary.LittleEndian.AppendUint32(nil, 5)}
+	attr := testParam{name: "trace_id", typ: mysql.MYSQL_TYPE_VAR_STRING, value: DumpLengthEncodedString(nil, []byte("abc"))}
+	params := &StmtParams{NumParams: 1}
+
+	// The types are sent in the first execution.
+	request := append(append([]byte{}, header...), 2)
+	request = append(request, dumpBinaryParams([]testParam{stmtParam, attr}, true)...)
+	attrs, stripped, err := ParseStmtExecuteAttrs(request, params)
+	require.NoError(t, err)
+	require.Len(t, attrs, 1)
+	require.Equal(t, "trace_id", attrs[0].Name)
+	require.Equal(t, "abc", attrs[0].String())
+	expected := []byte{ComStmtExecute.Byte(), 1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, mysql.MYSQL_TYPE_LONG, 0}
+	expected = append(expected, stmtParam.value...)
+	require.Equal(t, expected, stripped)
+
+	// The types are cached in the following executions.
+	request = append(append([]byte{}, header...), 2)
+	request = append(request, dumpBinaryParams([]testParam{stmtParam, attr}, false)...)
+	request = append(request, stmtParam.value...)
+	request = append(request, attr.value...)
+	attrs, stripped, err = ParseStmtExecuteAttrs(request, params)
+	require.NoError(t, err)
+	require.Equal(t, "abc", attrs[0].String())
+	expected = []byte{ComStmtExecute.Byte(), 1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0}
+	expected = append(expected, stmtParam.value...)
+	require.Equal(t, expected, stripped)
+
+	// The parameter sent by COM_STMT_SEND_LONG_DATA has no value.
+	params.LongData = map[int]struct{}{0: {}}
+	request = append(append([]byte{}, header...), 2)
+	request = append(request, dumpBinaryParams([]testParam{stmtParam, attr}, false)...)
+	request = append(request, attr.value...)
+	attrs, stripped, err = ParseStmtExecuteAttrs(request, params)
+	require.NoError(t, err)
+	require.Equal(t, "abc", attrs[0].String())
+	require.Equal(t, []byte{ComStmtExecute.Byte(), 1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0}, stripped)
+	params.LongData = nil
+
+	// No parameters or attributes.
+	attrs, stripped, err = ParseStmtExecuteAttrs(header, &StmtParams{})
+	require.NoError(t, err)
+	require.Empty(t, attrs)
+	require.Equal(t, header, stripped)
+
+	// The types are unknown.
+	request = append(append([]byte{}, header...), 2)
+	request = append(request, dumpBinaryParams([]testParam{stmtParam, attr}, false)...)
+	_, _, err = ParseStmtExecuteAttrs(request, &StmtParams{NumParams: 1})
+	require.ErrorIs(t, err, mysql.ErrMalformPacket)
+}
+
+func TestQueryAttrString(t *testing.T) {
+	tests := []struct {
+		attr QueryAttr
+		str  string
+	}{
+		{QueryAttr{Type: mysql.MYSQL_TYPE_TINY, Value: []byte{0xff}}, "-1"},
+		{QueryAttr{Type: mysql.MYSQL_TYPE_TINY, Unsigned: true, Value: []byte{0xff}}, "255"},
+		{QueryAttr{Type: mysql.MYSQL_TYPE_SHORT, Value: []byte{0xfe, 0xff}}, "-2"},
+		{QueryAttr{Type: mysql.MYSQL_TYPE_LONG, Value: binary.LittleEndian.AppendUint32(nil, 7)}, "7"},
+		{QueryAttr{Type: mysql.MYSQL_TYPE_DOUBLE, Value: binary.LittleEndian.AppendUint64(nil, 0x3ff8000000000000)}, "1.5"},
+		{QueryAttr{Type: mysql.MYSQL_TYPE_DATE, Value: []byte{0xe8, 0x07, 2, 29}}, "2024-02-29"},
+		{QueryAttr{Type: mysql.MYSQL_TYPE_DATETIME, Value: []byte{0xe8, 0x07, 2, 29, 13, 5, 9}}, "2024-02-29 13:05:09"},
+		{QueryAttr{Type: mysql.MYSQL_TYPE_TIME, Value: []byte{1, 1, 0, 0, 0, 2, 3, 4}}, "-26:03:04"},
+		{QueryAttr{Type: mysql.MYSQL_TYPE_STRING, Value: []byte("abc")}, "abc"},
+		{QueryAttr{Type: mysql.MYSQL_TYPE_STRING}, ""},
+	}
+	for i, test := range tests {
+		require.Equal(t, test.str, test.attr.String(), "case %d", i)
+	}
+}
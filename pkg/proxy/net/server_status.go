@@ -17,4 +17,6 @@ const (
 	ServerStatusMetadataChanged    uint16 = 0x0400
 	ServerStatusWasSlow            uint16 = 0x0800
 	ServerPSOutParams              uint16 = 0x1000
+	ServerStatusInTransReadonly    uint16 = 0x2000
+	ServerSessionStateChanged      uint16 = 0x4000
 )
@@ -6,7 +6,6 @@ package proxy
 import (
 	"context"
 	"net"
-	"strings"
 	"sync"
 	"time"
 
@@ -19,6 +18,7 @@ import (
 	"github.com/pingcap/tiproxy/pkg/proxy/client"
 	"github.com/pingcap/tiproxy/pkg/proxy/keepalive"
 	pnet "github.com/pingcap/tiproxy/pkg/proxy/net"
+	"github.com/pingcap/tiproxy/pkg/proxy/proxyprotocol"
 	"go.uber.org/zap"
 )
 
@@ -38,25 +38,32 @@ type serverState struct {
 	healthyKeepAlive   config.KeepAlive
 	unhealthyKeepAlive config.KeepAlive
 	clients            map[uint64]*client.ClientConnection
+	listenerConns      []uint64 // connection count of each listener
 	connID             uint64
 	maxConnections     uint64
 	connBufferSize     int
 	requireBackendTLS  bool
 	tcpKeepAlive       bool
 	proxyProtocol      bool
+	proxyVersion       proxyprotocol.ProxyVersion
+	proxyTrustedCIDRs  proxyprotocol.TrustedCIDRs
 	gracefulWait       int // graceful-wait-before-shutdown
 	gracefulClose      int // graceful-close-conn-timeout
 	status             serverStatus
+	ipFilter           *pnet.IPFilter
+	// listenerIPFilters maps the listener addrs to their IP filters.
+	listenerIPFilters   map[string]*pnet.IPFilter
+	migrationBufferSize int
 }
 
 type SQLServer struct {
-	listeners  []net.Listener
-	addrs      []string
-	logger     *zap.Logger
-	certMgr    *cert.CertManager
-	hsHandler  backend.HandshakeHandler
-	wg         waitgroup.WaitGroup
-	cancelFunc context.CancelFunc
+	listeners    []net.Listener
+	listenerCfgs []config.ProxyListener
+	logger       *zap.Logger
+	certMgr      *cert.CertManager
+	hsHandler    backend.HandshakeHandler
+	wg           waitgroup.WaitGroup
+	cancelFunc   context.CancelFunc
 
 	mu serverState
 }
@@ -76,12 +83,23 @@ func NewSQLServer(logger *zap.Logger, cfg *config.Config, certMgr *cert.CertMana
 	}
 
 	s.reset(cfg)
+	if s.mu.proxyProtocol && len(s.mu.proxyTrustedCIDRs) == 0 {
+		s.logger.Warn("proxy-protocol is enabled but trusted-cidrs is empty, so any client can send PROXY headers to spoof its address")
+	}
 
-	s.addrs = strings.Split(cfg.Proxy.Addr, ",")
-	s.listeners = make([]net.Listener, len(s.addrs))
-	for i, addr := range s.addrs {
-		s.listeners[i], err = net.Listen("tcp", addr)
+	perm, err := cfg.Proxy.UnixSocketFileMode()
+	if err != nil {
+		return nil, err
+	}
+	s.listenerCfgs = cfg.Proxy.ListenerConfigs()
+	s.listeners = make([]net.Listener, len(s.listenerCfgs))
+	s.mu.listenerConns = make([]uint64, len(s.listenerCfgs))
+	for i := range s.listenerCfgs {
+		s.listeners[i], err = listen(s.listenerCfgs[i].Addr, perm)
 		if err != nil {
+			for j := 0; j < i; j++ {
+				_ = s.listeners[j].Close()
+			}
 			return nil, err
 		}
 	}
@@ -95,11 +113,34 @@ func (s *SQLServer) reset(cfg *config.Config) {
 	s.mu.maxConnections = cfg.Proxy.MaxConnections
 	s.mu.requireBackendTLS = cfg.Security.RequireBackendTLS
 	s.mu.proxyProtocol = cfg.Proxy.ProxyProtocol != ""
+	s.mu.proxyVersion = proxyprotocol.ParseProxyVersion(cfg.Proxy.ProxyProtocol)
+	if trusted, err := proxyprotocol.ParseTrustedCIDRs(cfg.Proxy.TrustedCIDRs); err != nil {
+		s.logger.Error("parse trusted-cidrs failed, keep the previous value", zap.Error(err))
+	} else {
+		s.mu.proxyTrustedCIDRs = trusted
+	}
+	if filter, err := pnet.NewIPFilter(cfg.Proxy.AllowCIDRs, cfg.Proxy.DenyCIDRs); err != nil {
+		s.logger.Error("parse allow-cidrs or deny-cidrs failed, keep the previous value", zap.Error(err))
+	} else {
+		s.mu.ipFilter = filter
+	}
+	// The listeners can't be changed online, but their IP filters can.
+	listenerIPFilters := make(map[string]*pnet.IPFilter)
+	for _, listener := range cfg.Proxy.ListenerConfigs() {
+		filter, err := pnet.NewIPFilter(listener.AllowCIDRs, listener.DenyCIDRs)
+		if err != nil {
+			s.logger.Error("parse allow-cidrs or deny-cidrs of the listener failed, keep the previous value", zap.String("addr", listener.Addr), zap.Error(err))
+			filter = s.mu.listenerIPFilters[listener.Addr]
+		}
+		listenerIPFilters[listener.Addr] = filter
+	}
+	s.mu.listenerIPFilters = listenerIPFilters
 	s.mu.gracefulWait = cfg.Proxy.GracefulWaitBeforeShutdown
 	s.mu.gracefulClose = cfg.Proxy.GracefulCloseConnTimeout
 	s.mu.healthyKeepAlive = cfg.Proxy.BackendHealthyKeepalive
 	s.mu.unhealthyKeepAlive = cfg.Proxy.BackendUnhealthyKeepalive
 	s.mu.connBufferSize = cfg.Proxy.ConnBufferSize
+	s.mu.migrationBufferSize = cfg.Proxy.MigrationBufferSize
 	s.mu.Unlock()
 }
 
@@ -140,14 +181,16 @@ func (s *SQLServer) Run(ctx context.Context, cfgch <-chan *config.Config) {
 						continue
 					}
 
-					s.wg.RunWithRecover(func() { s.onConn(ctx, conn, s.addrs[j]) }, nil, s.logger)
+					s.wg.RunWithRecover(func() { s.onConn(ctx, conn, j) }, nil, s.logger)
 				}
 			}
 		})
 	}
 }
 
-func (s *SQLServer) onConn(ctx context.Context, conn net.Conn, addr string) {
+func (s *SQLServer) onConn(ctx context.Context, conn net.Conn, listenerIdx int) {
+	listenerCfg := &s.listenerCfgs[listenerIdx]
+	addr := listenerCfg.Addr
 	s.mu.Lock()
 
 	if s.mu.status >= statusWaitShutdown {
@@ -166,20 +209,33 @@ func (s *SQLServer) onConn(ctx context.Context, conn net.Conn, addr string) {
 		s.logger.Warn("too many connections", zap.Uint64("max connections", maxConns), zap.String("client_addr", conn.RemoteAddr().Network()), zap.Error(conn.Close()))
 		return
 	}
+	if maxConns = listenerCfg.MaxConnections; maxConns != 0 && s.mu.listenerConns[listenerIdx] >= maxConns {
+		s.mu.Unlock()
+		s.logger.Warn("too many connections on the listener", zap.String("addr", addr), zap.Uint64("max connections", maxConns), zap.String("client_addr", conn.RemoteAddr().Network()), zap.Error(conn.Close()))
+		return
+	}
 
 	connID := s.mu.connID
 	s.mu.connID++
 	logger := s.logger.With(zap.Uint64("connID", connID), zap.String("client_addr", conn.RemoteAddr().String()),
 		zap.String("addr", addr))
 	clientConn := client.NewClientConnection(logger.Named("conn"), conn, s.certMgr.ServerSQLTLS(), s.certMgr.SQLTLS(),
-		s.hsHandler, connID, addr, &backend.BCConfig{
-			ProxyProtocol:      s.mu.proxyProtocol,
-			RequireBackendTLS:  s.mu.requireBackendTLS,
-			HealthyKeepAlive:   s.mu.healthyKeepAlive,
-			UnhealthyKeepAlive: s.mu.unhealthyKeepAlive,
-			ConnBufferSize:     s.mu.connBufferSize,
+		s.hsHandler, connID, listenerCfg, &backend.BCConfig{
+			ProxyProtocol:          s.mu.proxyProtocol,
+			ProxyVersion:           s.mu.proxyVersion,
+			AcceptProxyProtocol:    listenerCfg.ProxyProtocol,
+			ProxyTrustedCIDRs:      s.mu.proxyTrustedCIDRs,
+			RequireSecureTransport: listenerCfg.RequireSecureTransport,
+			RequireBackendTLS:      s.mu.requireBackendTLS,
+			IPFilters:              []*pnet.IPFilter{s.mu.ipFilter, s.mu.listenerIPFilters[addr]},
+			RSAKey:                 s.certMgr.RSAKey,
+			HealthyKeepAlive:       s.mu.healthyKeepAlive,
+			UnhealthyKeepAlive:     s.mu.unhealthyKeepAlive,
+			ConnBufferSize:         s.mu.connBufferSize,
+			MigrationBufferSize:    s.mu.migrationBufferSize,
 		})
 	s.mu.clients[connID] = clientConn
+	s.mu.listenerConns[listenerIdx]++
 	logger.Debug("new connection", zap.Bool("proxy-protocol", s.mu.proxyProtocol), zap.Bool("require_backend_tls", s.mu.requireBackendTLS))
 	s.mu.Unlock()
 
@@ -189,6 +245,7 @@ func (s *SQLServer) onConn(ctx context.Context, conn net.Conn, addr string) {
 	defer func() {
 		s.mu.Lock()
 		delete(s.mu.clients, connID)
+		s.mu.listenerConns[listenerIdx]--
 		s.mu.Unlock()
 
 		if err := clientConn.Close(); err != nil && !pnet.IsDisconnectError(err) {
@@ -199,8 +256,11 @@ func (s *SQLServer) onConn(ctx context.Context, conn net.Conn, addr string) {
 		metrics.ConnGauge.Dec()
 	}()
 
-	if err := keepalive.SetKeepalive(conn, config.KeepAlive{Enabled: tcpKeepAlive}); err != nil {
-		logger.Warn("failed to set tcp keep alive option", zap.Error(err))
+	// Keepalive is meaningless for Unix sockets.
+	if _, ok := conn.(*net.TCPConn); ok {
+		if err := keepalive.SetKeepalive(conn, config.KeepAlive{Enabled: tcpKeepAlive}); err != nil {
+			logger.Warn("failed to set tcp keep alive option", zap.Error(err))
+		}
 	}
 
 	clientConn.Run(ctx)
@@ -8,6 +8,8 @@ import (
 	"database/sql"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -101,7 +103,7 @@ func TestGracefulCloseConn(t *testing.T) {
 		}()
 		conn, err := server.listeners[0].Accept()
 		require.NoError(t, err)
-		clientConn := client.NewClientConnection(lg, conn, nil, nil, hsHandler, 0, "", &backend.BCConfig{})
+		clientConn := client.NewClientConnection(lg, conn, nil, nil, hsHandler, 0, &config.ProxyListener{}, &backend.BCConfig{})
 		server.mu.clients[1] = clientConn
 		server.mu.Unlock()
 		return clientConn
@@ -206,6 +208,103 @@ func TestMultiAddr(t *testing.T) {
 	certManager.Close()
 }
 
+func TestListenerMaxConns(t *testing.T) {
+	lg, _ := logger.CreateLoggerForTest(t)
+	certManager := cert.NewCertManager()
+	err := certManager.Init(&config.Config{}, lg, nil)
+	require.NoError(t, err)
+	defer certManager.Close()
+	server, err := NewSQLServer(lg, &config.Config{
+		Proxy: config.ProxyServer{
+			Addr: "0.0.0.0:0",
+			Listeners: []config.ProxyListener{
+				{Addr: "127.0.0.1:0", MaxConnections: 1},
+				{Addr: "127.0.0.1:0"},
+			},
+		},
+	}, certManager, &panicHsHandler{})
+	require.NoError(t, err)
+	server.Run(context.Background(), nil)
+	defer func() {
+		require.NoError(t, server.Close())
+	}()
+
+	// Addr is ignored when the listeners are set.
+	require.Len(t, server.listeners, 2)
+	connect := func(idx int) (*pnet.PacketIO, error) {
+		conn, err := net.Dial("tcp", server.listeners[idx].Addr().String())
+		require.NoError(t, err)
+		pkt := pnet.NewPacketIO(conn, lg, pnet.DefaultConnBufferSize)
+		// read the initial handshake
+		_, err = pkt.ReadPacket()
+		return pkt, err
+	}
+	conn1, err := connect(0)
+	require.NoError(t, err)
+	// exceeds the max connections of the listener
+	conn2, err := connect(0)
+	require.Error(t, err)
+	require.NoError(t, conn2.Close())
+	// other listeners are not limited
+	conn3, err := connect(1)
+	require.NoError(t, err)
+	require.NoError(t, conn3.Close())
+
+	require.NoError(t, conn1.Close())
+	require.Eventually(t, func() bool {
+		server.mu.RLock()
+		defer server.mu.RUnlock()
+		return server.mu.listenerConns[0] == 0
+	}, 3*time.Second, 10*time.Millisecond)
+	conn4, err := connect(0)
+	require.NoError(t, err)
+	require.NoError(t, conn4.Close())
+}
+
+func TestUnixSocket(t *testing.T) {
+	lg, _ := logger.CreateLoggerForTest(t)
+	certManager := cert.NewCertManager()
+	err := certManager.Init(&config.Config{}, lg, nil)
+	require.NoError(t, err)
+	defer certManager.Close()
+	path := filepath.Join(t.TempDir(), "tiproxy.sock")
+	cfg := &config.Config{
+		Proxy: config.ProxyServer{
+			Addr:           "0.0.0.0:0," + config.UnixSocketAddrPrefix + path,
+			UnixSocketPerm: "0666",
+		},
+	}
+
+	// a regular file is never removed
+	require.NoError(t, os.WriteFile(path, []byte("test"), 0600))
+	_, err = NewSQLServer(lg, cfg, certManager, &panicHsHandler{})
+	require.Error(t, err)
+	require.NoError(t, os.Remove(path))
+
+	// a stale socket is removed
+	ln, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, ln.Close())
+	server, err := NewSQLServer(lg, cfg, certManager, &panicHsHandler{})
+	require.NoError(t, err)
+	server.Run(context.Background(), nil)
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0666), fi.Mode().Perm())
+
+	// a socket in use is never removed
+	_, err = NewSQLServer(lg, cfg, certManager, &panicHsHandler{})
+	require.Error(t, err)
+
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	require.NoError(t, server.Close())
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+}
+
 func TestWatchCfg(t *testing.T) {
 	lg, _ := logger.CreateLoggerForTest(t)
 	hsHandler := backend.NewDefaultHandshakeHandler(nil)
@@ -218,6 +317,7 @@ func TestWatchCfg(t *testing.T) {
 			ProxyServerOnline: config.ProxyServerOnline{
 				MaxConnections:           100,
 				ConnBufferSize:           1024 * 1024,
+				MigrationBufferSize:      4 * 1024 * 1024,
 				ProxyProtocol:            "v2",
 				GracefulCloseConnTimeout: 100,
 			},
@@ -233,6 +333,7 @@ func TestWatchCfg(t *testing.T) {
 		return server.mu.requireBackendTLS == cfg.Security.RequireBackendTLS &&
 			server.mu.maxConnections == cfg.Proxy.MaxConnections &&
 			server.mu.connBufferSize == cfg.Proxy.ConnBufferSize &&
+			server.mu.migrationBufferSize == cfg.Proxy.MigrationBufferSize &&
 			server.mu.proxyProtocol == (cfg.Proxy.ProxyProtocol != "") &&
 			server.mu.gracefulWait == cfg.Proxy.GracefulWaitBeforeShutdown
 	}, 3*time.Second, 10*time.Millisecond)
@@ -8,9 +8,18 @@ import "net"
 type ProxyVersion int
 
 const (
-	ProxyVersion2 ProxyVersion = iota + 2
+	ProxyVersion1 ProxyVersion = iota + 1
+	ProxyVersion2
 )
 
+// ParseProxyVersion converts the config value like `v1` to the version. Unknown values fall back to v2.
+func ParseProxyVersion(version string) ProxyVersion {
+	if version == "v1" {
+		return ProxyVersion1
+	}
+	return ProxyVersion2
+}
+
 type ProxyCommand int
 
 const (
@@ -51,6 +60,17 @@ const (
 	ProxyTlvNetns ProxyTlvType = iota + 0x30
 )
 
+// Vendor-specific TLVs, whose first byte of the content is the subtype.
+const (
+	// ProxyTlvAWS is sent by AWS NLB.
+	ProxyTlvAWS ProxyTlvType = 0xEA
+)
+
+const (
+	// ProxyTlvAWSVPCEndpointID is the subtype of the VPC endpoint ID in ProxyTlvAWS.
+	ProxyTlvAWSVPCEndpointID byte = 0x01
+)
+
 type ProxyTlv struct {
 	Content []byte
 	Typ     ProxyTlvType
@@ -68,3 +88,13 @@ type AddressWrapper interface {
 	net.Addr
 	Unwrap() net.Addr
 }
+
+// FindTLV returns the content of the first TLV of the type.
+func FindTLV(tlvs []ProxyTlv, typ ProxyTlvType) ([]byte, bool) {
+	for _, tlv := range tlvs {
+		if tlv.Typ == typ {
+			return tlv.Content, true
+		}
+	}
+	return nil, false
+}
@@ -7,4 +7,6 @@ import "github.com/pingcap/tiproxy/lib/util/errors"
 
 var (
 	ErrAddressFamilyMismatch = errors.New("address family between source and target mismatched")
+	ErrInvalidHeader         = errors.New("invalid proxy protocol header")
+	ErrUntrustedPeer         = errors.New("proxy protocol header from untrusted peer")
 )
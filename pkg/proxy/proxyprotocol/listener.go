@@ -7,6 +7,8 @@ import (
 	"bytes"
 	"io"
 	"net"
+
+	"github.com/pingcap/tiproxy/lib/util/errors"
 )
 
 var _ net.Listener = (*Listener)(nil)
@@ -14,42 +16,36 @@ var _ net.Conn = (*proxyConn)(nil)
 
 type Listener struct {
 	net.Listener
+	trusted TrustedCIDRs
 }
 
-func NewListener(o net.Listener) *Listener {
-	return &Listener{o}
+// NewListener wraps a listener to parse v1 and v2 headers.
+// Headers are only honoured from the trusted peers and connections from other peers that send headers are rejected.
+func NewListener(o net.Listener, trusted TrustedCIDRs) *Listener {
+	return &Listener{Listener: o, trusted: trusted}
 }
 
 func (n *Listener) Accept() (net.Conn, error) {
 	conn, err := n.Listener.Accept()
-	return &proxyConn{Conn: conn, buf: new(bytes.Buffer)}, err
+	return &proxyConn{Conn: conn, buf: new(bytes.Buffer), trusted: n.trusted}, err
 }
 
 type proxyConn struct {
 	net.Conn
-	buf    *bytes.Buffer
-	proxy  *Proxy
-	inited bool
+	buf     *bytes.Buffer
+	proxy   *Proxy
+	trusted TrustedCIDRs
+	err     error
+	inited  bool
 }
 
 func (c *proxyConn) Read(b []byte) (n int, err error) {
+	if c.err != nil {
+		return 0, c.err
+	}
 	if !c.inited {
-		_, err = c.buf.ReadFrom(io.LimitReader(c.Conn, int64(len(MagicV2)-c.buf.Len())))
-		if err != nil {
-			return
-		}
-		if bytes.HasPrefix(MagicV2, c.buf.Bytes()) {
-			if !bytes.Equal(MagicV2, c.buf.Bytes()) {
-				// prefix matches, maybe proxy header
-				// read again later
-				return 0, nil
-			}
-			// it is proxy protocol
-			c.buf.Reset()
-			c.proxy, _, err = ParseProxyV2(c.Conn)
-			if err != nil {
-				return 0, err
-			}
+		if c.err = c.readProxy(); c.err != nil {
+			return 0, c.err
 		}
 		// prefixes mismatched, or we have parsed PP header
 		c.inited = true
@@ -62,9 +58,52 @@ func (c *proxyConn) Read(b []byte) (n int, err error) {
 	return c.Conn.Read(b)
 }
 
+// readProxy reads the first byte to decide the version and then reads the rest of the magic.
+// It never reads beyond the magic because the data is returned to the caller if it's not a proxy header.
+func (c *proxyConn) readProxy() error {
+	var magic []byte
+	for {
+		limit := 1
+		if c.buf.Len() > 0 {
+			magic = MagicV2
+			if c.buf.Bytes()[0] == MagicV1[0] {
+				magic = MagicV1
+			}
+			if !bytes.HasPrefix(magic, c.buf.Bytes()) {
+				return nil
+			}
+			if c.buf.Len() == len(magic) {
+				break
+			}
+			limit = len(magic) - c.buf.Len()
+		}
+		read, err := c.buf.ReadFrom(io.LimitReader(c.Conn, int64(limit)))
+		if err != nil {
+			return err
+		}
+		if read == 0 {
+			// EOF, return the buffered data to the caller
+			return nil
+		}
+	}
+
+	// it is proxy protocol
+	if !c.trusted.Contains(c.Conn.RemoteAddr()) {
+		return errors.Wrapf(ErrUntrustedPeer, "peer %s", c.Conn.RemoteAddr().String())
+	}
+	c.buf.Reset()
+	var err error
+	if bytes.Equal(magic, MagicV1) {
+		c.proxy, _, err = ParseProxyV1(c.Conn)
+	} else {
+		c.proxy, _, err = ParseProxyV2(c.Conn)
+	}
+	return err
+}
+
 func (c *proxyConn) RemoteAddr() net.Addr {
-	if c.proxy != nil && c.proxy.DstAddress != nil {
-		return c.proxy.DstAddress
+	if c.proxy != nil && c.proxy.SrcAddress != nil {
+		return c.proxy.SrcAddress
 	}
 	return c.Conn.RemoteAddr()
 }
@@ -22,7 +22,7 @@ func TestProxyListener(t *testing.T) {
 		func(t *testing.T, network, addr string) net.Listener {
 			ln, err := net.Listen(network, addr)
 			require.NoError(t, err)
-			return NewListener(ln)
+			return NewListener(ln, nil)
 		},
 		func(t *testing.T, c net.Conn) {
 			p := &Proxy{
@@ -59,7 +59,7 @@ func TestProxyListener(t *testing.T) {
 		func(t *testing.T, network, addr string) net.Listener {
 			ln, err := net.Listen(network, addr)
 			require.NoError(t, err)
-			return NewListener(ln)
+			return NewListener(ln, nil)
 		},
 		func(t *testing.T, c net.Conn) {
 			_, err = io.Copy(c, strings.NewReader("test"))
@@ -71,3 +71,96 @@ func TestProxyListener(t *testing.T) {
 			require.Equal(t, []byte("test"), all)
 		}, 1)
 }
+
+func TestProxyListenerV1(t *testing.T) {
+	srcAddr := &net.TCPAddr{IP: net.ParseIP("192.168.1.1").To4(), Port: 34}
+	testkit.TestTCPConnWithListener(t,
+		func(t *testing.T, network, addr string) net.Listener {
+			ln, err := net.Listen(network, addr)
+			require.NoError(t, err)
+			trusted, err := ParseTrustedCIDRs([]string{"127.0.0.1"})
+			require.NoError(t, err)
+			return NewListener(ln, trusted)
+		},
+		func(t *testing.T, c net.Conn) {
+			p := &Proxy{
+				Version:    ProxyVersion1,
+				Command:    ProxyCommandProxy,
+				SrcAddress: srcAddr,
+				DstAddress: c.RemoteAddr(),
+			}
+			b, err := p.ToBytes()
+			require.NoError(t, err)
+			_, err = c.Write(append(b, []byte("test")...))
+			require.NoError(t, err)
+		},
+		func(t *testing.T, c net.Conn) {
+			all, err := io.ReadAll(c)
+			require.NoError(t, err)
+			require.Equal(t, []byte("test"), all)
+			require.Equal(t, srcAddr.String(), c.RemoteAddr().String())
+		}, 1)
+
+	// data that partially matches the magic is returned
+	testkit.TestTCPConnWithListener(t,
+		func(t *testing.T, network, addr string) net.Listener {
+			ln, err := net.Listen(network, addr)
+			require.NoError(t, err)
+			return NewListener(ln, nil)
+		},
+		func(t *testing.T, c net.Conn) {
+			_, err := io.Copy(c, strings.NewReader("PROX"))
+			require.NoError(t, err)
+		},
+		func(t *testing.T, c net.Conn) {
+			all, err := io.ReadAll(c)
+			require.NoError(t, err)
+			require.Equal(t, []byte("PROX"), all)
+		}, 1)
+}
+
+func TestProxyListenerUntrusted(t *testing.T) {
+	trusted, err := ParseTrustedCIDRs([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	for _, version := range []ProxyVersion{ProxyVersion1, ProxyVersion2} {
+		testkit.TestTCPConnWithListener(t,
+			func(t *testing.T, network, addr string) net.Listener {
+				ln, err := net.Listen(network, addr)
+				require.NoError(t, err)
+				return NewListener(ln, trusted)
+			},
+			func(t *testing.T, c net.Conn) {
+				p := &Proxy{
+					Version:    version,
+					Command:    ProxyCommandProxy,
+					SrcAddress: &net.TCPAddr{IP: net.ParseIP("10.0.0.1").To4(), Port: 34},
+					DstAddress: &net.TCPAddr{IP: net.ParseIP("10.0.0.2").To4(), Port: 34},
+				}
+				b, err := p.ToBytes()
+				require.NoError(t, err)
+				_, err = c.Write(append(b, []byte("test")...))
+				require.NoError(t, err)
+			},
+			func(t *testing.T, c net.Conn) {
+				_, err := io.ReadAll(c)
+				require.ErrorIs(t, err, ErrUntrustedPeer)
+			}, 1)
+	}
+
+	// untrusted peers without headers are still accepted
+	testkit.TestTCPConnWithListener(t,
+		func(t *testing.T, network, addr string) net.Listener {
+			ln, err := net.Listen(network, addr)
+			require.NoError(t, err)
+			return NewListener(ln, trusted)
+		},
+		func(t *testing.T, c net.Conn) {
+			_, err := io.Copy(c, strings.NewReader("test"))
+			require.NoError(t, err)
+		},
+		func(t *testing.T, c net.Conn) {
+			all, err := io.ReadAll(c)
+			require.NoError(t, err)
+			require.Equal(t, []byte("test"), all)
+		}, 1)
+}
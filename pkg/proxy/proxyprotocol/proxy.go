@@ -4,10 +4,16 @@
 package proxyprotocol
 
 import (
+	"bytes"
 	"io"
 	"net"
 )
 
+const (
+	// unixAddrLen is the length of each Unix address in v2 headers.
+	unixAddrLen = 108
+)
+
 var (
 	MagicV2 = []byte{0xD, 0xA, 0xD, 0xA, 0x0, 0xD, 0xA, 0x51, 0x55, 0x49, 0x54, 0xA}
 )
@@ -23,6 +29,9 @@ func unwrapOriginAddr(addr net.Addr) net.Addr {
 }
 
 func (p *Proxy) ToBytes() ([]byte, error) {
+	if p.Version == ProxyVersion1 {
+		return p.toBytesV1()
+	}
 	magicLen := len(MagicV2)
 	buf := make([]byte, magicLen+4)
 	_ = copy(buf, MagicV2)
@@ -75,8 +84,12 @@ func (p *Proxy) ToBytes() ([]byte, error) {
 		if !ok {
 			return nil, ErrAddressFamilyMismatch
 		}
-		buf = append(buf, []byte(sadd.Name)...)
-		buf = append(buf, []byte(dadd.Name)...)
+		// Unix addresses are padded to unixAddrLen bytes.
+		var sname, dname [unixAddrLen]byte
+		_ = copy(sname[:], sadd.Name)
+		_ = copy(dname[:], dadd.Name)
+		buf = append(buf, sname[:]...)
+		buf = append(buf, dname[:]...)
 	}
 	buf[magicLen+1] = byte(addressFamily<<4) | byte(network&0xF)
 
@@ -154,12 +167,12 @@ func ParseProxyV2(rd io.Reader) (m *Proxy, n int, err error) {
 		}
 		buf = buf[length*2+4:]
 	case ProxyAFUnix:
-		if len(buf) < 216 {
+		if len(buf) < 2*unixAddrLen {
 			// TODO: logging
 			break
 		}
-		saddr := string(buf[:108])
-		daddr := string(buf[108:216])
+		saddr := string(bytes.TrimRight(buf[:unixAddrLen], "\x00"))
+		daddr := string(bytes.TrimRight(buf[unixAddrLen:2*unixAddrLen], "\x00"))
 		switch network {
 		case ProxyNetworkStream:
 			m.SrcAddress = &net.UnixAddr{
@@ -182,7 +195,7 @@ func ParseProxyV2(rd io.Reader) (m *Proxy, n int, err error) {
 		default:
 			// TODO: logging
 		}
-		buf = buf[216:]
+		buf = buf[2*unixAddrLen:]
 	default:
 		buf = buf[len(buf):]
 	}
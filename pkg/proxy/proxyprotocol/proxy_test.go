@@ -92,3 +92,30 @@ func TestProxyToBytes(t *testing.T) {
 	_, err = hdr.ToBytes()
 	require.NoError(t, err)
 }
+
+func TestProxyUnixAddr(t *testing.T) {
+	p := &Proxy{
+		Version:    ProxyVersion2,
+		Command:    ProxyCommandProxy,
+		SrcAddress: &net.UnixAddr{Name: "", Net: "unix"},
+		DstAddress: &net.UnixAddr{Name: "/tmp/tiproxy.sock", Net: "unix"},
+		TLV: []ProxyTlv{
+			{
+				Typ:     ProxyTlvUniqueID,
+				Content: []byte("test"),
+			},
+		},
+	}
+	b, err := p.ToBytes()
+	require.NoError(t, err)
+	require.Len(t, b, len(MagicV2)+4+2*unixAddrLen+3+4)
+	parsed, _, err := ParseProxyV2(bytes.NewReader(b[len(MagicV2):]))
+	require.NoError(t, err)
+	require.Equal(t, p, parsed)
+
+	// v1 doesn't support Unix sockets
+	p.Version = ProxyVersion1
+	b, err = p.ToBytes()
+	require.NoError(t, err)
+	require.Equal(t, "PROXY UNKNOWN\r\n", string(b))
+}
@@ -0,0 +1,116 @@
+// Copyright 2023 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package proxyprotocol
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pingcap/tiproxy/lib/util/errors"
+)
+
+var (
+	MagicV1 = []byte("PROXY ")
+)
+
+const (
+	// maxV1HeaderLen is the max length of a v1 header, including the magic and CRLF.
+	maxV1HeaderLen = 107
+	v1ProtoTCP4    = "TCP4"
+	v1ProtoTCP6    = "TCP6"
+	v1ProtoUnknown = "UNKNOWN"
+)
+
+// toBytesV1 generates a human-readable header. TLVs are not supported in v1 and are ignored.
+func (p *Proxy) toBytesV1() ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, maxV1HeaderLen))
+	_, _ = buf.Write(MagicV1)
+
+	srcAddr, srcOK := unwrapOriginAddr(p.SrcAddress).(*net.TCPAddr)
+	dstAddr, dstOK := unwrapOriginAddr(p.DstAddress).(*net.TCPAddr)
+	if p.Command == ProxyCommandLocal || !srcOK || !dstOK {
+		_, _ = buf.WriteString(v1ProtoUnknown)
+		_, _ = buf.WriteString("\r\n")
+		return buf.Bytes(), nil
+	}
+
+	srcIP, dstIP := srcAddr.IP.To4(), dstAddr.IP.To4()
+	proto := v1ProtoTCP4
+	switch {
+	case srcIP != nil && dstIP != nil:
+	case srcIP == nil && dstIP == nil:
+		proto = v1ProtoTCP6
+		srcIP, dstIP = srcAddr.IP.To16(), dstAddr.IP.To16()
+		if srcIP == nil || dstIP == nil {
+			return nil, ErrAddressFamilyMismatch
+		}
+	default:
+		return nil, ErrAddressFamilyMismatch
+	}
+	_, _ = buf.WriteString(strings.Join([]string{proto, srcIP.String(), dstIP.String(),
+		strconv.Itoa(srcAddr.Port), strconv.Itoa(dstAddr.Port)}, " "))
+	_, _ = buf.WriteString("\r\n")
+	return buf.Bytes(), nil
+}
+
+// ParseProxyV1 parses a v1 header after the magic is consumed.
+// It reads byte by byte so that it never consumes data after the header.
+func ParseProxyV1(rd io.Reader) (m *Proxy, n int, err error) {
+	line := make([]byte, 0, maxV1HeaderLen-len(MagicV1))
+	var b [1]byte
+	for {
+		if len(line) >= cap(line) {
+			return nil, n, errors.Wrapf(ErrInvalidHeader, "v1 header exceeds %d bytes", maxV1HeaderLen)
+		}
+		if _, err = io.ReadFull(rd, b[:]); err != nil {
+			return nil, n, err
+		}
+		n++
+		line = append(line, b[0])
+		if b[0] == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, n, errors.Wrapf(ErrInvalidHeader, "v1 header does not end with CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	m = &Proxy{
+		Version: ProxyVersion1,
+		Command: ProxyCommandProxy,
+	}
+	switch fields[0] {
+	case v1ProtoUnknown:
+		// The receiver must ignore the rest of the line and use the real addresses.
+		m.Command = ProxyCommandLocal
+		return m, n, nil
+	case v1ProtoTCP4, v1ProtoTCP6:
+	default:
+		return nil, n, errors.Wrapf(ErrInvalidHeader, "unsupported v1 protocol %s", fields[0])
+	}
+	if len(fields) != 5 {
+		return nil, n, errors.Wrapf(ErrInvalidHeader, "v1 header has %d fields", len(fields))
+	}
+	var addrs [2]*net.TCPAddr
+	for i := range addrs {
+		ip := net.ParseIP(fields[1+i])
+		if ip == nil || (ip.To4() != nil) != (fields[0] == v1ProtoTCP4) {
+			return nil, n, errors.Wrapf(ErrInvalidHeader, "invalid v1 address %s", fields[1+i])
+		}
+		if fields[0] == v1ProtoTCP4 {
+			ip = ip.To4()
+		}
+		port, err := strconv.ParseUint(fields[3+i], 10, 16)
+		if err != nil {
+			return nil, n, errors.Wrapf(ErrInvalidHeader, "invalid v1 port %s", fields[3+i])
+		}
+		addrs[i] = &net.TCPAddr{IP: ip, Port: int(port)}
+	}
+	m.SrcAddress, m.DstAddress = addrs[0], addrs[1]
+	return m, n, nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2023 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package proxyprotocol
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyV1RoundTrip(t *testing.T) {
+	tests := []struct {
+		src    *net.TCPAddr
+		dst    *net.TCPAddr
+		header string
+	}{
+		{
+			src:    &net.TCPAddr{IP: net.ParseIP("192.168.1.1").To4(), Port: 34},
+			dst:    &net.TCPAddr{IP: net.ParseIP("10.0.0.1").To4(), Port: 4000},
+			header: "PROXY TCP4 192.168.1.1 10.0.0.1 34 4000\r\n",
+		},
+		{
+			src:    &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 65535},
+			dst:    &net.TCPAddr{IP: net.ParseIP("::1"), Port: 0},
+			header: "PROXY TCP6 fe80::1 ::1 65535 0\r\n",
+		},
+	}
+	for i, test := range tests {
+		p := &Proxy{
+			Version:    ProxyVersion1,
+			Command:    ProxyCommandProxy,
+			SrcAddress: test.src,
+			DstAddress: test.dst,
+		}
+		b, err := p.ToBytes()
+		require.NoError(t, err, "case %d", i)
+		require.Equal(t, test.header, string(b), "case %d", i)
+
+		// the data after the header must not be consumed
+		rd := bytes.NewReader(append(b, []byte("test")...))
+		_, err = rd.Seek(int64(len(MagicV1)), 0)
+		require.NoError(t, err)
+		parsed, n, err := ParseProxyV1(rd)
+		require.NoError(t, err, "case %d", i)
+		require.Equal(t, len(b)-len(MagicV1), n, "case %d", i)
+		require.Equal(t, p, parsed, "case %d", i)
+		require.Equal(t, 4, rd.Len(), "case %d", i)
+	}
+}
+
+func TestProxyV1Unknown(t *testing.T) {
+	p := &Proxy{
+		Version:    ProxyVersion1,
+		Command:    ProxyCommandLocal,
+		SrcAddress: &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 34},
+		DstAddress: &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 34},
+	}
+	b, err := p.ToBytes()
+	require.NoError(t, err)
+	require.Equal(t, "PROXY UNKNOWN\r\n", string(b))
+
+	parsed, _, err := ParseProxyV1(strings.NewReader("UNKNOWN ffff::1 ffff::2 1 2\r\n"))
+	require.NoError(t, err)
+	require.Equal(t, ProxyCommandLocal, parsed.Command)
+	require.Nil(t, parsed.SrcAddress)
+
+	p.Command = ProxyCommandProxy
+	p.DstAddress = &net.TCPAddr{IP: net.ParseIP("::1"), Port: 34}
+	_, err = p.ToBytes()
+	require.ErrorIs(t, err, ErrAddressFamilyMismatch)
+}
+
+func TestProxyV1Invalid(t *testing.T) {
+	headers := []string{
+		"TCP4 192.168.1.1 10.0.0.1 34 4000\n",
+		"TCP4 192.168.1.1 10.0.0.1 34\r\n",
+		"TCP4 ::1 10.0.0.1 34 4000\r\n",
+		"TCP6 192.168.1.1 ::1 34 4000\r\n",
+		"TCP4 192.168.1.1 10.0.0.1 34 65536\r\n",
+		"UDP4 192.168.1.1 10.0.0.1 34 4000\r\n",
+		"TCP4 " + strings.Repeat("1", maxV1HeaderLen) + "\r\n",
+	}
+	for i, header := range headers {
+		_, _, err := ParseProxyV1(strings.NewReader(header))
+		require.ErrorIs(t, err, ErrInvalidHeader, "case %d", i)
+	}
+}
+
+func TestTrustedCIDRs(t *testing.T) {
+	_, err := ParseTrustedCIDRs([]string{"10.0.0.0/33"})
+	require.Error(t, err)
+	_, err = ParseTrustedCIDRs([]string{"abc"})
+	require.Error(t, err)
+
+	var empty TrustedCIDRs
+	require.True(t, empty.Contains(&net.TCPAddr{IP: net.ParseIP("1.1.1.1")}))
+
+	trusted, err := ParseTrustedCIDRs([]string{"10.0.0.0/8", "192.168.1.1", "fe80::/64"})
+	require.NoError(t, err)
+	tests := []struct {
+		addr    net.Addr
+		trusted bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1}, true},
+		{&net.TCPAddr{IP: net.ParseIP("11.1.2.3"), Port: 1}, false},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.2"), Port: 1}, false},
+		{&net.TCPAddr{IP: net.ParseIP("fe80::2"), Port: 1}, true},
+		{&net.TCPAddr{IP: net.ParseIP("fe81::2"), Port: 1}, false},
+		{&originAddr{Addr: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1}}, true},
+		{&net.UnixAddr{Name: "/tmp/a.sock", Net: "unix"}, false},
+		{nil, false},
+	}
+	for i, test := range tests {
+		require.Equal(t, test.trusted, trusted.Contains(test.addr), "case %d", i)
+	}
+}
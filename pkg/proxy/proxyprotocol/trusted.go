@@ -0,0 +1,81 @@
+// Copyright 2023 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package proxyprotocol
+
+import (
+	"net"
+	"strings"
+
+	"github.com/pingcap/tiproxy/lib/util/errors"
+)
+
+// TrustedCIDRs is the allowlist of upstream proxies whose PROXY headers are honoured.
+// An empty list trusts all peers, which keeps compatible with previous versions.
+type TrustedCIDRs []*net.IPNet
+
+// ParseTrustedCIDRs parses CIDRs like `10.0.0.0/8`. A plain IP is treated as a single-host CIDR.
+func ParseTrustedCIDRs(cidrs []string) (TrustedCIDRs, error) {
+	trusted, err := ParseCIDRs(cidrs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid trusted CIDRs")
+	}
+	return trusted, nil
+}
+
+// ParseCIDRs parses CIDRs like `10.0.0.0/8`. A plain IP is treated as a single-host CIDR.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	ipNets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errors.Errorf("invalid CIDR %s", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			ipNets = append(ipNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid CIDR %s", cidr)
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets, nil
+}
+
+// Contains returns whether the peer is allowed to send PROXY headers.
+func (tc TrustedCIDRs) Contains(addr net.Addr) bool {
+	if len(tc) == 0 {
+		return true
+	}
+	var ip net.IP
+	switch a := unwrapOriginAddr(addr).(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		if addr == nil {
+			return false
+		}
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range tc {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,19 @@
+// Copyright 2024 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BackendHealthHistory returns the recent status changes of the backends in each namespace.
+func (h *Server) BackendHealthHistory(c *gin.Context) {
+	c.JSON(http.StatusOK, h.mgr.ns.HealthHistory())
+}
+
+func (h *Server) registerBackend(group *gin.RouterGroup) {
+	group.GET("/health", h.BackendHealthHistory)
+}
@@ -0,0 +1,61 @@
+// Copyright 2024 PingCAP, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tiproxy/lib/config"
+	"github.com/pingcap/tiproxy/lib/util/logger"
+	"github.com/pingcap/tiproxy/pkg/manager/infosync"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendHealthHistory(t *testing.T) {
+	srv, doHTTP := createServer(t, nil)
+
+	doHTTP(t, http.MethodGet, "/api/backend/health", nil, nil, func(t *testing.T, r *http.Response) {
+		all, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.Equal(t, `{}`, string(all))
+		require.Equal(t, http.StatusOK, r.StatusCode)
+	})
+
+	// The backend is unreachable, so a "down" event is recorded after the first health check.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	require.NoError(t, listener.Close())
+	lg, _ := logger.CreateLoggerForTest(t)
+	var is *infosync.InfoSyncer
+	nscs := []*config.Namespace{{Namespace: "test", Backend: config.BackendNamespace{Instances: []string{addr}}}}
+	require.NoError(t, srv.mgr.ns.Init(lg, nscs, is, is, http.DefaultClient, nil))
+	t.Cleanup(func() {
+		require.NoError(t, srv.mgr.ns.Close())
+	})
+
+	var history map[string]map[string][]map[string]any
+	require.Eventually(t, func() bool {
+		var body []byte
+		doHTTP(t, http.MethodGet, "/api/backend/health", nil, nil, func(t *testing.T, r *http.Response) {
+			require.Equal(t, http.StatusOK, r.StatusCode)
+			body, err = io.ReadAll(r.Body)
+			require.NoError(t, err)
+		})
+		require.NoError(t, json.Unmarshal(body, &history))
+		return len(history["test"][addr]) > 0
+	}, 10*time.Second, 100*time.Millisecond)
+	require.Len(t, history, 1)
+	event := history["test"][addr][0]
+	require.Equal(t, "down", event["status"])
+	require.NotEmpty(t, event["reason"])
+	_, err = time.Parse(time.RFC3339Nano, event["time"].(string))
+	require.NoError(t, err)
+	require.Len(t, event, 3)
+}
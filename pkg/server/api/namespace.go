@@ -28,7 +28,7 @@ func (h *Server) NamespaceGet(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, nsc)
+	c.JSON(http.StatusOK, nsc.Redact())
 }
 
 func (h *Server) NamespaceUpsert(c *gin.Context) {
@@ -130,7 +130,11 @@ func (h *Server) NamespaceList(c *gin.Context) {
 		return
 	}
 	if nscs != nil {
-		c.JSON(http.StatusOK, nscs)
+		redacted := make([]*config.Namespace, 0, len(nscs))
+		for _, nsc := range nscs {
+			redacted = append(redacted, nsc.Redact())
+		}
+		c.JSON(http.StatusOK, redacted)
 	} else {
 		c.JSON(http.StatusOK, "")
 	}
@@ -35,7 +35,7 @@ func TestNamespace(t *testing.T) {
 	doHTTP(t, http.MethodGet, "/api/admin/namespace/dge", nil, nil, func(t *testing.T, r *http.Response) {
 		all, err := io.ReadAll(r.Body)
 		require.NoError(t, err)
-		require.Equal(t, `{"namespace":"dge","frontend":{"user":"","security":{}},"backend":{"instances":null,"security":{}}}`, string(all))
+		require.Equal(t, `{"namespace":"dge","frontend":{"user":"","security":{},"limits":{},"load-data":{}},"backend":{"instances":null,"security":{},"health-check":{},"migration":{},"compression":{}}}`, string(all))
 		require.Equal(t, http.StatusOK, r.StatusCode)
 	})
 
@@ -55,3 +55,23 @@ func TestNamespace(t *testing.T) {
 		require.Equal(t, http.StatusInternalServerError, r.StatusCode)
 	})
 }
+
+func TestNamespaceRedactCredentials(t *testing.T) {
+	_, doHTTP := createServer(t, nil)
+
+	nsc := `{"namespace":"dge","frontend":{"local-users":[{"user":"app","auth-string":"*6BB4837EB74329105EE4568DDA7DC67ED2CA2AD9","backend-user":"svc","backend-password":"svc_pwd"}]},"backend":{"health-check":{"sql-user":"probe","sql-password":"probe_pwd"}}}`
+	doHTTP(t, http.MethodPut, "/api/admin/namespace", strings.NewReader(nsc), nil, func(t *testing.T, r *http.Response) {
+		require.Equal(t, http.StatusOK, r.StatusCode)
+	})
+	for _, path := range []string{"/api/admin/namespace/dge", "/api/admin/namespace"} {
+		doHTTP(t, http.MethodGet, path, nil, nil, func(t *testing.T, r *http.Response) {
+			all, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, r.StatusCode)
+			require.Contains(t, string(all), `"backend-user":"svc"`, path)
+			require.NotContains(t, string(all), "svc_pwd", path)
+			require.NotContains(t, string(all), "probe_pwd", path)
+			require.NotContains(t, string(all), "6BB4837EB74329105EE4568DDA7DC67ED2CA2AD9", path)
+		})
+	}
+}
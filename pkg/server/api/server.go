@@ -93,8 +93,16 @@ func NewServer(cfg config.API, lg *zap.Logger,
 		return nil, err
 	}
 	switch cfg.ProxyProtocol {
-	case "v2":
-		h.listener = proxyprotocol.NewListener(h.listener)
+	case "v1", "v2":
+		trusted, err := proxyprotocol.ParseTrustedCIDRs(cfg.TrustedCIDRs)
+		if err != nil {
+			_ = h.listener.Close()
+			return nil, err
+		}
+		if len(trusted) == 0 {
+			lg.Warn("proxy-protocol of the API server is enabled but trusted-cidrs is empty, so any client can send PROXY headers to spoof its address")
+		}
+		h.listener = proxyprotocol.NewListener(h.listener, trusted)
 	}
 
 	gin.SetMode(gin.ReleaseMode)
@@ -211,6 +219,7 @@ func (h *Server) registerAPI(g *gin.RouterGroup, cfg config.API, nsmgr *mgrns.Na
 		h.registerConfig(adminGroup.Group("config"))
 	}
 
+	h.registerBackend(g.Group("backend"))
 	h.registerMetrics(g.Group("metrics"))
 	h.registerDebug(g.Group("debug"))
 }
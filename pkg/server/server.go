@@ -18,7 +18,9 @@ import (
 	mgrns "github.com/pingcap/tiproxy/pkg/manager/namespace"
 	"github.com/pingcap/tiproxy/pkg/metrics"
 	"github.com/pingcap/tiproxy/pkg/proxy"
+	"github.com/pingcap/tiproxy/pkg/proxy/authwebhook"
 	"github.com/pingcap/tiproxy/pkg/proxy/backend"
+	"github.com/pingcap/tiproxy/pkg/proxy/proxyprotocol"
 	"github.com/pingcap/tiproxy/pkg/sctx"
 	"github.com/pingcap/tiproxy/pkg/server/api"
 	"github.com/pingcap/tiproxy/pkg/util/versioninfo"
@@ -129,7 +131,12 @@ func NewServer(ctx context.Context, sctx *sctx.Context) (srv *Server, err error)
 			nscs = append(nscs, nsc)
 		}
 
-		err = srv.NamespaceManager.Init(lg.Named("nsmgr"), nscs, srv.InfoSyncer, srv.InfoSyncer, srv.Http)
+		sqlProber := backend.NewSQLProber(lg.Named("sql_prober"), &backend.BCConfig{
+			ProxyProtocol:     cfg.Proxy.ProxyProtocol != "",
+			ProxyVersion:      proxyprotocol.ParseProxyVersion(cfg.Proxy.ProxyProtocol),
+			RequireBackendTLS: cfg.Security.RequireBackendTLS,
+		}, srv.CertManager.SQLTLS)
+		err = srv.NamespaceManager.Init(lg.Named("nsmgr"), nscs, srv.InfoSyncer, srv.InfoSyncer, srv.Http, sqlProber)
 		if err != nil {
 			err = errors.WithStack(err)
 			return
@@ -144,6 +151,14 @@ func NewServer(ctx context.Context, sctx *sctx.Context) (srv *Server, err error)
 		} else {
 			hsHandler = backend.NewDefaultHandshakeHandler(srv.NamespaceManager)
 		}
+		if cfg.Security.AuthWebhook != nil {
+			webhook, werr := authwebhook.NewWebhook(lg.Named("auth_webhook"), *cfg.Security.AuthWebhook)
+			if werr != nil {
+				err = errors.WithStack(werr)
+				return
+			}
+			hsHandler = authwebhook.NewHandshakeHandler(hsHandler, webhook)
+		}
 		srv.Proxy, err = proxy.NewSQLServer(lg.Named("proxy"), cfg, srv.CertManager, hsHandler)
 		if err != nil {
 			err = errors.WithStack(err)